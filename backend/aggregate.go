@@ -0,0 +1,204 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+var (
+	selectFieldsRegexp = regexp.MustCompile(`(?is)^\s*select\s+(.*?)\s+from\s`)
+	aggregateRegexp    = regexp.MustCompile(`(?is)^\s*(\w+)\s*\(\s*([^()]*?)\s*\)\s*(?:as\s+\S+\s*)?$`)
+)
+
+// SelectAggregate is the aggregate function and its argument of a select field, Func is empty for raw fields,
+// and "expr" for expressions which can't be merged
+type SelectAggregate struct {
+	Func string
+	Arg  string
+}
+
+// GetSelectAggregates returns the aggregates of the outer select fields, wildcard reports whether
+// a field such as count(*) expands to several columns
+func GetSelectAggregates(q string) (aggs []*SelectAggregate, wildcard bool) {
+	match := selectFieldsRegexp.FindStringSubmatch(q)
+	if match == nil {
+		return
+	}
+	for _, field := range splitFields(match[1]) {
+		if f := strings.TrimSpace(field); f == "*" || strings.HasPrefix(f, "/") {
+			wildcard = true
+			aggs = append(aggs, &SelectAggregate{Arg: f})
+		} else if m := aggregateRegexp.FindStringSubmatch(field); m != nil {
+			arg := strings.Trim(m[2], `"`)
+			wildcard = wildcard || arg == "*" || strings.HasPrefix(arg, "/")
+			aggs = append(aggs, &SelectAggregate{Func: strings.ToLower(m[1]), Arg: arg})
+		} else if strings.ContainsAny(field, "()+-*/%") {
+			aggs = append(aggs, &SelectAggregate{Func: "expr"})
+		} else {
+			aggs = append(aggs, &SelectAggregate{Arg: strings.Trim(strings.TrimSpace(field), `"`)})
+		}
+	}
+	return
+}
+
+// splitFields splits the select fields by the commas outside of parentheses and quotes
+func splitFields(s string) (fields []string) {
+	depth, start := 0, 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			fields = append(fields, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(fields, s[start:])
+}
+
+// columnAggregates aligns the aggregates to the columns after time, the columns are taken as expressions
+// if they can't be aligned
+func columnAggregates(aggs []*SelectAggregate, wildcard bool, columns []string) []*SelectAggregate {
+	n := len(columns) - 1
+	if n < 0 {
+		return nil
+	}
+	if wildcard && len(aggs) == 1 {
+		cols := make([]*SelectAggregate, n)
+		for i := range cols {
+			// the column of count(*) is named like count_value
+			arg := strings.TrimPrefix(columns[i+1], aggs[0].Func+"_")
+			cols[i] = &SelectAggregate{Func: aggs[0].Func, Arg: arg}
+		}
+		return cols
+	}
+	if !wildcard && len(aggs) == n {
+		return aggs
+	}
+	cols := make([]*SelectAggregate, n)
+	for i := range cols {
+		cols[i] = &SelectAggregate{}
+	}
+	for _, agg := range aggs {
+		if agg.Func != "" {
+			for i := range cols {
+				cols[i].Func = "expr"
+			}
+			break
+		}
+	}
+	return cols
+}
+
+// combineValues combines the value of the same time bucket from another backend into value,
+// and returns the names of the columns which can't be merged
+func combineValues(value, other []interface{}, columns []string, aggs []*SelectAggregate) (unmerged []string) {
+	means := false
+	for i, agg := range aggs {
+		c := i + 1
+		if c >= len(value) || c >= len(other) || other[c] == nil {
+			continue
+		}
+		if value[c] == nil {
+			value[c] = other[c]
+			continue
+		}
+		switch agg.Func {
+		case "count":
+			value[c] = addNumbers(value[c], other[c])
+		case "sum":
+			value[c] = addNumbers(value[c], other[c])
+		case "min":
+			if toFloat(other[c]) < toFloat(value[c]) {
+				value[c] = other[c]
+			}
+		case "max":
+			if toFloat(other[c]) > toFloat(value[c]) {
+				value[c] = other[c]
+			}
+		case "mean":
+			means = true
+		case "":
+			// raw fields of the same time keep the first value
+		default:
+			unmerged = append(unmerged, columns[c])
+		}
+	}
+	if means {
+		unmerged = append(unmerged, recomputeMeans(value, columns, aggs)...)
+	}
+	return
+}
+
+// recomputeMeans sets the means to sum/count of the same argument, which are combined already
+func recomputeMeans(value []interface{}, columns []string, aggs []*SelectAggregate) (unmerged []string) {
+	for i, agg := range aggs {
+		if agg.Func != "mean" {
+			continue
+		}
+		sum, count := -1, -1
+		for j, other := range aggs {
+			if other.Arg == agg.Arg && other.Func == "sum" {
+				sum = j + 1
+			} else if other.Arg == agg.Arg && other.Func == "count" {
+				count = j + 1
+			}
+		}
+		if sum < 0 || count < 0 || value[sum] == nil || toFloat(value[count]) == 0 {
+			unmerged = append(unmerged, columns[i+1])
+			continue
+		}
+		value[i+1] = toFloat(value[sum]) / toFloat(value[count])
+	}
+	return
+}
+
+func addNumbers(a, b interface{}) interface{} {
+	x, xok := toInt(a)
+	y, yok := toInt(b)
+	if xok && yok {
+		return x + y
+	}
+	return toFloat(a) + toFloat(b)
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case json.Number:
+		f, _ := n.Float64()
+		return f
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ddlRegexp matches the queries with any statement of drop, delete or alter
+var ddlRegexp = regexp.MustCompile(`(?i)(^|;)\s*(drop|delete|alter)\s`)
+
+// auditRedacted are the params whose values are not recorded
+var auditRedacted = []string{"p", "password"}
+
+// AuditRecord is a call of the management endpoints or a ddl query
+type AuditRecord struct {
+	Time   string     `json:"time"`
+	User   string     `json:"user"`
+	Client string     `json:"client"`
+	Method string     `json:"method"`
+	Path   string     `json:"path"`
+	Params url.Values `json:"params,omitempty"`
+	Status int        `json:"status"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// AuditLog appends the records as json lines to audit_log, which is rotated to audit_log.1 once it exceeds
+// audit_max_size, and audit_max_files rotated files are kept
+type AuditLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	lock     sync.Mutex
+}
+
+// NewAuditLog returns nil if audit_log is empty
+func NewAuditLog(cfg *ProxyConfig) (*AuditLog, error) {
+	if cfg.AuditLog == "" {
+		return nil, nil
+	}
+	al := &AuditLog{
+		path:     cfg.AuditLog,
+		maxSize:  int64(cfg.AuditMaxSize) * 1024 * 1024,
+		maxFiles: cfg.AuditMaxFiles,
+	}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+// IsDDL returns whether the query has any statement of drop, delete or alter
+func IsDDL(q string) bool {
+	return ddlRegexp.MatchString(q)
+}
+
+func (al *AuditLog) open() (err error) {
+	al.file, err = os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	fi, err := al.file.Stat()
+	if err != nil {
+		al.file.Close()
+		return
+	}
+	al.size = fi.Size()
+	return
+}
+
+// Write appends the record, the values of passwords are redacted
+func (al *AuditLog) Write(record *AuditRecord) error {
+	if len(record.Params) > 0 {
+		params := make(url.Values, len(record.Params))
+		for key, values := range record.Params {
+			params[key] = values
+		}
+		for _, key := range auditRedacted {
+			if _, ok := params[key]; ok {
+				params[key] = []string{"******"}
+			}
+		}
+		record.Params = params
+	}
+	if record.Time == "" {
+		record.Time = time.Now().Format(time.RFC3339Nano)
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if al.maxSize > 0 && al.size > 0 && al.size+int64(len(b)) > al.maxSize {
+		if err = al.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := al.file.Write(b)
+	al.size += int64(n)
+	return err
+}
+
+// rotate renames audit_log.i to audit_log.i+1 and audit_log to audit_log.1, the oldest is removed
+func (al *AuditLog) rotate() error {
+	if err := al.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", al.path, al.maxFiles))
+	for i := al.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", al.path, i), fmt.Sprintf("%s.%d", al.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(al.path, al.path+".1"); err != nil {
+		return err
+	}
+	return al.open()
+}
+
+func (al *AuditLog) Close() error {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	return al.file.Close()
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsDDL(t *testing.T) {
+	tests := []struct {
+		q    string
+		want bool
+	}{
+		{q: "select * from cpu", want: false},
+		{q: "DROP MEASUREMENT cpu", want: true},
+		{q: "  delete from cpu where time < now() - 1d", want: true},
+		{q: "alter retention policy rp on db duration 1d", want: true},
+		{q: "select * from cpu; drop series from cpu", want: true},
+		{q: "select * from dropped", want: false},
+		{q: "show measurements", want: false},
+	}
+	for _, tt := range tests {
+		if got := IsDDL(tt.q); got != tt.want {
+			t.Errorf("%q: got %t, want %t", tt.q, got, tt.want)
+		}
+	}
+}
+
+func readAuditRecords(t *testing.T, path string) []*AuditRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []*AuditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := &AuditRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	al, err := NewAuditLog(&ProxyConfig{AuditLog: path, AuditMaxSize: 1, AuditMaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+
+	params := url.Values{"username": {"u1"}, "password": {"secret"}}
+	err = al.Write(&AuditRecord{User: "admin", Client: "10.0.0.1:5000", Method: "POST", Path: "/admin/user", Params: params, Status: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Get("password") != "secret" {
+		t.Error("params of caller changed")
+	}
+	records := readAuditRecords(t, path)
+	if len(records) != 1 || records[0].User != "admin" || records[0].Time == "" || records[0].Status != 200 {
+		t.Fatalf("got %+v", records)
+	}
+	if got := records[0].Params; got.Get("username") != "u1" || got.Get("password") != "******" {
+		t.Errorf("params: got %v", got)
+	}
+
+	// the file is rotated once exceeding 1 MB, and 2 rotated files are kept
+	large := url.Values{"q": {strings.Repeat("x", 400*1024)}}
+	for i := 0; i < 10; i++ {
+		if err = al.Write(&AuditRecord{Path: "/query", Params: large}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 1024*1024 {
+			t.Errorf("%s: size %d exceeded", file, fi.Size())
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3: got %v, want not exist", path, err)
+	}
+}
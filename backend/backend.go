@@ -6,6 +6,7 @@ package backend
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"log"
 	"net/url"
@@ -13,6 +14,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/chengshiwen/influx-proxy/util"
 	"github.com/panjf2000/ants/v2"
 )
 
@@ -26,14 +28,26 @@ type Backend struct {
 	fb   *FileBackend
 	pool *ants.Pool
 
+	expiredCount    int64
+	expiredBytes    int64
+	bufferedPoints  int64
+	bufferedBytes   int64
+	rewriteBatches  int64
+	rewriteBytes    int64
+	dropped         Counters
+	flushLatency    *util.Histogram
+	paused          int32
 	running         atomic.Value
 	flushSize       int
 	flushTime       int
 	rewriteInterval int
+	dataMaxAge      time.Duration
 	rewriteTicker   *time.Ticker
 	chWrite         chan *LinePoint
+	chSync          chan chan struct{}
+	chClosed        chan struct{}
 	chTimer         <-chan time.Time
-	buffers         map[string]map[string]*CacheBuffer
+	buffers         map[string]map[string]map[string]*CacheBuffer
 	wg              sync.WaitGroup
 }
 
@@ -43,14 +57,21 @@ func NewBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (ib *Backend) {
 		flushSize:       pxcfg.FlushSize,
 		flushTime:       pxcfg.FlushTime,
 		rewriteInterval: pxcfg.RewriteInterval,
+		dataMaxAge:      time.Duration(pxcfg.DataMaxAge) * time.Second,
 		rewriteTicker:   time.NewTicker(time.Duration(pxcfg.RewriteInterval) * time.Second),
 		chWrite:         make(chan *LinePoint, 16),
-		buffers:         make(map[string]map[string]*CacheBuffer),
+		chSync:          make(chan chan struct{}),
+		chClosed:        make(chan struct{}),
+		buffers:         make(map[string]map[string]map[string]*CacheBuffer),
+		flushLatency:    util.NewHistogram(util.LatencyBuckets),
 	}
 	ib.running.Store(true)
 
-	var err error
-	ib.fb, err = NewFileBackend(cfg.Name, pxcfg.DataDir)
+	policy, err := ParseSyncPolicy(pxcfg.WriteSync)
+	if err != nil {
+		panic(err)
+	}
+	ib.fb, err = NewFileBackend(cfg.Name, pxcfg.DataDir, policy)
 	if err != nil {
 		panic(err)
 	}
@@ -68,6 +89,7 @@ func NewSimpleBackend(cfg *BackendConfig) *Backend {
 }
 
 func (ib *Backend) worker() {
+	defer close(ib.chClosed)
 	for ib.IsRunning() {
 		select {
 		case p, ok := <-ib.chWrite:
@@ -94,6 +116,17 @@ func (ib *Backend) worker() {
 
 		case <-ib.rewriteTicker.C:
 			ib.RewriteIdle()
+
+		case done := <-ib.chSync:
+			// points sent before the sync request are already in the channel
+			for n := len(ib.chWrite); n > 0; n-- {
+				if p, ok := <-ib.chWrite; ok {
+					ib.WriteBuffer(p)
+				}
+			}
+			ib.Flush()
+			ib.wg.Wait()
+			close(done)
 		}
 	}
 }
@@ -107,15 +140,18 @@ func (ib *Backend) WritePoint(point *LinePoint) (err error) {
 }
 
 func (ib *Backend) WriteBuffer(point *LinePoint) (err error) {
-	db, rp, line := point.Db, point.Rp, point.Line
+	db, rp, precision, line := point.Db, point.Rp, point.Precision, point.Line
 	// it's thread-safe since ib.buffers is only used (read-write) in ib.worker() goroutine
 	if _, ok := ib.buffers[db]; !ok {
-		ib.buffers[db] = make(map[string]*CacheBuffer)
+		ib.buffers[db] = make(map[string]map[string]*CacheBuffer)
 	}
 	if _, ok := ib.buffers[db][rp]; !ok {
-		ib.buffers[db][rp] = &CacheBuffer{Buffer: &bytes.Buffer{}}
+		ib.buffers[db][rp] = make(map[string]*CacheBuffer)
+	}
+	if _, ok := ib.buffers[db][rp][precision]; !ok {
+		ib.buffers[db][rp][precision] = &CacheBuffer{Buffer: &bytes.Buffer{}}
 	}
-	cb := ib.buffers[db][rp]
+	cb := ib.buffers[db][rp][precision]
 	cb.Counter++
 	if cb.Buffer == nil {
 		cb.Buffer = &bytes.Buffer{}
@@ -136,23 +172,28 @@ func (ib *Backend) WriteBuffer(point *LinePoint) (err error) {
 			log.Printf("buffer write error: %s", err)
 			return
 		}
+		n++
 	}
+	atomic.AddInt64(&ib.bufferedPoints, 1)
+	atomic.AddInt64(&ib.bufferedBytes, int64(n))
 
 	switch {
 	case cb.Counter >= ib.flushSize:
-		ib.FlushBuffer(db, rp)
+		ib.FlushBuffer(db, rp, precision)
 	case ib.chTimer == nil:
 		ib.chTimer = time.After(time.Duration(ib.flushTime) * time.Second)
 	}
 	return
 }
 
-func (ib *Backend) FlushBuffer(db, rp string) {
-	cb := ib.buffers[db][rp]
+func (ib *Backend) FlushBuffer(db, rp, precision string) {
+	cb := ib.buffers[db][rp][precision]
 	if cb.Buffer == nil {
 		return
 	}
 	p := cb.Buffer.Bytes()
+	atomic.AddInt64(&ib.bufferedPoints, -int64(cb.Counter))
+	atomic.AddInt64(&ib.bufferedBytes, -int64(len(p)))
 	cb.Buffer = nil
 	cb.Counter = 0
 	if len(p) == 0 {
@@ -162,51 +203,87 @@ func (ib *Backend) FlushBuffer(db, rp string) {
 	ib.wg.Add(1)
 	ib.pool.Submit(func() {
 		defer ib.wg.Done()
-		var buf bytes.Buffer
-		err := Compress(&buf, p)
-		if err != nil {
-			log.Print("compress buffer error: ", err)
-			return
-		}
+		start := time.Now()
+		ib.WriteBatch(db, rp, precision, p)
+		ib.flushLatency.Observe(time.Since(start).Seconds())
+	})
+}
 
-		p = buf.Bytes()
+// BufferedPoints returns the points buffered and queued to be buffered
+func (ib *Backend) BufferedPoints() int64 {
+	return atomic.LoadInt64(&ib.bufferedPoints) + int64(len(ib.chWrite))
+}
 
-		if ib.IsActive() {
-			err = ib.WriteCompressed(db, rp, p)
-			switch err {
-			case nil:
-				return
-			case ErrBadRequest:
-				log.Printf("bad request, drop all data")
-				return
-			case ErrNotFound:
-				log.Printf("bad backend, drop all data")
-				return
-			default:
-				log.Printf("write http error, url: %s, db: %s, rp: %s, plen: %d", ib.Url, db, rp, len(p))
-			}
+// WriteBatch compresses and writes the lines to backend, and saves them to file with gzip if failed
+func (ib *Backend) WriteBatch(db, rp, precision string, lines []byte) {
+	p, err := Encode(ib.Compression(), lines)
+	if err != nil {
+		log.Print("compress buffer error: ", err)
+		return
+	}
+
+	if ib.IsActive() && !ib.IsPaused() {
+		err = ib.WriteEncoded(db, rp, precision, p)
+		switch {
+		case err == nil:
+			return
+		case errors.Is(err, ErrBadRequest):
+			log.Printf("bad request, drop all data")
+			ib.dropped.Add(ReasonBadRequest, int64(bytes.Count(lines, []byte{'\n'})))
+			return
+		case err == ErrNotFound:
+			log.Printf("bad backend, drop all data")
+			ib.dropped.Add(ReasonNotFound, int64(bytes.Count(lines, []byte{'\n'})))
+			return
+		default:
+			log.Printf("write http error, url: %s, db: %s, rp: %s, plen: %d", ib.Url, db, rp, len(p))
 		}
+	}
 
-		b := bytes.Join([][]byte{[]byte(url.QueryEscape(db)), []byte(url.QueryEscape(rp)), p}, []byte{' '})
-		err = ib.fb.Write(b)
+	// rewrite always sends the file data with gzip, so that they are still valid if compression changes
+	if ib.Compression() != "gzip" {
+		p, err = Encode("gzip", lines)
 		if err != nil {
-			log.Printf("write db and data to file error: %s, db: %s, rp: %s, plen: %d", err, db, rp, len(p))
+			log.Print("compress buffer error: ", err)
 			return
 		}
-	})
+	}
+
+	b := bytes.Join([][]byte{[]byte(url.QueryEscape(db)), []byte(url.QueryEscape(rp)), []byte(url.QueryEscape(precision)), p}, []byte{' '})
+	err = ib.fb.Write(b)
+	if err != nil {
+		log.Printf("write db and data to file error: %s, db: %s, rp: %s, precision: %s, plen: %d", err, db, rp, precision, len(p))
+		return
+	}
 }
 
 func (ib *Backend) Flush() {
 	ib.chTimer = nil
 	for db := range ib.buffers {
 		for rp := range ib.buffers[db] {
-			if ib.buffers[db][rp].Counter > 0 {
-				ib.FlushBuffer(db, rp)
+			for precision := range ib.buffers[db][rp] {
+				if ib.buffers[db][rp][precision].Counter > 0 {
+					ib.FlushBuffer(db, rp, precision)
+				}
 			}
 		}
 	}
 }
 
+// Sync flushes all points written before and waits until they are sent to backend or saved to file
+func (ib *Backend) Sync() {
+	if !ib.IsRunning() {
+		return
+	}
+	done := make(chan struct{})
+	// the worker may have exited since the check of running
+	select {
+	case ib.chSync <- done:
+		<-done
+	case <-ib.chClosed:
+	}
+}
+
 func (ib *Backend) RewriteIdle() {
 	if !ib.IsRewriting() && ib.fb.IsData() {
 		ib.SetRewriting(true)
@@ -219,7 +296,7 @@ func (ib *Backend) RewriteLoop() {
 		if !ib.IsRunning() {
 			return
 		}
-		if !ib.IsActive() {
+		if !ib.IsActive() || ib.IsPaused() {
 			time.Sleep(time.Duration(ib.rewriteInterval) * time.Second)
 			continue
 		}
@@ -233,7 +310,7 @@ func (ib *Backend) RewriteLoop() {
 }
 
 func (ib *Backend) Rewrite() (err error) {
-	b, err := ib.fb.Read()
+	b, ts, err := ib.fb.Read()
 	if err != nil {
 		log.Print("rewrite read file error: ", err)
 		return
@@ -241,9 +318,28 @@ func (ib *Backend) Rewrite() (err error) {
 	if b == nil {
 		return
 	}
+	if ib.dataMaxAge > 0 && ts > 0 && time.Since(time.Unix(0, ts)) > ib.dataMaxAge {
+		atomic.AddInt64(&ib.expiredCount, 1)
+		atomic.AddInt64(&ib.expiredBytes, int64(len(b)))
+		// the records expired are always with write time and precision
+		if p := bytes.SplitN(b, []byte{' '}, 4); len(p) == 4 {
+			ib.dropped.Add(ReasonExpired, int64(countLines(p[3])))
+		}
+		log.Printf("rewrite data expired, drop it, url: %s, age: %s, plen: %d", ib.Url, time.Since(time.Unix(0, ts)).Truncate(time.Second), len(b))
+		err = ib.fb.UpdateMeta()
+		if err != nil {
+			log.Printf("update meta error: %s", err)
+		}
+		return
+	}
 
-	p := bytes.SplitN(b, []byte{' '}, 3)
-	if len(p) < 3 {
+	// records with write time also carry the precision, older records are always in nanoseconds
+	n := 3
+	if ts > 0 {
+		n = 4
+	}
+	p := bytes.SplitN(b, []byte{' '}, n)
+	if len(p) < n {
 		log.Print("rewrite read invalid data with length: ", len(p))
 		return
 	}
@@ -257,18 +353,30 @@ func (ib *Backend) Rewrite() (err error) {
 		log.Print("rewrite rp unescape error: ", err)
 		return
 	}
-	err = ib.WriteCompressed(db, rp, p[2])
+	precision := "ns"
+	if n == 4 {
+		precision, err = url.QueryUnescape(string(p[2]))
+		if err != nil {
+			log.Print("rewrite precision unescape error: ", err)
+			return
+		}
+	}
+	err = ib.WriteCompressed(db, rp, precision, p[n-1])
 
-	switch err {
-	case nil:
-	case ErrBadRequest:
+	switch {
+	case err == nil:
+		atomic.AddInt64(&ib.rewriteBatches, 1)
+		atomic.AddInt64(&ib.rewriteBytes, int64(len(b)))
+	case errors.Is(err, ErrBadRequest):
 		log.Printf("bad request, drop all data")
+		ib.dropped.Add(ReasonBadRequest, int64(countLines(p[n-1])))
 		err = nil
-	case ErrNotFound:
+	case err == ErrNotFound:
 		log.Printf("bad backend, drop all data")
+		ib.dropped.Add(ReasonNotFound, int64(countLines(p[n-1])))
 		err = nil
 	default:
-		log.Printf("rewrite http error, url: %s, db: %s, rp: %s, plen: %d", ib.Url, db, rp, len(p[1]))
+		log.Printf("rewrite http error, url: %s, db: %s, rp: %s, precision: %s, plen: %d", ib.Url, db, rp, precision, len(p[n-1]))
 
 		err = ib.fb.RollbackMeta()
 		if err != nil {
@@ -284,6 +392,19 @@ func (ib *Backend) Rewrite() (err error) {
 	return
 }
 
+// SetPaused makes the batches saved to file instead of written to backend, which are rewritten once resumed
+func (ib *Backend) SetPaused(b bool) {
+	var paused int32
+	if b {
+		paused = 1
+	}
+	atomic.StoreInt32(&ib.paused, paused)
+}
+
+func (ib *Backend) IsPaused() bool {
+	return atomic.LoadInt32(&ib.paused) == 1
+}
+
 func (ib *Backend) IsRunning() (b bool) {
 	return ib.running.Load().(bool)
 }
@@ -301,6 +422,9 @@ func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 		Backlog   bool        `json:"backlog"`
 		Rewriting bool        `json:"rewriting"`
 		WriteOnly bool        `json:"write_only"`
+		ReadOnly  bool        `json:"read_only"`
+		Zone      string      `json:"zone,omitempty"`
+		Expired   interface{} `json:"expired"`
 		Healthy   bool        `json:"healthy,omitempty"`
 		Stats     interface{} `json:"stats,omitempty"`
 	}{
@@ -310,6 +434,12 @@ func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 		Backlog:   ib.fb.IsData(),
 		Rewriting: ib.IsRewriting(),
 		WriteOnly: ib.IsWriteOnly(),
+		ReadOnly:  ib.IsReadOnly(),
+		Zone:      ib.Zone,
+		Expired: map[string]int64{
+			"count": atomic.LoadInt64(&ib.expiredCount),
+			"bytes": atomic.LoadInt64(&ib.expiredBytes),
+		},
 	}
 	if !withStats {
 		return health
@@ -324,9 +454,8 @@ func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 			inplace, incorrect := 0, 0
 			measurements := ib.GetMeasurements(db)
 			for _, meas := range measurements {
-				key := GetKey(db, meas)
-				nb := ic.GetBackend(key)
-				if nb.Url == ib.Url {
+				// the measurements spread by tags are in place in any backend
+				if ic.IsReplica(ib.Url, db, meas) {
 					inplace++
 				} else {
 					incorrect++
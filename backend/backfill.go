@@ -0,0 +1,159 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+var ErrBackfillBusy = errors.New("backfill queue is full")
+
+type backfillBatch struct {
+	db        string
+	rp        string
+	precision string
+	p         []byte
+}
+
+type backfillKey struct {
+	be        *Backend
+	db        string
+	rp        string
+	precision string
+}
+
+type backfillBuffer struct {
+	buffer  bytes.Buffer
+	counter int
+}
+
+// Backfill writes historical data through a separate queue with larger batches and its own rate limit,
+// so that it doesn't delay the live writes buffered by backends
+type Backfill struct {
+	ip        *Proxy
+	ch        chan *backfillBatch
+	flushSize int
+	flushTime time.Duration
+	rateLimit int
+	buffers   map[backfillKey]*backfillBuffer
+	start     time.Time
+	points    int
+	closing   chan struct{}
+	done      chan struct{}
+}
+
+func NewBackfill(ip *Proxy, cfg *ProxyConfig) (bf *Backfill) {
+	bf = &Backfill{
+		ip:        ip,
+		ch:        make(chan *backfillBatch, cfg.BackfillQueueSize),
+		flushSize: cfg.BackfillFlushSize,
+		flushTime: time.Duration(cfg.FlushTime) * time.Second,
+		rateLimit: cfg.BackfillRateLimit,
+		buffers:   make(map[backfillKey]*backfillBuffer),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go bf.worker()
+	return
+}
+
+// Write enqueues the batch and returns ErrBackfillBusy if the queue is full
+func (bf *Backfill) Write(p []byte, db, rp, precision string) error {
+	select {
+	case bf.ch <- &backfillBatch{db, rp, precision, p}:
+		return nil
+	default:
+		return ErrBackfillBusy
+	}
+}
+
+// Close writes the batches queued and flushes the buffers, and then stops the worker
+func (bf *Backfill) Close() {
+	close(bf.closing)
+	<-bf.done
+}
+
+func (bf *Backfill) worker() {
+	defer close(bf.done)
+	ticker := time.NewTicker(bf.flushTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case batch := <-bf.ch:
+			bf.writeBatch(batch)
+		case <-ticker.C:
+			bf.flush()
+		case <-bf.closing:
+			for n := len(bf.ch); n > 0; n-- {
+				bf.writeBatch(<-bf.ch)
+			}
+			bf.flush()
+			return
+		}
+	}
+}
+
+func (bf *Backfill) writeBatch(batch *backfillBatch) {
+	ScanLines(batch.p, func(line []byte) {
+		bf.writeRow(line, batch.db, batch.rp, batch.precision)
+	})
+}
+
+// writeRow buffers the line for the backends routed as live writes, including the fallbacks and precisions of circles
+func (bf *Backfill) writeRow(line []byte, db, rp, precision string) {
+	ok := bf.ip.routeRow(line, db, rp, precision, func(be *Backend, point *LinePoint) {
+		bk := backfillKey{be, db, rp, point.Precision}
+		bb, ok := bf.buffers[bk]
+		if !ok {
+			bb = &backfillBuffer{}
+			bf.buffers[bk] = bb
+		}
+		bb.buffer.Write(point.Line)
+		bb.buffer.WriteByte('\n')
+		bb.counter++
+		if bb.counter >= bf.flushSize {
+			bf.flushBuffer(bk, bb)
+		}
+	})
+	if ok {
+		bf.limit()
+	}
+}
+
+// limit sleeps when the points written in the current second exceed the rate limit
+func (bf *Backfill) limit() {
+	if bf.rateLimit <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(bf.start) >= time.Second {
+		bf.start = now
+		bf.points = 0
+	}
+	bf.points++
+	if bf.points > bf.rateLimit {
+		time.Sleep(bf.start.Add(time.Second).Sub(now))
+		bf.start = time.Now()
+		bf.points = 1
+	}
+}
+
+// flushBuffer writes synchronously, so the backfill slows down rather than piling up when backends are slow
+func (bf *Backfill) flushBuffer(key backfillKey, bb *backfillBuffer) {
+	if bb.counter == 0 {
+		return
+	}
+	key.be.WriteBatch(key.db, key.rp, key.precision, bb.buffer.Bytes())
+	bb.buffer.Reset()
+	bb.counter = 0
+}
+
+func (bf *Backfill) flush() {
+	for key, bb := range bf.buffers {
+		bf.flushBuffer(key, bb)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBackfillClose(t *testing.T) {
+	var lock sync.Mutex
+	var written []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/write" {
+			return
+		}
+		var r io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			r = zr
+		}
+		b, _ := ioutil.ReadAll(r)
+		lock.Lock()
+		written = append(written, req.URL.Query().Get("precision")+" "+string(b))
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &ProxyConfig{DataDir: dir, KeepPrecision: true, Circles: []*CircleConfig{
+		{Name: "circle-1", Backends: []*BackendConfig{{Name: "b1", Url: ts.URL}}},
+		{Name: "circle-2", Backends: []*BackendConfig{{Name: "b2", Url: ts.URL}}, NanoPrecision: true},
+	}}
+	cfg.setDefault()
+	ip := &Proxy{Circles: []*Circle{NewCircle(cfg.Circles[0], cfg, 0), NewCircle(cfg.Circles[1], cfg, 1)}, config: cfg, keepPrecision: true, transforms: &Transforms{}}
+	ip.Circles[1].SetWriteEnabled(false)
+	bf := NewBackfill(ip, cfg)
+	if err = bf.Write([]byte("cpu value=1 1\n"), "db1", "autogen", "s"); err != nil {
+		t.Fatal(err)
+	}
+	bf.Close()
+	for _, circle := range ip.Circles {
+		circle.Close()
+	}
+
+	// the disabled circle is skipped and the precision of circle is kept
+	lock.Lock()
+	defer lock.Unlock()
+	if len(written) != 1 || strings.TrimSpace(written[0]) != "s cpu value=1 1" {
+		t.Errorf("got %q", written)
+	}
+}
@@ -7,55 +7,143 @@ package backend
 import (
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+)
 
-	"stathat.com/c/consistent"
+const (
+	WriteDisabledBuffer = "buffer"
+	WriteDisabledSkip   = "skip"
 )
 
 type Circle struct {
-	CircleId     int // nolint:golint
-	Name         string
-	Backends     []*Backend
-	router       *consistent.Consistent
-	routerCache  sync.Map
-	mapToBackend map[string]*Backend
+	CircleId      int // nolint:golint
+	Name          string
+	Backends      []*Backend
+	NanoPrecision bool
+	Standby       bool
+	Cold          *Circle
+	coldAfter     time.Duration
+	router        HashRing
+	routerCache   sync.Map
+	replicas      int
+	replicaCache  sync.Map
+	peers         map[*Backend]*Backend
+	fallbacks     map[*Backend]*Backend
+	zoneAware     bool
+	avoidZones    func(key string) map[string]bool
+	mapToBackend  map[string]*Backend
+	shardKeys     ShardKeys
+	routingRules  RoutingRules
+	writeDisabled int32
+	disabledMode  string
 }
 
 func NewCircle(cfg *CircleConfig, pxcfg *ProxyConfig, circleId int) (ic *Circle) { // nolint:golint
+	backends := make([]*Backend, len(cfg.Backends))
+	for idx, bkcfg := range cfg.Backends {
+		backends[idx] = NewBackend(bkcfg, pxcfg)
+	}
+	ic = newCircle(cfg, pxcfg, circleId, backends)
+	if len(cfg.ColdBackends) > 0 {
+		// the cold tier is hashed in the same way as the hot one, and it's never written by the proxy
+		ic.Cold = NewCircle(&CircleConfig{
+			Name:          cfg.Name + "-cold",
+			Backends:      cfg.ColdBackends,
+			NanoPrecision: cfg.NanoPrecision,
+			HashAlgorithm: cfg.HashAlgorithm,
+			VirtualNodes:  cfg.VirtualNodes,
+			Role:          cfg.Role,
+		}, pxcfg, circleId)
+		ic.coldAfter = time.Duration(cfg.ColdAfter) * time.Second
+	}
+	return
+}
+
+// newCircle builds the hash ring of the backends created in the order of backend configs
+func newCircle(cfg *CircleConfig, pxcfg *ProxyConfig, circleId int, backends []*Backend) (ic *Circle) { // nolint:golint
 	ic = &Circle{
-		CircleId:     circleId,
-		Name:         cfg.Name,
-		Backends:     make([]*Backend, len(cfg.Backends)),
-		router:       consistent.New(),
-		mapToBackend: make(map[string]*Backend),
+		CircleId:      circleId,
+		Name:          cfg.Name,
+		Backends:      backends,
+		NanoPrecision: cfg.NanoPrecision || !pxcfg.KeepPrecision,
+		Standby:       cfg.Role == RoleStandby,
+		router:        NewHashRing(cfg.HashAlgorithm, cfg.VirtualNodes),
+		replicas:      cfg.Replicas,
+		mapToBackend:  make(map[string]*Backend),
+		shardKeys:     NewShardKeys(pxcfg),
+		zoneAware:     pxcfg.ZoneAware,
+		disabledMode:  pxcfg.WriteDisabledMode,
+	}
+	for idx, be := range ic.Backends {
+		ic.addRouter(be, idx, pxcfg.HashKey)
 	}
-	ic.router.NumberOfReplicas = 256
 	for idx, bkcfg := range cfg.Backends {
-		ic.Backends[idx] = NewBackend(bkcfg, pxcfg)
-		ic.addRouter(ic.Backends[idx], idx, pxcfg.HashKey)
+		if !bkcfg.ReadOnly {
+			continue
+		}
+		if ic.peers == nil {
+			ic.peers = make(map[*Backend]*Backend)
+		}
+		for _, be := range ic.Backends {
+			if be.Name == bkcfg.Peer {
+				ic.peers[ic.Backends[idx]] = be
+			}
+		}
+	}
+	for idx, bkcfg := range cfg.Backends {
+		if bkcfg.Fallback == "" {
+			continue
+		}
+		if ic.fallbacks == nil {
+			ic.fallbacks = make(map[*Backend]*Backend)
+		}
+		for _, be := range ic.Backends {
+			if be.Name == bkcfg.Fallback {
+				ic.fallbacks[ic.Backends[idx]] = be
+			}
+		}
+	}
+	var err error
+	ic.routingRules, err = NewRoutingRules(pxcfg)
+	if err != nil {
+		panic(err)
 	}
 	return
 }
 
+// rebuild returns the circle of the backends changed at runtime, the existing backends and the cold tier are kept
+func (ic *Circle) rebuild(cfg *CircleConfig, pxcfg *ProxyConfig, backends []*Backend) *Circle {
+	nc := newCircle(cfg, pxcfg, ic.CircleId, backends)
+	nc.Cold, nc.coldAfter = ic.Cold, ic.coldAfter
+	nc.avoidZones = ic.avoidZones
+	nc.SetWriteEnabled(ic.IsWriteEnabled())
+	return nc
+}
+
 func (ic *Circle) addRouter(be *Backend, idx int, hashKey string) {
+	var str string
 	if hashKey == "name" {
-		ic.router.Add(be.Name)
-		ic.mapToBackend[be.Name] = be
+		str = be.Name
 	} else if hashKey == "url" {
 		// compatible with version <= 2.3
-		ic.router.Add(be.Url)
-		ic.mapToBackend[be.Url] = be
+		str = be.Url
 	} else if hashKey == "exi" {
 		// exi: extended index, recommended, started with 2.5+
 		// no hash collision will occur before idx <= 100000, which has been tested
-		str := "|" + strconv.Itoa(idx)
-		ic.router.Add(str)
-		ic.mapToBackend[str] = be
+		str = "|" + strconv.Itoa(idx)
 	} else {
 		// idx: default index, compatible with version 2.4, recommended when the number of backends <= 10
 		// each additional backend causes 10% hash collision from 11th backend
-		str := strconv.Itoa(idx)
-		ic.router.Add(str)
-		ic.mapToBackend[str] = be
+		str = strconv.Itoa(idx)
+	}
+	ic.router.Add(str)
+	ic.mapToBackend[str] = be
+	// the backend of weight n is added n times, the keys of weight 1 are the same as before
+	for i := 1; i < be.Weight; i++ {
+		wstr := str + "#" + strconv.Itoa(i)
+		ic.router.Add(wstr)
+		ic.mapToBackend[wstr] = be
 	}
 }
 
@@ -63,12 +151,233 @@ func (ic *Circle) GetBackend(key string) *Backend {
 	if be, ok := ic.routerCache.Load(key); ok {
 		return be.(*Backend)
 	}
-	value, _ := ic.router.Get(key)
-	be := ic.mapToBackend[value]
+	var be *Backend
+	if ic.zoneAware {
+		be = ic.GetReplicas(key)[0]
+	} else {
+		ring, mapToBackend := ic.getRing(key)
+		value, _ := ring.Get(key)
+		be = mapToBackend[value]
+	}
 	ic.routerCache.Store(key, be)
 	return be
 }
 
+// GetReplicas returns the distinct backends to write the key, the first one is the backend of GetBackend
+// and the following ones are the next backends on the hash ring, up to the replicas of circle
+func (ic *Circle) GetReplicas(key string) []*Backend {
+	if ic.replicas <= 1 && !ic.zoneAware {
+		return []*Backend{ic.GetBackend(key)}
+	}
+	if backends, ok := ic.replicaCache.Load(key); ok {
+		return backends.([]*Backend)
+	}
+	ring, mapToBackend := ic.getRing(key)
+	// the weighted backends are added several times, so more elements are taken to get enough distinct backends
+	values, _ := ring.GetN(key, len(mapToBackend))
+	var avoid map[string]bool
+	if ic.avoidZones != nil {
+		avoid = ic.avoidZones(key)
+	}
+	backends := ic.pickReplicas(values, mapToBackend, avoid)
+	ic.replicaCache.Store(key, backends)
+	return backends
+}
+
+// pickReplicas picks the distinct backends in the order of hash ring, when zone aware, the backends in the zones
+// to avoid or in the zones already picked are put off, and they are picked only if there are not enough zones
+func (ic *Circle) pickReplicas(values []string, mapToBackend map[string]*Backend, avoid map[string]bool) []*Backend {
+	n := ic.replicas
+	if n < 1 {
+		n = 1
+	}
+	backends := make([]*Backend, 0, n)
+	var deferred []*Backend
+	set := make(map[*Backend]bool)
+	zones := make(map[string]bool)
+	for _, value := range values {
+		be := mapToBackend[value]
+		if set[be] {
+			continue
+		}
+		set[be] = true
+		if ic.zoneAware && be.Zone != "" && (avoid[be.Zone] || zones[be.Zone]) {
+			deferred = append(deferred, be)
+			continue
+		}
+		backends = append(backends, be)
+		zones[be.Zone] = true
+		if len(backends) == n {
+			return backends
+		}
+	}
+	for _, be := range deferred {
+		if len(backends) == n {
+			break
+		}
+		backends = append(backends, be)
+	}
+	return backends
+}
+
+// resetCache clears the cached backends of keys, which depend on the other circles when zone aware
+func (ic *Circle) resetCache() {
+	del := func(key, value interface{}) bool {
+		ic.routerCache.Delete(key)
+		ic.replicaCache.Delete(key)
+		return true
+	}
+	ic.routerCache.Range(del)
+	ic.replicaCache.Range(del)
+}
+
+// GetWriteReplicas returns the replicas of the key to write, where the read_only backends are replaced by their peers
+func (ic *Circle) GetWriteReplicas(key string) []*Backend {
+	replicas := ic.GetReplicas(key)
+	if len(ic.peers) == 0 {
+		return replicas
+	}
+	backends := make([]*Backend, 0, len(replicas))
+	set := make(map[*Backend]bool)
+	for _, be := range replicas {
+		if peer, ok := ic.peers[be]; ok {
+			be = peer
+		}
+		if !set[be] {
+			set[be] = true
+			backends = append(backends, be)
+		}
+	}
+	return backends
+}
+
+// GetFallback returns the fallback of the backend if the backend is down and the fallback is active, or nil
+func (ic *Circle) GetFallback(be *Backend) *Backend {
+	fallback, ok := ic.fallbacks[be]
+	if !ok || be.IsActive() || !fallback.IsActive() {
+		return nil
+	}
+	return fallback
+}
+
+// getRing returns the hash ring of the routing rule matching the key, which hashes among the backends of the rule
+// in this circle, the hash ring of circle is returned if no rule matches or the rule has no backend in this circle
+func (ic *Circle) getRing(key string) (HashRing, map[string]*Backend) {
+	names := ic.routingRules.Match(key)
+	if len(names) == 0 {
+		return ic.router, ic.mapToBackend
+	}
+	ring := &RendezvousHash{}
+	byName := make(map[string]*Backend)
+	for _, be := range ic.Backends {
+		for _, name := range names {
+			if be.Name == name {
+				ring.Add(name)
+				byName[name] = be
+			}
+		}
+	}
+	if len(byName) == 0 {
+		return ic.router, ic.mapToBackend
+	}
+	return ring, byName
+}
+
+// GetBackendByMeasurement returns the backend of the measurement, or nil if the measurement is spread by tags
+func (ic *Circle) GetBackendByMeasurement(db, meas string) *Backend {
+	if ic.shardKeys.Spread(db) {
+		return nil
+	}
+	return ic.GetBackend(ic.shardKeys.Key(db, meas, nil))
+}
+
+// GetReplicasByMeasurement returns the replicas of the measurement, or nil if the measurement is spread by tags
+func (ic *Circle) GetReplicasByMeasurement(db, meas string) []*Backend {
+	if ic.shardKeys.Spread(db) {
+		return nil
+	}
+	return ic.GetReplicas(ic.shardKeys.Key(db, meas, nil))
+}
+
+// IsReplica returns true if the backend of url is a replica of the measurement, or the measurement is spread by tags
+func (ic *Circle) IsReplica(url, db, meas string) bool {
+	replicas := ic.GetReplicasByMeasurement(db, meas)
+	if replicas == nil {
+		return true
+	}
+	for _, be := range replicas {
+		if be.Url == url {
+			return true
+		}
+	}
+	return false
+}
+
+// GetReplicasByMeasurements returns the distinct replicas of the measurements,
+// or all backends if any is a regex or the measurements are spread by tags
+func (ic *Circle) GetReplicasByMeasurements(db string, mms []string) []*Backend {
+	if ic.shardKeys.Spread(db) {
+		return ic.Backends
+	}
+	var backends []*Backend
+	set := make(map[*Backend]bool)
+	for _, mm := range mms {
+		if IsRegexMeasurement(mm) {
+			return ic.Backends
+		}
+		for _, be := range ic.GetReplicas(ic.shardKeys.Key(db, mm, nil)) {
+			if !set[be] {
+				set[be] = true
+				backends = append(backends, be)
+			}
+		}
+	}
+	return backends
+}
+
+// GetBackendsByMeasurements returns the distinct backends of the measurements,
+// or all backends if any is a regex or the measurements are spread by tags
+func (ic *Circle) GetBackendsByMeasurements(db string, mms []string) []*Backend {
+	if ic.shardKeys.Spread(db) {
+		return ic.Backends
+	}
+	var backends []*Backend
+	set := make(map[*Backend]bool)
+	for _, mm := range mms {
+		if IsRegexMeasurement(mm) {
+			return ic.Backends
+		}
+		be := ic.GetBackend(ic.shardKeys.Key(db, mm, nil))
+		if !set[be] {
+			set[be] = true
+			backends = append(backends, be)
+		}
+	}
+	return backends
+}
+
+// GetBackendsBySources returns the distinct backends of the measurements in their own databases,
+// db is used for the measurements without database, and all backends are returned if any is a regex
+func (ic *Circle) GetBackendsBySources(dbs []string, mms []string, db string) []*Backend {
+	var backends []*Backend
+	set := make(map[*Backend]bool)
+	for i, mm := range mms {
+		d := db
+		if i < len(dbs) && dbs[i] != "" {
+			d = dbs[i]
+		}
+		if IsRegexMeasurement(mm) || ic.shardKeys.Spread(d) {
+			return ic.Backends
+		}
+		be := ic.GetBackend(ic.shardKeys.Key(d, mm, nil))
+		if !set[be] {
+			set[be] = true
+			backends = append(backends, be)
+		}
+	}
+	return backends
+}
+
 func (ic *Circle) GetHealth(stats bool) interface{} {
 	var wg sync.WaitGroup
 	backends := make([]interface{}, len(ic.Backends))
@@ -81,18 +390,49 @@ func (ic *Circle) GetHealth(stats bool) interface{} {
 	}
 	wg.Wait()
 	circle := struct {
-		Id        int    `json:"id"` // nolint:golint
-		Name      string `json:"name"`
-		Active    bool   `json:"active"`
-		WriteOnly bool   `json:"write_only"`
-	}{ic.CircleId, ic.Name, ic.IsActive(), ic.IsWriteOnly()}
+		Id           int    `json:"id"` // nolint:golint
+		Name         string `json:"name"`
+		Active       bool   `json:"active"`
+		WriteOnly    bool   `json:"write_only"`
+		Standby      bool   `json:"standby"`
+		WriteEnabled bool   `json:"write_enabled"`
+	}{ic.CircleId, ic.Name, ic.IsActive(), ic.IsWriteOnly(), ic.Standby, ic.IsWriteEnabled()}
+	var cold interface{}
+	if ic.Cold != nil {
+		cold = ic.Cold.GetHealth(stats)
+	}
 	health := struct {
 		Circle   interface{} `json:"circle"`
 		Backends interface{} `json:"backends"`
-	}{circle, backends}
+		Cold     interface{} `json:"cold,omitempty"`
+	}{circle, backends, cold}
 	return health
 }
 
+// SetWriteEnabled stops or resumes sending new writes to the circle, while the reads are still served,
+// the points are buffered to the files of backends until resumed in buffer mode, or skipped in skip mode
+func (ic *Circle) SetWriteEnabled(enabled bool) {
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+	atomic.StoreInt32(&ic.writeDisabled, disabled)
+	if ic.disabledMode != WriteDisabledSkip {
+		for _, be := range ic.Backends {
+			be.SetPaused(!enabled)
+		}
+	}
+}
+
+func (ic *Circle) IsWriteEnabled() bool {
+	return atomic.LoadInt32(&ic.writeDisabled) == 0
+}
+
+// SkipWrite returns true if the writes are disabled and the points are skipped
+func (ic *Circle) SkipWrite() bool {
+	return !ic.IsWriteEnabled() && ic.disabledMode == WriteDisabledSkip
+}
+
 func (ic *Circle) IsActive() bool {
 	for _, be := range ic.Backends {
 		if !be.IsActive() {
@@ -121,4 +461,7 @@ func (ic *Circle) Close() {
 	for _, be := range ic.Backends {
 		be.Close()
 	}
+	if ic.Cold != nil {
+		ic.Cold.Close()
+	}
 }
@@ -6,7 +6,11 @@ package backend
 
 import (
 	"errors"
+	"io"
 	"log"
+	"math"
+	"net/url"
+	"strings"
 
 	"github.com/chengshiwen/influx-proxy/util"
 	jsoniter "github.com/json-iterator/go"
@@ -25,6 +29,17 @@ var (
 	ErrEmptyBackendName      = errors.New("backend name cannot be empty")
 	ErrDuplicatedBackendName = errors.New("backend name duplicated")
 	ErrInvalidHashKey        = errors.New("invalid hash_key, require idx, exi, name or url")
+	ErrInvalidCompression    = errors.New("invalid compression, require gzip, snappy or none")
+	ErrInvalidReadRepair     = errors.New("invalid read_repair_ratio, require between 0 and 1")
+	ErrInvalidColdTier       = errors.New("invalid cold tier, require both cold_backends and positive cold_after")
+	ErrInvalidReplicas       = errors.New("invalid replicas, require not more than the number of backends")
+	ErrInvalidWriteDisabled  = errors.New("invalid write_disabled_mode, require buffer or skip")
+	ErrInvalidWebhook        = errors.New("invalid transfer_webhook, require http or https url")
+	ErrInvalidConflict       = errors.New("invalid conflict_policy, require skip or cast")
+	ErrBackendNotFound       = errors.New("backend not found")
+	ErrInvalidReadOnly       = errors.New("invalid read_only backend, require a peer in the same circle which is not read_only or write_only")
+	ErrInvalidFallback       = errors.New("invalid fallback, require another backend in the same circle which is not read_only or write_only")
+	ErrInvalidRateLimit      = errors.New("invalid write_rate_limit or query_rate_limit, require not negative")
 )
 
 type BackendConfig struct { // nolint:golint
@@ -34,36 +49,208 @@ type BackendConfig struct { // nolint:golint
 	Password    string `mapstructure:"password"`
 	AuthEncrypt bool   `mapstructure:"auth_encrypt"`
 	WriteOnly   bool   `mapstructure:"write_only"`
+	Compression string `mapstructure:"compression"`
+	Weight      int    `mapstructure:"weight"`
+	ReadOnly    bool   `mapstructure:"read_only"`
+	Peer        string `mapstructure:"peer"`
+	Zone        string `mapstructure:"zone"`
+	Fallback    string `mapstructure:"fallback"`
+	TLSCA       string `mapstructure:"tls_ca"`
+	TLSCert     string `mapstructure:"tls_cert"`
+	TLSKey      string `mapstructure:"tls_key"`
+	SkipVerify  bool   `mapstructure:"tls_skip_verify"`
+	// the empty credentials are left out as the file written by hand, and null is not supported by toml
+	Credentials Credentials `mapstructure:"credentials,omitempty"`
+}
+
+type TransformConfig struct {
+	Db     string `mapstructure:"db"`
+	Name   string `mapstructure:"name"`
+	Plugin string `mapstructure:"plugin"`
+}
+
+type ContinuousQueryConfig struct {
+	Name  string `mapstructure:"name"`
+	Db    string `mapstructure:"db"`
+	Query string `mapstructure:"query"`
+	Every int    `mapstructure:"every"`
+	For   int    `mapstructure:"for"`
+}
+
+type QueryRuleConfig struct {
+	Name              string `mapstructure:"name"`
+	Action            string `mapstructure:"action"`
+	Match             string `mapstructure:"match"`
+	Unless            string `mapstructure:"unless"`
+	MaintenanceWindow string `mapstructure:"maintenance_window"`
+	Message           string `mapstructure:"message"`
+}
+
+type RoutingRuleConfig struct {
+	Db          string   `mapstructure:"db"`
+	Measurement string   `mapstructure:"measurement"`
+	Backends    []string `mapstructure:"backends"`
 }
 
 type CircleConfig struct {
-	Name     string           `mapstructure:"name"`
-	Backends []*BackendConfig `mapstructure:"backends"`
+	Name          string           `mapstructure:"name"`
+	Backends      []*BackendConfig `mapstructure:"backends"`
+	NanoPrecision bool             `mapstructure:"nano_precision"`
+	HashAlgorithm string           `mapstructure:"hash_algorithm"`
+	ColdBackends  []*BackendConfig `mapstructure:"cold_backends"`
+	ColdAfter     int              `mapstructure:"cold_after"`
+	Replicas      int              `mapstructure:"replicas"`
+	VirtualNodes  int              `mapstructure:"virtual_nodes"`
+	Role          string           `mapstructure:"role"`
+}
+
+// AllBackends returns the hot and cold backends of the circle
+func (cfg *CircleConfig) AllBackends() []*BackendConfig {
+	backends := make([]*BackendConfig, 0, len(cfg.Backends)+len(cfg.ColdBackends))
+	backends = append(backends, cfg.Backends...)
+	return append(backends, cfg.ColdBackends...)
+}
+
+// CheckReadOnly checks the peers of the read_only backends of the circle, which own their keys to write
+func CheckReadOnly(cfg *CircleConfig) error {
+	writable := make(map[string]bool)
+	for _, backend := range cfg.Backends {
+		writable[backend.Name] = !backend.ReadOnly && !backend.WriteOnly
+	}
+	for _, backend := range cfg.Backends {
+		if backend.ReadOnly && (backend.WriteOnly || !writable[backend.Peer]) {
+			return ErrInvalidReadOnly
+		}
+	}
+	return nil
+}
+
+// CheckFallback checks the fallbacks of the backends of the circle, which are written while the backends are down
+func CheckFallback(cfg *CircleConfig) error {
+	writable := make(map[string]bool)
+	for _, backend := range cfg.Backends {
+		writable[backend.Name] = !backend.ReadOnly && !backend.WriteOnly
+	}
+	for _, backend := range cfg.Backends {
+		if backend.Fallback != "" && (backend.Fallback == backend.Name || !writable[backend.Fallback]) {
+			return ErrInvalidFallback
+		}
+	}
+	return nil
 }
 
 type ProxyConfig struct {
-	Circles         []*CircleConfig `mapstructure:"circles"`
-	ListenAddr      string          `mapstructure:"listen_addr"`
-	DBList          []string        `mapstructure:"db_list"`
-	DataDir         string          `mapstructure:"data_dir"`
-	TLogDir         string          `mapstructure:"tlog_dir"`
-	HashKey         string          `mapstructure:"hash_key"`
-	FlushSize       int             `mapstructure:"flush_size"`
-	FlushTime       int             `mapstructure:"flush_time"`
-	CheckInterval   int             `mapstructure:"check_interval"`
-	RewriteInterval int             `mapstructure:"rewrite_interval"`
-	ConnPoolSize    int             `mapstructure:"conn_pool_size"`
-	WriteTimeout    int             `mapstructure:"write_timeout"`
-	IdleTimeout     int             `mapstructure:"idle_timeout"`
-	Username        string          `mapstructure:"username"`
-	Password        string          `mapstructure:"password"`
-	AuthEncrypt     bool            `mapstructure:"auth_encrypt"`
-	WriteTracing    bool            `mapstructure:"write_tracing"`
-	QueryTracing    bool            `mapstructure:"query_tracing"`
-	PprofEnabled    bool            `mapstructure:"pprof_enabled"`
-	HTTPSEnabled    bool            `mapstructure:"https_enabled"`
-	HTTPSCert       string          `mapstructure:"https_cert"`
-	HTTPSKey        string          `mapstructure:"https_key"`
+	Circles            []*CircleConfig          `mapstructure:"circles"`
+	ListenAddr         string                   `mapstructure:"listen_addr"`
+	DBList             []string                 `mapstructure:"db_list"`
+	DataDir            string                   `mapstructure:"data_dir"`
+	TLogDir            string                   `mapstructure:"tlog_dir"`
+	TransferWebhook    string                   `mapstructure:"transfer_webhook"`
+	ConflictPolicy     string                   `mapstructure:"conflict_policy"`
+	DriftCheckInterval int                      `mapstructure:"drift_check_interval"`
+	DriftCheckWindow   int                      `mapstructure:"drift_check_window"`
+	AntiEntropyTime    int                      `mapstructure:"anti_entropy_time"`
+	AntiEntropyWindow  int                      `mapstructure:"anti_entropy_window"`
+	AntiEntropyPoints  int64                    `mapstructure:"anti_entropy_points"`
+	HashKey            string                   `mapstructure:"hash_key"`
+	FlushSize          int                      `mapstructure:"flush_size"`
+	FlushTime          int                      `mapstructure:"flush_time"`
+	CheckInterval      int                      `mapstructure:"check_interval"`
+	RewriteInterval    int                      `mapstructure:"rewrite_interval"`
+	DataMaxAge         int                      `mapstructure:"data_max_age"`
+	WriteSync          string                   `mapstructure:"write_sync"`
+	KeepPrecision      bool                     `mapstructure:"keep_precision"`
+	WriteDurable       bool                     `mapstructure:"write_durable"`
+	BackfillFlushSize  int                      `mapstructure:"backfill_flush_size"`
+	BackfillQueueSize  int                      `mapstructure:"backfill_queue_size"`
+	BackfillRateLimit  int                      `mapstructure:"backfill_rate_limit"`
+	MaxBodySize        int64                    `mapstructure:"max_body_size"`
+	MaxDecodedSize     int64                    `mapstructure:"max_decoded_size"`
+	Transforms         []*TransformConfig       `mapstructure:"transforms"`
+	MaxRowLimit        int                      `mapstructure:"max_row_limit"`
+	MaxSelectSeries    int                      `mapstructure:"max_select_series"`
+	MaxSelectBuckets   int                      `mapstructure:"max_select_buckets"`
+	ContinuousQueries  []*ContinuousQueryConfig `mapstructure:"continuous_queries"`
+	ReadStrategy       string                   `mapstructure:"read_strategy"`
+	DBReadStrategy     map[string]string        `mapstructure:"db_read_strategy"`
+	DBShardKey         map[string]string        `mapstructure:"db_shard_key"`
+	DBCircles          map[string][]int         `mapstructure:"db_circles"`
+	ZoneAware          bool                     `mapstructure:"zone_aware"`
+	WriteDisabledMode  string                   `mapstructure:"write_disabled_mode"`
+	RoutingRules       []*RoutingRuleConfig     `mapstructure:"routing_rules"`
+	ReadRepairRatio    float64                  `mapstructure:"read_repair_ratio"`
+	QueryTimeout       int                      `mapstructure:"query_timeout"`
+	QueryRules         []*QueryRuleConfig       `mapstructure:"query_rules"`
+	AllowDestructive   bool                     `mapstructure:"allow_destructive"`
+	MetaCacheTTL       int                      `mapstructure:"meta_cache_ttl"`
+	MergeMaxSize       int                      `mapstructure:"merge_max_size"`
+	QueryMaxConcurrent int                      `mapstructure:"query_max_concurrent"`
+	QueryMaxPerMinute  int                      `mapstructure:"query_max_per_minute"`
+	Quotas             []*QuotaConfig           `mapstructure:"quotas"`
+	QuotaRefresh       int                      `mapstructure:"quota_refresh"`
+	WriteRateLimit     float64                  `mapstructure:"write_rate_limit"`
+	WriteRateBurst     int                      `mapstructure:"write_rate_burst"`
+	QueryRateLimit     float64                  `mapstructure:"query_rate_limit"`
+	QueryRateBurst     int                      `mapstructure:"query_rate_burst"`
+	HedgeDelay         int                      `mapstructure:"hedge_delay"`
+	PreferredCircleId  int                      `mapstructure:"preferred_circle_id"` // nolint:golint
+	ConnPoolSize       int                      `mapstructure:"conn_pool_size"`
+	WriteTimeout       int                      `mapstructure:"write_timeout"`
+	IdleTimeout        int                      `mapstructure:"idle_timeout"`
+	Username           string                   `mapstructure:"username"`
+	Password           string                   `mapstructure:"password"`
+	Users              []*UserConfig            `mapstructure:"users"`
+	DBCredentials      Credentials              `mapstructure:"db_credentials"`
+	Tenants            []*TenantConfig          `mapstructure:"tenants"`
+	MaskRules          []*MaskRuleConfig        `mapstructure:"mask_rules"`
+	MaskSalt           string                   `mapstructure:"mask_salt"`
+	AuthEncrypt        bool                     `mapstructure:"auth_encrypt"`
+	CipherKey          string                   `mapstructure:"cipher_key"`
+	CipherOldKeys      []string                 `mapstructure:"cipher_old_keys"`
+	SharedSecret       string                   `mapstructure:"shared_secret"`
+	VaultAddr          string                   `mapstructure:"vault_addr"`
+	VaultToken         string                   `mapstructure:"vault_token"`
+	SecretRefresh      int                      `mapstructure:"secret_refresh"`
+	HmacKeys           map[string]string        `mapstructure:"hmac_keys"`
+	HmacRequired       bool                     `mapstructure:"hmac_required"`
+	HmacWindow         int                      `mapstructure:"hmac_window"`
+	AuthPassthrough    bool                     `mapstructure:"auth_passthrough"`
+	LdapUrl            string                   `mapstructure:"ldap_url"` // nolint:golint
+	LdapUserDn         string                   `mapstructure:"ldap_user_dn"`
+	LdapGroupBaseDn    string                   `mapstructure:"ldap_group_base_dn"`
+	LdapGroupAttr      string                   `mapstructure:"ldap_group_attribute"`
+	LdapAdminGroups    []string                 `mapstructure:"ldap_admin_groups"`
+	LdapGroupGrants    map[string]Grants        `mapstructure:"ldap_group_grants"`
+	LdapCacheTTL       int                      `mapstructure:"ldap_cache_ttl"`
+	OidcIssuer         string                   `mapstructure:"oidc_issuer"`
+	OidcAudience       string                   `mapstructure:"oidc_audience"`
+	OidcJwksUrl        string                   `mapstructure:"oidc_jwks_url"` // nolint:golint
+	OidcUserClaim      string                   `mapstructure:"oidc_user_claim"`
+	OidcGroupsClaim    string                   `mapstructure:"oidc_groups_claim"`
+	OidcAdminGroups    []string                 `mapstructure:"oidc_admin_groups"`
+	OidcGroupGrants    map[string]Grants        `mapstructure:"oidc_group_grants"`
+	WriteTracing       bool                     `mapstructure:"write_tracing"`
+	QueryTracing       bool                     `mapstructure:"query_tracing"`
+	PprofEnabled       bool                     `mapstructure:"pprof_enabled"`
+	HTTPSEnabled       bool                     `mapstructure:"https_enabled"`
+	HTTPSCert          string                   `mapstructure:"https_cert"`
+	HTTPSKey           string                   `mapstructure:"https_key"`
+	HTTPSClientAuth    string                   `mapstructure:"https_client_auth"`
+	HTTPSClientCA      string                   `mapstructure:"https_client_ca"`
+	HTTPSClientUsers   map[string]string        `mapstructure:"https_client_users"`
+	HTTPSMinVersion    string                   `mapstructure:"https_min_version"`
+	HTTPSMaxVersion    string                   `mapstructure:"https_max_version"`
+	HTTPSCipherSuites  []string                 `mapstructure:"https_cipher_suites"`
+	HTTPSCurves        []string                 `mapstructure:"https_curve_preferences"`
+	DataAllowList      []string                 `mapstructure:"data_allow_list"`
+	DataDenyList       []string                 `mapstructure:"data_deny_list"`
+	AdminAllowList     []string                 `mapstructure:"admin_allow_list"`
+	AdminDenyList      []string                 `mapstructure:"admin_deny_list"`
+	AuditLog           string                   `mapstructure:"audit_log"`
+	AuditMaxSize       int                      `mapstructure:"audit_max_size"`
+	AuditMaxFiles      int                      `mapstructure:"audit_max_files"`
+	EtcdEndpoints      []string                 `mapstructure:"etcd_endpoints"`
+	EtcdPrefix         string                   `mapstructure:"etcd_prefix"`
 }
 
 func NewFileConfig(cfgfile string) (cfg *ProxyConfig, err error) {
@@ -78,7 +265,84 @@ func NewFileConfig(cfgfile string) (cfg *ProxyConfig, err error) {
 		return
 	}
 	cfg.setDefault()
-	err = cfg.checkConfig()
+	if err = InitSecrets(cfg); err != nil {
+		return
+	}
+	if err = cfg.checkConfig(); err != nil {
+		return
+	}
+	if err = cfg.resolveSecrets(); err != nil {
+		return
+	}
+	err = util.SetCipherKeys(cfg.CipherKey, cfg.CipherOldKeys)
+	return
+}
+
+// NewCircleConfig reads the circle config in json, it's checked when the circle is added to proxy
+func NewCircleConfig(r io.Reader) (cfg *CircleConfig, err error) {
+	cfg = &CircleConfig{}
+	err = readJSONConfig(r, cfg)
+	return
+}
+
+// NewBackendConfig reads the backend config in json, it's checked when the backend is added to circle
+func NewBackendConfig(r io.Reader) (cfg *BackendConfig, err error) {
+	cfg = &BackendConfig{}
+	err = readJSONConfig(r, cfg)
+	return
+}
+
+func readJSONConfig(r io.Reader, cfg interface{}) error {
+	v := viper.New()
+	v.SetConfigType("json")
+	if err := v.ReadConfig(r); err != nil {
+		return err
+	}
+	return v.Unmarshal(cfg)
+}
+
+// SaveCircles writes the circles back to the config file read, and the other settings are kept
+func (cfg *ProxyConfig) SaveCircles() error {
+	if viper.ConfigFileUsed() == "" {
+		return nil
+	}
+	b, err := MarshalCircles(cfg.Circles)
+	if err != nil {
+		return err
+	}
+	var circles []map[string]interface{}
+	if err = jsoniter.Unmarshal(b, &circles); err != nil {
+		return err
+	}
+	viper.Set("circles", circles)
+	return viper.WriteConfig()
+}
+
+// MarshalCircles returns the circles in json with the keys of config file
+func MarshalCircles(circfgs []*CircleConfig) ([]byte, error) {
+	json := jsoniter.Config{TagKey: "mapstructure"}.Froze()
+	b, err := json.Marshal(circfgs)
+	if err != nil {
+		return nil, err
+	}
+	var circles []map[string]interface{}
+	if err = json.Unmarshal(b, &circles); err != nil {
+		return nil, err
+	}
+	for _, circle := range circles {
+		// the empty settings are left out as the file written by hand, and null is not supported by toml
+		if circle["cold_backends"] == nil {
+			delete(circle, "cold_backends")
+			delete(circle, "cold_after")
+		}
+	}
+	return json.Marshal(circles)
+}
+
+// UnmarshalCircles parses the circles in json with the keys of config file
+func UnmarshalCircles(b []byte) (circfgs []*CircleConfig, err error) {
+	json := jsoniter.Config{TagKey: "mapstructure"}.Froze()
+	err = json.Unmarshal(b, &circfgs)
 	return
 }
 
@@ -92,6 +356,15 @@ func (cfg *ProxyConfig) setDefault() {
 	if cfg.TLogDir == "" {
 		cfg.TLogDir = "log"
 	}
+	if cfg.DriftCheckWindow <= 0 {
+		cfg.DriftCheckWindow = 86400
+	}
+	if cfg.AntiEntropyWindow <= 0 {
+		cfg.AntiEntropyWindow = 7200
+	}
+	if cfg.AntiEntropyPoints <= 0 {
+		cfg.AntiEntropyPoints = 10000
+	}
 	if cfg.HashKey == "" {
 		cfg.HashKey = "idx"
 	}
@@ -107,6 +380,94 @@ func (cfg *ProxyConfig) setDefault() {
 	if cfg.RewriteInterval <= 0 {
 		cfg.RewriteInterval = 10
 	}
+	if cfg.WriteSync == "" {
+		cfg.WriteSync = "always"
+	}
+	if cfg.MergeMaxSize <= 0 {
+		cfg.MergeMaxSize = 256 * 1024 * 1024
+	}
+	if cfg.WriteDisabledMode == "" {
+		cfg.WriteDisabledMode = WriteDisabledBuffer
+	}
+	if cfg.LdapGroupAttr == "" {
+		cfg.LdapGroupAttr = "member"
+	}
+	if cfg.LdapCacheTTL == 0 {
+		cfg.LdapCacheTTL = 300
+	}
+	// the burst defaults to the requests of one second, and at least one request
+	if cfg.WriteRateBurst <= 0 {
+		cfg.WriteRateBurst = int(math.Max(math.Ceil(cfg.WriteRateLimit), 1))
+	}
+	if cfg.QueryRateBurst <= 0 {
+		cfg.QueryRateBurst = int(math.Max(math.Ceil(cfg.QueryRateLimit), 1))
+	}
+	if cfg.QuotaRefresh <= 0 {
+		cfg.QuotaRefresh = 60
+	}
+	if cfg.SecretRefresh == 0 {
+		cfg.SecretRefresh = 300
+	}
+	if cfg.HmacWindow <= 0 {
+		cfg.HmacWindow = 300
+	}
+	for _, tcfg := range cfg.Tenants {
+		if tcfg != nil && tcfg.Prefix == "" {
+			tcfg.Prefix = tcfg.Name + "_"
+		}
+	}
+	if cfg.AuditMaxSize <= 0 {
+		cfg.AuditMaxSize = 100
+	}
+	if cfg.AuditMaxFiles <= 0 {
+		cfg.AuditMaxFiles = 5
+	}
+	if cfg.HTTPSClientAuth == "" {
+		cfg.HTTPSClientAuth = ClientAuthNone
+	}
+	if cfg.HTTPSMinVersion == "" {
+		cfg.HTTPSMinVersion = "1.2"
+	}
+	if cfg.OidcUserClaim == "" {
+		cfg.OidcUserClaim = "sub"
+	}
+	if cfg.OidcGroupsClaim == "" {
+		cfg.OidcGroupsClaim = "groups"
+	}
+	if cfg.ConflictPolicy == "" {
+		cfg.ConflictPolicy = ConflictSkip
+	}
+	if cfg.BackfillFlushSize <= 0 {
+		cfg.BackfillFlushSize = 50000
+	}
+	if cfg.BackfillQueueSize <= 0 {
+		cfg.BackfillQueueSize = 64
+	}
+	for _, circle := range cfg.Circles {
+		if circle.HashAlgorithm == "" {
+			circle.HashAlgorithm = HashConsistent
+		}
+		if circle.Replicas <= 0 {
+			circle.Replicas = 1
+		}
+		if circle.VirtualNodes <= 0 {
+			circle.VirtualNodes = 256
+		}
+		if circle.Role == "" {
+			circle.Role = RolePrimary
+		}
+		for _, backend := range circle.AllBackends() {
+			if backend.Compression == "" {
+				backend.Compression = "gzip"
+			}
+			if backend.Weight <= 0 {
+				backend.Weight = 1
+			}
+		}
+	}
+	if cfg.ReadStrategy == "" {
+		cfg.ReadStrategy = ReadRandom
+	}
 	if cfg.ConnPoolSize <= 0 {
 		cfg.ConnPoolSize = 20
 	}
@@ -116,6 +477,11 @@ func (cfg *ProxyConfig) setDefault() {
 	if cfg.IdleTimeout <= 0 {
 		cfg.IdleTimeout = 10
 	}
+	if cfg.EtcdPrefix == "" {
+		cfg.EtcdPrefix = "/influx-proxy/"
+	} else if !strings.HasSuffix(cfg.EtcdPrefix, "/") {
+		cfg.EtcdPrefix += "/"
+	}
 }
 
 func (cfg *ProxyConfig) checkConfig() (err error) {
@@ -127,7 +493,25 @@ func (cfg *ProxyConfig) checkConfig() (err error) {
 		if len(circle.Backends) == 0 {
 			return ErrEmptyBackends
 		}
-		for _, backend := range circle.Backends {
+		if err = CheckHashAlgorithm(circle.HashAlgorithm); err != nil {
+			return
+		}
+		if err = CheckCircleRole(circle.Role); err != nil {
+			return
+		}
+		if (len(circle.ColdBackends) > 0) != (circle.ColdAfter > 0) {
+			return ErrInvalidColdTier
+		}
+		if circle.Replicas > len(circle.Backends) {
+			return ErrInvalidReplicas
+		}
+		if err = CheckReadOnly(circle); err != nil {
+			return
+		}
+		if err = CheckFallback(circle); err != nil {
+			return
+		}
+		for _, backend := range circle.AllBackends() {
 			if backend.Name == "" {
 				return ErrEmptyBackendName
 			}
@@ -135,24 +519,117 @@ func (cfg *ProxyConfig) checkConfig() (err error) {
 				return ErrDuplicatedBackendName
 			}
 			set.Add(backend.Name)
+			if backend.Compression != "gzip" && backend.Compression != "snappy" && backend.Compression != "none" {
+				return ErrInvalidCompression
+			}
+			if _, _, err = NewBackendTLSConfig(backend); err != nil {
+				return
+			}
 		}
 	}
 	if cfg.HashKey != "idx" && cfg.HashKey != "exi" && cfg.HashKey != "name" && cfg.HashKey != "url" {
 		return ErrInvalidHashKey
 	}
+	if _, err = ParseSyncPolicy(cfg.WriteSync); err != nil {
+		return
+	}
+	if err = CheckReadStrategy(cfg.ReadStrategy); err != nil {
+		return
+	}
+	if cfg.ReadRepairRatio < 0 || cfg.ReadRepairRatio > 1 {
+		return ErrInvalidReadRepair
+	}
+	if cfg.WriteRateLimit < 0 || cfg.QueryRateLimit < 0 {
+		return ErrInvalidRateLimit
+	}
+	if cfg.WriteDisabledMode != WriteDisabledBuffer && cfg.WriteDisabledMode != WriteDisabledSkip {
+		return ErrInvalidWriteDisabled
+	}
+	if cfg.ConflictPolicy != ConflictSkip && cfg.ConflictPolicy != ConflictCast {
+		return ErrInvalidConflict
+	}
+	if cfg.TransferWebhook != "" {
+		if u, err := url.Parse(cfg.TransferWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return ErrInvalidWebhook
+		}
+	}
+	for _, strategy := range cfg.DBReadStrategy {
+		if err = CheckReadStrategy(strategy); err != nil {
+			return
+		}
+	}
+	for _, sk := range cfg.DBShardKey {
+		if err = CheckShardKey(sk); err != nil {
+			return
+		}
+	}
+	if err = CheckDBCircles(cfg); err != nil {
+		return
+	}
+	if err = cfg.checkSecrets(); err != nil {
+		return
+	}
+	if err = CheckCredentials(cfg); err != nil {
+		return
+	}
+	if err = CheckUsers(cfg); err != nil {
+		return
+	}
+	if err = CheckTenants(cfg); err != nil {
+		return
+	}
+	if err = CheckQuotas(cfg); err != nil {
+		return
+	}
+	if err = CheckMaskRules(cfg); err != nil {
+		return
+	}
+	if err = CheckLdap(cfg); err != nil {
+		return
+	}
+	if err = CheckOidc(cfg); err != nil {
+		return
+	}
+	if err = CheckHmac(cfg); err != nil {
+		return
+	}
+	if err = CheckClientAuth(cfg); err != nil {
+		return
+	}
+	if err = CheckServerTLS(cfg); err != nil {
+		return
+	}
+	if _, err = NewIPFilter(cfg.DataAllowList, cfg.DataDenyList); err != nil {
+		return
+	}
+	if _, err = NewIPFilter(cfg.AdminAllowList, cfg.AdminDenyList); err != nil {
+		return
+	}
+	if _, err = NewRoutingRules(cfg); err != nil {
+		return
+	}
+	for _, cqcfg := range cfg.ContinuousQueries {
+		if _, err = NewContinuousQuery(cqcfg); err != nil {
+			return
+		}
+	}
+	if _, err = NewQueryRules(cfg.QueryRules); err != nil {
+		return
+	}
 	return
 }
 
 func (cfg *ProxyConfig) PrintSummary() {
 	log.Printf("%d circles loaded from file", len(cfg.Circles))
 	for id, circle := range cfg.Circles {
-		log.Printf("circle %d: %d backends loaded", id, len(circle.Backends))
+		log.Printf("circle %d: %d backends loaded, hash algorithm: %s, replicas: %d", id, len(circle.Backends), circle.HashAlgorithm, circle.Replicas)
 	}
 	log.Printf("hash key: %s", cfg.HashKey)
 	if len(cfg.DBList) > 0 {
 		log.Printf("db list: %v", cfg.DBList)
 	}
-	log.Printf("auth: %t, encrypt: %t", cfg.Username != "" || cfg.Password != "", cfg.AuthEncrypt)
+	log.Printf("auth: %t, users: %d, ldap: %t, oidc: %t, encrypt: %t", cfg.Username != "" || cfg.Password != "" || len(cfg.Users) > 0 || cfg.LdapUrl != "" || cfg.OidcIssuer != "",
+		len(cfg.Users), cfg.LdapUrl != "", cfg.OidcIssuer != "", cfg.AuthEncrypt)
 }
 
 func (cfg *ProxyConfig) String() string {
@@ -0,0 +1,127 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+var ErrInvalidContinuousQuery = errors.New("invalid continuous query, require name, db, every and select into query with group by time")
+
+var (
+	groupByRegexp = regexp.MustCompile(`(?i)\s+group\s+by\s+`)
+	whereRegexp   = regexp.MustCompile(`(?i)\s+where\s+`)
+)
+
+// ContinuousQuery runs select into on schedule at the proxy, since each backend only holds part of the data
+type ContinuousQuery struct {
+	Name  string
+	Db    string
+	Query string
+	Every time.Duration
+	For   time.Duration
+}
+
+func NewContinuousQuery(cfg *ContinuousQueryConfig) (cq *ContinuousQuery, err error) {
+	if cfg.Name == "" || cfg.Db == "" || cfg.Every <= 0 {
+		return nil, ErrInvalidContinuousQuery
+	}
+	tokens := ScanTokens(cfg.Query, 0)
+	if len(tokens) == 0 || !CheckIntoFromTokens(tokens) || !IsGroupByTime(tokens) {
+		return nil, ErrInvalidContinuousQuery
+	}
+	if _, _, err = ParseIntoQuery(cfg.Query, cfg.Db); err != nil {
+		return nil, err
+	}
+	cq = &ContinuousQuery{
+		Name:  cfg.Name,
+		Db:    cfg.Db,
+		Query: strings.TrimRight(strings.TrimSpace(cfg.Query), "; "),
+		Every: time.Duration(cfg.Every) * time.Second,
+		For:   time.Duration(cfg.For) * time.Second,
+	}
+	if cq.For <= 0 {
+		cq.For = cq.Every
+	}
+	return
+}
+
+// Bound returns the query with the time range [start, end) added to the where clause
+func (cq *ContinuousQuery) Bound(start, end time.Time) string {
+	cond := fmt.Sprintf("time >= %d AND time < %d", start.UnixNano(), end.UnixNano())
+	groups := groupByRegexp.FindAllStringIndex(cq.Query, -1)
+	group := groups[len(groups)-1][0]
+	wheres := whereRegexp.FindAllStringIndex(cq.Query[:group], -1)
+	if len(wheres) > 0 {
+		where := wheres[len(wheres)-1]
+		// the where clause is of the outer query if it isn't inside parentheses
+		if strings.Count(cq.Query[:where[0]], "(") == strings.Count(cq.Query[:where[0]], ")") {
+			return fmt.Sprintf("%s WHERE %s AND (%s)%s", cq.Query[:where[0]], cond, cq.Query[where[1]:group], cq.Query[group:])
+		}
+	}
+	return fmt.Sprintf("%s WHERE %s%s", cq.Query[:group], cond, cq.Query[group:])
+}
+
+func (ip *Proxy) runContinuousQuery(cq *ContinuousQuery) {
+	for {
+		now := time.Now()
+		end := now.Truncate(cq.Every).Add(cq.Every)
+		time.Sleep(end.Sub(now))
+		q := cq.Bound(end.Add(-cq.For), end)
+		req, _ := http.NewRequest("GET", "/query", nil)
+		req.Form = url.Values{"db": []string{cq.Db}, "q": []string{q}}
+		body, err := ip.Query(&discardResponseWriter{header: http.Header{}}, req)
+		if err == nil {
+			var rsp *Response
+			rsp, err = ResponseFromResponseBytes(body)
+			if err == nil && rsp.Err != "" {
+				err = errors.New(rsp.Err)
+			}
+		}
+		if err != nil {
+			log.Printf("continuous query error: %s, name: %s, db: %s, query: %s", err, cq.Name, cq.Db, q)
+		}
+	}
+}
+
+// ShowContinuousQueries returns the continuous queries of proxy grouped by db
+func (ip *Proxy) ShowContinuousQueries() *Response {
+	var series models.Rows
+	index := make(map[string]*models.Row)
+	for _, cq := range ip.cqs {
+		row, ok := index[cq.Db]
+		if !ok {
+			row = &models.Row{Name: cq.Db, Columns: []string{"name", "query"}, Values: [][]interface{}{}}
+			index[cq.Db] = row
+			series = append(series, row)
+		}
+		row.Values = append(row.Values, []interface{}{cq.Name, cq.Query})
+	}
+	return ResponseFromSeries(series)
+}
+
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(statusCode int) {
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContinuousQueryBound(t *testing.T) {
+	start, end := time.Unix(0, 1000), time.Unix(0, 2000)
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "without where",
+			query: `SELECT mean("value") INTO "cpu_1h" FROM "cpu" GROUP BY time(1h), *`,
+			want:  `SELECT mean("value") INTO "cpu_1h" FROM "cpu" WHERE time >= 1000 AND time < 2000 GROUP BY time(1h), *`,
+		},
+		{
+			name:  "with where",
+			query: `select mean(value) into cpu_1h from cpu where (host = 'a' or host = 'b')  group by time(1h)`,
+			want:  `select mean(value) into cpu_1h from cpu WHERE time >= 1000 AND time < 2000 AND ((host = 'a' or host = 'b'))  group by time(1h)`,
+		},
+		{
+			name:  "with where in subquery",
+			query: `select max(v) into cpu_1h from (select v from cpu where host = 'a') group by time(1h)`,
+			want:  `select max(v) into cpu_1h from (select v from cpu where host = 'a') WHERE time >= 1000 AND time < 2000 group by time(1h)`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq, err := NewContinuousQuery(&ContinuousQueryConfig{Name: "cq", Db: "db", Query: tt.query, Every: 3600})
+			if err != nil {
+				t.Fatalf("error: %s", err)
+			}
+			if got := cq.Bound(start, end); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewContinuousQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *ContinuousQueryConfig
+	}{
+		{name: "no every", cfg: &ContinuousQueryConfig{Name: "cq", Db: "db", Query: `select mean(v) into m from cpu group by time(1h)`}},
+		{name: "no into", cfg: &ContinuousQueryConfig{Name: "cq", Db: "db", Query: `select mean(v) from cpu group by time(1h)`, Every: 60}},
+		{name: "no group by time", cfg: &ContinuousQueryConfig{Name: "cq", Db: "db", Query: `select v into m from cpu group by host`, Every: 60}},
+	}
+	for _, tt := range tests {
+		if _, err := NewContinuousQuery(tt.cfg); err != ErrInvalidContinuousQuery {
+			t.Errorf("%s: invalid continuous query accepted: %v", tt.name, err)
+		}
+	}
+}
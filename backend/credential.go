@@ -0,0 +1,63 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"log"
+)
+
+var ErrInvalidCredential = errors.New("invalid credentials, require database and username or password")
+
+// CredentialConfig is the username and password of backends for a database, with encryption if auth_encrypt
+// of backend is enabled, or secret references
+type CredentialConfig struct {
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// Credentials are the credentials by database
+type Credentials map[string]*CredentialConfig
+
+type credential struct {
+	username *Secret
+	password *Secret
+}
+
+func newCredential(backend, db string, cfg *CredentialConfig) *credential {
+	username, err := NewSecret(cfg.Username)
+	if err != nil {
+		log.Printf("backend %s username of db %s error: %s", backend, db, err)
+	}
+	password, err := NewSecret(cfg.Password)
+	if err != nil {
+		log.Printf("backend %s password of db %s error: %s", backend, db, err)
+	}
+	return &credential{username: username, password: password}
+}
+
+// CheckCredentials checks the credentials by database of all backends and of each backend
+func CheckCredentials(cfg *ProxyConfig) error {
+	all := []Credentials{cfg.DBCredentials}
+	for _, circle := range cfg.Circles {
+		for _, backend := range circle.AllBackends() {
+			all = append(all, backend.Credentials)
+		}
+	}
+	for _, credentials := range all {
+		for db, crcfg := range credentials {
+			if db == "" || crcfg == nil || (crcfg.Username == "" && crcfg.Password == "") {
+				return ErrInvalidCredential
+			}
+			if err := CheckSecret(crcfg.Username); err != nil {
+				return err
+			}
+			if err := CheckSecret(crcfg.Password); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
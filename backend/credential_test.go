@@ -0,0 +1,122 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCheckCredentials(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *ProxyConfig
+		want error
+	}{
+		{
+			name: "empty",
+			cfg:  &ProxyConfig{},
+			want: nil,
+		},
+		{
+			name: "db",
+			cfg:  &ProxyConfig{DBCredentials: Credentials{"db1": {Username: "u1", Password: "p1"}}},
+			want: nil,
+		},
+		{
+			name: "backend",
+			cfg: &ProxyConfig{Circles: []*CircleConfig{{Backends: []*BackendConfig{
+				{Name: "b1", Credentials: Credentials{"db1": {Username: "u1", Password: "env:PASSWORD"}}},
+			}}}},
+			want: nil,
+		},
+		{
+			name: "empty db",
+			cfg:  &ProxyConfig{DBCredentials: Credentials{"": {Username: "u1", Password: "p1"}}},
+			want: ErrInvalidCredential,
+		},
+		{
+			name: "empty credential",
+			cfg: &ProxyConfig{Circles: []*CircleConfig{{Backends: []*BackendConfig{
+				{Name: "b1", Credentials: Credentials{"db1": {}}},
+			}}}},
+			want: ErrInvalidCredential,
+		},
+		{
+			name: "invalid secret",
+			cfg:  &ProxyConfig{DBCredentials: Credentials{"db1": {Username: "u1", Password: "env:"}}},
+			want: ErrInvalidSecret,
+		},
+	}
+	for _, tt := range tests {
+		if got := CheckCredentials(tt.cfg); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBackendCredentials(t *testing.T) {
+	var lock sync.Mutex
+	auths := make(map[string]string)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			username, password, _ := req.BasicAuth()
+			lock.Lock()
+			auths[req.URL.Query().Get("db")] = username + ":" + password
+			lock.Unlock()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	cfg := &BackendConfig{
+		Name:        "b1",
+		Url:         ts.URL,
+		Username:    "admin",
+		Password:    "pass",
+		Credentials: Credentials{"db1": {Username: "u1", Password: "p1"}, "db2": {Username: "u2", Password: "p2"}},
+	}
+	pxcfg := &ProxyConfig{WriteTimeout: 10, DBCredentials: Credentials{"db2": {Username: "t2", Password: "q2"}, "db3": {Username: "t3", Password: "q3"}}}
+	hb := NewHttpBackend(cfg, pxcfg)
+	defer hb.Close()
+	for _, db := range []string{"db1", "db2", "db3", "db4"} {
+		if err := hb.WriteStream(db, "", "", bytes.NewBufferString("cpu value=1"), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the credentials of backend override the ones of all backends, and the default ones are used for the others
+	want := map[string]string{"db1": "u1:p1", "db2": "u2:p2", "db3": "t3:q3", "db4": "admin:pass"}
+	for db, auth := range want {
+		if auths[db] != auth {
+			t.Errorf("%s: got %s, want %s", db, auths[db], auth)
+		}
+	}
+}
+
+func TestMarshalCredentials(t *testing.T) {
+	circles := []*CircleConfig{{Name: "c1", Backends: []*BackendConfig{
+		{Name: "b1", Url: "http://127.0.0.1:8086"},
+		{Name: "b2", Url: "http://127.0.0.1:8087", Credentials: Credentials{"db1": {Username: "u1", Password: "p1"}}},
+	}}}
+	b, err := MarshalCircles(circles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(b), `"credentials"`) != 1 {
+		t.Errorf("empty credentials not left out: %s", b)
+	}
+	got, err := UnmarshalCircles(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crcfg := got[0].Backends[1].Credentials["db1"]; crcfg == nil || crcfg.Username != "u1" || crcfg.Password != "p1" {
+		t.Errorf("credentials: got %+v", got[0].Backends[1].Credentials)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+)
+
+var ErrInvalidDBCircles = errors.New("invalid db_circles, require non-empty list of existing circle ids")
+
+// DBCircles pins the databases to the circles by id, the databases not pinned are in all circles
+type DBCircles map[string]map[int]bool
+
+func CheckDBCircles(cfg *ProxyConfig) error {
+	for _, ids := range cfg.DBCircles {
+		if len(ids) == 0 {
+			return ErrInvalidDBCircles
+		}
+		for _, id := range ids {
+			if id < 0 || id >= len(cfg.Circles) {
+				return ErrInvalidDBCircles
+			}
+		}
+	}
+	return nil
+}
+
+func NewDBCircles(cfg *ProxyConfig) DBCircles {
+	dcs := make(DBCircles, len(cfg.DBCircles))
+	for db, ids := range cfg.DBCircles {
+		dcs[db] = make(map[int]bool, len(ids))
+		for _, id := range ids {
+			dcs[db][id] = true
+		}
+	}
+	return dcs
+}
+
+// Contains returns true if the database is in the circle of id
+func (dcs DBCircles) Contains(db string, circleId int) bool { // nolint:golint
+	ids, ok := dcs[db]
+	return !ok || ids[circleId]
+}
+
+// Filter returns the circles containing all the databases, the empty database is ignored
+func (dcs DBCircles) Filter(circles []*Circle, dbs ...string) []*Circle {
+	if len(dcs) == 0 {
+		return circles
+	}
+	filtered := make([]*Circle, 0, len(circles))
+	for _, circle := range circles {
+		contains := true
+		for _, db := range dbs {
+			if db != "" && !dcs.Contains(db, circle.CircleId) {
+				contains = false
+				break
+			}
+		}
+		if contains {
+			filtered = append(filtered, circle)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckDBCircles(t *testing.T) {
+	circles := []*CircleConfig{{Name: "circle-0"}, {Name: "circle-1"}, {Name: "circle-2"}}
+	tests := []struct {
+		name      string
+		dbCircles map[string][]int
+		ok        bool
+	}{
+		{name: "none", dbCircles: nil, ok: true},
+		{name: "pinned", dbCircles: map[string][]int{"audit": {0, 2}}, ok: true},
+		{name: "empty", dbCircles: map[string][]int{"audit": {}}, ok: false},
+		{name: "out of range", dbCircles: map[string][]int{"audit": {3}}, ok: false},
+		{name: "negative", dbCircles: map[string][]int{"audit": {-1}}, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckDBCircles(&ProxyConfig{Circles: circles, DBCircles: tt.dbCircles}); (err == nil) != tt.ok {
+				t.Errorf("CheckDBCircles() error = %v, ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestDBCirclesFilter(t *testing.T) {
+	circles := []*Circle{{CircleId: 0}, {CircleId: 1}, {CircleId: 2}}
+	dcs := NewDBCircles(&ProxyConfig{DBCircles: map[string][]int{"audit": {0, 2}, "eu": {1, 2}}})
+	ids := func(circles []*Circle) (ids []int) {
+		for _, circle := range circles {
+			ids = append(ids, circle.CircleId)
+		}
+		return
+	}
+	tests := []struct {
+		name string
+		dbs  []string
+		want []int
+	}{
+		{name: "not pinned", dbs: []string{"db"}, want: []int{0, 1, 2}},
+		{name: "pinned", dbs: []string{"audit"}, want: []int{0, 2}},
+		{name: "empty db ignored", dbs: []string{"", "audit"}, want: []int{0, 2}},
+		{name: "intersection", dbs: []string{"audit", "eu"}, want: []int{2}},
+		{name: "no db", dbs: nil, want: []int{0, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ids(dcs.Filter(circles, tt.dbs...)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Filter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
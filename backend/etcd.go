@@ -0,0 +1,254 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EtcdCircles        = "circles"
+	EtcdDBList         = "db_list"
+	EtcdResyncing      = "transfer/resyncing"
+	EtcdTransferPrefix = "transfer/circle/"
+	EtcdTransferLock   = "transfer/lock"
+)
+
+var ErrEtcdUnavailable = errors.New("etcd unavailable")
+
+// Etcd stores the state shared by proxies under the prefix, by the json gateway of etcd v3 api
+type Etcd struct {
+	endpoints []string
+	prefix    string
+	client    *http.Client
+	watcher   *http.Client
+}
+
+type etcdKeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type etcdEvent struct {
+	Type string        `json:"type"`
+	Kv   *etcdKeyValue `json:"kv"`
+}
+
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+// NewEtcd returns nil if no endpoint is configured
+func NewEtcd(cfg *ProxyConfig) *Etcd {
+	if len(cfg.EtcdEndpoints) == 0 {
+		return nil
+	}
+	endpoints := make([]string, len(cfg.EtcdEndpoints))
+	for i, endpoint := range cfg.EtcdEndpoints {
+		endpoints[i] = strings.TrimRight(endpoint, "/")
+	}
+	return &Etcd{
+		endpoints: endpoints,
+		prefix:    cfg.EtcdPrefix,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		watcher:   &http.Client{},
+	}
+}
+
+// GetAll returns the values of all names under the prefix, and the revision of etcd
+func (e *Etcd) GetAll() (values map[string][]byte, revision int64, err error) {
+	var resp struct {
+		Header etcdHeader      `json:"header"`
+		Kvs    []*etcdKeyValue `json:"kvs"`
+	}
+	body := map[string]string{"key": e.encode(e.prefix), "range_end": e.encode(prefixEnd(e.prefix))}
+	if err = e.post("/v3/kv/range", body, &resp); err != nil {
+		return
+	}
+	values = make(map[string][]byte)
+	for _, kv := range resp.Kvs {
+		name, value, err := e.decode(kv)
+		if err != nil {
+			return nil, 0, err
+		}
+		values[name] = value
+	}
+	revision, _ = strconv.ParseInt(resp.Header.Revision, 10, 64)
+	return
+}
+
+func (e *Etcd) Put(name string, value []byte) error {
+	body := map[string]string{"key": e.encode(e.prefix + name), "value": base64.StdEncoding.EncodeToString(value)}
+	return e.post("/v3/kv/put", body, nil)
+}
+
+// Lock puts the value of name with a lease of ttl seconds if the name is absent, and returns the lease which should
+// be kept alive by KeepAlive and revoked by Unlock, the name is removed once the lease is revoked or expired.
+// The lease is empty if the name is held, and the value held is returned
+func (e *Etcd) Lock(name string, value []byte, ttl int) (lease string, held []byte, err error) {
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	if err = e.post("/v3/lease/grant", map[string]string{"TTL": strconv.Itoa(ttl)}, &grant); err != nil {
+		return
+	}
+	key := e.encode(e.prefix + name)
+	body := map[string]interface{}{
+		"compare": []map[string]string{{"key": key, "result": "EQUAL", "target": "CREATE", "create_revision": "0"}},
+		"success": []map[string]interface{}{{"request_put": map[string]string{"key": key, "value": base64.StdEncoding.EncodeToString(value), "lease": grant.ID}}},
+		"failure": []map[string]interface{}{{"request_range": map[string]string{"key": key}}},
+	}
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+		Responses []struct {
+			ResponseRange struct {
+				Kvs []*etcdKeyValue `json:"kvs"`
+			} `json:"response_range"`
+		} `json:"responses"`
+	}
+	if err = e.post("/v3/kv/txn", body, &resp); err != nil {
+		e.Unlock(grant.ID)
+		return
+	}
+	if resp.Succeeded {
+		return grant.ID, nil, nil
+	}
+	e.Unlock(grant.ID)
+	for _, r := range resp.Responses {
+		for _, kv := range r.ResponseRange.Kvs {
+			_, held, err = e.decode(kv)
+			return
+		}
+	}
+	return
+}
+
+func (e *Etcd) KeepAlive(lease string) error {
+	return e.post("/v3/lease/keepalive", map[string]string{"ID": lease}, nil)
+}
+
+func (e *Etcd) Unlock(lease string) error {
+	return e.post("/v3/lease/revoke", map[string]string{"ID": lease}, nil)
+}
+
+// Watch calls fn with the names put under the prefix since revision, it reconnects until the proxy exits
+func (e *Etcd) Watch(revision int64, fn func(name string, value []byte)) {
+	for i := 0; ; i++ {
+		endpoint := e.endpoints[i%len(e.endpoints)]
+		err := e.watch(endpoint, &revision, fn)
+		log.Printf("etcd watch error: %s, endpoint: %s", err, endpoint)
+		time.Sleep(time.Second)
+	}
+}
+
+func (e *Etcd) watch(endpoint string, revision *int64, fn func(name string, value []byte)) error {
+	req := map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            e.encode(e.prefix),
+			"range_end":      e.encode(prefixEnd(e.prefix)),
+			"start_revision": strconv.FormatInt(*revision, 10),
+		},
+	}
+	b, _ := json.Marshal(req)
+	resp, err := e.watcher.Post(endpoint+"/v3/watch", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg struct {
+			Result struct {
+				Header etcdHeader   `json:"header"`
+				Events []*etcdEvent `json:"events"`
+			} `json:"result"`
+		}
+		if err = json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return err
+		}
+		for _, ev := range msg.Result.Events {
+			if ev.Type == "DELETE" || ev.Kv == nil {
+				continue
+			}
+			name, value, err := e.decode(ev.Kv)
+			if err != nil {
+				return err
+			}
+			fn(name, value)
+		}
+		if rev, err := strconv.ParseInt(msg.Result.Header.Revision, 10, 64); err == nil && rev >= *revision {
+			*revision = rev + 1
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return ErrEtcdUnavailable
+}
+
+// post tries the endpoints in order until one succeeds
+func (e *Etcd) post(path string, body interface{}, v interface{}) (err error) {
+	b, _ := json.Marshal(body)
+	for _, endpoint := range e.endpoints {
+		var resp *http.Response
+		resp, err = e.client.Post(endpoint+path, "application/json", bytes.NewReader(b))
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("etcd error: status %d, endpoint: %s", resp.StatusCode, endpoint)
+			continue
+		}
+		if v != nil {
+			err = json.NewDecoder(resp.Body).Decode(v)
+		}
+		resp.Body.Close()
+		return
+	}
+	if err == nil {
+		err = ErrEtcdUnavailable
+	}
+	return
+}
+
+func (e *Etcd) encode(key string) string {
+	return base64.StdEncoding.EncodeToString([]byte(key))
+}
+
+func (e *Etcd) decode(kv *etcdKeyValue) (name string, value []byte, err error) {
+	key, err := base64.StdEncoding.DecodeString(kv.Key)
+	if err != nil {
+		return
+	}
+	value, err = base64.StdEncoding.DecodeString(kv.Value)
+	return strings.TrimPrefix(string(key), e.prefix), value, err
+}
+
+// prefixEnd returns the range end to get all keys with the prefix
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
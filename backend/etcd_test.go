@@ -0,0 +1,123 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{prefix: "/influx-proxy/", want: "/influx-proxy0"},
+		{prefix: "a\xff", want: "b"},
+		{prefix: "\xff", want: "\x00"},
+	}
+	for _, tt := range tests {
+		if got := prefixEnd(tt.prefix); got != tt.want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestEtcd(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	store := map[string]string{"/proxy/db_list": `["db1"]`}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		switch req.URL.Path {
+		case "/v3/kv/range":
+			var kvs []string
+			for k, v := range store {
+				kvs = append(kvs, fmt.Sprintf(`{"key":"%s","value":"%s"}`, b64(k), b64(v)))
+			}
+			fmt.Fprintf(w, `{"header":{"revision":"7"},"kvs":[%s]}`, kvs[0])
+		case "/v3/kv/put":
+			key, _ := base64.StdEncoding.DecodeString(body["key"].(string))
+			value, _ := base64.StdEncoding.DecodeString(body["value"].(string))
+			store[string(key)] = string(value)
+			fmt.Fprint(w, `{"header":{"revision":"8"}}`)
+		case "/v3/watch":
+			fmt.Fprintf(w, "{\"result\":{\"header\":{\"revision\":\"8\"},\"created\":true}}\n")
+			fmt.Fprintf(w, "{\"result\":{\"header\":{\"revision\":\"9\"},\"events\":[{\"kv\":{\"key\":\"%s\",\"value\":\"%s\"}},{\"type\":\"DELETE\",\"kv\":{\"key\":\"%s\"}}]}}\n",
+				b64("/proxy/transfer/resyncing"), b64("true"), b64("/proxy/db_list"))
+		}
+	}))
+	defer ts.Close()
+
+	etcd := NewEtcd(&ProxyConfig{EtcdEndpoints: []string{"http://127.0.0.1:1", ts.URL + "/"}, EtcdPrefix: "/proxy/"})
+	values, revision, err := etcd.GetAll()
+	if err != nil || revision != 7 || string(values[EtcdDBList]) != `["db1"]` {
+		t.Fatalf("get all error: %v, revision: %d, values: %v", err, revision, values)
+	}
+	if err = etcd.Put(EtcdCircles, []byte("[]")); err != nil || store["/proxy/circles"] != "[]" {
+		t.Fatalf("put error: %v, store: %v", err, store)
+	}
+	events := make(map[string]string)
+	revision = 8
+	etcd.watch(ts.URL, &revision, func(name string, value []byte) {
+		events[name] = string(value)
+	})
+	if len(events) != 1 || events[EtcdResyncing] != "true" || revision != 10 {
+		t.Errorf("watch events: %v, revision: %d", events, revision)
+	}
+}
+
+func TestEtcdLock(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	store := make(map[string]string)
+	leases := make(map[string]string)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		switch req.URL.Path {
+		case "/v3/lease/grant":
+			id := fmt.Sprint(len(leases) + 1)
+			leases[id] = ""
+			fmt.Fprintf(w, `{"ID":"%s","TTL":"%s"}`, id, body["TTL"])
+		case "/v3/lease/revoke":
+			id := body["ID"].(string)
+			if key := leases[id]; key != "" {
+				delete(store, key)
+			}
+			delete(leases, id)
+			fmt.Fprint(w, `{}`)
+		case "/v3/kv/txn":
+			key := body["compare"].([]interface{})[0].(map[string]interface{})["key"].(string)
+			if value, ok := store[key]; ok {
+				fmt.Fprintf(w, `{"succeeded":false,"responses":[{"response_range":{"kvs":[{"key":"%s","value":"%s"}]}}]}`, key, value)
+				return
+			}
+			put := body["success"].([]interface{})[0].(map[string]interface{})["request_put"].(map[string]interface{})
+			store[key] = put["value"].(string)
+			leases[put["lease"].(string)] = key
+			fmt.Fprint(w, `{"succeeded":true}`)
+		}
+	}))
+	defer ts.Close()
+
+	etcd := NewEtcd(&ProxyConfig{EtcdEndpoints: []string{ts.URL}, EtcdPrefix: "/proxy/"})
+	lease, held, err := etcd.Lock(EtcdTransferLock, []byte("a"), 60)
+	if err != nil || lease == "" || held != nil || store[b64("/proxy/transfer/lock")] != b64("a") {
+		t.Fatalf("lock error: %v, lease: %q, held: %q, store: %v", err, lease, held, store)
+	}
+	if lease2, held, err := etcd.Lock(EtcdTransferLock, []byte("b"), 60); err != nil || lease2 != "" || string(held) != "a" {
+		t.Fatalf("lock held error: %v, lease: %q, held: %q", err, lease2, held)
+	}
+	if err = etcd.Unlock(lease); err != nil || len(store) != 0 || len(leases) != 0 {
+		t.Fatalf("unlock error: %v, store: %v, leases: %v", err, store, leases)
+	}
+	if lease, _, err = etcd.Lock(EtcdTransferLock, []byte("b"), 60); err != nil || lease == "" {
+		t.Errorf("lock again error: %v, lease: %q", err, lease)
+	}
+}
@@ -6,12 +6,16 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/chengshiwen/influx-proxy/util"
 	"github.com/influxdata/influxdb1-client/models"
@@ -23,79 +27,352 @@ var (
 	ErrBackendsUnavailable = errors.New("backends unavailable")
 	ErrGetMeasurement      = errors.New("can't get measurement")
 	ErrGetBackends         = errors.New("can't get backends")
+	ErrMergeTooLarge       = errors.New("responses to merge exceed merge_max_size, narrow the time range or add limit")
 )
 
-func query(w http.ResponseWriter, req *http.Request, ip *Proxy, key string, fn func(*Backend, *http.Request, http.ResponseWriter) ([]byte, error)) (body []byte, err error) {
+func query(w http.ResponseWriter, req *http.Request, ip *Proxy, db, key string, fn func(*Backend, *http.Request, http.ResponseWriter) ([]byte, error)) (body []byte, err error) {
+	// backends failed in this request, the query fails over to the replica in next circle
+	var failed []string
+	for _, be := range readCandidates(ip, req, db, key) {
+		body, err = tryQuery(w, req, ip, be, fn, &failed)
+		if err == nil || req.Context().Err() != nil {
+			return
+		}
+	}
+
+	if err != nil {
+		return
+	}
+	return nil, ErrBackendsUnavailable
+}
+
+// readCandidates returns the active backends by key in the order to read, from the cold tiers if the query reads cold data
+func readCandidates(ip *Proxy, req *http.Request, db, key string) (backends []*Backend) {
+	circles := ip.readTiers(req, db)
 	// pass non-active, rewriting or write-only.
-	perms := rand.Perm(len(ip.Circles))
+	perms := ip.readRouter.Order(circles, db, func(circle *Circle) []*Backend {
+		return circle.GetReplicas(key)
+	})
 	for _, p := range perms {
-		be := ip.Circles[p].GetBackend(key)
-		if !be.IsActive() || be.IsRewriting() || be.IsWriteOnly() {
-			continue
-		}
-		body, err = fn(be, req, w)
-		if err == nil {
-			return
+		for _, be := range circles[p].GetReplicas(key) {
+			if !be.IsActive() || be.IsRewriting() || be.IsWriteOnly() {
+				continue
+			}
+			backends = append(backends, be)
 		}
 	}
 
 	// pass non-active, non-writing (excluding rewriting and write-only).
-	backends := ip.GetBackends(key)
-	for _, be := range backends {
-		if !be.IsActive() || !(be.IsRewriting() || be.IsWriteOnly()) {
-			continue
-		}
-		body, err = fn(be, req, w)
-		if err == nil {
-			return
+	for _, circle := range circles {
+		for _, be := range circle.GetReplicas(key) {
+			if !be.IsActive() || !(be.IsRewriting() || be.IsWriteOnly()) {
+				continue
+			}
+			backends = append(backends, be)
 		}
 	}
+	return
+}
 
+// tryQuery queries the backend within query timeout, and notes the backends failed before in response header
+func tryQuery(w http.ResponseWriter, req *http.Request, ip *Proxy, be *Backend, fn func(*Backend, *http.Request, http.ResponseWriter) ([]byte, error), failed *[]string) (body []byte, err error) {
+	r := req
+	if ip.queryTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), ip.queryTimeout)
+		defer cancel()
+		r = req.WithContext(ctx)
+	}
+	if len(*failed) > 0 {
+		// set before the query since a streamed response writes the header at once
+		w.Header().Set(HeaderFailover, strings.Join(*failed, ","))
+	}
+	body, err = fn(be, r, w)
 	if err != nil {
-		return
+		*failed = append(*failed, be.Name)
 	}
-	return nil, ErrBackendsUnavailable
+	return
 }
 
 func ReadProm(w http.ResponseWriter, req *http.Request, ip *Proxy, db, meas string) (err error) {
 	// all circles -> backend by key(db,meas) -> select or show
-	key := GetKey(db, meas)
+	if ip.shardKeys.Spread(db) {
+		return ErrSpreadByTags
+	}
+	key := ip.shardKeys.Key(db, meas, nil)
 	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
 		err = be.ReadProm(req, w)
 		return nil, err
 	}
-	_, err = query(w, req, ip, key, fn)
+	_, err = query(w, req, ip, db, key, fn)
 	return
 }
 
-func QueryFlux(w http.ResponseWriter, req *http.Request, ip *Proxy, bucket, meas string) (err error) {
-	// all circles -> backend by key(org,bucket,meas) -> query flux
-	key := GetKey(bucket, meas)
+func QueryFlux(w http.ResponseWriter, req *http.Request, ip *Proxy, db, meas string) (err error) {
+	// all circles -> backend by key(db,meas) -> query flux
+	key := ip.shardKeys.Key(db, meas, nil)
 	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
 		err = be.QueryFlux(req, w)
 		return nil, err
 	}
-	_, err = query(w, req, ip, key, fn)
+	_, err = query(w, req, ip, db, key, fn)
 	return
 }
 
+func QueryFluxMerged(w http.ResponseWriter, req *http.Request, ip *Proxy, db string, mms []string) (err error) {
+	// one circle -> backends by key(db,meas) of all measurements, or all backends if unknown -> query flux, and concat
+	rbody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return
+	}
+	backendsOf := func(circle *Circle) []*Backend {
+		if len(mms) == 0 {
+			return circle.Backends
+		}
+		return circle.GetBackendsByMeasurements(db, mms)
+	}
+	circles := ip.GetCircles(db)
+	perms := ip.readRouter.Order(circles, db, backendsOf)
+	for _, p := range perms {
+		backends := backendsOf(circles[p])
+		if !queryable(backends) {
+			continue
+		}
+		var wg sync.WaitGroup
+		qrs := make([]*QueryResult, len(backends))
+		for i, be := range backends {
+			wg.Add(1)
+			go func(i int, be *Backend) {
+				defer wg.Done()
+				cr := req.Clone(req.Context())
+				cr.Body = ioutil.NopCloser(bytes.NewReader(rbody))
+				cr.Header.Del("Accept-Encoding")
+				qrs[i] = be.QueryFluxResult(cr)
+			}(i, be)
+		}
+		wg.Wait()
+		bodies := make([][]byte, 0, len(qrs))
+		for _, qr := range qrs {
+			if qr.Err == nil && qr.Status >= 400 {
+				// pass through the error of backend
+				CopyHeader(w.Header(), qr.Header)
+				w.WriteHeader(qr.Status)
+				_, err = w.Write(qr.Body)
+				return
+			}
+			if qr.Err != nil {
+				err = qr.Err
+				break
+			}
+			bodies = append(bodies, qr.Body)
+		}
+		if err != nil {
+			continue
+		}
+		w.Header().Set("Content-Type", qrs[0].Header.Get("Content-Type"))
+		merged := time.Now()
+		body := ConcatFluxResponses(bodies)
+		traceMerge(req, merged)
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(body)
+		return
+	}
+	if err != nil {
+		return
+	}
+	return ErrBackendsUnavailable
+}
+
 func QueryFromQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string, db string) (body []byte, err error) {
+	dbs, mms, err := GetSourcesFromTokens(tokens)
+	if err == nil && (len(mms) > 1 || (len(mms) == 1 && IsRegexMeasurement(mms[0])) || IsCrossDatabase(dbs, db) || ip.shardKeys.Spread(db)) {
+		return QueryMergedQL(w, req, ip, tokens, db, dbs, mms)
+	}
+
 	// all circles -> backend by key(db,meas) -> select or show
 	meas, err := GetMeasurementFromTokens(tokens)
 	if err != nil {
 		return nil, ErrGetMeasurement
 	}
-	key := GetKey(db, meas)
-	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
-		qr := be.Query(req, w, false)
-		return qr.Body, qr.Err
+	key := ip.shardKeys.Key(db, meas, nil)
+	limited := ip.limits.Enabled()
+	if limited {
+		// remove support of query parameter `chunked`
+		req.Form.Del("chunked")
+	}
+	sw, stream := w.(*StreamWriter)
+	var served *Backend
+	if ip.hedgeDelay > 0 {
+		// hedged responses are buffered since only the first one is returned
+		fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
+			qr := be.Query(req, w, limited)
+			return qr.Body, qr.Err
+		}
+		body, served, err = hedgedQuery(w, req, ip, db, key, fn)
+	} else {
+		fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
+			served = be
+			if stream && !limited {
+				return nil, be.QueryStream(req, sw)
+			}
+			qr := be.Query(req, w, limited)
+			return qr.Body, qr.Err
+		}
+		body, err = query(w, req, ip, db, key, fn)
+	}
+	if err != nil {
+		return
+	}
+	if strings.ToLower(tokens[0]) == "select" {
+		rp, _ := GetRetentionPolicyFromTokens(tokens)
+		if rp == "" {
+			rp = req.FormValue("rp")
+		}
+		ip.readRepair.Sample(ip, req.FormValue("q"), db, rp, meas, served)
+	}
+	if !limited {
+		return
+	}
+	rsp, err := ResponseFromResponseBytes(body)
+	if err != nil {
+		return
+	}
+	ip.limits.Apply(rsp, IsGroupByTime(tokens))
+	return marshalResponse(w, req, rsp)
+}
+
+func QueryMergedQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string, db string, dbs []string, mms []string) (body []byte, err error) {
+	// one circle -> backends by key(db,meas) of all measurements -> select or show, and merge
+	// remove support of query parameter `chunked`
+	req.Form.Del("chunked")
+	desc := strings.Contains(GetHeadStmtFromTokens(tokens, 0), "order by time desc")
+	// the backends are queried with the limits added by offsets, and the limits are applied again after merge
+	pushed := CloneQueryRequest(req)
+	q, sl := PushDownLimits(req.FormValue("q"))
+	pushed.Form.Set("q", q)
+	// the fully qualified measurements of other databases are routed by their own databases
+	cross := IsCrossDatabase(dbs, db)
+	circles := ip.readTiers(req, append([]string{db}, dbs...)...)
+	perms := ip.readRouter.Order(circles, db, func(circle *Circle) []*Backend {
+		return circle.GetBackendsBySources(dbs, mms, db)
+	})
+	for _, p := range perms {
+		circle := circles[p]
+		backends := circle.GetBackendsBySources(dbs, mms, db)
+		if !queryable(backends) {
+			continue
+		}
+		// regex measurements across databases are not resolved, all backends are queried
+		if !cross {
+			if resolved, err := resolveMeasurements(backends, db, mms); err == nil {
+				// only the backends owning the measurements matched by regex are queried
+				backends = circle.GetBackendsByMeasurements(db, resolved)
+				if len(backends) == 0 {
+					backends = circle.Backends[:1]
+				}
+			}
+		}
+		if strings.ToLower(tokens[0]) == "show" {
+			return QueryUnionQL(w, req, ip, backends)
+		}
+		var bodies [][]byte
+		bodies, _, err = QueryInParallel(backends, pushed, w, true)
+		if err != nil {
+			continue
+		}
+		// the responses are buffered to merge, rather than streamed
+		size := 0
+		for _, b := range bodies {
+			size += len(b)
+		}
+		if ip.mergeMaxSize > 0 && size > ip.mergeMaxSize {
+			return nil, ErrMergeTooLarge
+		}
+		var rsp *Response
+		merged := time.Now()
+		rsp, err = MergeResponses(bodies, desc, req.FormValue("q"))
+		traceMerge(req, merged)
+		if err != nil {
+			return
+		}
+		applyLimits(rsp, sl)
+		ip.limits.Apply(rsp, IsGroupByTime(tokens))
+		return marshalResponse(w, req, rsp)
+	}
+	if err != nil {
+		return
+	}
+	return nil, ErrBackendsUnavailable
+}
+
+// resolveMeasurements replaces the regex measurements with the measurements matched in the backends
+func resolveMeasurements(backends []*Backend, db string, mms []string) (resolved []string, err error) {
+	set := util.NewSet()
+	for _, mm := range mms {
+		if !IsRegexMeasurement(mm) {
+			if !set[mm] {
+				set.Add(mm)
+				resolved = append(resolved, mm)
+			}
+			continue
+		}
+		q := fmt.Sprintf("show measurements with measurement =~ %s", mm)
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		for _, be := range backends {
+			wg.Add(1)
+			go func(be *Backend) {
+				defer wg.Done()
+				qr := be.Query(NewQueryRequest("GET", db, q, ""), nil, true)
+				var series models.Rows
+				if qr.Err == nil {
+					series, qr.Err = SeriesFromResponseBytes(qr.Body)
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				if qr.Err != nil {
+					err = qr.Err
+					return
+				}
+				for _, serie := range series {
+					for _, value := range serie.Values {
+						name := util.CastString(value[0])
+						if !set[name] {
+							set.Add(name)
+							resolved = append(resolved, name)
+						}
+					}
+				}
+			}(be)
+		}
+		wg.Wait()
+		if err != nil {
+			return nil, err
+		}
 	}
-	body, err = query(w, req, ip, key, fn)
 	return
 }
 
+func queryable(backends []*Backend) bool {
+	for _, be := range backends {
+		if !be.IsActive() || be.IsRewriting() || be.IsWriteOnly() {
+			return false
+		}
+	}
+	return true
+}
+
 func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string) (body []byte, err error) {
 	// all circles -> all backends -> show
+	stmt2 := GetHeadStmtFromTokens(tokens, 2)
+	stmt3 := GetHeadStmtFromTokens(tokens, 3)
+	if stmt2 == "show series" || stmt3 == "show tag keys" || stmt3 == "show tag values" {
+		return QueryUnionQL(w, req, ip, nil)
+	} else if stmt2 == "show stats" || stmt2 == "show diagnostics" || stmt2 == "show shards" {
+		return QueryStatsQL(w, req, ip)
+	}
+	if body, ok := marshalCached(w, req, ip); ok {
+		return body, nil
+	}
 	// remove support of query parameter `chunked`
 	req.Form.Del("chunked")
 	backends := ip.GetAllBackends()
@@ -111,16 +388,13 @@ func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	}
 
 	var rsp *Response
-	stmt2 := GetHeadStmtFromTokens(tokens, 2)
-	stmt3 := GetHeadStmtFromTokens(tokens, 3)
-	if stmt2 == "show measurements" || stmt2 == "show series" || stmt2 == "show databases" {
+	defer traceMerge(req, time.Now())
+	if stmt2 == "show measurements" || stmt2 == "show databases" {
 		rsp, err = reduceByValues(bodies)
-	} else if stmt3 == "show field keys" || stmt3 == "show tag keys" || stmt3 == "show tag values" {
+	} else if stmt3 == "show field keys" {
 		rsp, err = reduceBySeries(bodies)
 	} else if stmt3 == "show retention policies" {
 		rsp, err = attachByValues(bodies)
-	} else if stmt2 == "show stats" {
-		rsp, err = concatByResults(bodies)
 	}
 	if err != nil {
 		return
@@ -128,6 +402,11 @@ func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	if rsp == nil {
 		rsp = ResponseFromSeries(nil)
 	}
+	ip.metaCache.Set(req.FormValue("db"), req.FormValue("q"), rsp)
+	return marshalResponse(w, req, scopeDatabases(req, rsp))
+}
+
+func marshalResponse(w http.ResponseWriter, req *http.Request, rsp *Response) (body []byte, err error) {
 	pretty := req.URL.Query().Get("pretty") == "true"
 	body = util.MarshalJSON(rsp, pretty)
 	if w.Header().Get("Content-Encoding") == "gzip" {
@@ -142,15 +421,257 @@ func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	return
 }
 
-func QueryDeleteOrDropQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string, db string) (body []byte, err error) {
-	// all circles -> backend by key(db,meas) -> delete or drop measurement/series
-	meas, err := GetMeasurementFromTokens(tokens)
+func QueryMultiQL(w http.ResponseWriter, req *http.Request, ip *Proxy, stmts []string) (body []byte, err error) {
+	// each statement -> routed independently, and the results are stitched with statement ids
+	results := make([]*Result, 0, len(stmts))
+	for i, stmt := range stmts {
+		sreq := CloneQueryRequest(req)
+		sreq.Form.Set("q", stmt)
+		sreq.Form.Del("chunked")
+		sreq.Header.Del("Accept-Encoding")
+		var sbody []byte
+		var rsp *Response
+		sbody, err = ip.Query(unstream(w), sreq)
+		if err == nil {
+			rsp, err = ResponseFromResponseBytes(sbody)
+		}
+		if err == nil && rsp.Err != "" {
+			err = errors.New(rsp.Err)
+		}
+		if err != nil {
+			// stop at the failed statement like influxd
+			results = append(results, &Result{StatementID: i, Err: err.Error()})
+			break
+		}
+		for _, r := range rsp.Results {
+			r.StatementID = i
+			results = append(results, r)
+		}
+	}
+	w.Header().Del("Content-Encoding")
+	return marshalResponse(w, req, ResponseFromResults(results))
+}
+
+func QueryStatsQL(w http.ResponseWriter, req *http.Request, ip *Proxy) (body []byte, err error) {
+	// all circles -> all backends -> show stats, diagnostics or shards, tagged by backend name
+	req.Form.Del("chunked")
+	names, bodies := queryBackendsNamed(w, req, ip.GetAllBackends())
+	if len(bodies) == 0 {
+		return nil, ErrBackendsUnavailable
+	}
+	merged := time.Now()
+	rsp, err := tagByBackends(names, bodies)
+	traceMerge(req, merged)
 	if err != nil {
-		return nil, err
+		return
 	}
-	key := GetKey(db, meas)
-	backends := ip.GetBackends(key)
-	return QueryBackends(backends, req, w)
+	return marshalResponse(w, req, rsp)
+}
+
+// queryBackendsNamed queries the backends in parallel and returns the names and bodies of the succeeded ones
+func queryBackendsNamed(w http.ResponseWriter, req *http.Request, backends []*Backend) (names []string, bodies [][]byte) {
+	qrs := make([]*QueryResult, len(backends))
+	var wg sync.WaitGroup
+	for i, be := range backends {
+		if !be.IsActive() {
+			qrs[i] = &QueryResult{Err: fmt.Errorf("backend %s(%s) unavailable", be.Name, be.Url)}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, be *Backend) {
+			defer wg.Done()
+			qrs[i] = be.Query(CloneQueryRequest(req), nil, true)
+		}(i, be)
+	}
+	wg.Wait()
+
+	names = make([]string, 0, len(backends))
+	bodies = make([][]byte, 0, len(backends))
+	for i, qr := range qrs {
+		if qr.Err != nil {
+			log.Printf("query: %s, backend: %s, error: %s", req.FormValue("q"), backends[i].Name, qr.Err)
+			continue
+		}
+		if len(bodies) == 0 {
+			CopyHeader(w.Header(), qr.Header)
+		}
+		names = append(names, backends[i].Name)
+		bodies = append(bodies, qr.Body)
+	}
+	return
+}
+
+func QueryDropShardQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string) (body []byte, err error) {
+	// all circles -> backend owning the shard id -> drop shard
+	if len(tokens) < 3 {
+		return nil, ErrIllegalQL
+	}
+	id, err := strconv.ParseInt(tokens[2], 10, 64)
+	if err != nil {
+		return nil, ErrIllegalQL
+	}
+	backends := ip.GetAllBackends()
+	if name := req.FormValue("backend"); name != "" {
+		// the shard ids of backends are independent, the backend can be specified if the id is ambiguous
+		var selected []*Backend
+		for _, be := range backends {
+			if be.Name == name {
+				selected = append(selected, be)
+			}
+		}
+		backends = selected
+	}
+	sreq := CloneQueryRequest(req)
+	sreq.Form.Set("q", "show shards")
+	sreq.Form.Del("chunked")
+	sreq.Header.Del("Accept-Encoding")
+	names, bodies := queryBackendsNamed(&discardResponseWriter{header: http.Header{}}, sreq, backends)
+	owners, err := FindShardOwners(names, bodies, id)
+	if err != nil {
+		return
+	}
+	if len(owners) == 0 {
+		return nil, fmt.Errorf("shard %d not found", id)
+	} else if len(owners) > 1 {
+		return nil, fmt.Errorf("shard %d exists on backends %s, specify one by query parameter backend", id, strings.Join(owners, ", "))
+	}
+	for _, be := range backends {
+		if be.Name == owners[0] {
+			qr := be.Query(req, w, false)
+			return qr.Body, qr.Err
+		}
+	}
+	return nil, ErrGetBackends
+}
+
+// FindShardOwners returns the names of backends whose show shards results contain the shard id
+func FindShardOwners(names []string, bodies [][]byte, id int64) (owners []string, err error) {
+	for i, b := range bodies {
+		series, err := SeriesFromResponseBytes(b)
+		if err != nil {
+			return nil, err
+		}
+	search:
+		for _, serie := range series {
+			col := -1
+			for j, column := range serie.Columns {
+				if column == "id" {
+					col = j
+				}
+			}
+			if col < 0 {
+				continue
+			}
+			for _, value := range serie.Values {
+				if n, ok := toInt(value[col]); ok && n == id {
+					owners = append(owners, names[i])
+					break search
+				}
+			}
+		}
+	}
+	return
+}
+
+// tagByBackends merges the series of backends into one result with the backend tag of their names
+func tagByBackends(names []string, bodies [][]byte) (rsp *Response, err error) {
+	var series models.Rows
+	for i, b := range bodies {
+		_series, err := SeriesFromResponseBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		for _, serie := range _series {
+			tags := make(map[string]string, len(serie.Tags)+1)
+			for k, v := range serie.Tags {
+				tags[k] = v
+			}
+			tags["backend"] = names[i]
+			serie.Tags = tags
+			series = append(series, serie)
+		}
+	}
+	return ResponseFromSeries(series), nil
+}
+
+func QueryDeleteOrDropQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string, db string) (body []byte, err error) {
+	// all circles and their cold tiers -> backends by key(db,meas) of all measurements, or all backends without from -> delete or drop measurement/series
+	var backends []*Backend
+	var mms []string
+	if GetHeadStmtFromTokens(tokens, 2) == "drop measurement" {
+		meas, err := GetMeasurementFromTokens(tokens)
+		if err != nil {
+			return nil, err
+		}
+		mms = []string{meas}
+	} else if CheckFromTokens(tokens) {
+		mms, err = GetMeasurementsFromTokens(tokens)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, circle := range ip.allTiers(db) {
+		if mms == nil {
+			backends = append(backends, circle.Backends...)
+		} else {
+			backends = append(backends, circle.GetReplicasByMeasurements(db, mms)...)
+		}
+	}
+	if len(backends) == 0 {
+		return nil, ErrGetBackends
+	}
+	// refuse the statement if any replica is unavailable, rather than leaving the replicas inconsistent
+	for _, be := range backends {
+		if !be.IsActive() {
+			return nil, fmt.Errorf("backend %s(%s) unavailable", be.Name, be.Url)
+		}
+	}
+	req.Form.Del("chunked")
+	qrs := make([]*QueryResult, len(backends))
+	var wg sync.WaitGroup
+	for i, be := range backends {
+		wg.Add(1)
+		go func(i int, be *Backend) {
+			defer wg.Done()
+			qrs[i] = be.Query(CloneQueryRequest(req), nil, true)
+		}(i, be)
+	}
+	wg.Wait()
+	rsp := CombineDeleteStatus(backends, qrs)
+	if rsp.Results[0].Err != "" {
+		log.Printf("partial delete: %s, query: %s, db: %s", rsp.Results[0].Err, req.FormValue("q"), db)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Encoding")
+	return marshalResponse(w, req, rsp)
+}
+
+// CombineDeleteStatus returns the result reporting the backends on which the statement succeeded or failed
+func CombineDeleteStatus(backends []*Backend, qrs []*QueryResult) *Response {
+	var succeeded, failed []string
+	for i, qr := range qrs {
+		err := qr.Err
+		if err == nil {
+			if results, e := ResultsFromResponseBytes(qr.Body); e != nil {
+				err = e
+			} else if len(results) > 0 && results[0].Err != "" {
+				err = errors.New(results[0].Err)
+			}
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%s)", backends[i].Name, err))
+		} else {
+			succeeded = append(succeeded, backends[i].Name)
+		}
+	}
+	r := &Result{}
+	if len(succeeded) > 0 {
+		r.Messages = append(r.Messages, &Message{Level: "info", Text: "succeeded on backends: " + strings.Join(succeeded, ", ")})
+	}
+	if len(failed) > 0 {
+		r.Err = "failed on backends: " + strings.Join(failed, ", ")
+	}
+	return ResponseFromResults([]*Result{r})
 }
 
 func QueryAlterQL(w http.ResponseWriter, req *http.Request, ip *Proxy) (body []byte, err error) {
@@ -287,17 +808,3 @@ func attachByValues(bodies [][]byte) (rsp *Response, err error) {
 	}
 	return ResponseFromSeries(series), nil
 }
-
-func concatByResults(bodies [][]byte) (rsp *Response, err error) {
-	var results []*Result
-	for _, b := range bodies {
-		_results, err := ResultsFromResponseBytes(b)
-		if err != nil {
-			return nil, err
-		}
-		if len(_results) == 1 {
-			results = append(results, _results[0])
-		}
-	}
-	return ResponseFromResults(results), nil
-}
@@ -0,0 +1,122 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+func TestTagByBackends(t *testing.T) {
+	bodies := [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"runtime","columns":["NumGoroutine"],"values":[[10]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"shard","tags":{"id":"1"},"columns":["writePointsOk"],"values":[[5]]}]}]}`),
+	}
+	rsp, err := tagByBackends([]string{"influxdb-1", "influxdb-2"}, bodies)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	want := `{"results":[{"statement_id":0,"series":[{"name":"runtime","tags":{"backend":"influxdb-1"},"columns":["NumGoroutine"],"values":[[10]]},{"name":"shard","tags":{"backend":"influxdb-2","id":"1"},"columns":["writePointsOk"],"values":[[5]]}]}]}` + "\n"
+	if got := string(util.MarshalJSON(rsp, false)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestTryQuery(t *testing.T) {
+	ip := &Proxy{queryTimeout: 10 * time.Millisecond}
+	slow := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+	fail := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
+		return nil, errors.New("internal error")
+	}
+	ok := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
+		return []byte("ok"), nil
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/query", nil)
+	var failed []string
+	if _, err := tryQuery(w, req, ip, &Backend{HttpBackend: &HttpBackend{Name: "influxdb-1"}}, slow, &failed); err == nil {
+		t.Fatalf("error expected on timeout")
+	}
+	if _, err := tryQuery(w, req, ip, &Backend{HttpBackend: &HttpBackend{Name: "influxdb-2"}}, fail, &failed); err == nil {
+		t.Fatalf("error expected")
+	}
+	body, err := tryQuery(w, req, ip, &Backend{HttpBackend: &HttpBackend{Name: "influxdb-3"}}, ok, &failed)
+	if err != nil || string(body) != "ok" {
+		t.Fatalf("got %s, %v", body, err)
+	}
+	if got := w.Header().Get(HeaderFailover); got != "influxdb-1,influxdb-2" {
+		t.Errorf("got failover header %q", got)
+	}
+}
+
+func TestCombineDeleteStatus(t *testing.T) {
+	backends := []*Backend{
+		{HttpBackend: &HttpBackend{Name: "influxdb-1"}},
+		{HttpBackend: &HttpBackend{Name: "influxdb-2"}},
+		{HttpBackend: &HttpBackend{Name: "influxdb-3"}},
+	}
+	tests := []struct {
+		name string
+		qrs  []*QueryResult
+		want string
+	}{
+		{
+			name: "succeeded",
+			qrs: []*QueryResult{
+				{Body: []byte(`{"results":[{"statement_id":0}]}`)},
+				{Body: []byte(`{"results":[{"statement_id":0}]}`)},
+				{Body: []byte(`{"results":[{"statement_id":0}]}`)},
+			},
+			want: `{"results":[{"statement_id":0,"messages":[{"level":"info","text":"succeeded on backends: influxdb-1, influxdb-2, influxdb-3"}]}]}`,
+		},
+		{
+			name: "partial",
+			qrs: []*QueryResult{
+				{Body: []byte(`{"results":[{"statement_id":0}]}`)},
+				{Err: errors.New("timeout")},
+				{Body: []byte(`{"results":[{"statement_id":0,"error":"shard is disabled"}]}`)},
+			},
+			want: `{"results":[{"statement_id":0,"messages":[{"level":"info","text":"succeeded on backends: influxdb-1"}],"error":"failed on backends: influxdb-2 (timeout), influxdb-3 (shard is disabled)"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		rsp := CombineDeleteStatus(backends, tt.qrs)
+		if got := string(util.MarshalJSON(rsp, false)); got != tt.want+"\n" {
+			t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindShardOwners(t *testing.T) {
+	names := []string{"influxdb-1", "influxdb-2"}
+	bodies := [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"_internal","columns":["id","database","retention_policy","shard_group","start_time","end_time","expiry_time","owners"],"values":[[1,"_internal","monitor",1,"2021-01-01T00:00:00Z","2021-01-02T00:00:00Z","2021-01-09T00:00:00Z",""]]},{"name":"db","columns":["id","database","retention_policy","shard_group","start_time","end_time","expiry_time","owners"],"values":[[2,"db","autogen",2,"2021-01-01T00:00:00Z","2021-01-08T00:00:00Z","2021-01-08T00:00:00Z",""]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"db","columns":["id","database","retention_policy","shard_group","start_time","end_time","expiry_time","owners"],"values":[[1,"db","autogen",1,"2021-01-01T00:00:00Z","2021-01-08T00:00:00Z","2021-01-08T00:00:00Z",""],[3,"db","autogen",3,"2021-01-08T00:00:00Z","2021-01-15T00:00:00Z","2021-01-15T00:00:00Z",""]]}]}]}`),
+	}
+	tests := []struct {
+		id   int64
+		want []string
+	}{
+		{id: 1, want: []string{"influxdb-1", "influxdb-2"}},
+		{id: 2, want: []string{"influxdb-1"}},
+		{id: 3, want: []string{"influxdb-2"}},
+		{id: 4, want: nil},
+	}
+	for _, tt := range tests {
+		got, err := FindShardOwners(names, bodies, tt.id)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, %v, want %v", tt.id, got, err, tt.want)
+		}
+	}
+}
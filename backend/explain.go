@@ -0,0 +1,114 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+var explainRegexp = regexp.MustCompile(`(?i)^explain\s+((?:analyze|route)\s+)?`)
+
+// ParseExplainQuery returns the mode of explain, which is empty, analyze or route, and the explained query
+func ParseExplainQuery(q string) (mode string, stmt string, err error) {
+	match := explainRegexp.FindStringSubmatchIndex(q)
+	if match == nil {
+		return "", "", ErrIllegalQL
+	}
+	if match[2] >= 0 {
+		mode = strings.ToLower(strings.TrimSpace(q[match[2]:match[3]]))
+	}
+	stmt = strings.TrimSpace(q[match[1]:])
+	if stmt == "" {
+		return "", "", ErrIllegalQL
+	}
+	return
+}
+
+func (ip *Proxy) explainQuery(w http.ResponseWriter, req *http.Request, q string) (body []byte, err error) {
+	mode, stmt, err := ParseExplainQuery(q)
+	if err != nil {
+		return
+	}
+	tokens, check, from := CheckQuery(stmt)
+	if !check {
+		return nil, ErrIllegalQL
+	}
+	db, _, err := ip.queryDatabase(req, tokens)
+	if err != nil {
+		return
+	}
+	if mode == "route" {
+		return marshalResponse(w, req, ip.ExplainRoute(tokens, db, from))
+	}
+	if strings.ToLower(tokens[0]) != "select" || !from || CheckIntoFromTokens(tokens) {
+		return nil, ErrIllegalQL
+	}
+	return QueryExplainQL(w, req, ip, tokens, db)
+}
+
+// ExplainRoute returns the backends of each circle the query would hit and their measurements, without executing it
+func (ip *Proxy) ExplainRoute(tokens []string, db string, from bool) *Response {
+	var mms []string
+	if from {
+		mms, _ = GetMeasurementsFromTokens(tokens)
+	}
+	row := &models.Row{Name: "route", Columns: []string{"circle", "backend", "url", "active", "measurements"}, Values: [][]interface{}{}}
+	for _, circle := range ip.GetCircles(db) {
+		backends := circle.GetBackendsByMeasurements(db, mms)
+		if len(mms) == 0 {
+			backends = circle.Backends
+		}
+		for _, be := range backends {
+			var owned []string
+			for _, mm := range mms {
+				if IsRegexMeasurement(mm) || circle.IsReplica(be.Url, db, mm) {
+					owned = append(owned, mm)
+				}
+			}
+			if len(owned) == 0 {
+				owned = []string{"*"}
+			}
+			row.Values = append(row.Values, []interface{}{circle.Name, be.Name, be.Url, be.IsActive(), strings.Join(owned, ",")})
+		}
+	}
+	return ResponseFromSeries(models.Rows{row})
+}
+
+func QueryExplainQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string, db string) (body []byte, err error) {
+	// one circle -> backends by key(db,meas) of all measurements -> explain, tagged by backend name
+	req.Form.Del("chunked")
+	mms, err := GetMeasurementsFromTokens(tokens)
+	if err != nil {
+		return nil, ErrGetMeasurement
+	}
+	circles := ip.GetCircles(db)
+	perms := ip.readRouter.Order(circles, db, func(circle *Circle) []*Backend {
+		return circle.GetBackendsByMeasurements(db, mms)
+	})
+	for _, p := range perms {
+		backends := circles[p].GetBackendsByMeasurements(db, mms)
+		if !queryable(backends) {
+			continue
+		}
+		names, bodies := queryBackendsNamed(w, req, backends)
+		if len(bodies) < len(backends) {
+			continue
+		}
+		merged := time.Now()
+		var rsp *Response
+		rsp, err = tagByBackends(names, bodies)
+		traceMerge(req, merged)
+		if err != nil {
+			return
+		}
+		return marshalResponse(w, req, rsp)
+	}
+	return nil, ErrBackendsUnavailable
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import "testing"
+
+func TestParseExplainQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		have string
+		mode string
+		stmt string
+		werr error
+	}{
+		{
+			name: "explain",
+			have: "EXPLAIN SELECT mean(value) FROM cpu",
+			stmt: "SELECT mean(value) FROM cpu",
+		},
+		{
+			name: "analyze",
+			have: "explain  Analyze select * from cpu where time > now() - 1h",
+			mode: "analyze",
+			stmt: "select * from cpu where time > now() - 1h",
+		},
+		{
+			name: "route",
+			have: "explain route select * from cpu, mem",
+			mode: "route",
+			stmt: "select * from cpu, mem",
+		},
+		{
+			name: "analyzed measurement",
+			have: "explain select * from analyzed",
+			stmt: "select * from analyzed",
+		},
+		{
+			name: "empty",
+			have: "explain analyze ",
+			werr: ErrIllegalQL,
+		},
+		{
+			name: "not explain",
+			have: "select * from cpu",
+			werr: ErrIllegalQL,
+		},
+	}
+	for _, tt := range tests {
+		mode, stmt, err := ParseExplainQuery(tt.have)
+		if err != tt.werr || mode != tt.mode || stmt != tt.stmt {
+			t.Errorf("%v: got %q, %q, %v, want %q, %q, %v", tt.name, mode, stmt, err, tt.mode, tt.stmt, tt.werr)
+		}
+	}
+}
@@ -6,13 +6,49 @@ package backend
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"time"
 )
 
+var ErrInvalidWriteSync = errors.New("invalid write_sync, require always, never, number of batches or duration like 100ms")
+
+// timeFlag marks a record whose length is followed by an 8-byte unix nano timestamp,
+// records written by older versions have no timestamp and never expire
+const timeFlag uint32 = 1 << 31
+
+// SyncPolicy controls when written data is fsynced to disk
+type SyncPolicy struct {
+	Batches  int           // fsync every n batches, 0 means not by batches
+	Interval time.Duration // fsync every interval if there are unsynced batches, 0 means not by interval
+}
+
+// ParseSyncPolicy parses write_sync: always, never, number of batches or duration
+func ParseSyncPolicy(s string) (*SyncPolicy, error) {
+	switch s {
+	case "", "always":
+		return &SyncPolicy{Batches: 1}, nil
+	case "never":
+		return &SyncPolicy{}, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 {
+			return nil, ErrInvalidWriteSync
+		}
+		return &SyncPolicy{Batches: n}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return nil, ErrInvalidWriteSync
+	}
+	return &SyncPolicy{Interval: d}, nil
+}
+
 type FileBackend struct {
 	lock     sync.Mutex
 	filename string
@@ -21,12 +57,20 @@ type FileBackend struct {
 	producer *os.File
 	consumer *os.File
 	meta     *os.File
+	policy   *SyncPolicy
+	unsynced int
+	closing  chan struct{}
 }
 
-func NewFileBackend(filename string, datadir string) (fb *FileBackend, err error) {
+func NewFileBackend(filename string, datadir string, policy *SyncPolicy) (fb *FileBackend, err error) {
+	if policy == nil {
+		policy = &SyncPolicy{Batches: 1}
+	}
 	fb = &FileBackend{
 		filename: filename,
 		datadir:  datadir,
+		policy:   policy,
+		closing:  make(chan struct{}),
 	}
 
 	pathname := filepath.Join(datadir, filename)
@@ -52,6 +96,38 @@ func NewFileBackend(filename string, datadir string) (fb *FileBackend, err error
 	producerOffset, _ := fb.producer.Seek(0, io.SeekEnd)
 	offset, _ := fb.consumer.Seek(0, io.SeekCurrent)
 	fb.dataflag = producerOffset > offset
+	if policy.Interval > 0 {
+		go fb.syncLoop()
+	}
+	return
+}
+
+func (fb *FileBackend) syncLoop() {
+	ticker := time.NewTicker(fb.policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fb.lock.Lock()
+			fb.sync()
+			fb.lock.Unlock()
+		case <-fb.closing:
+			return
+		}
+	}
+}
+
+// sync must be called with lock held
+func (fb *FileBackend) sync() (err error) {
+	if fb.unsynced == 0 {
+		return
+	}
+	err = fb.producer.Sync()
+	if err != nil {
+		log.Print("sync producer error: ", err)
+		return
+	}
+	fb.unsynced = 0
 	return
 }
 
@@ -59,12 +135,17 @@ func (fb *FileBackend) Write(p []byte) (err error) {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
 
-	var length = uint32(len(p))
+	var length = uint32(len(p)) | timeFlag
 	err = binary.Write(fb.producer, binary.BigEndian, length)
 	if err != nil {
 		log.Print("write length error: ", err)
 		return
 	}
+	err = binary.Write(fb.producer, binary.BigEndian, time.Now().UnixNano())
+	if err != nil {
+		log.Print("write time error: ", err)
+		return
+	}
 
 	n, err := fb.producer.Write(p)
 	if err != nil {
@@ -75,25 +156,47 @@ func (fb *FileBackend) Write(p []byte) (err error) {
 		return io.ErrShortWrite
 	}
 
-	err = fb.producer.Sync()
-	if err != nil {
-		log.Print("sync meta error: ", err)
-		return
+	fb.unsynced++
+	if fb.policy.Batches > 0 && fb.unsynced >= fb.policy.Batches {
+		err = fb.sync()
+		if err != nil {
+			return
+		}
 	}
 
 	fb.dataflag = true
 	return
 }
 
+// Backlog returns the bytes of file since the offset of meta, which are not rewritten yet
+func (fb *FileBackend) Backlog() int64 {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if !fb.dataflag {
+		return 0
+	}
+	info, err := fb.producer.Stat()
+	if err != nil {
+		return 0
+	}
+	var offset int64
+	b := make([]byte, 8)
+	if _, err = fb.meta.ReadAt(b, 0); err == nil {
+		offset = int64(binary.BigEndian.Uint64(b))
+	}
+	return info.Size() - offset
+}
+
 func (fb *FileBackend) IsData() bool {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
 	return fb.dataflag
 }
 
-func (fb *FileBackend) Read() (p []byte, err error) {
+// Read returns the next record and the unix nano time it was written, ts is 0 if unknown
+func (fb *FileBackend) Read() (p []byte, ts int64, err error) {
 	if !fb.IsData() {
-		return nil, nil
+		return nil, 0, nil
 	}
 	var length uint32
 
@@ -102,6 +205,14 @@ func (fb *FileBackend) Read() (p []byte, err error) {
 		log.Print("read length error: ", err)
 		return
 	}
+	if length&timeFlag != 0 {
+		length &^= timeFlag
+		err = binary.Read(fb.consumer, binary.BigEndian, &ts)
+		if err != nil {
+			log.Print("read time error: ", err)
+			return
+		}
+	}
 	p = make([]byte, length)
 
 	_, err = io.ReadFull(fb.consumer, p)
@@ -203,6 +314,7 @@ func (fb *FileBackend) CleanUp() (err error) {
 		log.Print("close producer error: ", err)
 		return
 	}
+	fb.unsynced = 0
 	fb.producer, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		log.Print("open producer error: ", err)
@@ -213,6 +325,10 @@ func (fb *FileBackend) CleanUp() (err error) {
 }
 
 func (fb *FileBackend) Close() {
+	close(fb.closing)
+	fb.lock.Lock()
+	fb.sync()
+	fb.lock.Unlock()
 	fb.producer.Close()
 	fb.consumer.Close()
 	fb.meta.Close()
@@ -0,0 +1,148 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseSyncPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		sync string
+		want *SyncPolicy
+		err  error
+	}{
+		{name: "empty", sync: "", want: &SyncPolicy{Batches: 1}},
+		{name: "always", sync: "always", want: &SyncPolicy{Batches: 1}},
+		{name: "never", sync: "never", want: &SyncPolicy{}},
+		{name: "batches", sync: "100", want: &SyncPolicy{Batches: 100}},
+		{name: "interval", sync: "500ms", want: &SyncPolicy{Interval: 500 * time.Millisecond}},
+		{name: "zero", sync: "0", err: ErrInvalidWriteSync},
+		{name: "negative", sync: "-1s", err: ErrInvalidWriteSync},
+		{name: "invalid", sync: "sometimes", err: ErrInvalidWriteSync},
+	}
+	for _, tt := range tests {
+		got, err := ParseSyncPolicy(tt.sync)
+		if err != tt.err {
+			t.Errorf("%v: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && *got != *tt.want {
+			t.Errorf("%v: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// fileRecord returns the record of file, with the write time if ts isn't 0 or the legacy one without it
+func fileRecord(t *testing.T, ts int64, fields ...string) []byte {
+	lines, err := Encode("gzip", []byte(fields[len(fields)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([][]byte, 0, len(fields))
+	for _, field := range fields[:len(fields)-1] {
+		data = append(data, []byte(field))
+	}
+	data = append(data, lines)
+	p := bytes.Join(data, []byte{' '})
+	var buf bytes.Buffer
+	if ts == 0 {
+		binary.Write(&buf, binary.BigEndian, uint32(len(p)))
+	} else {
+		binary.Write(&buf, binary.BigEndian, uint32(len(p))|timeFlag)
+		binary.Write(&buf, binary.BigEndian, ts)
+	}
+	buf.Write(p)
+	return buf.Bytes()
+}
+
+func TestRewriteExpired(t *testing.T) {
+	var lock sync.Mutex
+	var written []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/write" {
+			return
+		}
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b, _ := ioutil.ReadAll(zr)
+		// the points in nanoseconds are written without precision
+		precision := req.URL.Query().Get("precision")
+		if precision == "" {
+			precision = "ns"
+		}
+		lock.Lock()
+		written = append(written, req.URL.Query().Get("db")+" "+precision+" "+string(b))
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	tests := []struct {
+		name    string
+		record  []byte
+		written string
+		expired int64
+		dropped int64
+	}{
+		{name: "legacy record without time", record: fileRecord(t, 0, "db1", "autogen", "cpu value=1 1\n"), written: "db1 ns cpu value=1 1\n"},
+		{name: "record expired", record: fileRecord(t, now.Add(-2*time.Hour).UnixNano(), "db1", "autogen", "s", "cpu value=2 2\ncpu value=3 3\n"), expired: 1, dropped: 2},
+		{name: "record within ttl", record: fileRecord(t, now.UnixNano(), "db2", "autogen", "s", "mem value=4 4\n"), written: "db2 s mem value=4 4\n", expired: 1, dropped: 2},
+	}
+	var data []byte
+	for _, tt := range tests {
+		data = append(data, tt.record...)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "b1.dat"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ProxyConfig{DataDir: dir, DataMaxAge: 3600, RewriteInterval: 3600}
+	cfg.setDefault()
+	ib := NewBackend(&BackendConfig{Name: "b1", Url: ts.URL}, cfg)
+	defer ib.Close()
+
+	for _, tt := range tests {
+		lock.Lock()
+		written = nil
+		lock.Unlock()
+		if err = ib.Rewrite(); err != nil {
+			t.Fatalf("%v: rewrite error: %s", tt.name, err)
+		}
+		lock.Lock()
+		if got := strings.Join(written, ""); got != tt.written {
+			t.Errorf("%v: got written %q, want %q", tt.name, got, tt.written)
+		}
+		lock.Unlock()
+		_, dropped := ib.dropped.Values()
+		if expired := atomic.LoadInt64(&ib.expiredCount); expired != tt.expired || dropped[ReasonExpired] != tt.dropped {
+			t.Errorf("%v: got expired %d dropped %d, want %d %d", tt.name, expired, dropped[ReasonExpired], tt.expired, tt.dropped)
+		}
+	}
+	if ib.fb.IsData() {
+		t.Error("records left after rewrite")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"regexp"
 	"strings"
 
 	"github.com/chengshiwen/influx-proxy/util"
@@ -20,6 +21,8 @@ var (
 	ErrIllegalFluxQuery  = errors.New("illegal flux query")
 )
 
+var fluxMeasurementRegexp = regexp.MustCompile(`(?:\._measurement|\[\s*"_measurement"\s*\])\s*(==|!=|=~|!~)?\s*("(?:[^"\\]|\\.)*")?`)
+
 type QueryRequest struct {
 	Spec  *Spec  `json:"spec,omitempty"`
 	Query string `json:"query"`
@@ -114,6 +117,46 @@ func ParseQueryMeasurement(query string) (measurement string, err error) {
 	return "", ErrGetMeasurement
 }
 
+// ParseQueryMeasurements returns the measurements of all `_measurement == "..."` filters, the query
+// can't be routed by measurements if there is any other comparison of _measurement
+func ParseQueryMeasurements(query string) (mms []string, err error) {
+	matches := fluxMeasurementRegexp.FindAllStringSubmatch(query, -1)
+	if len(matches) == 0 {
+		return nil, ErrGetMeasurement
+	}
+	set := util.NewSet()
+	for _, match := range matches {
+		if match[1] != "==" || match[2] == "" {
+			return nil, ErrEqualMeasurement
+		}
+		mm := util.UnescapeIdentifier(match[2][1 : len(match[2])-1])
+		if !set[mm] {
+			set.Add(mm)
+			mms = append(mms, mm)
+		}
+	}
+	return
+}
+
+// GetDatabaseFromBucket returns the database of bucket in the form of database/retention-policy
+func GetDatabaseFromBucket(bucket string) string {
+	return strings.SplitN(bucket, "/", 2)[0]
+}
+
+// ConcatFluxResponses joins the annotated csv responses of backends, the tables are separated by empty lines
+func ConcatFluxResponses(bodies [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, b := range bodies {
+		b = bytes.TrimRight(b, "\r\n")
+		if len(b) == 0 {
+			continue
+		}
+		buf.Write(b)
+		buf.WriteString("\r\n\r\n")
+	}
+	return buf.Bytes()
+}
+
 func ScanSpec(spec *Spec) (bucket string, measurement string, err error) {
 	for _, op := range spec.Operations {
 		switch op.Kind {
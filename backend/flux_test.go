@@ -4,7 +4,10 @@
 
 package backend
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestParseQueryBucket(t *testing.T) {
 	tests := []struct {
@@ -151,6 +154,60 @@ data() |> filter(fn: (r) => r._measurement == "m1")`,
 	}
 }
 
+func TestParseQueryMeasurements(t *testing.T) {
+	tests := []struct {
+		name string
+		have string
+		want []string
+		werr error
+	}{
+		{
+			name: "single",
+			have: `from(bucket: "db/autogen") |> range(start: -1h) |> filter(fn: (r) => r._measurement == "cpu" and r._field == "idle")`,
+			want: []string{"cpu"},
+		},
+		{
+			name: "or",
+			have: `from(bucket: "db") |> range(start: -1h) |> filter(fn: (r) => r._measurement == "cpu" or r["_measurement"] == "mem")`,
+			want: []string{"cpu", "mem"},
+		},
+		{
+			name: "union",
+			have: `data = () => from(bucket: "db") |> range(start: -1h)
+data() |> filter(fn: (r) => r._measurement == "cpu")
+data() |> filter(fn: (r) => r._measurement == "mem")
+data() |> filter(fn: (r) => r._measurement == "cpu")`,
+			want: []string{"cpu", "mem"},
+		},
+		{
+			name: "escaped",
+			have: `from(bucket: "db") |> range(start: -1h) |> filter(fn: (r) => r._measurement == "\"quoted\" cpu")`,
+			want: []string{`"quoted" cpu`},
+		},
+		{
+			name: "regex",
+			have: `from(bucket: "db") |> range(start: -1h) |> filter(fn: (r) => r._measurement =~ /cpu.*/)`,
+			werr: ErrEqualMeasurement,
+		},
+		{
+			name: "not equal",
+			have: `from(bucket: "db") |> range(start: -1h) |> filter(fn: (r) => r._measurement == "cpu" or r._measurement != "mem")`,
+			werr: ErrEqualMeasurement,
+		},
+		{
+			name: "none",
+			have: `from(bucket: "db") |> range(start: -1h)`,
+			werr: ErrGetMeasurement,
+		},
+	}
+	for _, tt := range tests {
+		got, err := ParseQueryMeasurements(tt.have)
+		if err != tt.werr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, %v, want %v, %v", tt.name, got, err, tt.want, tt.werr)
+		}
+	}
+}
+
 func TestParseSpecBucket(t *testing.T) {
 	tests := []struct {
 		name string
@@ -255,3 +312,24 @@ func TestParseSpecMeasurement(t *testing.T) {
 		}
 	}
 }
+
+func TestConcatFluxResponses(t *testing.T) {
+	bodies := [][]byte{
+		[]byte("#datatype,string,long,double\r\n#group,false,false,false\r\n#default,_result,,\r\n,result,table,_value\r\n,,0,1\r\n\r\n"),
+		[]byte("\r\n"),
+		[]byte("#datatype,string,long,double\r\n#group,false,false,false\r\n#default,_result,,\r\n,result,table,_value\r\n,,0,2\r\n"),
+	}
+	want := "#datatype,string,long,double\r\n#group,false,false,false\r\n#default,_result,,\r\n,result,table,_value\r\n,,0,1\r\n\r\n" +
+		"#datatype,string,long,double\r\n#group,false,false,false\r\n#default,_result,,\r\n,result,table,_value\r\n,,0,2\r\n\r\n"
+	if got := string(ConcatFluxResponses(bodies)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGetDatabaseFromBucket(t *testing.T) {
+	for have, want := range map[string]string{"db": "db", "db/autogen": "db", "db/": "db"} {
+		if got := GetDatabaseFromBucket(have); got != want {
+			t.Errorf("%v: got %v, want %v", have, got, want)
+		}
+	}
+}
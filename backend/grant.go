@@ -0,0 +1,154 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	PrivilegeRead  = "read"
+	PrivilegeWrite = "write"
+	PrivilegeAll   = "all"
+)
+
+// HeaderConfirm confirms the destructive statement by the database dropped or deleted from
+const HeaderConfirm = "X-Influxdb-Proxy-Confirm"
+
+var ErrInvalidPrivilege = errors.New("invalid privilege, require read, write or all")
+
+// Grants are the privileges of a user by database as influxdb 1.x, a non-admin user without grants is denied on all databases
+type Grants map[string]string
+
+// CheckPrivilege checks the privilege is read, write or all
+func CheckPrivilege(privilege string) error {
+	if privilege != PrivilegeRead && privilege != PrivilegeWrite && privilege != PrivilegeAll {
+		return ErrInvalidPrivilege
+	}
+	return nil
+}
+
+// Allows returns whether the privilege on db is granted, the nil grants are the same as the empty ones
+func (g Grants) Allows(db, privilege string) bool {
+	granted := g[db]
+	return granted == PrivilegeAll || granted == privilege
+}
+
+func (g Grants) copy() Grants {
+	if g == nil {
+		return nil
+	}
+	c := make(Grants, len(g))
+	for db, privilege := range g {
+		c[db] = privilege
+	}
+	return c
+}
+
+// newGroupUser returns the user of external identity, who is admin if in any admin group, and granted the
+// privileges of groups, the privileges on a database of multiple groups are merged
+func newGroupUser(username string, groups []string, adminGroups map[string]bool, groupGrants map[string]Grants) *UserConfig {
+	user := &UserConfig{Username: username, Grants: make(Grants)}
+	for _, group := range groups {
+		if adminGroups[group] {
+			user.Admin = true
+		}
+		for db, privilege := range groupGrants[group] {
+			if granted := user.Grants[db]; granted != "" && granted != privilege {
+				privilege = PrivilegeAll
+			}
+			user.Grants[db] = privilege
+		}
+	}
+	return user
+}
+
+// AuthorizationError is returned if the user isn't granted the privilege on the database
+type AuthorizationError struct {
+	User      string
+	Db        string
+	Privilege string
+}
+
+func (e *AuthorizationError) Error() string {
+	return fmt.Sprintf("user %s not authorized, requires %s privilege on database %s", e.User, e.Privilege, e.Db)
+}
+
+// DestructiveError is returned if the destructive statement on the database isn't run by an elevated user nor confirmed
+type DestructiveError struct {
+	User string
+	Db   string
+}
+
+func (e *DestructiveError) Error() string {
+	if e.Db == "" {
+		return fmt.Sprintf("user %s not authorized, requires admin to run destructive statement", e.User)
+	}
+	return fmt.Sprintf("user %s not authorized, requires admin or all privilege on database %s to run destructive statement, or header %s: %s if allowed", e.User, e.Db, HeaderConfirm, e.Db)
+}
+
+type userKey struct{}
+
+// WithUser returns the request carrying the username authenticated, rather than the one passed by the client
+func WithUser(req *http.Request, user string) *http.Request {
+	if user == "" {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), userKey{}, user))
+}
+
+// GetUser returns the username authenticated of request, or empty without auth
+func GetUser(req *http.Request) string {
+	user, _ := req.Context().Value(userKey{}).(string)
+	return user
+}
+
+type grantKey struct{}
+
+type grantee struct {
+	user   string
+	grants Grants
+}
+
+// WithGrants returns the request carrying the grants of the non-admin user authenticated, the nil grants deny all databases
+func WithGrants(req *http.Request, user string, grants Grants) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), grantKey{}, &grantee{user: user, grants: grants}))
+}
+
+// Authorize checks the privilege on db is granted to the user of request, the request without grants is admin or without auth
+func Authorize(req *http.Request, db, privilege string) error {
+	ge, _ := req.Context().Value(grantKey{}).(*grantee)
+	if ge == nil || ge.grants.Allows(db, privilege) {
+		return nil
+	}
+	return &AuthorizationError{User: ge.user, Db: db, Privilege: privilege}
+}
+
+// queryOwner returns the user whose queries are listed and killed by the request, which is empty for the request
+// without grants of admin or without auth, so that a non-admin user only sees and kills its own queries
+func queryOwner(req *http.Request) string {
+	if ge, _ := req.Context().Value(grantKey{}).(*grantee); ge != nil {
+		return ge.user
+	}
+	return ""
+}
+
+// AuthorizeDestructive checks the destructive statement on db is run by an elevated user, who is admin or granted
+// all privilege on db explicitly, otherwise it must be allowed and confirmed by the header of db. The request without
+// grants is admin or without auth, the statements without db like drop shard require admin
+func AuthorizeDestructive(req *http.Request, db string, allowed bool) error {
+	ge, _ := req.Context().Value(grantKey{}).(*grantee)
+	if ge == nil || (db != "" && ge.grants[db] == PrivilegeAll) {
+		return nil
+	}
+	// the tenant users confirm the database without the prefix
+	if allowed && db != "" && GetTenant(req).DB(req.Header.Get(HeaderConfirm)) == db {
+		return nil
+	}
+	return &DestructiveError{User: ge.user, Db: db}
+}
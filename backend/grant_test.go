@@ -0,0 +1,131 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	grants := Grants{"db1": PrivilegeRead, "db2": PrivilegeWrite, "db3": PrivilegeAll}
+	tests := []struct {
+		name      string
+		grants    Grants
+		db        string
+		privilege string
+		want      bool
+	}{
+		{name: "read", grants: grants, db: "db1", privilege: PrivilegeRead, want: true},
+		{name: "read only", grants: grants, db: "db1", privilege: PrivilegeWrite},
+		{name: "write", grants: grants, db: "db2", privilege: PrivilegeWrite, want: true},
+		{name: "write only", grants: grants, db: "db2", privilege: PrivilegeRead},
+		{name: "all read", grants: grants, db: "db3", privilege: PrivilegeRead, want: true},
+		{name: "all write", grants: grants, db: "db3", privilege: PrivilegeWrite, want: true},
+		{name: "not granted", grants: grants, db: "db4", privilege: PrivilegeRead},
+		{name: "no grants", db: "db4", privilege: PrivilegeWrite},
+		{name: "empty grants", grants: Grants{}, db: "db1", privilege: PrivilegeRead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := WithGrants(&http.Request{}, "user", tt.grants)
+			err := Authorize(req, tt.db, tt.privilege)
+			if got := err == nil; got != tt.want {
+				t.Errorf("got %v, want %t", err, tt.want)
+			}
+			if _, ok := err.(*AuthorizationError); err != nil && !ok {
+				t.Errorf("got error type %T", err)
+			}
+		})
+	}
+}
+
+func TestWithUser(t *testing.T) {
+	req := &http.Request{URL: &url.URL{RawQuery: "u=admin"}}
+	if user := GetUser(req); user != "" {
+		t.Errorf("without user: got %s", user)
+	}
+	if user := GetUser(WithUser(req, "alice")); user != "alice" {
+		t.Errorf("with user: got %s, want alice", user)
+	}
+}
+
+func TestQueryDatabaseGrants(t *testing.T) {
+	ip := &Proxy{}
+	grants := Grants{"db1": PrivilegeRead, "db2": PrivilegeAll}
+	tests := []struct {
+		name string
+		q    string
+		want bool
+	}{
+		{name: "select", q: "select * from cpu", want: true},
+		{name: "show", q: "show measurements", want: true},
+		{name: "delete", q: "delete from cpu"},
+		{name: "drop", q: "drop measurement cpu"},
+		{name: "select into", q: "select * into cpu2 from cpu"},
+		{name: "cross database", q: "select * from db2.autogen.cpu", want: true},
+		{name: "cross database not granted", q: "select * from db3.autogen.cpu"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := WithGrants(&http.Request{Form: url.Values{"db": []string{"db1"}}}, "user", grants)
+			tokens, _, _ := CheckQuery(tt.q)
+			_, _, err := ip.queryDatabase(req, tokens)
+			if got := err == nil; got != tt.want {
+				t.Errorf("got %v, want %t", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryDatabaseDestructive(t *testing.T) {
+	grants := Grants{"db1": PrivilegeWrite, "db2": PrivilegeAll}
+	tests := []struct {
+		name    string
+		q       string
+		grants  Grants
+		admin   bool
+		allowed bool
+		confirm string
+		want    bool
+	}{
+		{name: "select into", q: "select * into cpu2 from cpu", grants: grants, want: true},
+		{name: "delete", q: "delete from cpu", grants: grants},
+		{name: "delete where", q: "delete where time < 0", grants: grants},
+		{name: "drop measurement", q: "drop measurement cpu", grants: grants},
+		{name: "drop series", q: "drop series from cpu", grants: grants},
+		{name: "drop database", q: "drop database db1", grants: grants},
+		{name: "drop retention policy", q: "drop retention policy rp1 on db1", grants: grants},
+		{name: "drop shard", q: "drop shard 1", grants: grants},
+		{name: "no grants", q: "drop measurement cpu"},
+		{name: "admin", q: "drop database db1", admin: true, want: true},
+		{name: "admin drop shard", q: "drop shard 1", admin: true, want: true},
+		{name: "all privilege", q: "drop database db2", grants: grants, want: true},
+		{name: "all privilege of another db", q: "drop retention policy rp1 on db1", grants: Grants{"db1": PrivilegeWrite, "db2": PrivilegeAll}},
+		{name: "confirmed but not allowed", q: "delete from cpu", grants: grants, confirm: "db1"},
+		{name: "allowed without confirm", q: "delete from cpu", grants: grants, allowed: true},
+		{name: "allowed and confirmed", q: "delete from cpu", grants: grants, allowed: true, confirm: "db1", want: true},
+		{name: "confirmed another db", q: "drop database db1", grants: grants, allowed: true, confirm: "db2"},
+		{name: "confirmed drop shard", q: "drop shard 1", grants: grants, allowed: true, confirm: "db1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := &Proxy{destructive: tt.allowed}
+			req := &http.Request{Form: url.Values{"db": []string{"db1"}}, Header: http.Header{}}
+			if !tt.admin {
+				req = WithGrants(req, "user", tt.grants)
+			}
+			if tt.confirm != "" {
+				req.Header.Set(HeaderConfirm, tt.confirm)
+			}
+			tokens, _, _ := CheckQuery(tt.q)
+			_, _, err := ip.queryDatabase(req, tokens)
+			if got := err == nil; got != tt.want {
+				t.Errorf("got %v, want %t", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+
+	"stathat.com/c/consistent"
+)
+
+const (
+	HashConsistent = "consistent"
+	HashJump       = "jump"
+	HashRendezvous = "rendezvous"
+)
+
+var (
+	ErrInvalidHashAlgorithm = errors.New("invalid hash_algorithm, require consistent, jump or rendezvous")
+	ErrEmptyHashRing        = errors.New("empty hash ring")
+)
+
+// HashRing maps the keys to the elements added, GetN returns n distinct elements and the first one is of Get
+type HashRing interface {
+	Add(elt string)
+	Get(key string) (string, error)
+	GetN(key string, n int) ([]string, error)
+}
+
+func CheckHashAlgorithm(algorithm string) error {
+	switch algorithm {
+	case HashConsistent, HashJump, HashRendezvous:
+		return nil
+	}
+	return ErrInvalidHashAlgorithm
+}
+
+// NewHashRing returns the hash ring of algorithm, the consistent hash ring with the virtual nodes
+// per element is returned by default
+func NewHashRing(algorithm string, virtualNodes int) HashRing {
+	switch algorithm {
+	case HashJump:
+		return &JumpHash{}
+	case HashRendezvous:
+		return &RendezvousHash{}
+	}
+	ring := consistent.New()
+	ring.NumberOfReplicas = virtualNodes
+	return ring
+}
+
+// JumpHash is the jump consistent hash of the fnv-1a 64 hash of key, the elements are numbered in the order added
+type JumpHash struct {
+	elts []string
+}
+
+func (jh *JumpHash) Add(elt string) {
+	jh.elts = append(jh.elts, elt)
+}
+
+func (jh *JumpHash) Get(key string) (string, error) {
+	if len(jh.elts) == 0 {
+		return "", ErrEmptyHashRing
+	}
+	return jh.elts[jump(fnv64a(key), len(jh.elts))], nil
+}
+
+// GetN returns the element of key and the ones following it
+func (jh *JumpHash) GetN(key string, n int) ([]string, error) {
+	if len(jh.elts) == 0 {
+		return nil, ErrEmptyHashRing
+	}
+	if n > len(jh.elts) {
+		n = len(jh.elts)
+	}
+	idx := jump(fnv64a(key), len(jh.elts))
+	elts := make([]string, n)
+	for i := range elts {
+		elts[i] = jh.elts[(idx+i)%len(jh.elts)]
+	}
+	return elts, nil
+}
+
+// jump is the jump consistent hash algorithm of Lamping and Veach
+func jump(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// RendezvousHash returns the element of the highest score, which is the murmur3 finalizer of
+// the xor of the fnv-1a 64 hashes of element and key
+type RendezvousHash struct {
+	elts []string
+}
+
+func (rh *RendezvousHash) Add(elt string) {
+	rh.elts = append(rh.elts, elt)
+}
+
+func (rh *RendezvousHash) Get(key string) (string, error) {
+	if len(rh.elts) == 0 {
+		return "", ErrEmptyHashRing
+	}
+	kh := fnv64a(key)
+	var max uint64
+	var elt string
+	for i, e := range rh.elts {
+		if score := fmix64(fnv64a(e) ^ kh); i == 0 || score > max {
+			max, elt = score, e
+		}
+	}
+	return elt, nil
+}
+
+// GetN returns the n elements of the highest scores in descending order
+func (rh *RendezvousHash) GetN(key string, n int) ([]string, error) {
+	if len(rh.elts) == 0 {
+		return nil, ErrEmptyHashRing
+	}
+	kh := fnv64a(key)
+	elts := make([]string, len(rh.elts))
+	scores := make(map[string]uint64, len(rh.elts))
+	for i, e := range rh.elts {
+		elts[i] = e
+		scores[e] = fmix64(fnv64a(e) ^ kh)
+	}
+	sort.SliceStable(elts, func(i, j int) bool { return scores[elts[i]] > scores[elts[j]] })
+	if n < len(elts) {
+		elts = elts[:n]
+	}
+	return elts, nil
+}
+
+func fnv64a(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// fmix64 is the finalizer of murmur3 to avalanche the bits
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
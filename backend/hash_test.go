@@ -0,0 +1,234 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHashRingMonotone(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+	}{
+		{name: "consistent", algorithm: HashConsistent},
+		{name: "jump", algorithm: HashJump},
+		{name: "rendezvous", algorithm: HashRendezvous},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			small, large := NewHashRing(tt.algorithm, 256), NewHashRing(tt.algorithm, 256)
+			for i := 0; i < 5; i++ {
+				small.Add(strconv.Itoa(i))
+				large.Add(strconv.Itoa(i))
+			}
+			large.Add("5")
+			counts := make(map[string]int)
+			for i := 0; i < 6000; i++ {
+				key := GetKey("db", "cpu"+strconv.Itoa(i))
+				before, err := small.Get(key)
+				if err != nil {
+					t.Fatalf("get error: %s", err)
+				}
+				after, _ := large.Get(key)
+				// the keys are only moved to the element added
+				if before != after && after != "5" {
+					t.Errorf("key %s moved from %s to %s", key, before, after)
+				}
+				counts[after]++
+			}
+			for elt, count := range counts {
+				if count < 500 || count > 1500 {
+					t.Errorf("element %s got %d keys of 6000", elt, count)
+				}
+			}
+		})
+	}
+}
+
+func TestCircleWeight(t *testing.T) {
+	for _, algorithm := range []string{HashConsistent, HashJump, HashRendezvous} {
+		circle := &Circle{router: NewHashRing(algorithm, 256), mapToBackend: make(map[string]*Backend)}
+		for i, weight := range []int{1, 3} {
+			be := &Backend{HttpBackend: &HttpBackend{Name: "influxdb-" + strconv.Itoa(i), Weight: weight}}
+			circle.Backends = append(circle.Backends, be)
+			circle.addRouter(be, i, "idx")
+		}
+		counts := make(map[*Backend]int)
+		for i := 0; i < 8000; i++ {
+			counts[circle.GetBackend(GetKey("db", "cpu"+strconv.Itoa(i)))]++
+		}
+		// the backend of weight 3 gets about 6000 keys
+		if n := counts[circle.Backends[1]]; n < 5200 || n > 6800 {
+			t.Errorf("%s: backend of weight 3 got %d keys of 8000", algorithm, n)
+		}
+	}
+}
+
+func TestHashRingVirtualNodes(t *testing.T) {
+	ring := NewHashRing(HashConsistent, 2048)
+	for i := 0; i < 3; i++ {
+		ring.Add(strconv.Itoa(i))
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		elt, _ := ring.Get(GetKey("db", "cpu"+strconv.Itoa(i)))
+		counts[elt]++
+	}
+	// each backend gets about 10000 keys
+	for elt, n := range counts {
+		if n < 9000 || n > 11000 {
+			t.Errorf("element %s got %d keys of 30000", elt, n)
+		}
+	}
+}
+
+func TestCircleReplicas(t *testing.T) {
+	for _, algorithm := range []string{HashConsistent, HashJump, HashRendezvous} {
+		circle := &Circle{router: NewHashRing(algorithm, 256), mapToBackend: make(map[string]*Backend), replicas: 3}
+		for i, weight := range []int{1, 2, 1, 3} {
+			be := &Backend{HttpBackend: &HttpBackend{Name: "influxdb-" + strconv.Itoa(i), Weight: weight}}
+			circle.Backends = append(circle.Backends, be)
+			circle.addRouter(be, i, "idx")
+		}
+		for i := 0; i < 1000; i++ {
+			key := GetKey("db", "cpu"+strconv.Itoa(i))
+			replicas := circle.GetReplicas(key)
+			if len(replicas) != 3 {
+				t.Fatalf("%s: got %d replicas, want 3", algorithm, len(replicas))
+			}
+			if replicas[0] != circle.GetBackend(key) {
+				t.Errorf("%s: first replica %s is not the backend of key %s", algorithm, replicas[0].Name, key)
+			}
+			if replicas[0] == replicas[1] || replicas[0] == replicas[2] || replicas[1] == replicas[2] {
+				t.Errorf("%s: replicas of key %s not distinct", algorithm, key)
+			}
+		}
+	}
+}
+
+func TestCircleReadOnly(t *testing.T) {
+	circle := &Circle{router: NewHashRing(HashConsistent, 256), mapToBackend: make(map[string]*Backend), replicas: 2}
+	for i := 0; i < 3; i++ {
+		be := &Backend{HttpBackend: &HttpBackend{Name: "influxdb-" + strconv.Itoa(i), Weight: 1}}
+		circle.Backends = append(circle.Backends, be)
+		circle.addRouter(be, i, "idx")
+	}
+	readOnly, peer := circle.Backends[0], circle.Backends[1]
+	circle.peers = map[*Backend]*Backend{readOnly: peer}
+	for i := 0; i < 1000; i++ {
+		key := GetKey("db", "cpu"+strconv.Itoa(i))
+		replicas := circle.GetReplicas(key)
+		writes := circle.GetWriteReplicas(key)
+		for _, be := range writes {
+			if be == readOnly {
+				t.Fatalf("read only backend written for key %s", key)
+			}
+		}
+		if replicas[0] == readOnly && writes[0] != peer {
+			t.Errorf("key %s written to %s, want peer", key, writes[0].Name)
+		}
+		if len(writes) == 0 || len(writes) > len(replicas) {
+			t.Errorf("key %s written to %d backends of %d replicas", key, len(writes), len(replicas))
+		}
+	}
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	tests := []struct {
+		name     string
+		backends []*BackendConfig
+		ok       bool
+	}{
+		{name: "no read only", backends: []*BackendConfig{{Name: "b1"}, {Name: "b2"}}, ok: true},
+		{name: "peer", backends: []*BackendConfig{{Name: "b1", ReadOnly: true, Peer: "b2"}, {Name: "b2"}}, ok: true},
+		{name: "no peer", backends: []*BackendConfig{{Name: "b1", ReadOnly: true}, {Name: "b2"}}, ok: false},
+		{name: "unknown peer", backends: []*BackendConfig{{Name: "b1", ReadOnly: true, Peer: "b3"}, {Name: "b2"}}, ok: false},
+		{name: "read only peer", backends: []*BackendConfig{{Name: "b1", ReadOnly: true, Peer: "b2"}, {Name: "b2", ReadOnly: true, Peer: "b1"}}, ok: false},
+		{name: "write only peer", backends: []*BackendConfig{{Name: "b1", ReadOnly: true, Peer: "b2"}, {Name: "b2", WriteOnly: true}}, ok: false},
+		{name: "read and write only", backends: []*BackendConfig{{Name: "b1", ReadOnly: true, WriteOnly: true, Peer: "b2"}, {Name: "b2"}}, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckReadOnly(&CircleConfig{Backends: tt.backends}); (err == nil) != tt.ok {
+				t.Errorf("CheckReadOnly() error = %v, ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCircleZoneAware(t *testing.T) {
+	newZoneCircle := func(id int, zones ...string) *Circle {
+		circle := &Circle{CircleId: id, router: NewHashRing(HashConsistent, 256), mapToBackend: make(map[string]*Backend), replicas: 2, zoneAware: true}
+		for i, zone := range zones {
+			be := &Backend{HttpBackend: &HttpBackend{Name: "influxdb-" + strconv.Itoa(id) + "-" + strconv.Itoa(i), Weight: 1, Zone: zone}}
+			circle.Backends = append(circle.Backends, be)
+			circle.addRouter(be, i, "idx")
+		}
+		return circle
+	}
+	ip := &Proxy{Circles: []*Circle{newZoneCircle(0, "a", "a", "b"), newZoneCircle(1, "a", "b", "c", "c")}}
+	ip.Circles[1].avoidZones = ip.zonesBefore(1)
+	for i := 0; i < 1000; i++ {
+		key := GetKey("db", "cpu"+strconv.Itoa(i))
+		replicas := ip.Circles[0].GetReplicas(key)
+		if len(replicas) != 2 || replicas[0].Zone == replicas[1].Zone {
+			t.Fatalf("replicas of key %s not across zones: %s, %s", key, replicas[0].Zone, replicas[1].Zone)
+		}
+		if replicas[0] != ip.Circles[0].GetBackend(key) {
+			t.Errorf("first replica %s is not the backend of key %s", replicas[0].Name, key)
+		}
+		// zones a and b already hold the key, so only the first replica can avoid them
+		if be := ip.Circles[1].GetBackend(key); be.Zone != "c" {
+			t.Errorf("backend of key %s in zone %s of previous circle", key, be.Zone)
+		}
+	}
+}
+
+func TestCircleWriteEnabled(t *testing.T) {
+	for _, mode := range []string{WriteDisabledBuffer, WriteDisabledSkip} {
+		cfg := &ProxyConfig{WriteDisabledMode: mode, Circles: []*CircleConfig{{
+			Name:     "circle-1",
+			Backends: []*BackendConfig{{Name: "b1", Url: "http://b1"}, {Name: "b2", Url: "http://b2"}},
+		}}}
+		cfg.setDefault()
+		circfg := cfg.Circles[0]
+		circle := newCircle(circfg, cfg, 0, []*Backend{NewSimpleBackend(circfg.Backends[0])})
+		circle.SetWriteEnabled(false)
+		// the backend added to the disabled circle is disabled as well
+		circle = circle.rebuild(circfg, cfg, append(circle.Backends, NewSimpleBackend(circfg.Backends[1])))
+		if circle.IsWriteEnabled() || circle.SkipWrite() != (mode == WriteDisabledSkip) {
+			t.Errorf("%s: circle write enabled: %t, skip write: %t", mode, circle.IsWriteEnabled(), circle.SkipWrite())
+		}
+		for _, be := range circle.Backends {
+			if be.IsPaused() != (mode == WriteDisabledBuffer) {
+				t.Errorf("%s: backend %s paused: %t", mode, be.Name, be.IsPaused())
+			}
+		}
+		circle.SetWriteEnabled(true)
+		if !circle.IsWriteEnabled() || circle.SkipWrite() || circle.Backends[0].IsPaused() || circle.Backends[1].IsPaused() {
+			t.Errorf("%s: circle write not enabled", mode)
+		}
+	}
+}
+
+func TestHashRingEmpty(t *testing.T) {
+	for _, algorithm := range []string{HashConsistent, HashJump, HashRendezvous} {
+		if _, err := NewHashRing(algorithm, 256).Get("db,cpu"); err == nil {
+			t.Errorf("%s: error expected on empty ring", algorithm)
+		}
+	}
+}
+
+func TestJump(t *testing.T) {
+	for buckets := 1; buckets <= 100; buckets++ {
+		for key := uint64(0); key < 100; key++ {
+			if b := jump(key*7919, buckets); b < 0 || b >= buckets {
+				t.Fatalf("jump(%d, %d) = %d out of range", key*7919, buckets, b)
+			}
+		}
+	}
+}
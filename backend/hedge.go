@@ -0,0 +1,93 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const HeaderHedged = "X-Influxdb-Proxy-Hedged"
+
+type hedgeAttempt struct {
+	be     *Backend
+	header http.Header
+	body   []byte
+	err    error
+}
+
+// hedgedQuery queries the first backend, and the replica in next circle if no response arrives within hedge delay,
+// the first successful response is returned and the others are cancelled, a failed query fails over at once
+func hedgedQuery(w http.ResponseWriter, req *http.Request, ip *Proxy, db, key string, fn func(*Backend, *http.Request, http.ResponseWriter) ([]byte, error)) (body []byte, served *Backend, err error) {
+	backends := readCandidates(ip, req, db, key)
+	if len(backends) == 0 {
+		return nil, nil, ErrBackendsUnavailable
+	}
+	ch := make(chan *hedgeAttempt, len(backends))
+	cancels := make([]context.CancelFunc, 0, len(backends))
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	launch := func(be *Backend) {
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if ip.queryTimeout > 0 {
+			ctx, cancel = context.WithTimeout(req.Context(), ip.queryTimeout)
+		} else {
+			ctx, cancel = context.WithCancel(req.Context())
+		}
+		cancels = append(cancels, cancel)
+		r := CloneQueryRequest(req).WithContext(ctx)
+		go func() {
+			hw := &discardResponseWriter{header: http.Header{}}
+			body, err := fn(be, r, hw)
+			ch <- &hedgeAttempt{be: be, header: hw.header, body: body, err: err}
+		}()
+	}
+
+	var failed []string
+	next, pending := 1, 1
+	launch(backends[0])
+	timer := time.NewTimer(ip.hedgeDelay)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case a := <-ch:
+			pending--
+			if a.err == nil {
+				CopyHeader(w.Header(), a.header)
+				if len(failed) > 0 {
+					w.Header().Set(HeaderFailover, strings.Join(failed, ","))
+				}
+				if a.be != backends[0] {
+					w.Header().Set(HeaderHedged, a.be.Name)
+				}
+				return a.body, a.be, nil
+			}
+			failed = append(failed, a.be.Name)
+			err = a.err
+			if req.Context().Err() != nil {
+				return
+			}
+			if next < len(backends) {
+				launch(backends[next])
+				next++
+				pending++
+			}
+		case <-timer.C:
+			if next < len(backends) {
+				launch(backends[next])
+				next++
+				pending++
+				timer.Reset(ip.hedgeDelay)
+			}
+		}
+	}
+	return
+}
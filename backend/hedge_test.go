@@ -0,0 +1,60 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"stathat.com/c/consistent"
+)
+
+func TestHedgedQuery(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-req.Context().Done():
+		}
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	circles := make([]*Circle, 2)
+	for i, url := range []string{slow.URL, fast.URL} {
+		be := &Backend{HttpBackend: NewSimpleHttpBackend(&BackendConfig{Name: url, Url: url})}
+		circles[i] = &Circle{CircleId: i, Backends: []*Backend{be}, router: consistent.New(), mapToBackend: make(map[string]*Backend)}
+		circles[i].addRouter(be, 0, "idx")
+	}
+	ip := &Proxy{
+		Circles:    circles,
+		readRouter: NewReadRouter(&ProxyConfig{ReadStrategy: ReadPreferredCircle}),
+		hedgeDelay: 20 * time.Millisecond,
+	}
+	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
+		qr := be.Query(req, w, false)
+		return qr.Body, qr.Err
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/query?db=db&q=select+*+from+cpu", nil)
+	req.ParseForm()
+	body, served, err := hedgedQuery(w, req, ip, "db", GetKey("db", "cpu"), fn)
+	if err != nil || string(body) != "fast" || served != circles[1].Backends[0] {
+		t.Fatalf("got %s, %v, want fast", body, err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("hedged query waited for the slow backend")
+	}
+	if got := w.Header().Get(HeaderHedged); got != fast.URL {
+		t.Errorf("got hedged header %q, want %q", got, fast.URL)
+	}
+}
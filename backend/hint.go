@@ -0,0 +1,231 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+// hintWindow is the time range of points forwarded by one query
+const hintWindow = int64(time.Hour)
+
+// Hint records the time range of the points of a measurement written to the fallback while the owner is down
+type Hint struct {
+	CircleId int    `json:"circle_id"` // nolint:golint
+	Owner    string `json:"owner"`
+	Fallback string `json:"fallback"`
+	Db       string `json:"db"`
+	Rp       string `json:"rp"`
+	Meas     string `json:"meas"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`
+}
+
+type hintKey struct {
+	circleId int
+	owner    string
+	fallback string
+	db       string
+	rp       string
+	meas     string
+}
+
+// Hints keeps the hints in memory and saves them to file under data dir periodically,
+// the points are forwarded from the fallback to the owner once the owner is active again
+type Hints struct {
+	path  string
+	hints map[hintKey]*Hint
+	dirty bool
+	lock  sync.Mutex
+}
+
+func NewHints(cfg *ProxyConfig) *Hints {
+	hs := &Hints{path: filepath.Join(cfg.DataDir, "hints.json"), hints: make(map[hintKey]*Hint)}
+	b, err := ioutil.ReadFile(hs.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("read hints error: %s", err)
+		}
+		return hs
+	}
+	var hints []*Hint
+	if err = json.Unmarshal(b, &hints); err != nil {
+		log.Printf("load hints error: %s", err)
+		return hs
+	}
+	for _, h := range hints {
+		hs.hints[hintKey{h.CircleId, h.Owner, h.Fallback, h.Db, h.Rp, h.Meas}] = h
+	}
+	return hs
+}
+
+// Add extends the time range of the hint by the point at time ts in nanoseconds
+func (hs *Hints) Add(circleId int, owner, fallback *Backend, db, rp, meas string, ts int64) { // nolint:golint
+	hk := hintKey{circleId, owner.Name, fallback.Name, db, rp, meas}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	h, ok := hs.hints[hk]
+	if !ok {
+		hs.hints[hk] = &Hint{CircleId: circleId, Owner: owner.Name, Fallback: fallback.Name, Db: db, Rp: rp, Meas: meas, Start: ts, End: ts + 1}
+		hs.dirty = true
+		return
+	}
+	if ts < h.Start {
+		h.Start = ts
+		hs.dirty = true
+	}
+	if ts >= h.End {
+		h.End = ts + 1
+		hs.dirty = true
+	}
+}
+
+// List returns the copies of hints sorted by circle, owner and measurement
+func (hs *Hints) List() []*Hint {
+	hs.lock.Lock()
+	hints := make([]*Hint, 0, len(hs.hints))
+	for _, h := range hs.hints {
+		hint := *h
+		hints = append(hints, &hint)
+	}
+	hs.lock.Unlock()
+	sort.Slice(hints, func(i, j int) bool {
+		a, b := hints[i], hints[j]
+		if a.CircleId != b.CircleId {
+			return a.CircleId < b.CircleId
+		}
+		if a.Owner != b.Owner {
+			return a.Owner < b.Owner
+		}
+		if a.Db != b.Db {
+			return a.Db < b.Db
+		}
+		if a.Rp != b.Rp {
+			return a.Rp < b.Rp
+		}
+		return a.Meas < b.Meas
+	})
+	return hints
+}
+
+// remove removes the hint forwarded, unless its time range is extended in the meantime
+func (hs *Hints) remove(forwarded *Hint) {
+	hk := hintKey{forwarded.CircleId, forwarded.Owner, forwarded.Fallback, forwarded.Db, forwarded.Rp, forwarded.Meas}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if h, ok := hs.hints[hk]; ok && h.Start == forwarded.Start && h.End == forwarded.End {
+		delete(hs.hints, hk)
+		hs.dirty = true
+	}
+}
+
+// save writes the hints to a temporary file and renames it, if they have changed since the last save
+func (hs *Hints) save() {
+	hs.lock.Lock()
+	if !hs.dirty {
+		hs.lock.Unlock()
+		return
+	}
+	hs.dirty = false
+	hints := make([]*Hint, 0, len(hs.hints))
+	for _, h := range hs.hints {
+		hints = append(hints, h)
+	}
+	b, err := json.Marshal(hints)
+	hs.lock.Unlock()
+	if err == nil {
+		tmp := hs.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, hs.path)
+		}
+	}
+	if err != nil {
+		log.Printf("save hints error: %s", err)
+	}
+}
+
+// forwardHints forwards the hints whose owners are active every interval, and saves the hints left
+func (ip *Proxy) forwardHints(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, h := range ip.hints.List() {
+			owner, fallback := ip.hintBackends(h)
+			if owner == nil || fallback == nil {
+				log.Printf("hint dropped: backends not found, circle: %d, owner: %s, fallback: %s", h.CircleId, h.Owner, h.Fallback)
+				ip.hints.remove(h)
+				continue
+			}
+			if !owner.IsActive() || !fallback.IsActive() {
+				continue
+			}
+			// the points buffered by the fallback are flushed before they are queried
+			fallback.Sync()
+			if err := forwardHint(h, fallback, owner); err != nil {
+				log.Printf("forward hint error: %s, circle: %d, owner: %s, fallback: %s, db: %s, rp: %s, meas: %s", err, h.CircleId, h.Owner, h.Fallback, h.Db, h.Rp, h.Meas)
+				continue
+			}
+			log.Printf("hint forwarded, circle: %d, owner: %s, fallback: %s, db: %s, rp: %s, meas: %s, start: %d, end: %d", h.CircleId, h.Owner, h.Fallback, h.Db, h.Rp, h.Meas, h.Start, h.End)
+			ip.hints.remove(h)
+		}
+		ip.hints.save()
+	}
+}
+
+func (ip *Proxy) hintBackends(h *Hint) (owner, fallback *Backend) {
+	circles := ip.AllCircles()
+	if h.CircleId < 0 || h.CircleId >= len(circles) {
+		return
+	}
+	for _, be := range circles[h.CircleId].Backends {
+		switch be.Name {
+		case h.Owner:
+			owner = be
+		case h.Fallback:
+			fallback = be
+		}
+	}
+	return
+}
+
+// forwardHint copies the points of the hint from src to dst window by window
+func forwardHint(h *Hint, src, dst *Backend) error {
+	from := fmt.Sprintf("\"%s\"", util.EscapeIdentifier(h.Meas))
+	if h.Rp != "" {
+		from = fmt.Sprintf("\"%s\".%s", util.EscapeIdentifier(h.Rp), from)
+	}
+	fieldTypes, err := src.GetFieldTypes(h.Db, h.Rp, h.Meas)
+	if err != nil {
+		return err
+	}
+	for start := h.Start; start < h.End; start += hintWindow {
+		end := start + hintWindow
+		if end > h.End {
+			end = h.End
+		}
+		q := fmt.Sprintf("select * from %s where time >= %d and time < %d group by *", from, start, end)
+		body, err := src.QueryIQL("GET", h.Db, q, "ns")
+		if err != nil {
+			return err
+		}
+		series, err := SeriesFromResponseBytes(body)
+		if err != nil {
+			return err
+		}
+		if p, n := SeriesToLines(series, &IntoTarget{Measurement: h.Meas}, fieldTypes); n > 0 {
+			// the batch is saved to file and rewritten later if the write fails
+			dst.WriteBatch(h.Db, h.Rp, "ns", p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCheckFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		backends []*BackendConfig
+		ok       bool
+	}{
+		{name: "no fallback", backends: []*BackendConfig{{Name: "b1"}, {Name: "b2"}}, ok: true},
+		{name: "fallback", backends: []*BackendConfig{{Name: "b1", Fallback: "b2"}, {Name: "b2", Fallback: "b1"}}, ok: true},
+		{name: "self fallback", backends: []*BackendConfig{{Name: "b1", Fallback: "b1"}, {Name: "b2"}}, ok: false},
+		{name: "unknown fallback", backends: []*BackendConfig{{Name: "b1", Fallback: "b3"}, {Name: "b2"}}, ok: false},
+		{name: "read only fallback", backends: []*BackendConfig{{Name: "b1", Fallback: "b2"}, {Name: "b2", ReadOnly: true, Peer: "b1"}}, ok: false},
+		{name: "write only fallback", backends: []*BackendConfig{{Name: "b1", Fallback: "b2"}, {Name: "b2", WriteOnly: true}}, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckFallback(&CircleConfig{Backends: tt.backends}); (err == nil) != tt.ok {
+				t.Errorf("CheckFallback() error = %v, ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	owner, fallback := NewSimpleBackend(&BackendConfig{Name: "b1"}), NewSimpleBackend(&BackendConfig{Name: "b2"})
+	hs := NewHints(&ProxyConfig{DataDir: dir})
+	hs.Add(0, owner, fallback, "db", "", "cpu", 200)
+	hs.Add(0, owner, fallback, "db", "", "cpu", 100)
+	hs.Add(0, owner, fallback, "db", "", "mem", 300)
+	hints := hs.List()
+	if len(hints) != 2 || hints[0].Meas != "cpu" || hints[0].Start != 100 || hints[0].End != 201 {
+		t.Fatalf("hints not recorded: %+v", hints)
+	}
+
+	// the hint extended after listed is kept
+	hs.Add(0, owner, fallback, "db", "", "cpu", 500)
+	hs.remove(hints[0])
+	hs.remove(hints[1])
+	hs.save()
+	hints = NewHints(&ProxyConfig{DataDir: dir}).List()
+	if len(hints) != 1 || hints[0].Meas != "cpu" || hints[0].Start != 100 || hints[0].End != 501 {
+		t.Errorf("hints not loaded: %+v", hints)
+	}
+}
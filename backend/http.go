@@ -7,6 +7,7 @@ package backend
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -21,6 +22,7 @@ import (
 	"time"
 
 	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/golang/snappy"
 )
 
 var (
@@ -33,6 +35,8 @@ var (
 
 const (
 	HeaderQueryOrigin = "Query-Origin"
+	HeaderFailover    = "X-Influxdb-Proxy-Failover"
+	HeaderTrace       = "X-Influxdb-Proxy-Trace"
 	QueryParallel     = "Parallel"
 )
 
@@ -44,38 +48,75 @@ type QueryResult struct {
 }
 
 type HttpBackend struct { // nolint:golint
-	client      *http.Client
-	transport   *http.Transport
-	Name        string
-	Url         string // nolint:golint
-	username    string
-	password    string
-	authEncrypt bool
-	interval    int
-	running     atomic.Value
-	active      atomic.Value
-	rewriting   atomic.Value
-	transferIn  atomic.Value
-	writeOnly   bool
+	queryPending int64
+	queryLatency int64
+	client       *http.Client
+	transport    *http.Transport
+	tlsConfig    *tls.Config
+	certs        *CertReloader
+	Name         string
+	Url          string // nolint:golint
+	Weight       int
+	Zone         string
+	username     *Secret
+	password     *Secret
+	dbAuth       map[string]*credential
+	authEncrypt  bool
+	interval     int
+	running      atomic.Value
+	active       atomic.Value
+	rewriting    atomic.Value
+	transferIn   atomic.Value
+	writeOnly    bool
+	readOnly     bool
+	compression  string
 }
 
 func NewHttpBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (hb *HttpBackend) { // nolint:golint
 	hb = NewSimpleHttpBackend(cfg)
-	hb.client = NewClient(strings.HasPrefix(cfg.Url, "https"), pxcfg.WriteTimeout)
+	hb.client = &http.Client{Transport: newTransport(hb.tlsConfig), Timeout: time.Duration(pxcfg.WriteTimeout) * time.Second}
 	hb.interval = pxcfg.CheckInterval
+	for db, crcfg := range pxcfg.DBCredentials {
+		if _, ok := hb.dbAuth[db]; !ok {
+			hb.dbAuth[db] = newCredential(cfg.Name, db, crcfg)
+		}
+	}
 	go hb.CheckActive()
 	return
 }
 
 func NewSimpleHttpBackend(cfg *BackendConfig) (hb *HttpBackend) { // nolint:golint
+	tlsConfig, certs, err := NewBackendTLSConfig(cfg)
+	if err != nil {
+		log.Printf("backend %s tls config error: %s", cfg.Name, err)
+		tlsConfig = &tls.Config{}
+	}
+	username, err := NewSecret(cfg.Username)
+	if err != nil {
+		log.Printf("backend %s username error: %s", cfg.Name, err)
+	}
+	password, err := NewSecret(cfg.Password)
+	if err != nil {
+		log.Printf("backend %s password error: %s", cfg.Name, err)
+	}
 	hb = &HttpBackend{
-		transport:   NewTransport(strings.HasPrefix(cfg.Url, "https")),
+		transport:   newTransport(tlsConfig),
+		tlsConfig:   tlsConfig,
+		certs:       certs,
 		Name:        cfg.Name,
 		Url:         cfg.Url,
-		username:    cfg.Username,
-		password:    cfg.Password,
+		Weight:      cfg.Weight,
+		Zone:        cfg.Zone,
+		username:    username,
+		password:    password,
+		dbAuth:      make(map[string]*credential, len(cfg.Credentials)),
 		authEncrypt: cfg.AuthEncrypt,
 		writeOnly:   cfg.WriteOnly,
+		readOnly:    cfg.ReadOnly,
+		compression: cfg.Compression,
+	}
+	for db, crcfg := range cfg.Credentials {
+		hb.dbAuth[db] = newCredential(cfg.Name, db, crcfg)
 	}
 	hb.running.Store(true)
 	hb.active.Store(true)
@@ -89,6 +130,10 @@ func NewClient(tlsSkip bool, timeout int) *http.Client {
 }
 
 func NewTransport(tlsSkip bool) *http.Transport {
+	return newTransport(&tls.Config{InsecureSkipVerify: tlsSkip})
+}
+
+func newTransport(tlsConfig *tls.Config) *http.Transport {
 	return &http.Transport{
 		DialContext: (&net.Dialer{
 			Timeout:   time.Second * 30,
@@ -99,7 +144,7 @@ func NewTransport(tlsSkip bool) *http.Transport {
 		IdleConnTimeout:       time.Second * 90,
 		TLSHandshakeTimeout:   time.Second * 10,
 		ExpectContinueTimeout: time.Second * 1,
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: tlsSkip},
+		TLSClientConfig:       tlsConfig,
 	}
 }
 
@@ -136,6 +181,19 @@ func Compress(buf *bytes.Buffer, p []byte) (err error) {
 	return
 }
 
+// Encode compresses p with gzip or snappy, and returns p as is for none
+func Encode(encoding string, p []byte) ([]byte, error) {
+	switch encoding {
+	case "gzip":
+		var buf bytes.Buffer
+		err := Compress(&buf, p)
+		return buf.Bytes(), err
+	case "snappy":
+		return snappy.Encode(nil, p), nil
+	}
+	return p, nil
+}
+
 func CopyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -152,16 +210,48 @@ func SetBasicAuth(req *http.Request, username string, password string, authEncry
 	}
 }
 
-func (hb *HttpBackend) SetBasicAuth(req *http.Request) {
-	SetBasicAuth(req, hb.username, hb.password, hb.authEncrypt)
+// credentials returns the username and password of backend for db, the ones of db override the default ones,
+// and they're refreshed if they're secret references
+func (hb *HttpBackend) credentials(db string) (string, string) {
+	if c, ok := hb.dbAuth[db]; ok {
+		return c.username.Value(), c.password.Value()
+	}
+	return hb.username.Value(), hb.password.Value()
+}
+
+func (hb *HttpBackend) hasAuth(db string) bool {
+	username, password := hb.credentials(db)
+	return username != "" || password != ""
+}
+
+// SetBasicAuth sets the credentials of backend for db
+func (hb *HttpBackend) SetBasicAuth(req *http.Request, db string) {
+	username, password := hb.credentials(db)
+	SetBasicAuth(req, username, password, hb.authEncrypt)
 }
 
+type passthroughKey struct{}
+
+// WithPassthrough returns the request whose credentials of client are forwarded to the backends
+// instead of the credentials of backends
+func WithPassthrough(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), passthroughKey{}, true))
+}
+
+// IsPassthrough returns whether the credentials of client are forwarded
+func IsPassthrough(req *http.Request) bool {
+	passthrough, _ := req.Context().Value(passthroughKey{}).(bool)
+	return passthrough
+}
+
+// SetTokenAuth sets the default credentials of backend, since the database of flux query is unknown
 func (hb *HttpBackend) SetTokenAuth(req *http.Request) {
 	var auth string
+	username, password := hb.credentials("")
 	if hb.authEncrypt {
-		auth = fmt.Sprintf("Token %s:%s", util.AesDecrypt(hb.username), util.AesDecrypt(hb.password))
+		auth = fmt.Sprintf("Token %s:%s", util.AesDecrypt(username), util.AesDecrypt(password))
 	} else {
-		auth = fmt.Sprintf("Token %s:%s", hb.username, hb.password)
+		auth = fmt.Sprintf("Token %s:%s", username, password)
 	}
 	req.Header.Set("Authorization", auth)
 }
@@ -193,6 +283,10 @@ func (hb *HttpBackend) IsWriteOnly() (b bool) {
 	return hb.writeOnly || hb.transferIn.Load().(bool)
 }
 
+func (hb *HttpBackend) IsReadOnly() (b bool) {
+	return hb.readOnly
+}
+
 func (hb *HttpBackend) Ping() bool {
 	resp, err := hb.client.Get(hb.Url + "/ping")
 	if err != nil {
@@ -214,24 +308,37 @@ func (hb *HttpBackend) Write(db, rp string, p []byte) (err error) {
 		log.Print("compress error: ", err)
 		return
 	}
-	return hb.WriteStream(db, rp, &buf, true)
+	return hb.WriteStream(db, rp, "", &buf, "gzip")
+}
+
+func (hb *HttpBackend) WriteCompressed(db, rp, precision string, p []byte) (err error) {
+	buf := bytes.NewBuffer(p)
+	return hb.WriteStream(db, rp, precision, buf, "gzip")
 }
 
-func (hb *HttpBackend) WriteCompressed(db, rp string, p []byte) (err error) {
+// WriteEncoded writes p already encoded with the compression of backend
+func (hb *HttpBackend) WriteEncoded(db, rp, precision string, p []byte) (err error) {
 	buf := bytes.NewBuffer(p)
-	return hb.WriteStream(db, rp, buf, true)
+	return hb.WriteStream(db, rp, precision, buf, hb.compression)
 }
 
-func (hb *HttpBackend) WriteStream(db, rp string, stream io.Reader, compressed bool) (err error) {
+func (hb *HttpBackend) Compression() string {
+	return hb.compression
+}
+
+func (hb *HttpBackend) WriteStream(db, rp, precision string, stream io.Reader, encoding string) (err error) {
 	q := url.Values{}
 	q.Set("db", db)
 	q.Set("rp", rp)
+	if precision != "" && precision != "ns" && precision != "n" {
+		q.Set("precision", precision)
+	}
 	req, err := http.NewRequest("POST", hb.Url+"/write?"+q.Encode(), stream)
-	if hb.username != "" || hb.password != "" {
-		hb.SetBasicAuth(req)
+	if hb.hasAuth(db) {
+		hb.SetBasicAuth(req, db)
 	}
-	if compressed {
-		req.Header.Add("Content-Encoding", "gzip")
+	if encoding == "gzip" || encoding == "snappy" {
+		req.Header.Add("Content-Encoding", encoding)
 	}
 
 	resp, err := hb.client.Do(req)
@@ -268,6 +375,10 @@ func (hb *HttpBackend) WriteStream(db, rp string, stream io.Reader, compressed b
 	}
 	if bytes.Contains(respbuf, []byte("retention policy not found")) {
 		err = ErrBadRequest
+	} else if resp.StatusCode == 400 {
+		if conflict := ParseFieldTypeConflict(respbuf); conflict != nil {
+			err = conflict
+		}
 	}
 	return
 }
@@ -276,10 +387,12 @@ func (hb *HttpBackend) ReadProm(req *http.Request, w http.ResponseWriter) (err e
 	if len(req.Form) == 0 {
 		req.Form = url.Values{}
 	}
-	req.Form.Del("u")
-	req.Form.Del("p")
-	if hb.username != "" || hb.password != "" {
-		hb.SetBasicAuth(req)
+	if !IsPassthrough(req) {
+		req.Form.Del("u")
+		req.Form.Del("p")
+		if db := req.Form.Get("db"); hb.hasAuth(db) {
+			hb.SetBasicAuth(req, db)
+		}
 	}
 
 	req.URL, err = url.Parse(hb.Url + "/api/v1/prom/read?" + req.Form.Encode())
@@ -309,54 +422,80 @@ func (hb *HttpBackend) ReadProm(req *http.Request, w http.ResponseWriter) (err e
 }
 
 func (hb *HttpBackend) QueryFlux(req *http.Request, w http.ResponseWriter) (err error) {
-	if hb.username != "" || hb.password != "" {
+	qr := hb.QueryFluxResult(req)
+	if qr.Err != nil {
+		return qr.Err
+	}
+	CopyHeader(w.Header(), qr.Header)
+	w.WriteHeader(qr.Status)
+	_, err = w.Write(qr.Body)
+	return
+}
+
+// QueryFluxResult returns the response of flux query, the error responses of backend are not taken as errors
+func (hb *HttpBackend) QueryFluxResult(req *http.Request) (qr *QueryResult) {
+	qr = &QueryResult{}
+	if hb.hasAuth("") && !IsPassthrough(req) {
 		hb.SetTokenAuth(req)
 	}
 
-	req.URL, err = url.Parse(hb.Url + "/api/v2/query")
-	if err != nil {
-		log.Print("internal url parse error: ", err)
+	req.URL, qr.Err = url.Parse(hb.Url + "/api/v2/query")
+	if qr.Err != nil {
+		log.Print("internal url parse error: ", qr.Err)
 		return
 	}
 
+	defer traceBackend(req, hb, time.Now())
 	resp, err := hb.transport.RoundTrip(req)
 	if err != nil {
+		qr.Err = err
 		log.Printf("flux query error: %s", err)
 		return
 	}
 	defer resp.Body.Close()
 
-	CopyHeader(w.Header(), resp.Header)
-
-	p, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("flux read body error: %s", err)
+	qr.Body, qr.Err = ioutil.ReadAll(resp.Body)
+	if qr.Err != nil {
+		log.Printf("flux read body error: %s", qr.Err)
 		return
 	}
-	w.WriteHeader(resp.StatusCode)
-	_, err = w.Write(p)
+	qr.Header = resp.Header
+	qr.Status = resp.StatusCode
 	return
 }
 
-func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompress bool) (qr *QueryResult) {
-	qr = &QueryResult{}
+func (hb *HttpBackend) prepareQuery(req *http.Request) (err error) {
 	if len(req.Form) == 0 {
 		req.Form = url.Values{}
 	}
-	req.Form.Del("u")
-	req.Form.Del("p")
 	req.ContentLength = 0
-	if hb.username != "" || hb.password != "" {
-		hb.SetBasicAuth(req)
+	if !IsPassthrough(req) {
+		req.Form.Del("u")
+		req.Form.Del("p")
+		if db := req.Form.Get("db"); hb.hasAuth(db) {
+			hb.SetBasicAuth(req, db)
+		}
 	}
 
-	req.URL, qr.Err = url.Parse(hb.Url + "/query?" + req.Form.Encode())
+	req.URL, err = url.Parse(hb.Url + "/query?" + req.Form.Encode())
+	if err != nil {
+		log.Print("internal url parse error: ", err)
+	}
+	return
+}
+
+func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompress bool) (qr *QueryResult) {
+	qr = &QueryResult{}
+	qr.Err = hb.prepareQuery(req)
 	if qr.Err != nil {
-		log.Print("internal url parse error: ", qr.Err)
 		return
 	}
 
 	q := strings.TrimSpace(req.FormValue("q"))
+	atomic.AddInt64(&hb.queryPending, 1)
+	defer atomic.AddInt64(&hb.queryPending, -1)
+	defer hb.observeLatency(time.Now())
+	defer traceBackend(req, hb, time.Now())
 	resp, err := hb.transport.RoundTrip(req)
 	if err != nil {
 		if req.Header.Get(HeaderQueryOrigin) != QueryParallel || err.Error() != "context canceled" {
@@ -396,6 +535,85 @@ func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompres
 	return
 }
 
+// QueryStream copies the response to client as it arrives, the error responses are returned
+// without being written so that the query can fail over
+func (hb *HttpBackend) QueryStream(req *http.Request, w *StreamWriter) (err error) {
+	err = hb.prepareQuery(req)
+	if err != nil {
+		return
+	}
+
+	q := strings.TrimSpace(req.FormValue("q"))
+	atomic.AddInt64(&hb.queryPending, 1)
+	defer atomic.AddInt64(&hb.queryPending, -1)
+	defer hb.observeLatency(time.Now())
+	start := time.Now()
+	resp, err := hb.transport.RoundTrip(req)
+	if err != nil {
+		traceBackend(req, hb, start)
+		log.Printf("query error: %s, the query is %s", err, q)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var body io.Reader = resp.Body
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			var b *gzip.Reader
+			b, err = gzip.NewReader(resp.Body)
+			if err != nil {
+				log.Printf("unable to decode gzip body: %s", err)
+				return
+			}
+			defer b.Close()
+			body = b
+		}
+		var p []byte
+		p, err = ioutil.ReadAll(body)
+		if err != nil {
+			log.Printf("read body error: %s, the query is %s", err, q)
+			return
+		}
+		traceBackend(req, hb, start)
+		rsp, _ := ResponseFromResponseBytes(p)
+		return errors.New(rsp.Err)
+	}
+
+	CopyHeader(w.Header(), resp.Header)
+	if qt := GetQueryTrace(req); qt != nil {
+		// the header is written before the body is streamed, so the latency is up to the response header
+		traceBackend(req, hb, start)
+		w.Header().Set(HeaderTrace, qt.String())
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Streamed = true
+	_, err = w.ReadFrom(resp.Body)
+	if err != nil {
+		// the response is partially written and can't fail over
+		log.Printf("stream body error: %s, the query is %s", err, q)
+	}
+	return nil
+}
+
+// observeLatency updates the moving average of query latency
+func (hb *HttpBackend) observeLatency(start time.Time) {
+	latency := int64(time.Since(start))
+	if old := atomic.LoadInt64(&hb.queryLatency); old > 0 {
+		latency = old - old/5 + latency/5
+	}
+	atomic.StoreInt64(&hb.queryLatency, latency)
+}
+
+// QueryPending returns the number of in-flight queries
+func (hb *HttpBackend) QueryPending() int64 {
+	return atomic.LoadInt64(&hb.queryPending)
+}
+
+// QueryLatency returns the moving average of query latency in nanoseconds
+func (hb *HttpBackend) QueryLatency() int64 {
+	return atomic.LoadInt64(&hb.queryLatency)
+}
+
 func (hb *HttpBackend) QueryIQL(method, db, q, epoch string) ([]byte, error) {
 	qr := hb.Query(NewQueryRequest(method, db, q, epoch), nil, true)
 	return qr.Body, qr.Err
@@ -428,6 +646,69 @@ func (hb *HttpBackend) GetRetentionPolicies(db string) []string {
 	return hb.GetSeriesValues(db, "show retention policies")
 }
 
+// RetentionPolicy is the retention policy of database shown by the backend
+type RetentionPolicy struct {
+	Name               string
+	Duration           string
+	ShardGroupDuration string
+	Default            bool
+}
+
+func (hb *HttpBackend) GetRetentionPolicyInfos(db string) []*RetentionPolicy {
+	var rps []*RetentionPolicy
+	qr := hb.Query(NewQueryRequest("GET", db, "show retention policies", ""), nil, true)
+	if qr.Err != nil {
+		return rps
+	}
+	series, _ := SeriesFromResponseBytes(qr.Body)
+	for _, s := range series {
+		index := make(map[string]int)
+		for i, column := range s.Columns {
+			index[column] = i
+		}
+		for _, v := range s.Values {
+			if len(v) != len(s.Columns) {
+				continue
+			}
+			rp := &RetentionPolicy{}
+			rp.Name, _ = v[index["name"]].(string)
+			rp.Duration, _ = v[index["duration"]].(string)
+			rp.ShardGroupDuration, _ = v[index["shardGroupDuration"]].(string)
+			rp.Default, _ = v[index["default"]].(bool)
+			if rp.Name != "" && rp.Duration != "" {
+				rps = append(rps, rp)
+			}
+		}
+	}
+	return rps
+}
+
+// GetContinuousQueries returns the statements of the continuous queries of database
+func (hb *HttpBackend) GetContinuousQueries(db string) map[string]string {
+	cqs := make(map[string]string)
+	qr := hb.Query(NewQueryRequest("GET", "", "show continuous queries", ""), nil, true)
+	if qr.Err != nil {
+		return cqs
+	}
+	series, _ := SeriesFromResponseBytes(qr.Body)
+	for _, s := range series {
+		if s.Name != db {
+			continue
+		}
+		for _, v := range s.Values {
+			if len(v) < 2 {
+				continue
+			}
+			name, _ := v[0].(string)
+			query, _ := v[1].(string)
+			if name != "" && query != "" {
+				cqs[name] = query
+			}
+		}
+	}
+	return cqs
+}
+
 func (hb *HttpBackend) GetMeasurements(db string) []string {
 	return hb.GetSeriesValues(db, "show measurements")
 }
@@ -453,12 +734,42 @@ func (hb *HttpBackend) GetFieldKeys(db, rp, meas string) map[string][]string {
 	return fieldKeys
 }
 
+// GetFieldTypes returns the first type of each field, rp can be empty for the default retention policy
+func (hb *HttpBackend) GetFieldTypes(db, rp, meas string) (map[string]string, error) {
+	fieldTypes := make(map[string]string)
+	q := fmt.Sprintf("show field keys from \"%s\"", util.EscapeIdentifier(meas))
+	if rp != "" {
+		q = fmt.Sprintf("show field keys from \"%s\".\"%s\"", util.EscapeIdentifier(rp), util.EscapeIdentifier(meas))
+	}
+	qr := hb.Query(NewQueryRequest("GET", db, q, ""), nil, true)
+	if qr.Err != nil {
+		return fieldTypes, qr.Err
+	}
+	series, _ := SeriesFromResponseBytes(qr.Body)
+	for _, s := range series {
+		for _, v := range s.Values {
+			if _, ok := fieldTypes[v[0].(string)]; !ok {
+				fieldTypes[v[0].(string)] = v[1].(string)
+			}
+		}
+	}
+	return fieldTypes, nil
+}
+
 func (hb *HttpBackend) DropMeasurement(db, meas string) ([]byte, error) {
 	q := fmt.Sprintf("drop measurement \"%s\"", util.EscapeIdentifier(meas))
 	qr := hb.Query(NewQueryRequest("POST", db, q, ""), nil, true)
 	return qr.Body, qr.Err
 }
 
+// ReloadCert reloads the client certificate of tls_cert and tls_key if set
+func (hb *HttpBackend) ReloadCert() error {
+	if hb.certs == nil {
+		return nil
+	}
+	return hb.certs.Reload()
+}
+
 func (hb *HttpBackend) Close() {
 	hb.running.Store(false)
 	hb.transport.CloseIdleConnections()
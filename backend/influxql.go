@@ -21,6 +21,9 @@ var SupportCmds = util.NewSet(
 	"show tag keys",
 	"show tag values",
 	"show stats",
+	"show diagnostics",
+	"show shards",
+	"drop shard",
 	"show databases",
 	"create database",
 	"drop database",
@@ -29,7 +32,9 @@ var SupportCmds = util.NewSet(
 	"alter retention policy",
 	"drop retention policy",
 	"delete from",
+	"delete where",
 	"drop series from",
+	"drop series where",
 	"drop measurement",
 )
 
@@ -199,6 +204,10 @@ func ScanToken(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		} else {
 			advance += start
 		}
+		// split the subquery from keyword, e.g. FROM(SELECT ...)
+		if advance-start > 5 && data[start+4] == '(' && bytes.EqualFold(data[start:start+4], []byte("from")) {
+			advance = start + 4
+		}
 	}
 	if err != nil {
 		log.Printf("scan token error: %s", err)
@@ -225,6 +234,31 @@ func ScanTokens(q string, n int) (tokens []string) {
 	return
 }
 
+// SplitStatements splits the query into statements by the semicolons outside quotes
+func SplitStatements(q string) (stmts []string) {
+	var quote byte
+	start := 0
+	for i := 0; i < len(q); i++ {
+		switch c := q[i]; {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ';':
+			if stmt := strings.TrimSpace(q[start:i]); stmt != "" {
+				stmts = append(stmts, stmt)
+			}
+			start = i + 1
+		}
+	}
+	if stmt := strings.TrimSpace(q[start:]); stmt != "" {
+		stmts = append(stmts, stmt)
+	}
+	return
+}
+
 func GetHeadStmtFromTokens(tokens []string, n int) string {
 	if n <= 0 || n > len(tokens) {
 		n = len(tokens)
@@ -276,6 +310,106 @@ func GetMeasurementFromTokens(tokens []string) (mm string, err error) {
 	return
 }
 
+func GetMeasurementsFromInfluxQL(q string) ([]string, error) {
+	return GetMeasurementsFromTokens(ScanTokens(q, 0))
+}
+
+// GetMeasurementsFromTokens returns all the measurements after from, regex measurements are kept with slashes
+func GetMeasurementsFromTokens(tokens []string) (mms []string, err error) {
+	_, mms, err = GetSourcesFromTokens(tokens)
+	return
+}
+
+func GetSourcesFromInfluxQL(q string) ([]string, []string, error) {
+	return GetSourcesFromTokens(ScanTokens(q, 0))
+}
+
+// GetSourcesFromTokens returns the databases and measurements of all the sources after from,
+// the database is empty if the measurement isn't fully qualified
+func GetSourcesFromTokens(tokens []string) (dbs []string, mms []string, err error) {
+	start := -1
+	for i, token := range tokens {
+		if strings.ToLower(token) == "from" {
+			start = i + 1
+			break
+		}
+	}
+	if start == -1 || start == len(tokens) {
+		return nil, nil, ErrIllegalQL
+	}
+	tokens = splitCommaTokens(tokens[start:])
+	var source []string
+	for i := 0; i <= len(tokens); i++ {
+		if i < len(tokens) && tokens[i] != "," && !FromClauseEnds[strings.ToLower(tokens[i])] {
+			source = append(source, tokens[i])
+			continue
+		}
+		if len(source) > 0 {
+			subDbs, subMms, err := getSources(source)
+			if err != nil {
+				return nil, nil, err
+			}
+			dbs = append(dbs, subDbs...)
+			mms = append(mms, subMms...)
+			source = nil
+		}
+		if i < len(tokens) && tokens[i] != "," {
+			break
+		}
+	}
+	return
+}
+
+// splitCommaTokens splits the unquoted tokens like "cpu," or "cpu,mem" so that commas are separate tokens
+func splitCommaTokens(tokens []string) (split []string) {
+	for _, token := range tokens {
+		if token[0] == '"' || token[0] == '\'' || token[0] == '(' || token[0] == '/' || token == "," || !strings.Contains(token, ",") {
+			split = append(split, token)
+			continue
+		}
+		for i, part := range strings.Split(token, ",") {
+			if i > 0 {
+				split = append(split, ",")
+			}
+			if part != "" {
+				split = append(split, part)
+			}
+		}
+	}
+	return
+}
+
+var FromClauseEnds = util.NewSet("where", "group", "order", "limit", "offset", "slimit", "soffset", "tz", "with")
+
+func getSources(source []string) ([]string, []string, error) {
+	mm := source[0]
+	if len(source) == 1 && len(mm) > 16 && mm[0] == '(' && mm[len(mm)-1] == ')' && strings.HasPrefix(strings.ToLower(strings.TrimLeft(mm, "( ")), "select ") {
+		return GetSourcesFromInfluxQL(mm[1 : len(mm)-1])
+	}
+	db := getDatabase(source, "from")
+	for i, token := range source {
+		if token[0] == '/' {
+			return []string{db}, []string{strings.Join(source[i:], "")}, nil
+		}
+	}
+	return []string{db}, []string{getMeasurement(source, "from")}, nil
+}
+
+// IsCrossDatabase returns true if the sources span more than one database, db is used for the unqualified sources
+func IsCrossDatabase(dbs []string, db string) bool {
+	for _, d := range dbs {
+		if d != "" && d != db {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRegexMeasurement returns true if mm is a regex like /cpu.*/
+func IsRegexMeasurement(mm string) bool {
+	return len(mm) >= 2 && mm[0] == '/' && mm[len(mm)-1] == '/'
+}
+
 func GetIdentifierFromTokens(tokens []string, keywords []string, fn func([]string, string) string) (string, error) {
 	for i := 0; i < len(tokens); i++ {
 		for j := 0; j < len(keywords); j++ {
@@ -370,9 +504,6 @@ func CheckQuery(q string) (tokens []string, check bool, from bool) {
 	if stmt == "select" {
 		for i := 2; i < len(tokens); i++ {
 			stmt := strings.ToLower(tokens[i])
-			if stmt == "into" {
-				return tokens, false, false
-			}
 			if stmt == "from" {
 				return tokens, true, true
 			}
@@ -401,7 +532,8 @@ func CheckQuery(q string) (tokens []string, check bool, from bool) {
 
 func CheckDatabaseFromTokens(tokens []string) (check bool, show bool, alter bool, db string) {
 	stmt := GetHeadStmtFromTokens(tokens, 2)
-	show = stmt == "show databases"
+	// the statements of server are run without database
+	show = stmt == "show databases" || stmt == "show stats" || stmt == "show diagnostics" || stmt == "show shards" || stmt == "drop shard"
 	alter = stmt == "create database" || stmt == "drop database"
 	check = show || alter
 	if alter && len(tokens) >= 3 {
@@ -427,7 +559,28 @@ func CheckSelectOrShowFromTokens(tokens []string) (check bool) {
 func CheckDeleteOrDropMeasurementFromTokens(tokens []string) (check bool) {
 	if len(tokens) >= 3 {
 		stmt := GetHeadStmtFromTokens(tokens, 2)
-		return stmt == "delete from" || stmt == "drop measurement" || stmt == "drop series"
+		return stmt == "delete from" || stmt == "delete where" || stmt == "drop measurement" || stmt == "drop series"
 	}
 	return
 }
+
+// CheckDestructiveFromTokens returns whether the statement drops or deletes data, including drop database, measurement,
+// series, shard and retention policy, and delete
+func CheckDestructiveFromTokens(tokens []string) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	stmt := GetHeadStmtFromTokens(tokens, 2)
+	return strings.ToLower(tokens[0]) == "delete" || stmt == "drop database" || stmt == "drop measurement" ||
+		stmt == "drop series" || stmt == "drop shard" || GetHeadStmtFromTokens(tokens, 3) == "drop retention policy"
+}
+
+// CheckFromTokens returns whether the statement has a from clause
+func CheckFromTokens(tokens []string) bool {
+	for _, token := range tokens {
+		if strings.ToLower(token) == "from" {
+			return true
+		}
+	}
+	return false
+}
@@ -4,7 +4,10 @@
 
 package backend
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 // ALTER RETENTION POLICY "1h.cpu" ON "mydb" DEFAULT
 // ALTER RETENTION POLICY "policy1" ON "somedb" DURATION 1h REPLICATION 4
@@ -392,6 +395,9 @@ func TestGetMeasurementFromInfluxQL(t *testing.T) {
 	assertMeasurement(t, `select mean(kpi_3) from (select kpi_1+kpi_2 as kpi_3 from cpu where time < 1620877962) where time < 1620877962 group by time(1m),app`, "cpu")
 	assertMeasurement(t, `select mean(kpi_3),max(kpi_3) FRoM (select kpi_1+kpi_2 as kpi_3 from cpu where time < 1620877962) where time < 1620877962 group by time(1m),app`, "cpu")
 
+	assertMeasurement(t, `SELECT mean(x) FROM(SELECT x FROM cpu)`, "cpu")
+	assertMeasurement(t, `select count(x) from (select x from (select x from "cpu"))`, "cpu")
+
 	assertMeasurement(t, `SHOW FIELD KEYS`, "")
 	assertMeasurement(t, `SHOW FIELD KEYS FROM "cpu"`, "cpu")
 	assertMeasurement(t, `SHOW FIELD KEYS FROM "1h"."cpu"`, "cpu")
@@ -470,3 +476,100 @@ func BenchmarkGetMeasurementFromInfluxQL(b *testing.B) {
 		}
 	}
 }
+
+func TestGetMeasurementsFromInfluxQL(t *testing.T) {
+	tests := []struct {
+		name string
+		q    string
+		want []string
+	}{
+		{name: "single", q: `select * from cpu where time > now() - 1h`, want: []string{"cpu"}},
+		{name: "multiple", q: `select * from cpu, "mem" where time > now() - 1h`, want: []string{"cpu", "mem"}},
+		{name: "multiple without space", q: `select * from cpu,mem`, want: []string{"cpu", "mem"}},
+		{name: "multiple with rp", q: `select * from db.rp.cpu,db..mem group by time(1m)`, want: []string{"cpu", "mem"}},
+		{name: "regex", q: `select * from /cpu.*/ limit 10`, want: []string{"/cpu.*/"}},
+		{name: "regex with rp", q: `select * from db.rp./^cpu$/`, want: []string{"/^cpu$/"}},
+		{name: "subquery", q: `select mean(v) from (select * from cpu, mem) group by time(1m)`, want: []string{"cpu", "mem"}},
+		{name: "nested subquery", q: `select count(x) from(select x from (select x from cpu, /mem.*/))`, want: []string{"cpu", "/mem.*/"}},
+		{name: "multiple subqueries", q: `select mean(x) from (select x from cpu), (select y from db.rp.mem) where time > 0`, want: []string{"cpu", "mem"}},
+		{name: "show", q: `show tag values from cpu, mem with key = "host"`, want: []string{"cpu", "mem"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetMeasurementsFromInfluxQL(tt.q)
+			if err != nil {
+				t.Errorf("error: %s, %s", tt.q, err)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("measurements wrong: %s, %v != %v", tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSourcesFromInfluxQL(t *testing.T) {
+	tests := []struct {
+		name string
+		q    string
+		dbs  []string
+		mms  []string
+	}{
+		{name: "unqualified", q: `select * from cpu, mem`, dbs: []string{"", ""}, mms: []string{"cpu", "mem"}},
+		{name: "cross database", q: `select * from "db1"."rp"."cpu", "db2".."mem"`, dbs: []string{"db1", "db2"}, mms: []string{"cpu", "mem"}},
+		{name: "mixed", q: `select * from cpu, db2.rp.mem where time > 0`, dbs: []string{"", "db2"}, mms: []string{"cpu", "mem"}},
+		{name: "rp only", q: `select * from rp.cpu`, dbs: []string{""}, mms: []string{"cpu"}},
+		{name: "regex", q: `select * from db1.rp./cpu.*/`, dbs: []string{"db1"}, mms: []string{"/cpu.*/"}},
+		{name: "subquery", q: `select mean(v) from (select * from db1..cpu, db2..mem) group by time(1m)`, dbs: []string{"db1", "db2"}, mms: []string{"cpu", "mem"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbs, mms, err := GetSourcesFromInfluxQL(tt.q)
+			if err != nil {
+				t.Errorf("error: %s, %s", tt.q, err)
+				return
+			}
+			if !reflect.DeepEqual(dbs, tt.dbs) || !reflect.DeepEqual(mms, tt.mms) {
+				t.Errorf("sources wrong: %s, %v %v != %v %v", tt.q, dbs, mms, tt.dbs, tt.mms)
+			}
+		})
+	}
+}
+
+func TestIsCrossDatabase(t *testing.T) {
+	tests := []struct {
+		name string
+		dbs  []string
+		db   string
+		want bool
+	}{
+		{name: "unqualified", dbs: []string{"", ""}, db: "db1", want: false},
+		{name: "same database", dbs: []string{"db1", ""}, db: "db1", want: false},
+		{name: "other database", dbs: []string{"db1", "db2"}, db: "db1", want: true},
+		{name: "default database", dbs: []string{"", "db2"}, db: "db1", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsCrossDatabase(tt.dbs, tt.db); got != tt.want {
+				t.Errorf("IsCrossDatabase() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{q: `select * from cpu`, want: []string{"select * from cpu"}},
+		{q: `select * from cpu;`, want: []string{"select * from cpu"}},
+		{q: `select * from cpu; show measurements ;; `, want: []string{"select * from cpu", "show measurements"}},
+		{q: `select * from "c;pu" where a = 'x;\'y'; select * from mem`, want: []string{`select * from "c;pu" where a = 'x;\'y'`, "select * from mem"}},
+	}
+	for _, tt := range tests {
+		if got := SplitStatements(tt.q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("statements wrong: %s, %q != %q", tt.q, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+var ErrIllegalInto = errors.New("illegal into clause")
+
+var intoRegexp = regexp.MustCompile(`(?is)^\s*(select\s.+?)\s+into\s+(.+?)\s+(from\s.+)$`)
+
+// IntoTarget is the destination of select into, measurement :MEASUREMENT means the name of source measurement
+type IntoTarget struct {
+	Db          string
+	Rp          string
+	Measurement string
+}
+
+func CheckIntoFromTokens(tokens []string) bool {
+	if strings.ToLower(tokens[0]) != "select" {
+		return false
+	}
+	for i := 2; i < len(tokens); i++ {
+		stmt := strings.ToLower(tokens[i])
+		if stmt == "into" {
+			return true
+		}
+		if stmt == "from" {
+			return false
+		}
+	}
+	return false
+}
+
+// ParseIntoQuery splits select into to the source query and the target, db is the default target database
+func ParseIntoQuery(q, db string) (source string, target *IntoTarget, err error) {
+	matches := intoRegexp.FindStringSubmatch(strings.TrimRight(strings.TrimSpace(q), "; "))
+	if matches == nil {
+		return "", nil, ErrIllegalInto
+	}
+	source = matches[1] + " " + matches[3]
+
+	var parts []string
+	var part string
+	for _, token := range ScanTokens(matches[2], 0) {
+		if token == "." {
+			parts = append(parts, part)
+			part = ""
+			continue
+		}
+		if token[0] == '"' || token[0] == '\'' {
+			token = util.UnescapeIdentifier(token[1 : len(token)-1])
+		}
+		part += token
+	}
+	parts = append(parts, part)
+
+	target = &IntoTarget{Db: db}
+	switch len(parts) {
+	case 1:
+		target.Measurement = parts[0]
+	case 2:
+		target.Rp, target.Measurement = parts[0], parts[1]
+	case 3:
+		target.Db, target.Rp, target.Measurement = parts[0], parts[1], parts[2]
+		if target.Db == "" {
+			target.Db = db
+		}
+	default:
+		return "", nil, ErrIllegalInto
+	}
+	if target.Measurement == "" {
+		return "", nil, ErrIllegalInto
+	}
+	if strings.EqualFold(target.Measurement, ":MEASUREMENT") {
+		target.Measurement = ":MEASUREMENT"
+	}
+	return
+}
+
+// SeriesToLines converts the series queried with epoch ns to line protocol, numbers are written as float
+// unless the field is integer in fieldTypes
+func SeriesToLines(series models.Rows, target *IntoTarget, fieldTypes map[string]string) (p []byte, n int) {
+	var buf bytes.Buffer
+	for _, serie := range series {
+		meas := target.Measurement
+		if meas == ":MEASUREMENT" {
+			meas = serie.Name
+		}
+		tagKeys := make([]string, 0, len(serie.Tags))
+		for k := range serie.Tags {
+			tagKeys = append(tagKeys, k)
+		}
+		sort.Strings(tagKeys)
+		var mtag strings.Builder
+		mtag.WriteString(util.EscapeMeasurement(meas))
+		for _, k := range tagKeys {
+			if serie.Tags[k] != "" {
+				mtag.WriteString(fmt.Sprintf(",%s=%s", util.EscapeTag(k), util.EscapeTag(serie.Tags[k])))
+			}
+		}
+		for _, value := range serie.Values {
+			fieldSet := make([]string, 0, len(value))
+			for i := 1; i < len(value) && i < len(serie.Columns); i++ {
+				k := util.EscapeTag(serie.Columns[i])
+				switch v := value[i].(type) {
+				case json.Number:
+					if fieldTypes[serie.Columns[i]] == "integer" {
+						fieldSet = append(fieldSet, fmt.Sprintf("%s=%si", k, v))
+					} else {
+						fieldSet = append(fieldSet, fmt.Sprintf("%s=%s", k, v))
+					}
+				case string:
+					fieldSet = append(fieldSet, fmt.Sprintf("%s=\"%s\"", k, models.EscapeStringField(v)))
+				case bool:
+					fieldSet = append(fieldSet, fmt.Sprintf("%s=%t", k, v))
+				}
+			}
+			if len(fieldSet) == 0 {
+				continue
+			}
+			buf.WriteString(fmt.Sprintf("%s %s %s\n", mtag.String(), strings.Join(fieldSet, ","), util.CastString(value[0])))
+			n++
+		}
+	}
+	return buf.Bytes(), n
+}
+
+func QueryIntoQL(w http.ResponseWriter, req *http.Request, ip *Proxy, db string) (body []byte, err error) {
+	// all circles -> backends of source -> select, and write the results by the ring
+	source, target, err := ParseIntoQuery(req.FormValue("q"), db)
+	if err != nil {
+		return
+	}
+	if ip.IsForbiddenDB(target.Db) {
+		return nil, fmt.Errorf("database forbidden: %s", target.Db)
+	}
+
+	sreq := CloneQueryRequest(req)
+	sreq.Form.Set("q", source)
+	sreq.Form.Set("epoch", "ns")
+	sreq.Form.Del("chunked")
+	sreq.Header.Del("Accept-Encoding")
+	sbody, err := QueryFromQL(unstream(w), sreq, ip, ScanTokens(source, 0), db)
+	if err != nil {
+		return
+	}
+	rsp, err := ResponseFromResponseBytes(sbody)
+	if err != nil {
+		return
+	}
+	if rsp.Err != "" {
+		return nil, errors.New(rsp.Err)
+	}
+
+	var fieldTypes map[string]string
+	if target.Measurement != ":MEASUREMENT" {
+		fieldTypes = ip.getFieldTypes(target.Db, target.Rp, target.Measurement)
+	}
+	written := 0
+	for _, r := range rsp.Results {
+		if r.Err != "" {
+			return nil, errors.New(r.Err)
+		}
+		p, n := SeriesToLines(r.Series, target, fieldTypes)
+		if n == 0 {
+			continue
+		}
+		err = ip.Write(p, target.Db, target.Rp, "ns")
+		if err != nil {
+			return
+		}
+		written += n
+	}
+	w.Header().Del("Content-Encoding")
+	series := models.Rows{{Name: "result", Columns: []string{"time", "written"}, Values: [][]interface{}{{0, written}}}}
+	return marshalResponse(w, req, ResponseFromSeries(series))
+}
+
+// getFieldTypes returns the field types of the existing measurement, so that integer fields keep integer
+func (ip *Proxy) getFieldTypes(db, rp, meas string) map[string]string {
+	for _, be := range ip.GetBackendsByMeasurement(db, meas) {
+		if !be.IsActive() {
+			continue
+		}
+		if fieldTypes, err := be.GetFieldTypes(db, rp, meas); err == nil {
+			return fieldTypes
+		}
+	}
+	return make(map[string]string)
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIntoQuery(t *testing.T) {
+	tests := []struct {
+		q      string
+		source string
+		target *IntoTarget
+	}{
+		{
+			q:      `SELECT mean("value") INTO "cpu_1h" FROM "cpu" GROUP BY time(1h), *`,
+			source: `SELECT mean("value") FROM "cpu" GROUP BY time(1h), *`,
+			target: &IntoTarget{Db: "db", Measurement: "cpu_1h"},
+		},
+		{
+			q:      `select mean(value) into rp1.cpu_1h from cpu group by time(1h)`,
+			source: `select mean(value) from cpu group by time(1h)`,
+			target: &IntoTarget{Db: "db", Rp: "rp1", Measurement: "cpu_1h"},
+		},
+		{
+			q:      `SELECT mean("value") INTO "db2"."rp 1"."cpu.1h" FROM cpu`,
+			source: `SELECT mean("value") FROM cpu`,
+			target: &IntoTarget{Db: "db2", Rp: "rp 1", Measurement: "cpu.1h"},
+		},
+		{
+			q:      `SELECT mean("value") INTO db2..cpu_1h FROM cpu;`,
+			source: `SELECT mean("value") FROM cpu`,
+			target: &IntoTarget{Db: "db2", Measurement: "cpu_1h"},
+		},
+		{
+			q:      `SELECT mean("value") INTO "cpu_1h".:measurement FROM /cpu.*/`,
+			source: `SELECT mean("value") FROM /cpu.*/`,
+			target: &IntoTarget{Db: "db", Rp: "cpu_1h", Measurement: ":MEASUREMENT"},
+		},
+	}
+	for _, tt := range tests {
+		source, target, err := ParseIntoQuery(tt.q, "db")
+		if err != nil {
+			t.Errorf("error: %s, %s", tt.q, err)
+			continue
+		}
+		if source != tt.source || !reflect.DeepEqual(target, tt.target) {
+			t.Errorf("into wrong: %s, %s %+v != %s %+v", tt.q, source, target, tt.source, tt.target)
+		}
+	}
+	if _, _, err := ParseIntoQuery(`SELECT * INTO a.b.c.d FROM cpu`, "db"); err != ErrIllegalInto {
+		t.Errorf("illegal into accepted: %v", err)
+	}
+}
+
+func TestSeriesToLines(t *testing.T) {
+	body := `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"region":"us west","host":"a"},"columns":["time","mean","count","last"],"values":[[1000,1.5,2,"ok"],[2000,null,null,null],[3000,2,1,"a \"b\""]]}]}]}`
+	series, err := SeriesFromResponseBytes([]byte(body))
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	p, n := SeriesToLines(series, &IntoTarget{Measurement: ":MEASUREMENT"}, map[string]string{"count": "integer"})
+	want := "cpu,host=a,region=us\\ west mean=1.5,count=2i,last=\"ok\" 1000\n" +
+		"cpu,host=a,region=us\\ west mean=2,count=1i,last=\"a \\\"b\\\"\" 3000\n"
+	if string(p) != want || n != 2 {
+		t.Errorf("lines wrong: %d %s", n, p)
+	}
+}
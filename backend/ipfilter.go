@@ -0,0 +1,86 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var ErrInvalidCidr = errors.New("invalid cidr, require cidr like 10.0.0.0/8 or ip in allow and deny lists")
+
+// IPFilter restricts the client ips of an endpoint group, the ip is allowed if it's in the allow list
+// or the allow list is empty, and it's not in the deny list
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter returns nil if both lists are empty, the ip without prefix length matches itself only
+func NewIPFilter(allow, deny []string) (f *IPFilter, err error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	f = &IPFilter{}
+	if f.allow, err = parseCidrs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCidrs(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseCidrs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, ErrInvalidCidr
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, ErrInvalidCidr
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// Allows returns whether the ip of remote addr like host:port is allowed
+func (f *IPFilter) Allows(addr string) bool {
+	if f == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
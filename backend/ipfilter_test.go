@@ -0,0 +1,62 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		addr  string
+		want  bool
+	}{
+		{name: "no lists", addr: "10.1.1.1:8086", want: true},
+		{name: "allowed", allow: []string{"10.0.0.0/8"}, addr: "10.1.1.1:8086", want: true},
+		{name: "not allowed", allow: []string{"10.0.0.0/8"}, addr: "192.168.1.1:8086", want: false},
+		{name: "single ip", allow: []string{"192.168.1.1"}, addr: "192.168.1.1:8086", want: true},
+		{name: "single ip mismatched", allow: []string{"192.168.1.1"}, addr: "192.168.1.2:8086", want: false},
+		{name: "denied", allow: []string{"10.0.0.0/8"}, deny: []string{"10.1.0.0/16"}, addr: "10.1.1.1:8086", want: false},
+		{name: "deny only", deny: []string{"10.1.0.0/16"}, addr: "10.2.1.1:8086", want: true},
+		{name: "ipv6", allow: []string{"fd00::/8"}, addr: "[fd00::1]:8086", want: true},
+		{name: "ipv4 mapped", allow: []string{"10.0.0.0/8"}, addr: "[::ffff:10.1.1.1]:8086", want: true},
+		{name: "no port", allow: []string{"10.0.0.0/8"}, addr: "10.1.1.1", want: true},
+		{name: "invalid addr", allow: []string{"10.0.0.0/8"}, addr: "@", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewIPFilter(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Allows(tt.addr); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewIPFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		err   error
+	}{
+		{name: "valid", allow: []string{"10.0.0.0/8", "::1"}, deny: []string{"10.1.1.1"}},
+		{name: "invalid cidr", allow: []string{"10.0.0.0/33"}, err: ErrInvalidCidr},
+		{name: "invalid ip", deny: []string{"10.0.0"}, err: ErrInvalidCidr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewIPFilter(tt.allow, tt.deny); err != tt.err {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
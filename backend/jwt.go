@@ -0,0 +1,108 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken  = errors.New("invalid jwt token")
+	ErrInvalidSign   = errors.New("invalid jwt signature")
+	ErrTokenExpired  = errors.New("jwt token expired")
+	ErrTokenNoExpiry = errors.New("jwt token requires exp claim")
+	ErrTokenNoUser   = errors.New("jwt token requires username claim")
+)
+
+var jwtHashes = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// jwtToken is the token split into the header, the payload and the signature
+type jwtToken struct {
+	alg     string
+	kid     string
+	payload string
+	input   []byte
+	sign    []byte
+}
+
+func splitJWT(token string) (*jwtToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	sign, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return nil, ErrInvalidSign
+	}
+	return &jwtToken{alg: header.Alg, kid: header.Kid, payload: parts[1], input: []byte(parts[0] + "." + parts[1]), sign: sign}, nil
+}
+
+// IsHmacJWT returns whether the token is signed with hmac, which is verified by shared secret rather than oidc
+func IsHmacJWT(token string) bool {
+	jt, err := splitJWT(token)
+	return err == nil && jwtHashes[jt.alg] != nil
+}
+
+// ParseJWT verifies the token signed by secret with hmac as influxdb 1.x, and returns the username claim.
+// The token requires the exp claim in unix seconds
+func ParseJWT(token, secret string, now time.Time) (string, error) {
+	jt, err := splitJWT(token)
+	if err != nil {
+		return "", err
+	}
+	fn, ok := jwtHashes[jt.alg]
+	if !ok {
+		return "", ErrInvalidToken
+	}
+	mac := hmac.New(fn, []byte(secret))
+	mac.Write(jt.input)
+	if !hmac.Equal(jt.sign, mac.Sum(nil)) {
+		return "", ErrInvalidSign
+	}
+	var claims struct {
+		Username string  `json:"username"`
+		Exp      float64 `json:"exp"`
+	}
+	if err = decodeSegment(jt.payload, &claims); err != nil {
+		return "", ErrInvalidToken
+	}
+	if claims.Exp == 0 {
+		return "", ErrTokenNoExpiry
+	}
+	if now.Unix() >= int64(claims.Exp) {
+		return "", ErrTokenExpired
+	}
+	if claims.Username == "" {
+		return "", ErrTokenNoUser
+	}
+	return claims.Username, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func signJWT(header, claims, secret string) string {
+	s := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(s))
+	return s + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestParseJWT(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	header := `{"alg":"HS256","typ":"JWT"}`
+	tests := []struct {
+		name  string
+		token string
+		want  string
+		err   error
+	}{
+		{
+			name:  "valid",
+			token: signJWT(header, `{"username":"u1","exp":1600000060}`, "secret"),
+			want:  "u1",
+		},
+		{
+			name:  "expired",
+			token: signJWT(header, `{"username":"u1","exp":1600000000}`, "secret"),
+			err:   ErrTokenExpired,
+		},
+		{
+			name:  "no expiry",
+			token: signJWT(header, `{"username":"u1"}`, "secret"),
+			err:   ErrTokenNoExpiry,
+		},
+		{
+			name:  "no username",
+			token: signJWT(header, `{"exp":1600000060}`, "secret"),
+			err:   ErrTokenNoUser,
+		},
+		{
+			name:  "wrong secret",
+			token: signJWT(header, `{"username":"u1","exp":1600000060}`, "other"),
+			err:   ErrInvalidSign,
+		},
+		{
+			name:  "alg none",
+			token: signJWT(`{"alg":"none"}`, `{"username":"u1","exp":1600000060}`, "secret"),
+			err:   ErrInvalidToken,
+		},
+		{
+			name:  "malformed",
+			token: "abc.def",
+			err:   ErrInvalidToken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseJWT(tt.token, "secret", now)
+			if got != tt.want || err != tt.err {
+				t.Errorf("got %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidLdap     = errors.New("invalid ldap, require ldap or ldaps url, ldap_user_dn with %s and valid privileges of ldap_group_grants")
+	ErrLdapBindFailed  = errors.New("ldap bind failed")
+	ErrLdapBadResponse = errors.New("ldap bad response")
+)
+
+// LdapTimeout is the timeout of connection to ldap server
+var LdapTimeout = 10 * time.Second
+
+const (
+	ldapBindRequest   = 0x60
+	ldapBindResponse  = 0x61
+	ldapUnbindRequest = 0x42
+	ldapSearchRequest = 0x63
+	ldapSearchEntry   = 0x64
+	ldapSearchDone    = 0x65
+	ldapSearchRef     = 0x73
+)
+
+// Ldap authenticates the users by simple bind with the dn of ldap_user_dn, and maps the groups whose
+// ldap_group_attribute contains the dn of user to the admin and grants
+type Ldap struct {
+	url         *url.URL
+	userDn      string
+	groupBaseDn string
+	groupAttr   string
+	adminGroups map[string]bool
+	groupGrants map[string]Grants
+	cacheTTL    time.Duration
+	cache       map[string]*ldapEntry
+	lock        sync.Mutex
+}
+
+type ldapEntry struct {
+	hash   [sha256.Size]byte
+	user   *UserConfig
+	expire time.Time
+}
+
+// CheckLdap checks the ldap options of config
+func CheckLdap(cfg *ProxyConfig) error {
+	if cfg.LdapUrl == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.LdapUrl)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" || strings.Count(cfg.LdapUserDn, "%s") != 1 {
+		return ErrInvalidLdap
+	}
+	for _, grants := range cfg.LdapGroupGrants {
+		for _, privilege := range grants {
+			if CheckPrivilege(privilege) != nil {
+				return ErrInvalidLdap
+			}
+		}
+	}
+	return nil
+}
+
+// NewLdap returns nil if ldap_url is empty
+func NewLdap(cfg *ProxyConfig) *Ldap {
+	if cfg.LdapUrl == "" {
+		return nil
+	}
+	u, _ := url.Parse(cfg.LdapUrl)
+	if u.Port() == "" {
+		if u.Scheme == "ldaps" {
+			u.Host = net.JoinHostPort(u.Host, "636")
+		} else {
+			u.Host = net.JoinHostPort(u.Host, "389")
+		}
+	}
+	l := &Ldap{
+		url:         u,
+		userDn:      cfg.LdapUserDn,
+		groupBaseDn: cfg.LdapGroupBaseDn,
+		groupAttr:   cfg.LdapGroupAttr,
+		adminGroups: make(map[string]bool),
+		groupGrants: cfg.LdapGroupGrants,
+		cacheTTL:    time.Duration(cfg.LdapCacheTTL) * time.Second,
+		cache:       make(map[string]*ldapEntry),
+	}
+	for _, group := range cfg.LdapAdminGroups {
+		l.adminGroups[group] = true
+	}
+	return l
+}
+
+// Authenticate binds with the username and password, the user authenticated is cached for ldap_cache_ttl
+func (l *Ldap) Authenticate(username, password string) (*UserConfig, error) {
+	// the bind without password is an unauthenticated bind which always succeeds
+	if username == "" || password == "" {
+		return nil, ErrLdapBindFailed
+	}
+	hash := sha256.Sum256([]byte(username + "\x00" + password))
+	l.lock.Lock()
+	entry, ok := l.cache[username]
+	l.lock.Unlock()
+	if ok && entry.hash == hash && time.Now().Before(entry.expire) {
+		return entry.user, nil
+	}
+
+	groups, err := l.bind(username, password)
+	if err != nil {
+		return nil, err
+	}
+	user := newGroupUser(username, groups, l.adminGroups, l.groupGrants)
+	if l.cacheTTL > 0 {
+		l.lock.Lock()
+		l.cache[username] = &ldapEntry{hash: hash, user: user, expire: time.Now().Add(l.cacheTTL)}
+		l.lock.Unlock()
+	}
+	return user, nil
+}
+
+// bind binds as the user and returns the cn of groups of the user
+func (l *Ldap) bind(username, password string) ([]string, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: LdapTimeout}
+	if l.url.Scheme == "ldaps" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", l.url.Host, &tls.Config{ServerName: l.url.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", l.url.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(LdapTimeout))
+	r := bufio.NewReader(conn)
+
+	dn := fmt.Sprintf(l.userDn, escapeDn(username))
+	bind := berTLV(ldapBindRequest, berInt(0x02, 3), berString(0x04, dn), berString(0x80, password))
+	if _, err = conn.Write(berTLV(0x30, berInt(0x02, 1), bind)); err != nil {
+		return nil, err
+	}
+	op, err := readLdapMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if op.tag != ldapBindResponse {
+		return nil, ErrLdapBadResponse
+	}
+	if code, err := ldapResultCode(op); err != nil || code != 0 {
+		return nil, ErrLdapBindFailed
+	}
+
+	var groups []string
+	if l.groupBaseDn != "" {
+		if groups, err = l.searchGroups(conn, r, dn); err != nil {
+			return nil, err
+		}
+	}
+	conn.Write(berTLV(0x30, berInt(0x02, 3), berTLV(ldapUnbindRequest)))
+	return groups, nil
+}
+
+func (l *Ldap) searchGroups(conn net.Conn, r *bufio.Reader, dn string) ([]string, error) {
+	filter := berTLV(0xa3, berString(0x04, l.groupAttr), berString(0x04, dn))
+	search := berTLV(ldapSearchRequest,
+		berString(0x04, l.groupBaseDn),
+		berInt(0x0a, 2), // whole subtree
+		berInt(0x0a, 0), // never deref aliases
+		berInt(0x02, 0),
+		berInt(0x02, int(LdapTimeout/time.Second)),
+		berTLV(0x01, 0x00),
+		filter,
+		berTLV(0x30, berString(0x04, "cn")),
+	)
+	if _, err := conn.Write(berTLV(0x30, berInt(0x02, 2), search)); err != nil {
+		return nil, err
+	}
+	var groups []string
+	for {
+		op, err := readLdapMessage(r)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchEntry:
+			elems, err := berParse(op.value)
+			if err != nil || len(elems) < 2 {
+				return nil, ErrLdapBadResponse
+			}
+			attrs, err := berParse(elems[1].value)
+			if err != nil {
+				return nil, ErrLdapBadResponse
+			}
+			for _, attr := range attrs {
+				parts, err := berParse(attr.value)
+				if err != nil || len(parts) < 2 || !strings.EqualFold(string(parts[0].value), "cn") {
+					continue
+				}
+				vals, _ := berParse(parts[1].value)
+				for _, val := range vals {
+					groups = append(groups, string(val.value))
+				}
+			}
+		case ldapSearchRef:
+			// the referrals are not followed
+		case ldapSearchDone:
+			if code, err := ldapResultCode(op); err != nil || code != 0 {
+				return nil, ErrLdapBadResponse
+			}
+			return groups, nil
+		default:
+			return nil, ErrLdapBadResponse
+		}
+	}
+}
+
+// escapeDn escapes the special characters of attribute value in dn
+func escapeDn(s string) string {
+	var b strings.Builder
+	for i, c := range s {
+		switch {
+		case strings.ContainsRune(",+\"\\<>;=", c), c == '#' && i == 0, c == ' ' && (i == 0 || i == len(s)-1):
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c == 0:
+			b.WriteString("\\00")
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+type berElem struct {
+	tag   byte
+	value []byte
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berTLV(tag byte, values ...interface{}) []byte {
+	var value []byte
+	for _, v := range values {
+		switch tv := v.(type) {
+		case []byte:
+			value = append(value, tv...)
+		case byte:
+			value = append(value, tv)
+		case int:
+			value = append(value, byte(tv))
+		}
+	}
+	b := append([]byte{tag}, berLength(len(value))...)
+	return append(b, value...)
+}
+
+func berInt(tag byte, n int) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	// the non-negative integer requires the high bit cleared
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+func berRead(r io.Reader) (*berElem, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	n := int(head[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 {
+			return nil, ErrLdapBadResponse
+		}
+		lb := make([]byte, size)
+		if _, err := io.ReadFull(r, lb); err != nil {
+			return nil, err
+		}
+		n = 0
+		for _, c := range lb {
+			n = n<<8 | int(c)
+		}
+	}
+	value := make([]byte, n)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+	return &berElem{tag: head[0], value: value}, nil
+}
+
+func berParse(b []byte) ([]*berElem, error) {
+	var elems []*berElem
+	r := strings.NewReader(string(b))
+	for r.Len() > 0 {
+		elem, err := berRead(r)
+		if err != nil {
+			return nil, ErrLdapBadResponse
+		}
+		elems = append(elems, elem)
+	}
+	return elems, nil
+}
+
+// readLdapMessage returns the protocol op of the next ldap message
+func readLdapMessage(r io.Reader) (*berElem, error) {
+	msg, err := berRead(r)
+	if err != nil {
+		return nil, err
+	}
+	elems, err := berParse(msg.value)
+	if err != nil || msg.tag != 0x30 || len(elems) < 2 {
+		return nil, ErrLdapBadResponse
+	}
+	return elems[1], nil
+}
+
+// ldapResultCode returns the result code of ldap result
+func ldapResultCode(op *berElem) (int, error) {
+	elems, err := berParse(op.value)
+	if err != nil || len(elems) == 0 || elems[0].tag != 0x0a {
+		return 0, ErrLdapBadResponse
+	}
+	code := 0
+	for _, c := range elems[0].value {
+		code = code<<8 | int(c)
+	}
+	return code, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// serveLdap serves the binds of uid=<name>,ou=people,dc=example with the password p-<name>, and the groups of
+// member uid=u1 are admins and dev
+func serveLdap(ln net.Listener, binds *int32) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				msg, err := berRead(r)
+				if err != nil {
+					return
+				}
+				elems, _ := berParse(msg.value)
+				id, op := elems[0].value[0], elems[1]
+				switch op.tag {
+				case ldapBindRequest:
+					atomic.AddInt32(binds, 1)
+					parts, _ := berParse(op.value)
+					dn, password := string(parts[1].value), string(parts[2].value)
+					code := 49
+					if (dn == "uid=u1,ou=people,dc=example" && password == "p-u1") || (dn == "uid=u2,ou=people,dc=example" && password == "p-u2") {
+						code = 0
+					}
+					conn.Write(berTLV(0x30, berInt(0x02, int(id)), berTLV(ldapBindResponse, berInt(0x0a, code), berString(0x04, ""), berString(0x04, ""))))
+				case ldapSearchRequest:
+					parts, _ := berParse(op.value)
+					filter, _ := berParse(parts[6].value)
+					if string(filter[0].value) == "member" && string(filter[1].value) == "uid=u1,ou=people,dc=example" {
+						for _, group := range []string{"admins", "dev"} {
+							attr := berTLV(0x30, berString(0x04, "cn"), berTLV(0x31, berString(0x04, group)))
+							conn.Write(berTLV(0x30, berInt(0x02, int(id)), berTLV(ldapSearchEntry, berString(0x04, "cn="+group+",ou=groups,dc=example"), berTLV(0x30, attr))))
+						}
+					}
+					conn.Write(berTLV(0x30, berInt(0x02, int(id)), berTLV(ldapSearchDone, berInt(0x0a, 0), berString(0x04, ""), berString(0x04, ""))))
+				case ldapUnbindRequest:
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+func TestLdap(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var binds int32
+	go serveLdap(ln, &binds)
+
+	cfg := &ProxyConfig{
+		LdapUrl:         "ldap://" + ln.Addr().String(),
+		LdapUserDn:      "uid=%s,ou=people,dc=example",
+		LdapGroupBaseDn: "ou=groups,dc=example",
+		LdapGroupAttr:   "member",
+		LdapAdminGroups: []string{"admins"},
+		LdapGroupGrants: map[string]Grants{"dev": {"db1": PrivilegeRead}, "ops": {"db2": PrivilegeAll}},
+		LdapCacheTTL:    300,
+	}
+	if err := CheckLdap(cfg); err != nil {
+		t.Fatal(err)
+	}
+	l := NewLdap(cfg)
+	tests := []struct {
+		name     string
+		username string
+		password string
+		err      error
+		admin    bool
+		grants   Grants
+	}{
+		{name: "groups", username: "u1", password: "p-u1", admin: true, grants: Grants{"db1": PrivilegeRead}},
+		{name: "no group", username: "u2", password: "p-u2", grants: Grants{}},
+		{name: "wrong password", username: "u1", password: "p-u2", err: ErrLdapBindFailed},
+		{name: "empty password", username: "u1", password: "", err: ErrLdapBindFailed},
+		{name: "injection", username: "u1,ou=people", password: "p-u1", err: ErrLdapBindFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := l.Authenticate(tt.username, tt.password)
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if user.Admin != tt.admin || len(user.Grants) != len(tt.grants) || user.Grants["db1"] != tt.grants["db1"] {
+				t.Errorf("got %+v, want admin %t, grants %v", user, tt.admin, tt.grants)
+			}
+		})
+	}
+
+	// the user authenticated is cached, while the wrong password binds again
+	n := atomic.LoadInt32(&binds)
+	if _, err := l.Authenticate("u1", "p-u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Authenticate("u1", "p-u3"); err != ErrLdapBindFailed {
+		t.Fatalf("got error %v", err)
+	}
+	if got := atomic.LoadInt32(&binds); got != n+1 {
+		t.Errorf("binds: got %d, want %d", got, n+1)
+	}
+}
+
+func TestEscapeDn(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{s: "user", want: "user"},
+		{s: "a,b=c", want: `a\,b\=c`},
+		{s: "#a b ", want: `\#a b\ `},
+		{s: ` a+"\`, want: `\ a\+\"\\`},
+	}
+	for _, tt := range tests {
+		if got := escapeDn(tt.s); got != tt.want {
+			t.Errorf("escapeDn(%q): got %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"strings"
+)
+
+// QueryLimits truncates the query results at the proxy, zero means unlimited
+type QueryLimits struct {
+	MaxRowLimit      int
+	MaxSelectSeries  int
+	MaxSelectBuckets int
+}
+
+func NewQueryLimits(cfg *ProxyConfig) *QueryLimits {
+	return &QueryLimits{
+		MaxRowLimit:      cfg.MaxRowLimit,
+		MaxSelectSeries:  cfg.MaxSelectSeries,
+		MaxSelectBuckets: cfg.MaxSelectBuckets,
+	}
+}
+
+func (ql *QueryLimits) Enabled() bool {
+	return ql.MaxRowLimit > 0 || ql.MaxSelectSeries > 0 || ql.MaxSelectBuckets > 0
+}
+
+// Apply truncates the series and rows exceeding the limits and marks the results partial like influxd,
+// the buckets limit only applies to the series of GROUP BY time
+func (ql *QueryLimits) Apply(rsp *Response, groupByTime bool) {
+	for _, r := range rsp.Results {
+		if ql.MaxSelectSeries > 0 && len(r.Series) > ql.MaxSelectSeries {
+			r.Series = r.Series[:ql.MaxSelectSeries]
+			r.Partial = true
+		}
+		rows := 0
+		for i, serie := range r.Series {
+			if groupByTime && ql.MaxSelectBuckets > 0 && len(serie.Values) > ql.MaxSelectBuckets {
+				serie.Values = serie.Values[:ql.MaxSelectBuckets]
+				serie.Partial = true
+				r.Partial = true
+			}
+			if ql.MaxRowLimit > 0 && rows+len(serie.Values) > ql.MaxRowLimit {
+				if rows == ql.MaxRowLimit {
+					r.Series = r.Series[:i]
+					r.Partial = true
+					break
+				}
+				serie.Values = serie.Values[:ql.MaxRowLimit-rows]
+				serie.Partial = true
+				r.Series = r.Series[:i+1]
+				r.Partial = true
+				break
+			}
+			rows += len(serie.Values)
+		}
+	}
+}
+
+// IsGroupByTime returns true if the query groups by time intervals
+func IsGroupByTime(tokens []string) bool {
+	stmt := strings.ReplaceAll(GetHeadStmtFromTokens(tokens, 0), "time (", "time(")
+	i := strings.LastIndex(stmt, "group by ")
+	return i >= 0 && strings.Contains(stmt[i:], "time(")
+}
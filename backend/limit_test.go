@@ -0,0 +1,79 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+func TestQueryLimitsApply(t *testing.T) {
+	body := `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[1,1],[2,2],[3,3]]},{"name":"cpu","tags":{"host":"b"},"columns":["time","v"],"values":[[1,1],[2,2]]}]}]}`
+	tests := []struct {
+		name        string
+		limits      *QueryLimits
+		groupByTime bool
+		want        string
+	}{
+		{
+			name:   "unlimited",
+			limits: &QueryLimits{},
+			want:   body,
+		},
+		{
+			name:   "rows",
+			limits: &QueryLimits{MaxRowLimit: 4},
+			want:   `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[1,1],[2,2],[3,3]]},{"name":"cpu","tags":{"host":"b"},"columns":["time","v"],"values":[[1,1]],"partial":true}],"partial":true}]}`,
+		},
+		{
+			name:   "rows at series boundary",
+			limits: &QueryLimits{MaxRowLimit: 3},
+			want:   `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[1,1],[2,2],[3,3]]}],"partial":true}]}`,
+		},
+		{
+			name:   "series",
+			limits: &QueryLimits{MaxSelectSeries: 1},
+			want:   `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[1,1],[2,2],[3,3]]}],"partial":true}]}`,
+		},
+		{
+			name:        "buckets",
+			limits:      &QueryLimits{MaxSelectBuckets: 2},
+			groupByTime: true,
+			want:        `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[1,1],[2,2]],"partial":true},{"name":"cpu","tags":{"host":"b"},"columns":["time","v"],"values":[[1,1],[2,2]]}],"partial":true}]}`,
+		},
+		{
+			name:   "buckets without group by time",
+			limits: &QueryLimits{MaxSelectBuckets: 2},
+			want:   body,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp, _ := ResponseFromResponseBytes([]byte(body))
+			tt.limits.Apply(rsp, tt.groupByTime)
+			if got := string(util.MarshalJSON(rsp, false)); got != tt.want+"\n" {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsGroupByTime(t *testing.T) {
+	tests := []struct {
+		q    string
+		want bool
+	}{
+		{q: `select mean(v) from cpu group by time(1m)`, want: true},
+		{q: `SELECT mean(v) FROM cpu GROUP BY host, time (1m) fill(0)`, want: true},
+		{q: `SELECT mean(v) FROM cpu GROUP BY time (1m), host`, want: true},
+		{q: `select v from cpu group by host`, want: false},
+	}
+	for _, tt := range tests {
+		if got := IsGroupByTime(ScanTokens(tt.q, 0)); got != tt.want {
+			t.Errorf("group by time wrong: %s, %t != %t", tt.q, got, tt.want)
+		}
+	}
+}
@@ -15,9 +15,37 @@ import (
 )
 
 type LinePoint struct {
-	Db   string
-	Rp   string
-	Line []byte
+	Db        string
+	Rp        string
+	Precision string
+	Line      []byte
+}
+
+// ScanLines calls fn with a copy of every non-empty and non-comment line
+func ScanLines(p []byte, fn func(line []byte)) {
+	var (
+		pos   int
+		block []byte
+	)
+	for pos < len(p) {
+		pos, block = ScanLine(p, pos)
+		pos++
+
+		if len(block) == 0 {
+			continue
+		}
+		start := SkipWhitespace(block, 0)
+		if start >= len(block) || block[start] == '#' {
+			continue
+		}
+		if block[len(block)-1] == '\n' {
+			block = block[:len(block)-1]
+		}
+
+		line := make([]byte, len(block[start:]))
+		copy(line, block[start:])
+		fn(line)
+	}
 }
 
 func ScanKey(pointbuf []byte) (key string, err error) {
@@ -40,6 +68,37 @@ func ScanKey(pointbuf []byte) (key string, err error) {
 	return "", io.EOF
 }
 
+// ScanTagValue returns the unescaped value of tag key of the line, or empty if the tag doesn't exist
+func ScanTagValue(line []byte, key string) string {
+	var b strings.Builder
+	var k string
+	inKey := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line):
+			i++
+			b.WriteByte(line[i])
+		case c == ',' || c == ' ':
+			if !inKey && k == key {
+				return b.String()
+			}
+			if c == ' ' {
+				return ""
+			}
+			inKey = true
+			b.Reset()
+		case c == '=' && inKey:
+			inKey = false
+			k = b.String()
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return ""
+}
+
 func ScanTime(buf []byte) (int, bool) {
 	i := len(buf) - 1
 	for ; i >= 0; i-- {
@@ -72,6 +131,19 @@ func AppendNano(line []byte, precision string) []byte {
 	}
 }
 
+// AppendTime keeps the original precision, and appends the current time with the precision if no timestamp.
+// It always returns a new slice since AppendNano may modify the line in place.
+func AppendTime(line []byte, precision string) []byte {
+	line = bytes.TrimSpace(line)
+	buf := make([]byte, len(line), len(line)+20)
+	copy(buf, line)
+	if _, found := ScanTime(buf); found {
+		return buf
+	}
+	now := time.Now().UnixNano() / models.GetPrecisionMultiplier(precision)
+	return append(buf, []byte(" "+strconv.FormatInt(now, 10))...)
+}
+
 func Int64ToBytes(n int64) []byte {
 	return []byte(strconv.FormatInt(n, 10))
 }
@@ -215,6 +215,46 @@ func TestAppendNano(t *testing.T) {
 	}
 }
 
+func TestAppendTime(t *testing.T) {
+	tests := []struct {
+		name string
+		line []byte
+		unit string
+		want string
+	}{
+		{
+			name: "test1",
+			line: []byte(" cpu1 value=3,value2=4 1422568543702900257 "),
+			unit: "ns",
+			want: "cpu1 value=3,value2=4 1422568543702900257",
+		},
+		{
+			name: "test2",
+			line: []byte("cpu2 value=3,value2=4 1596819659"),
+			unit: "s",
+			want: "cpu2 value=3,value2=4 1596819659",
+		},
+		{
+			name: "test3",
+			line: []byte("cpu3 value=3,value2=4 443610"),
+			unit: "h",
+			want: "cpu3 value=3,value2=4 443610",
+		},
+	}
+	for _, tt := range tests {
+		got := AppendTime(tt.line, tt.unit)
+		if string(got) != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, string(got), tt.want)
+		}
+	}
+
+	got := AppendTime([]byte("cpu4 value=1"), "s")
+	pos, found := ScanTime(got)
+	if !found || len(got)-pos-1 != 10 {
+		t.Errorf("append time: got %v, want timestamp in seconds", string(got))
+	}
+}
+
 func BenchmarkAppendNano(b *testing.B) {
 	buf := &bytes.Buffer{}
 	for i := 0; i < b.N; i++ {
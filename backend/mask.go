@@ -0,0 +1,323 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+const (
+	MaskActionHash   = "hash"
+	MaskActionRedact = "redact"
+)
+
+var ErrInvalidMaskRule = errors.New("invalid mask rule, require name, action hash or redact, columns and valid regexp measurement")
+
+var (
+	// maskLiteralRegexp matches the string literals and the regexes compared, which are removed before the clauses are checked
+	maskLiteralRegexp = regexp.MustCompile(`'(?:[^'\\]|\\.)*'|[=!]~\s*/(?:[^/\\]|\\.)*/`)
+	maskIntoRegexp    = regexp.MustCompile(`(?i)\binto\b`)
+	maskWhereRegexp   = regexp.MustCompile(`(?is)\bwhere\b(.*?)(\bgroup\s+by\b|\border\s+by\b|\bs?limit\b|\bs?offset\b|\btz\s*\(|;|$)`)
+)
+
+// MaskRuleConfig masks the columns of tag keys or fields in the query responses of the users, the empty users
+// mean all users except admin, the empty db and measurement mean all
+type MaskRuleConfig struct {
+	Name        string   `mapstructure:"name"`
+	Users       []string `mapstructure:"users"`
+	Db          string   `mapstructure:"db"`
+	Measurement string   `mapstructure:"measurement"`
+	Columns     []string `mapstructure:"columns"`
+	Action      string   `mapstructure:"action"`
+}
+
+// MaskError is returned if the query renames a masked column, which isn't masked by the name of response column,
+// filters by a masked column, or writes the values selected into another measurement
+type MaskError struct {
+	Rule   string
+	Column string
+	Clause string
+}
+
+func (e *MaskError) Error() string {
+	switch {
+	case e.Clause == "into":
+		return fmt.Sprintf("query denied by mask rule %s: into is not allowed", e.Rule)
+	case e.Clause != "":
+		return fmt.Sprintf("query denied by mask rule %s: column %s is not allowed in %s", e.Rule, e.Column, e.Clause)
+	}
+	return fmt.Sprintf("query denied by mask rule %s: column %s is only allowed as it is", e.Rule, e.Column)
+}
+
+// MaskRule hashes or redacts the values of columns of the measurements matched
+type MaskRule struct {
+	name        string
+	users       util.Set
+	db          string
+	measurement *regexp.Regexp
+	columns     util.Set
+	renamed     map[string]*regexp.Regexp
+	referenced  map[string]*regexp.Regexp
+	hash        bool
+}
+
+func NewMaskRule(cfg *MaskRuleConfig) (rule *MaskRule, err error) {
+	if cfg.Name == "" || len(cfg.Columns) == 0 || (cfg.Action != MaskActionHash && cfg.Action != MaskActionRedact) {
+		return nil, ErrInvalidMaskRule
+	}
+	rule = &MaskRule{
+		name:       cfg.Name,
+		users:      util.NewSet(cfg.Users...),
+		db:         cfg.Db,
+		columns:    util.NewSet(cfg.Columns...),
+		renamed:    make(map[string]*regexp.Regexp),
+		referenced: make(map[string]*regexp.Regexp),
+		hash:       cfg.Action == MaskActionHash,
+	}
+	// the column in functions or with alias is renamed in the response
+	for _, column := range cfg.Columns {
+		c := regexp.QuoteMeta(column)
+		rule.renamed[column] = regexp.MustCompile(`(?i)(\(\s*"?` + c + `"?\s*[,)])|((^|[^\w"])"?` + c + `"?\s+as\b)`)
+		rule.referenced[column] = regexp.MustCompile(`(?i)(^|[^\w"])"?` + c + `"?([^\w"]|$)`)
+	}
+	if cfg.Measurement != "" {
+		if rule.measurement, err = regexp.Compile(cfg.Measurement); err != nil {
+			return nil, ErrInvalidMaskRule
+		}
+	}
+	return
+}
+
+// CheckMaskRules checks the mask rules
+func CheckMaskRules(cfg *ProxyConfig) error {
+	for _, mrcfg := range cfg.MaskRules {
+		if mrcfg == nil {
+			return ErrInvalidMaskRule
+		}
+		if _, err := NewMaskRule(mrcfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Masker masks the query responses of the users by the mask rules, the salt is prepended to the values hashed
+// so that the identifiers can't be found by hashing the guesses
+type Masker struct {
+	rules []*MaskRule
+	salt  string
+}
+
+// NewMasker returns nil if there is no mask rule, the rules are checked by config
+func NewMasker(cfg *ProxyConfig) *Masker {
+	if len(cfg.MaskRules) == 0 {
+		return nil
+	}
+	m := &Masker{salt: cfg.MaskSalt}
+	for _, mrcfg := range cfg.MaskRules {
+		rule, _ := NewMaskRule(mrcfg)
+		m.rules = append(m.rules, rule)
+	}
+	return m
+}
+
+// Lookup returns the masks of the user, or nil if no rule applies
+func (m *Masker) Lookup(user string) *Masks {
+	if m == nil {
+		return nil
+	}
+	var rules []*MaskRule
+	for _, rule := range m.rules {
+		if len(rule.users) == 0 || rule.users[user] {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return &Masks{rules: rules, salt: m.salt}
+}
+
+// Masks are the mask rules applied to the query responses of a user
+type Masks struct {
+	rules []*MaskRule
+	salt  string
+}
+
+type maskKey struct{}
+
+// WithMasks returns the request whose query responses are masked
+func WithMasks(req *http.Request, masks *Masks) *http.Request {
+	if masks == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), maskKey{}, masks))
+}
+
+// GetMasks returns the masks of request, or nil if it isn't masked
+func GetMasks(req *http.Request) *Masks {
+	masks, _ := req.Context().Value(maskKey{}).(*Masks)
+	return masks
+}
+
+// Check denies the query which renames any masked column by functions or aliases, filters by any masked column
+// in where clause so that the values can't be probed, or selects into another measurement which isn't masked
+func (masks *Masks) Check(q string) error {
+	if masks == nil {
+		return nil
+	}
+	stripped := maskLiteralRegexp.ReplaceAllString(q, " ''")
+	var wheres []string
+	for _, match := range maskWhereRegexp.FindAllStringSubmatch(stripped, -1) {
+		wheres = append(wheres, match[1])
+	}
+	for _, rule := range masks.rules {
+		if maskIntoRegexp.MatchString(stripped) {
+			return &MaskError{Rule: rule.name, Clause: "into"}
+		}
+		for column, re := range rule.renamed {
+			if re.MatchString(q) {
+				return &MaskError{Rule: rule.name, Column: column}
+			}
+		}
+		for column, re := range rule.referenced {
+			for _, where := range wheres {
+				if re.MatchString(where) {
+					return &MaskError{Rule: rule.name, Column: column, Clause: "where"}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// MaskResponse returns the body of query response masked by the masks of request, the response must be
+// json without chunks nor compression, the statements are taken by statement id to match the databases
+func MaskResponse(w http.ResponseWriter, req *http.Request, body []byte) ([]byte, error) {
+	masks := GetMasks(req)
+	if masks == nil {
+		return body, nil
+	}
+	rsp, err := ResponseFromResponseBytes(body)
+	if err != nil {
+		return nil, fmt.Errorf("mask response error: %s", err)
+	}
+	stmts := SplitStatements(req.FormValue("q"))
+	for _, result := range rsp.Results {
+		stmt := ""
+		if result.StatementID >= 0 && result.StatementID < len(stmts) {
+			stmt = stmts[result.StatementID]
+		}
+		tokens := ScanTokens(stmt, 0)
+		dbs := util.NewSet(req.FormValue("db"))
+		if db, err := GetDatabaseFromTokens(tokens); err == nil {
+			dbs.Add(db)
+		}
+		if sdbs, _, err := GetSourcesFromTokens(tokens); err == nil {
+			for _, db := range sdbs {
+				dbs.Add(db)
+			}
+		}
+		var rules []*MaskRule
+		for _, rule := range masks.rules {
+			if rule.db == "" || dbs[rule.db] {
+				rules = append(rules, rule)
+			}
+		}
+		showSeries := GetHeadStmtFromTokens(tokens, 2) == "show series"
+		showTagValues := GetHeadStmtFromTokens(tokens, 3) == "show tag values"
+		for _, row := range result.Series {
+			masks.maskRow(rules, row, showSeries, showTagValues)
+		}
+	}
+	w.Header().Del("Content-Length")
+	return util.MarshalJSON(rsp, req.URL.Query().Get("pretty") == "true"), nil
+}
+
+// maskRow masks the tags and the values of columns of the row, the series keys of show series and
+// the tag values of show tag values are masked by the tag keys
+func (masks *Masks) maskRow(rules []*MaskRule, row *models.Row, showSeries, showTagValues bool) {
+	for _, rule := range rules {
+		if rule.measurement != nil && !rule.measurement.MatchString(row.Name) && !showSeries {
+			continue
+		}
+		for key, value := range row.Tags {
+			if rule.columns[key] {
+				row.Tags[key] = masks.maskString(rule, value)
+			}
+		}
+		for i, column := range row.Columns {
+			switch {
+			case rule.columns[column]:
+				for _, values := range row.Values {
+					values[i] = masks.mask(rule, values[i])
+				}
+			case showSeries && column == "key":
+				for _, values := range row.Values {
+					values[i] = masks.maskSeriesKey(rule, values[i])
+				}
+			case showTagValues && column == "value" && i > 0 && row.Columns[0] == "key":
+				for _, values := range row.Values {
+					if key, ok := values[0].(string); ok && rule.columns[key] {
+						values[i] = masks.mask(rule, values[i])
+					}
+				}
+			}
+		}
+	}
+}
+
+func (masks *Masks) maskSeriesKey(rule *MaskRule, value interface{}) interface{} {
+	key, ok := value.(string)
+	if !ok {
+		return value
+	}
+	name, tags := models.ParseKeyBytes([]byte(key))
+	if rule.measurement != nil && !rule.measurement.MatchString(string(name)) {
+		return value
+	}
+	for i, tag := range tags {
+		if rule.columns[string(tag.Key)] {
+			tags[i].Value = []byte(masks.maskString(rule, string(tag.Value)))
+		}
+	}
+	return string(models.MakeKey(name, tags))
+}
+
+// mask hashes the value by sha256 or redacts it as null
+func (masks *Masks) mask(rule *MaskRule, value interface{}) interface{} {
+	if value == nil || !rule.hash {
+		return nil
+	}
+	return masks.maskString(rule, fmt.Sprint(value))
+}
+
+// maskString hashes the value by sha256 or redacts it as empty
+func (masks *Masks) maskString(rule *MaskRule, value string) string {
+	if !rule.hash || value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(masks.salt + value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// PrepareMasked makes the query response of request json without chunks nor compression to be masked
+func PrepareMasked(req *http.Request) {
+	if GetMasks(req) == nil {
+		return
+	}
+	req.Form.Del("chunked")
+	req.Header.Del("Accept-Encoding")
+	req.Header.Del("Accept")
+}
@@ -0,0 +1,183 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckMaskRules(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *ProxyConfig
+		want error
+	}{
+		{
+			name: "empty",
+			cfg:  &ProxyConfig{},
+			want: nil,
+		},
+		{
+			name: "rules",
+			cfg: &ProxyConfig{MaskRules: []*MaskRuleConfig{
+				{Name: "customer", Users: []string{"support"}, Db: "db1", Measurement: "^cpu", Columns: []string{"customer"}, Action: MaskActionHash},
+				{Name: "email", Columns: []string{"email"}, Action: MaskActionRedact},
+			}},
+			want: nil,
+		},
+		{
+			name: "nil rule",
+			cfg:  &ProxyConfig{MaskRules: []*MaskRuleConfig{nil}},
+			want: ErrInvalidMaskRule,
+		},
+		{
+			name: "no name",
+			cfg:  &ProxyConfig{MaskRules: []*MaskRuleConfig{{Columns: []string{"customer"}, Action: MaskActionHash}}},
+			want: ErrInvalidMaskRule,
+		},
+		{
+			name: "no columns",
+			cfg:  &ProxyConfig{MaskRules: []*MaskRuleConfig{{Name: "customer", Action: MaskActionHash}}},
+			want: ErrInvalidMaskRule,
+		},
+		{
+			name: "invalid action",
+			cfg:  &ProxyConfig{MaskRules: []*MaskRuleConfig{{Name: "customer", Columns: []string{"customer"}, Action: "drop"}}},
+			want: ErrInvalidMaskRule,
+		},
+		{
+			name: "invalid measurement",
+			cfg:  &ProxyConfig{MaskRules: []*MaskRuleConfig{{Name: "customer", Measurement: "(", Columns: []string{"customer"}, Action: MaskActionHash}}},
+			want: ErrInvalidMaskRule,
+		},
+	}
+	for _, tt := range tests {
+		if got := CheckMaskRules(tt.cfg); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMasksCheck(t *testing.T) {
+	masker := NewMasker(&ProxyConfig{MaskRules: []*MaskRuleConfig{{Name: "customer", Columns: []string{"customer"}, Action: MaskActionHash}}})
+	masks := masker.Lookup("support")
+	tests := []struct {
+		name   string
+		q      string
+		denied bool
+	}{
+		{name: "select", q: `select customer, value from cpu`, denied: false},
+		{name: "group by", q: `select mean(value) from cpu group by customer`, denied: false},
+		{name: "field named like", q: `select customer_id as c from cpu`, denied: false},
+		{name: "alias", q: `select customer AS c from cpu`, denied: true},
+		{name: "quoted alias", q: `select "customer" as c from cpu`, denied: true},
+		{name: "function", q: `select distinct(customer) from cpu`, denied: true},
+		{name: "function with args", q: `select top("customer", 3) from cpu`, denied: true},
+		{name: "into", q: `select * into cpu_copy from cpu`, denied: true},
+		{name: "into of another statement", q: `select value from mem; select customer into cpu_copy from cpu`, denied: true},
+		{name: "where", q: `select value from cpu where customer = 'acme'`, denied: true},
+		{name: "where quoted", q: `select value from cpu where time > now() - 1h and "customer" =~ /^a/ group by host`, denied: true},
+		{name: "where of another column", q: `select value from cpu where host = 'customer' group by customer`, denied: false},
+		{name: "where literal into", q: `select value from cpu where host = 'into' and customer_id = 1`, denied: false},
+		{name: "where of another statement", q: `select customer from cpu where host = 'a'; select value from mem where customer = 'acme'`, denied: true},
+	}
+	for _, tt := range tests {
+		if got := masks.Check(tt.q); (got != nil) != tt.denied {
+			t.Errorf("%s: got %v, want denied %v", tt.name, got, tt.denied)
+		}
+	}
+	if err := (*Masks)(nil).Check(`select distinct(customer) from cpu`); err != nil {
+		t.Errorf("nil masks: got %v", err)
+	}
+}
+
+func TestMaskResponse(t *testing.T) {
+	masker := NewMasker(&ProxyConfig{
+		MaskRules: []*MaskRuleConfig{
+			{Name: "customer", Users: []string{"support"}, Db: "db1", Measurement: "^cpu$", Columns: []string{"customer"}, Action: MaskActionHash},
+			{Name: "email", Columns: []string{"email"}, Action: MaskActionRedact},
+		},
+		MaskSalt: "salt",
+	})
+	if masks := masker.Lookup("other"); masks == nil || len(masks.rules) != 1 {
+		t.Fatalf("lookup other: got %+v", masks)
+	}
+	masks := masker.Lookup("support")
+	hash := masks.maskString(masks.rules[0], "acme")
+	if hash == "acme" || len(hash) != 16 {
+		t.Fatalf("hash: got %s", hash)
+	}
+	tests := []struct {
+		name string
+		db   string
+		q    string
+		body string
+		want string
+	}{
+		{
+			name: "select",
+			db:   "db1",
+			q:    "select * from cpu",
+			body: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","customer","email","value"],"values":[[1,"acme","a@acme.com",1]]}]}]}`,
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","customer","email","value"],"values":[[1,"` + hash + `",null,1]]}]}]}`,
+		},
+		{
+			name: "group by",
+			db:   "db1",
+			q:    "select mean(value) from cpu group by customer",
+			body: `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"customer":"acme"},"columns":["time","mean"],"values":[[1,1]]}]}]}`,
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"customer":"` + hash + `"},"columns":["time","mean"],"values":[[1,1]]}]}]}`,
+		},
+		{
+			name: "another db",
+			db:   "db2",
+			q:    "select * from cpu",
+			body: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","customer","email"],"values":[[1,"acme","a@acme.com"]]}]}]}`,
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","customer","email"],"values":[[1,"acme",null]]}]}]}`,
+		},
+		{
+			name: "another measurement",
+			db:   "db1",
+			q:    "select * from mem",
+			body: `{"results":[{"statement_id":0,"series":[{"name":"mem","columns":["time","customer"],"values":[[1,"acme"]]}]}]}`,
+			want: `{"results":[{"statement_id":0,"series":[{"name":"mem","columns":["time","customer"],"values":[[1,"acme"]]}]}]}`,
+		},
+		{
+			name: "show series",
+			db:   "db1",
+			q:    "show series",
+			body: `{"results":[{"statement_id":0,"series":[{"columns":["key"],"values":[["cpu,customer=acme,host=h1"],["mem,customer=acme"]]}]}]}`,
+			want: `{"results":[{"statement_id":0,"series":[{"columns":["key"],"values":[["cpu,customer=` + hash + `,host=h1"],["mem,customer=acme"]]}]}]}`,
+		},
+		{
+			name: "show tag values",
+			db:   "db1",
+			q:    "show tag values from cpu with key in (customer, host)",
+			body: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["key","value"],"values":[["customer","acme"],["host","h1"]]}]}]}`,
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["key","value"],"values":[["customer","` + hash + `"],["host","h1"]]}]}]}`,
+		},
+		{
+			name: "statements",
+			q:    "select * from db2..cpu; select * from db1..cpu",
+			body: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","customer"],"values":[[1,"acme"]]}]},{"statement_id":1,"series":[{"name":"cpu","columns":["time","customer"],"values":[[1,"acme"]]}]}]}`,
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","customer"],"values":[[1,"acme"]]}]},{"statement_id":1,"series":[{"name":"cpu","columns":["time","customer"],"values":[[1,"` + hash + `"]]}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/query?"+url.Values{"db": {tt.db}, "q": {tt.q}}.Encode(), nil)
+		req = WithMasks(req, masks)
+		got, err := MaskResponse(httptest.NewRecorder(), req, []byte(tt.body))
+		if err != nil {
+			t.Errorf("%s: error: %s", tt.name, err)
+			continue
+		}
+		if strings.TrimSpace(string(got)) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
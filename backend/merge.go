@@ -0,0 +1,217 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+// PushDownLimits returns the query sent to backends whose limit and slimit are added by offset and soffset without
+// offsets, since each backend only has a part of points and series, and the limits are applied again after merge
+func PushDownLimits(q string) (string, *ShowLimits) {
+	_, sl := StripLimits(q)
+	q = limitRegexp.ReplaceAllStringFunc(q, func(s string) string {
+		match := limitRegexp.FindStringSubmatch(s)
+		switch strings.ToLower(match[1]) {
+		case "limit":
+			return " " + match[1] + " " + strconv.Itoa(sl.Limit+sl.Offset)
+		case "slimit":
+			return " " + match[1] + " " + strconv.Itoa(sl.SLimit+sl.SOffset)
+		}
+		return ""
+	})
+	return q, sl
+}
+
+// applyLimits cuts the merged series of results by soffset and slimit, and their values by offset and limit,
+// the series without values left are removed
+func applyLimits(rsp *Response, sl *ShowLimits) {
+	for _, r := range rsp.Results {
+		start, end := bounds(len(r.Series), sl.SOffset, sl.SLimit)
+		r.Series = r.Series[start:end]
+		if sl.Offset == 0 && sl.Limit == 0 {
+			continue
+		}
+		series := r.Series[:0]
+		for _, serie := range r.Series {
+			start, end = bounds(len(serie.Values), sl.Offset, sl.Limit)
+			if serie.Values = serie.Values[start:end]; len(serie.Values) > 0 {
+				series = append(series, serie)
+			}
+		}
+		r.Series = series
+	}
+}
+
+// MergeResponses merges the results of the same query q from several backends statement by statement,
+// the series with the same name and tags are merged by time in order, so that GROUP BY time buckets stay aligned,
+// and the aggregates of the same bucket are combined if they are mergeable
+func MergeResponses(bodies [][]byte, desc bool, q string) (rsp *Response, err error) {
+	aggs, wildcard := GetSelectAggregates(q)
+	var results []*Result
+	for _, b := range bodies {
+		_rsp, err := ResponseFromResponseBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		if _rsp.Err != "" {
+			return _rsp, nil
+		}
+		for i, r := range _rsp.Results {
+			if i >= len(results) {
+				results = append(results, &Result{StatementID: r.StatementID})
+			}
+			results[i].Series = append(results[i].Series, r.Series...)
+			results[i].Messages = append(results[i].Messages, r.Messages...)
+			results[i].Partial = results[i].Partial || r.Partial
+			if results[i].Err == "" {
+				results[i].Err = r.Err
+			}
+		}
+	}
+	for _, r := range results {
+		var messages []*Message
+		r.Series, messages = mergeSeries(r.Series, desc, aggs, wildcard)
+		r.Messages = append(r.Messages, messages...)
+	}
+	return ResponseFromResults(results), nil
+}
+
+func mergeSeries(series models.Rows, desc bool, aggs []*SelectAggregate, wildcard bool) (models.Rows, []*Message) {
+	var messages []*Message
+	var keys []string
+	groups := make(map[string]models.Rows)
+	for _, serie := range series {
+		key := seriesKey(serie)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], serie)
+	}
+	sort.Strings(keys)
+	merged := make(models.Rows, 0, len(keys))
+	for _, key := range keys {
+		group := groups[key]
+		serie := group[0]
+		if len(group) > 1 {
+			if len(serie.Columns) > 0 && serie.Columns[0] == "time" {
+				var unmerged []string
+				serie.Values, unmerged = mergeValuesByTime(group, desc, columnAggregates(aggs, wildcard, serie.Columns))
+				if len(unmerged) > 0 {
+					messages = append(messages, &Message{
+						Level: "warning",
+						Text:  fmt.Sprintf("aggregates %s of series %s can't be merged across backends, the values of one backend are kept", strings.Join(unmerged, ", "), serie.Name),
+					})
+				}
+			} else {
+				serie.Values = mergeValuesByRow(group)
+			}
+		}
+		merged = append(merged, serie)
+	}
+	return merged, messages
+}
+
+func seriesKey(serie *models.Row) string {
+	tags := make([]string, 0, len(serie.Tags))
+	for k, v := range serie.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return serie.Name + "," + strings.Join(tags, ",")
+}
+
+// mergeValuesByTime does a k-way merge of values already ordered by time, the values of the same time are combined
+// by the aggregates of columns if any, and returns the columns which can't be merged. The raw values of the same
+// time are different points of the series from different backends, which are all kept
+func mergeValuesByTime(group models.Rows, desc bool, aggs []*SelectAggregate) ([][]interface{}, []string) {
+	aggregated := false
+	for _, agg := range aggs {
+		aggregated = aggregated || agg.Func != ""
+	}
+	unmerged := util.NewSet()
+	total := 0
+	for _, serie := range group {
+		total += len(serie.Values)
+	}
+	values := make([][]interface{}, 0, total)
+	pos := make([]int, len(group))
+	var last int64
+	for {
+		pick := -1
+		var pickTime int64
+		for i, serie := range group {
+			if pos[i] >= len(serie.Values) {
+				continue
+			}
+			t := timeOfValue(serie.Values[pos[i]])
+			if pick == -1 || (!desc && t < pickTime) || (desc && t > pickTime) {
+				pick, pickTime = i, t
+			}
+		}
+		if pick == -1 {
+			break
+		}
+		value := group[pick].Values[pos[pick]]
+		pos[pick]++
+		if aggregated && len(values) > 0 && pickTime == last {
+			for _, col := range combineValues(values[len(values)-1], value, group[0].Columns, aggs) {
+				unmerged.Add(col)
+			}
+			continue
+		}
+		values = append(values, value)
+		last = pickTime
+	}
+	cols := make([]string, 0, len(unmerged))
+	for col := range unmerged {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	return values, cols
+}
+
+func mergeValuesByRow(group models.Rows) [][]interface{} {
+	var values [][]interface{}
+	seen := make(map[string]bool)
+	for _, serie := range group {
+		for _, value := range serie.Values {
+			key := fmt.Sprint(value...)
+			if !seen[key] {
+				seen[key] = true
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+func timeOfValue(value []interface{}) int64 {
+	if len(value) == 0 {
+		return 0
+	}
+	switch t := value[0].(type) {
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return int64(f)
+	case float64:
+		return int64(t)
+	case string:
+		tm, _ := time.Parse(time.RFC3339Nano, t)
+		return tm.UnixNano()
+	}
+	return 0
+}
@@ -0,0 +1,187 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+func TestMergeResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		bodies []string
+		q      string
+		desc   bool
+		want   string
+	}{
+		{
+			name: "distinct series",
+			bodies: []string{
+				`{"results":[{"statement_id":0,"series":[{"name":"mem","columns":["time","v"],"values":[[1,1]]}]}]}`,
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[[1,2]]}]}]}`,
+			},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[[1,2]]},{"name":"mem","columns":["time","v"],"values":[[1,1]]}]}]}`,
+		},
+		{
+			name: "same series by time",
+			bodies: []string{
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[1,1],[3,3]]}]}]}`,
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[2,2],[3,4]]}]}]}`,
+			},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[1,1],[2,2],[3,3],[3,4]]}]}]}`,
+		},
+		{
+			name: "same series by time desc",
+			bodies: []string{
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[["2021-01-01T00:00:03Z",3],["2021-01-01T00:00:01Z",1]]}]}]}`,
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[["2021-01-01T00:00:02.5Z",2]]}]}]}`,
+			},
+			desc: true,
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[["2021-01-01T00:00:03Z",3],["2021-01-01T00:00:02.5Z",2],["2021-01-01T00:00:01Z",1]]}]}]}`,
+		},
+		{
+			name: "group by time aggregates",
+			q:    "select count(v), sum(v), mean(v), min(v), max(v) from cpu where time > now() - 1h group by time(1m)",
+			bodies: []string{
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","count","sum","mean","min","max"],"values":[[0,2,4,2,1,3],[60,1,5,5,5,5]]}]}]}`,
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","count","sum","mean","min","max"],"values":[[0,2,8,4,0,6],[60,null,null,null,null,null]]}]}]}`,
+			},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","count","sum","mean","min","max"],"values":[[0,4,12,3,0,6],[60,1,5,5,5,5]]}]}]}`,
+		},
+		{
+			name: "group by time wildcard count",
+			q:    "SELECT count(*) FROM cpu GROUP BY time(1m)",
+			bodies: []string{
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","count_a","count_b"],"values":[[0,1,2]]}]}]}`,
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","count_a","count_b"],"values":[[0,3,4]]}]}]}`,
+			},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","count_a","count_b"],"values":[[0,4,6]]}]}]}`,
+		},
+		{
+			name: "group by time non-mergeable",
+			q:    `select mean("v"), last(v) as l from cpu group by time(1m)`,
+			bodies: []string{
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","mean","l"],"values":[[0,1.5,1]]}]}]}`,
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","mean","l"],"values":[[0,2.5,2]]}]}]}`,
+			},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","mean","l"],"values":[[0,1.5,1]]}],"messages":[{"level":"warning","text":"aggregates l, mean of series cpu can't be merged across backends, the values of one backend are kept"}]}]}`,
+		},
+		{
+			name: "without time",
+			bodies: []string{
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["tagKey"],"values":[["host"],["region"]]}]}]}`,
+				`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["tagKey"],"values":[["host"],["zone"]]}]}]}`,
+			},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["tagKey"],"values":[["host"],["region"],["zone"]]}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bodies := make([][]byte, len(tt.bodies))
+			for i, b := range tt.bodies {
+				bodies[i] = []byte(b)
+			}
+			rsp, err := MergeResponses(bodies, tt.desc, tt.q)
+			if err != nil {
+				t.Errorf("error: %s", err)
+				return
+			}
+			if got := string(util.MarshalJSON(rsp, false)); got != tt.want+"\n" {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPushDownLimits(t *testing.T) {
+	bodies := [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[1,1],[3,3],[5,5]]},{"name":"cpu","tags":{"host":"c"},"columns":["time","v"],"values":[[1,1]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[2,2],[4,4]]},{"name":"cpu","tags":{"host":"b"},"columns":["time","v"],"values":[[1,1]]}]}]}`),
+	}
+	tests := []struct {
+		name   string
+		q      string
+		pushed string
+		want   string
+	}{
+		{
+			name:   "no limits",
+			q:      "select v from cpu group by host",
+			pushed: "select v from cpu group by host",
+			want:   `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[1,1],[2,2],[3,3],[4,4],[5,5]]},{"name":"cpu","tags":{"host":"b"},"columns":["time","v"],"values":[[1,1]]},{"name":"cpu","tags":{"host":"c"},"columns":["time","v"],"values":[[1,1]]}]}]}`,
+		},
+		{
+			name:   "limit offset",
+			q:      "select v from cpu group by host limit 2 offset 1",
+			pushed: "select v from cpu group by host limit 3",
+			want:   `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[2,2],[3,3]]}]}]}`,
+		},
+		{
+			name:   "slimit soffset",
+			q:      "select v from cpu group by host LIMIT 1 SLIMIT 1 SOFFSET 1",
+			pushed: "select v from cpu group by host LIMIT 1 SLIMIT 2",
+			want:   `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"b"},"columns":["time","v"],"values":[[1,1]]}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		pushed, sl := PushDownLimits(tt.q)
+		if pushed != tt.pushed {
+			t.Errorf("%s: pushed %s, want %s", tt.name, pushed, tt.pushed)
+		}
+		rsp, err := MergeResponses(bodies, false, tt.q)
+		if err != nil {
+			t.Fatalf("%s: error: %s", tt.name, err)
+		}
+		applyLimits(rsp, sl)
+		if got := string(util.MarshalJSON(rsp, false)); got != tt.want+"\n" {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetSelectAggregates(t *testing.T) {
+	tests := []struct {
+		name     string
+		q        string
+		want     []SelectAggregate
+		wildcard bool
+	}{
+		{
+			name: "aggregates",
+			q:    `SELECT mean("value") AS m, count(value),max(value) FROM cpu GROUP BY time(1m)`,
+			want: []SelectAggregate{{Func: "mean", Arg: "value"}, {Func: "count", Arg: "value"}, {Func: "max", Arg: "value"}},
+		},
+		{
+			name:     "wildcard",
+			q:        `select count(*) from cpu group by time(1m)`,
+			want:     []SelectAggregate{{Func: "count", Arg: "*"}},
+			wildcard: true,
+		},
+		{
+			name: "expression and raw",
+			q:    `select sum(a) / count(a), "b" from (select a, b from cpu) group by time(1m)`,
+			want: []SelectAggregate{{Func: "expr"}, {Arg: "b"}},
+		},
+		{
+			name:     "raw wildcard",
+			q:        `select * from cpu`,
+			want:     []SelectAggregate{{Arg: "*"}},
+			wildcard: true,
+		},
+	}
+	for _, tt := range tests {
+		aggs, wildcard := GetSelectAggregates(tt.q)
+		got := make([]SelectAggregate, len(aggs))
+		for i, agg := range aggs {
+			got[i] = *agg
+		}
+		if !reflect.DeepEqual(got, tt.want) || wildcard != tt.wildcard {
+			t.Errorf("%v: got %v, %v, want %v, %v", tt.name, got, wildcard, tt.want, tt.wildcard)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const metaCacheMaxEntries = 1024
+
+type metaEntry struct {
+	rsp    *Response
+	expire time.Time
+}
+
+// MetaCache caches the merged results of meta queries like show measurements and show databases for a short ttl,
+// it's invalidated by the ddl statements passing through the proxy
+type MetaCache struct {
+	ttl     time.Duration
+	entries map[string]*metaEntry
+	lock    sync.RWMutex
+}
+
+func NewMetaCache(cfg *ProxyConfig) *MetaCache {
+	return &MetaCache{
+		ttl:     time.Duration(cfg.MetaCacheTTL) * time.Second,
+		entries: make(map[string]*metaEntry),
+	}
+}
+
+func (mc *MetaCache) Enabled() bool {
+	return mc.ttl > 0
+}
+
+// Get returns the cached response of query q on db, or nil if it's missing or expired
+func (mc *MetaCache) Get(db, q string) *Response {
+	if !mc.Enabled() {
+		return nil
+	}
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	entry, ok := mc.entries[db+"\x00"+q]
+	if !ok || time.Now().After(entry.expire) {
+		return nil
+	}
+	return entry.rsp
+}
+
+// Set caches the response, the response must not be modified after that
+func (mc *MetaCache) Set(db, q string, rsp *Response) {
+	if !mc.Enabled() {
+		return
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	now := time.Now()
+	if len(mc.entries) >= metaCacheMaxEntries {
+		for key, entry := range mc.entries {
+			if now.After(entry.expire) {
+				delete(mc.entries, key)
+			}
+		}
+		if len(mc.entries) >= metaCacheMaxEntries {
+			return
+		}
+	}
+	mc.entries[db+"\x00"+q] = &metaEntry{rsp: rsp, expire: now.Add(mc.ttl)}
+}
+
+func (mc *MetaCache) Invalidate() {
+	if !mc.Enabled() {
+		return
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.entries = make(map[string]*metaEntry)
+}
+
+// marshalCached returns the cached response of the meta query if any
+func marshalCached(w http.ResponseWriter, req *http.Request, ip *Proxy) (body []byte, ok bool) {
+	rsp := ip.metaCache.Get(req.FormValue("db"), req.FormValue("q"))
+	if rsp == nil {
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Encoding")
+	body, err := marshalResponse(w, req, scopeDatabases(req, rsp))
+	return body, err == nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetaCache(t *testing.T) {
+	disabled := NewMetaCache(&ProxyConfig{})
+	disabled.Set("db", "show measurements", ResponseFromSeries(nil))
+	if disabled.Get("db", "show measurements") != nil {
+		t.Errorf("disabled cache returns response")
+	}
+
+	mc := NewMetaCache(&ProxyConfig{MetaCacheTTL: 10})
+	rsp := ResponseFromSeries(nil)
+	mc.Set("db", "show measurements", rsp)
+	if mc.Get("db", "show measurements") != rsp {
+		t.Errorf("cached response expected")
+	}
+	if mc.Get("db2", "show measurements") != nil || mc.Get("db", "show databases") != nil {
+		t.Errorf("response of other query returned")
+	}
+	mc.Invalidate()
+	if mc.Get("db", "show measurements") != nil {
+		t.Errorf("response returned after invalidation")
+	}
+
+	mc.Set("db", "show databases", rsp)
+	mc.entries["db\x00show databases"].expire = time.Now().Add(-time.Second)
+	if mc.Get("db", "show databases") != nil {
+		t.Errorf("expired response returned")
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+const (
+	ReasonTransform     = "transform"
+	ReasonBackendClosed = "backend_closed"
+	ReasonBadRequest    = "bad_request"
+	ReasonNotFound      = "not_found"
+	ReasonExpired       = "expired"
+)
+
+// Counters are the monotonic counters by label, unlike the write errors they are never reset
+type Counters struct {
+	m sync.Map
+}
+
+func (cs *Counters) Add(label string, n int64) {
+	v, ok := cs.m.Load(label)
+	if !ok {
+		v, _ = cs.m.LoadOrStore(label, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), n)
+}
+
+// Values returns the labels sorted and the values by label
+func (cs *Counters) Values() ([]string, map[string]int64) {
+	var labels []string
+	values := make(map[string]int64)
+	cs.m.Range(func(k, v interface{}) bool {
+		labels = append(labels, k.(string))
+		values[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	sort.Strings(labels)
+	return labels, values
+}
+
+// WriteStats are the points and bytes written and the points dropped by reason before sent to backends, the writes
+// aren't counted by db since the databases written by clients may be unknown and unbounded
+type WriteStats struct {
+	points  int64
+	bytes   int64
+	dropped Counters
+}
+
+func (ws *WriteStats) AddWrite(points, bytes int) {
+	atomic.AddInt64(&ws.points, int64(points))
+	atomic.AddInt64(&ws.bytes, int64(bytes))
+}
+
+func (ws *WriteStats) AddDropped(reason string, points int) {
+	ws.dropped.Add(reason, int64(points))
+}
+
+// countLines returns the number of lines of gzip data, which is 0 if invalid
+func countLines(p []byte) (n int) {
+	zr, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		nr, err := zr.Read(buf)
+		n += bytes.Count(buf[:nr], []byte{'\n'})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// WriteMetrics writes the writes, the drops, the buffers, flushes, backlogs and rewrites of backends and the hash rings
+// of circles in the prometheus text format
+func (ip *Proxy) WriteMetrics(w io.Writer) {
+	mw := &util.MetricWriter{W: w}
+	name := "influx_proxy_write_points_total"
+	mw.Header(name, "counter", "Number of points written.")
+	mw.Sample(name, float64(atomic.LoadInt64(&ip.writeStats.points)))
+	name = "influx_proxy_write_bytes_total"
+	mw.Header(name, "counter", "Number of bytes of lines written.")
+	mw.Sample(name, float64(atomic.LoadInt64(&ip.writeStats.bytes)))
+	reasons, dropped := ip.writeStats.dropped.Values()
+	name = "influx_proxy_dropped_points_total"
+	mw.Header(name, "counter", "Number of points dropped before sent to backends by reason.")
+	for _, reason := range reasons {
+		mw.Sample(name, float64(dropped[reason]), "reason", reason)
+	}
+
+	type circleBackend struct {
+		circleId string
+		be       *Backend
+	}
+	var cbs []circleBackend
+	circles := ip.AllCircles()
+	name = "influx_proxy_hash_ring_nodes"
+	mw.Header(name, "gauge", "Number of nodes of the hash ring by circle, the backends of weight n are n nodes.")
+	for _, circle := range circles {
+		circleId := strconv.Itoa(circle.CircleId)
+		mw.Sample(name, float64(len(circle.mapToBackend)), "circle_id", circleId, "circle", circle.Name)
+		for _, be := range circle.Backends {
+			cbs = append(cbs, circleBackend{circleId, be})
+		}
+	}
+	name = "influx_proxy_hash_ring_backends"
+	mw.Header(name, "gauge", "Number of backends of the hash ring by circle.")
+	for _, circle := range circles {
+		mw.Sample(name, float64(len(circle.Backends)), "circle_id", strconv.Itoa(circle.CircleId), "circle", circle.Name)
+	}
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(be *Backend) float64
+	}{
+		{"influx_proxy_backend_buffer_points", "Number of points buffered to flush by backend.", func(be *Backend) float64 { return float64(be.BufferedPoints()) }},
+		{"influx_proxy_backend_buffer_bytes", "Number of bytes of lines buffered to flush by backend.", func(be *Backend) float64 { return float64(atomic.LoadInt64(&be.bufferedBytes)) }},
+		{"influx_proxy_backend_file_backlog_bytes", "Number of bytes of the file not rewritten yet by backend.", func(be *Backend) float64 { return float64(be.fb.Backlog()) }},
+		{"influx_proxy_backend_rewriting", "Whether the backend is rewriting the file, 1 if rewriting.", func(be *Backend) float64 { return boolToFloat(be.IsRewriting()) }},
+	}
+	for _, g := range gauges {
+		mw.Header(g.name, "gauge", g.help)
+		for _, cb := range cbs {
+			mw.Sample(g.name, g.value(cb.be), "circle_id", cb.circleId, "backend", cb.be.Url)
+		}
+	}
+	counters := []struct {
+		name  string
+		help  string
+		value func(be *Backend) float64
+	}{
+		{"influx_proxy_backend_rewrite_batches_total", "Number of batches of the file rewritten by backend.", func(be *Backend) float64 { return float64(atomic.LoadInt64(&be.rewriteBatches)) }},
+		{"influx_proxy_backend_rewrite_bytes_total", "Number of bytes of the file rewritten by backend.", func(be *Backend) float64 { return float64(atomic.LoadInt64(&be.rewriteBytes)) }},
+	}
+	for _, c := range counters {
+		mw.Header(c.name, "counter", c.help)
+		for _, cb := range cbs {
+			mw.Sample(c.name, c.value(cb.be), "circle_id", cb.circleId, "backend", cb.be.Url)
+		}
+	}
+	name = "influx_proxy_backend_dropped_points_total"
+	mw.Header(name, "counter", "Number of points dropped by backend and reason.")
+	for _, cb := range cbs {
+		reasons, dropped := cb.be.dropped.Values()
+		for _, reason := range reasons {
+			mw.Sample(name, float64(dropped[reason]), "circle_id", cb.circleId, "backend", cb.be.Url, "reason", reason)
+		}
+	}
+	name = "influx_proxy_backend_flush_duration_seconds"
+	mw.Header(name, "histogram", "Duration of flushing the buffers to backend or file in seconds by backend.")
+	for _, cb := range cbs {
+		mw.Histogram(name, cb.be.flushLatency, "circle_id", cb.circleId, "backend", cb.be.Url)
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
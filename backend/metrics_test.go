@@ -0,0 +1,92 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+func TestCountLines(t *testing.T) {
+	p, err := Encode("gzip", []byte("cpu value=1\ncpu value=2\nmem value=3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countLines(p); n != 3 {
+		t.Errorf("got %d, want 3", n)
+	}
+	if n := countLines([]byte("cpu value=1\n")); n != 0 {
+		t.Errorf("invalid gzip: got %d, want 0", n)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fb, err := NewFileBackend("influxdb-1", dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+	if err = fb.Write([]byte("db1 autogen ns data")); err != nil {
+		t.Fatal(err)
+	}
+	be := &Backend{
+		HttpBackend:  &HttpBackend{Name: "influxdb-1", Url: "http://127.0.0.1:8086", Weight: 2},
+		fb:           fb,
+		chWrite:      make(chan *LinePoint, 16),
+		flushLatency: util.NewHistogram(util.LatencyBuckets),
+	}
+	be.running.Store(true)
+	be.rewriting.Store(false)
+	be.chWrite <- &LinePoint{}
+	be.bufferedPoints, be.bufferedBytes = 2, 24
+	be.dropped.Add(ReasonBadRequest, 3)
+	be.flushLatency.Observe(0.02)
+	be.flushLatency.Observe(20)
+	circle := &Circle{CircleId: 0, Name: "circle-1", Backends: []*Backend{be}, router: NewHashRing(HashConsistent, 256), mapToBackend: make(map[string]*Backend)}
+	circle.addRouter(be, 0, "idx")
+
+	ip := &Proxy{Circles: []*Circle{circle}}
+	ip.writeStats.AddWrite(2, 24)
+	ip.writeStats.AddWrite(1, 12)
+	ip.writeStats.AddDropped(ReasonTransform, 1)
+
+	var buf bytes.Buffer
+	ip.WriteMetrics(&buf)
+	out := buf.String()
+	backend := `circle_id="0",backend="http://127.0.0.1:8086"`
+	for _, want := range []string{
+		`influx_proxy_write_points_total 3`,
+		`influx_proxy_write_bytes_total 36`,
+		`influx_proxy_dropped_points_total{reason="transform"} 1`,
+		`influx_proxy_hash_ring_nodes{circle_id="0",circle="circle-1"} 2`,
+		`influx_proxy_hash_ring_backends{circle_id="0",circle="circle-1"} 1`,
+		`influx_proxy_backend_buffer_points{` + backend + `} 3`,
+		`influx_proxy_backend_buffer_bytes{` + backend + `} 24`,
+		`influx_proxy_backend_file_backlog_bytes{` + backend + `} 31`,
+		`influx_proxy_backend_rewriting{` + backend + `} 0`,
+		`influx_proxy_backend_dropped_points_total{` + backend + `,reason="bad_request"} 3`,
+		`influx_proxy_backend_flush_duration_seconds_bucket{` + backend + `,le="0.01"} 0`,
+		`influx_proxy_backend_flush_duration_seconds_bucket{` + backend + `,le="0.025"} 1`,
+		`influx_proxy_backend_flush_duration_seconds_bucket{` + backend + `,le="10"} 1`,
+		`influx_proxy_backend_flush_duration_seconds_bucket{` + backend + `,le="+Inf"} 2`,
+		`influx_proxy_backend_flush_duration_seconds_sum{` + backend + `} 20.02`,
+		`influx_proxy_backend_flush_duration_seconds_count{` + backend + `} 2`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %s in:\n%s", want, out)
+		}
+	}
+}
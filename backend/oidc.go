@@ -0,0 +1,316 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidOidc     = errors.New("invalid oidc, require http or https oidc_issuer and oidc_audience, and valid privileges of oidc_group_grants")
+	ErrTokenIssuer     = errors.New("oidc token issuer mismatched")
+	ErrTokenAudience   = errors.New("oidc token audience mismatched")
+	ErrTokenNotYet     = errors.New("oidc token not valid yet")
+	ErrTokenKeyMissing = errors.New("oidc token key not found")
+)
+
+var (
+	// OidcRefresh is the interval to refresh the keys of jwks
+	OidcRefresh = time.Hour
+	// OidcRetry is the min interval to fetch the keys of jwks again for an unknown kid
+	OidcRetry = time.Minute
+	// OidcLeeway is the clock skew allowed to check the exp and nbf claims
+	OidcLeeway = 60 * time.Second
+)
+
+var oidcHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// Oidc verifies the bearer tokens issued by oidc_issuer for oidc_audience with the keys of jwks, and maps
+// the claims to the user, who is admin by oidc_admin_groups and granted by oidc_group_grants
+type Oidc struct {
+	issuer      string
+	audience    string
+	jwksUrl     string // nolint:golint
+	userClaim   string
+	groupsClaim string
+	adminGroups map[string]bool
+	groupGrants map[string]Grants
+	client      *http.Client
+	keys        map[string]crypto.PublicKey
+	fetched     time.Time
+	lock        sync.Mutex
+}
+
+// CheckOidc checks the oidc options of config
+func CheckOidc(cfg *ProxyConfig) error {
+	if cfg.OidcIssuer == "" {
+		return nil
+	}
+	for _, s := range []string{cfg.OidcIssuer, cfg.OidcJwksUrl} {
+		if s == "" {
+			continue
+		}
+		if u, err := url.Parse(s); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return ErrInvalidOidc
+		}
+	}
+	if cfg.OidcAudience == "" {
+		return ErrInvalidOidc
+	}
+	for _, grants := range cfg.OidcGroupGrants {
+		for _, privilege := range grants {
+			if CheckPrivilege(privilege) != nil {
+				return ErrInvalidOidc
+			}
+		}
+	}
+	return nil
+}
+
+// NewOidc returns nil if oidc_issuer is empty
+func NewOidc(cfg *ProxyConfig) *Oidc {
+	if cfg.OidcIssuer == "" {
+		return nil
+	}
+	o := &Oidc{
+		issuer:      cfg.OidcIssuer,
+		audience:    cfg.OidcAudience,
+		jwksUrl:     cfg.OidcJwksUrl,
+		userClaim:   cfg.OidcUserClaim,
+		groupsClaim: cfg.OidcGroupsClaim,
+		adminGroups: make(map[string]bool),
+		groupGrants: cfg.OidcGroupGrants,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, group := range cfg.OidcAdminGroups {
+		o.adminGroups[group] = true
+	}
+	return o
+}
+
+// Authenticate verifies the token and returns the user of claims
+func (o *Oidc) Authenticate(token string, now time.Time) (*UserConfig, error) {
+	jt, err := splitJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	hash, ok := oidcHashes[jt.alg]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	key, err := o.getKey(jt.kid, now)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifySign(jt, hash, key); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if err = decodeSegment(jt.payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if iss, _ := claims["iss"].(string); iss != o.issuer {
+		return nil, ErrTokenIssuer
+	}
+	if !matchAudience(claims["aud"], o.audience) {
+		return nil, ErrTokenAudience
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, ErrTokenNoExpiry
+	}
+	if now.Add(-OidcLeeway).Unix() >= int64(exp) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(OidcLeeway).Unix() < int64(nbf) {
+		return nil, ErrTokenNotYet
+	}
+	username, _ := claims[o.userClaim].(string)
+	if username == "" {
+		return nil, ErrTokenNoUser
+	}
+	var groups []string
+	switch tv := claims[o.groupsClaim].(type) {
+	case []interface{}:
+		for _, v := range tv {
+			if group, ok := v.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	case string:
+		groups = strings.Fields(tv)
+	}
+	return newGroupUser(username, groups, o.adminGroups, o.groupGrants), nil
+}
+
+func matchAudience(aud interface{}, audience string) bool {
+	switch tv := aud.(type) {
+	case string:
+		return tv == audience
+	case []interface{}:
+		for _, v := range tv {
+			if v == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifySign(jt *jwtToken, hash crypto.Hash, key crypto.PublicKey) error {
+	h := hash.New()
+	h.Write(jt.input)
+	digest := h.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(jt.alg, "RS") && rsa.VerifyPKCS1v15(pub, hash, digest, jt.sign) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		// the signature of jws is r and s of the fixed size of curve
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(jt.alg, "ES") && len(jt.sign) == 2*size {
+			r, s := new(big.Int).SetBytes(jt.sign[:size]), new(big.Int).SetBytes(jt.sign[size:])
+			if ecdsa.Verify(pub, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return ErrInvalidSign
+}
+
+// getKey returns the key of kid, the keys are fetched every OidcRefresh, or again for an unknown kid after OidcRetry.
+// The token without kid is verified by the only key
+func (o *Oidc) getKey(kid string, now time.Time) (crypto.PublicKey, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.keys == nil || now.Sub(o.fetched) >= OidcRefresh || (o.findKey(kid) == nil && now.Sub(o.fetched) >= OidcRetry) {
+		keys, err := o.fetchKeys()
+		o.fetched = now
+		if err != nil {
+			log.Printf("oidc fetch keys error: %s", err)
+			if o.keys == nil {
+				return nil, err
+			}
+		} else {
+			o.keys = keys
+		}
+	}
+	if key := o.findKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, ErrTokenKeyMissing
+}
+
+func (o *Oidc) findKey(kid string) crypto.PublicKey {
+	if kid == "" && len(o.keys) == 1 {
+		for _, key := range o.keys {
+			return key
+		}
+	}
+	return o.keys[kid]
+}
+
+func (o *Oidc) fetchKeys() (map[string]crypto.PublicKey, error) {
+	jwksUrl := o.jwksUrl // nolint:golint
+	if jwksUrl == "" {
+		var discovery struct {
+			JwksUri string `json:"jwks_uri"` // nolint:golint
+		}
+		if err := o.getJSON(strings.TrimSuffix(o.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		jwksUrl = discovery.JwksUri
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(jwksUrl, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := decodeBigInt(k.N)
+			e, err2 := decodeBigInt(k.E)
+			if err1 == nil && err2 == nil {
+				keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, err1 := decodeBigInt(k.X)
+			y, err2 := decodeBigInt(k.Y)
+			if err1 == nil && err2 == nil {
+				keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (o *Oidc) getJSON(u string, v interface{}) error {
+	resp, err := o.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s status code: %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
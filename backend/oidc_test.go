@@ -0,0 +1,139 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func encodeBigInt(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+func signOidc(t *testing.T, alg, kid string, claims map[string]interface{}, key crypto.Signer) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	s := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(s))
+	var sign []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sign, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sign = make([]byte, 64)
+		r.FillBytes(sign[:32])
+		s.FillBytes(sign[32:])
+	}
+	return s + "." + base64.RawURLEncoding.EncodeToString(sign)
+}
+
+func TestOidc(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issuer string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer":%q,"jwks_uri":%q}`, issuer, issuer+"/keys")
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"k1","use":"sig","n":%q,"e":%q},{"kty":"EC","kid":"k2","crv":"P-256","x":%q,"y":%q}]}`,
+			encodeBigInt(rsaKey.N), encodeBigInt(big.NewInt(int64(rsaKey.E))), encodeBigInt(ecKey.X), encodeBigInt(ecKey.Y))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	issuer = ts.URL
+
+	cfg := &ProxyConfig{
+		OidcIssuer:      issuer,
+		OidcAudience:    "proxy",
+		OidcUserClaim:   "email",
+		OidcGroupsClaim: "groups",
+		OidcAdminGroups: []string{"ops"},
+		OidcGroupGrants: map[string]Grants{"dev": {"db1": PrivilegeWrite}},
+	}
+	if err := CheckOidc(cfg); err != nil {
+		t.Fatal(err)
+	}
+	o := NewOidc(cfg)
+	now := time.Now()
+	claims := func(m map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": issuer, "aud": "proxy", "exp": now.Unix() + 300, "email": "u1@example.com", "groups": []string{"dev"}}
+		for k, v := range m {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	tests := []struct {
+		name  string
+		token string
+		err   error
+		admin bool
+	}{
+		{name: "rsa", token: signOidc(t, "RS256", "k1", claims(nil), rsaKey)},
+		{name: "ec", token: signOidc(t, "ES256", "k2", claims(nil), ecKey)},
+		{name: "admin", token: signOidc(t, "RS256", "k1", claims(map[string]interface{}{"groups": []string{"ops"}}), rsaKey), admin: true},
+		{name: "audience list", token: signOidc(t, "RS256", "k1", claims(map[string]interface{}{"aud": []string{"other", "proxy"}}), rsaKey)},
+		{name: "wrong key", token: signOidc(t, "RS256", "k1", claims(nil), otherKey), err: ErrInvalidSign},
+		{name: "alg mismatched", token: signOidc(t, "ES256", "k1", claims(nil), ecKey), err: ErrInvalidSign},
+		{name: "unknown kid", token: signOidc(t, "RS256", "k3", claims(nil), rsaKey), err: ErrTokenKeyMissing},
+		{name: "issuer", token: signOidc(t, "RS256", "k1", claims(map[string]interface{}{"iss": "https://other"}), rsaKey), err: ErrTokenIssuer},
+		{name: "audience", token: signOidc(t, "RS256", "k1", claims(map[string]interface{}{"aud": "other"}), rsaKey), err: ErrTokenAudience},
+		{name: "expired", token: signOidc(t, "RS256", "k1", claims(map[string]interface{}{"exp": now.Unix() - 300}), rsaKey), err: ErrTokenExpired},
+		{name: "not yet", token: signOidc(t, "RS256", "k1", claims(map[string]interface{}{"nbf": now.Unix() + 300}), rsaKey), err: ErrTokenNotYet},
+		{name: "no user", token: signOidc(t, "RS256", "k1", claims(map[string]interface{}{"email": nil}), rsaKey), err: ErrTokenNoUser},
+		{name: "hmac", token: signJWT(`{"alg":"HS256"}`, `{"username":"u1","exp":1600000060}`, "secret"), err: ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := o.Authenticate(tt.token, now)
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if user.Username != "u1@example.com" || user.Admin != tt.admin {
+				t.Errorf("got %+v, want admin %t", user, tt.admin)
+			}
+			if !tt.admin && user.Grants["db1"] != PrivilegeWrite {
+				t.Errorf("grants: got %v", user.Grants)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Placement is the key to backends mapping of all circles along with the ring parameters
+type Placement struct {
+	HashKey string             `json:"hash_key"`
+	Circles []*CirclePlacement `json:"circles"`
+}
+
+type CirclePlacement struct {
+	Id            int                 `json:"id"` // nolint:golint
+	Name          string              `json:"name"`
+	HashAlgorithm string              `json:"hash_algorithm"`
+	VirtualNodes  int                 `json:"virtual_nodes"`
+	Replicas      int                 `json:"replicas"`
+	Backends      []*BackendPlacement `json:"backends"`
+	Keys          map[string][]string `json:"keys"`
+}
+
+type BackendPlacement struct {
+	Name   string `json:"name"`
+	Url    string `json:"url"` // nolint:golint
+	Weight int    `json:"weight"`
+}
+
+// CircleReplicas is the database to measurement to backends mapping of a circle
+type CircleReplicas struct {
+	Id           int                                       `json:"id"` // nolint:golint
+	Name         string                                    `json:"name"`
+	Measurements map[string]map[string][]*BackendPlacement `json:"measurements"`
+}
+
+// ExportPlacement returns the placement of the keys of the measurements in the databases of dbs, or all databases
+// if dbs is empty, the measurements are collected from the active backends and the ones spread by tags are left out
+func (ip *Proxy) ExportPlacement(dbs []string) *Placement {
+	keys := ip.collectKeys(dbs)
+	placement := &Placement{HashKey: ip.currentConfig().HashKey}
+	for _, circle := range ip.AllCircles() {
+		cp := ip.circlePlacement(circle)
+		for _, key := range keys {
+			cp.Keys[key] = backendNames(circle.GetReplicas(key))
+		}
+		placement.Circles = append(placement.Circles, cp)
+	}
+	return placement
+}
+
+// VerifyPlacement compares the placement imported with the local one, and returns the differences
+func (ip *Proxy) VerifyPlacement(placement *Placement) (diffs []string) {
+	if hashKey := ip.currentConfig().HashKey; placement.HashKey != hashKey {
+		diffs = append(diffs, fmt.Sprintf("hash_key: %s != %s", placement.HashKey, hashKey))
+	}
+	circles := ip.AllCircles()
+	for _, cp := range placement.Circles {
+		if cp.Id < 0 || cp.Id >= len(circles) {
+			diffs = append(diffs, fmt.Sprintf("circle %d: not found", cp.Id))
+			continue
+		}
+		circle := circles[cp.Id]
+		local := ip.circlePlacement(circle)
+		if cp.HashAlgorithm != local.HashAlgorithm || cp.VirtualNodes != local.VirtualNodes || cp.Replicas != local.Replicas || !reflect.DeepEqual(cp.Backends, local.Backends) {
+			diffs = append(diffs, fmt.Sprintf("circle %d: ring parameters differ", cp.Id))
+		}
+		keys := make([]string, 0, len(cp.Keys))
+		for key := range cp.Keys {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if names := backendNames(circle.GetReplicas(key)); !reflect.DeepEqual(cp.Keys[key], names) {
+				diffs = append(diffs, fmt.Sprintf("circle %d key %s: %v != %v", cp.Id, key, cp.Keys[key], names))
+			}
+		}
+	}
+	if len(placement.Circles) != len(circles) {
+		diffs = append(diffs, fmt.Sprintf("circles: %d != %d", len(placement.Circles), len(circles)))
+	}
+	return
+}
+
+func (ip *Proxy) circlePlacement(circle *Circle) *CirclePlacement {
+	circfg := ip.currentConfig().Circles[circle.CircleId]
+	cp := &CirclePlacement{
+		Id:            circle.CircleId,
+		Name:          circle.Name,
+		HashAlgorithm: circfg.HashAlgorithm,
+		VirtualNodes:  circfg.VirtualNodes,
+		Replicas:      circfg.Replicas,
+		Keys:          make(map[string][]string),
+	}
+	for _, be := range circle.Backends {
+		cp.Backends = append(cp.Backends, &BackendPlacement{Name: be.Name, Url: be.Url, Weight: be.Weight})
+	}
+	return cp
+}
+
+// ReplicaMap returns the backends of all the measurements in the databases of dbs, or all databases if dbs is empty,
+// for each circle containing the database, all the backends of circle are returned if the database is spread by tags
+func (ip *Proxy) ReplicaMap(dbs []string) []*CircleReplicas {
+	measurements := ip.collectMeasurements(ip.GetAllBackends(), dbs)
+	circles := ip.AllCircles()
+	crs := make([]*CircleReplicas, 0, len(circles))
+	for _, circle := range circles {
+		cr := &CircleReplicas{Id: circle.CircleId, Name: circle.Name, Measurements: make(map[string]map[string][]*BackendPlacement)}
+		for db, meases := range measurements {
+			if !ip.dbCircles.Contains(db, circle.CircleId) {
+				continue
+			}
+			cr.Measurements[db] = make(map[string][]*BackendPlacement, len(meases))
+			for _, meas := range meases {
+				replicas := circle.GetReplicasByMeasurements(db, []string{meas})
+				bps := make([]*BackendPlacement, len(replicas))
+				for i, be := range replicas {
+					bps[i] = &BackendPlacement{Name: be.Name, Url: be.Url, Weight: be.Weight}
+				}
+				cr.Measurements[db][meas] = bps
+			}
+		}
+		crs = append(crs, cr)
+	}
+	return crs
+}
+
+// collectKeys returns the sorted keys of the measurements in the active backends
+func (ip *Proxy) collectKeys(dbs []string) []string {
+	keys := make([]string, 0)
+	for db, meases := range ip.collectMeasurements(ip.GetAllBackends(), dbs) {
+		if ip.shardKeys.Spread(db) {
+			continue
+		}
+		for _, meas := range meases {
+			keys = append(keys, ip.shardKeys.Key(db, meas, nil))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// collectMeasurements returns the sorted measurements of the databases in the active backends
+func (ip *Proxy) collectMeasurements(backends []*Backend, dbs []string) map[string][]string {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	set := make(map[string]map[string]bool)
+	for _, be := range backends {
+		if !be.IsActive() {
+			continue
+		}
+		wg.Add(1)
+		go func(be *Backend) {
+			defer wg.Done()
+			bdbs := dbs
+			if len(bdbs) == 0 {
+				bdbs = be.GetDatabases()
+			}
+			for _, db := range bdbs {
+				meases := be.GetMeasurements(db)
+				mu.Lock()
+				if set[db] == nil {
+					set[db] = make(map[string]bool)
+				}
+				for _, meas := range meases {
+					set[db][meas] = true
+				}
+				mu.Unlock()
+			}
+		}(be)
+	}
+	wg.Wait()
+	measurements := make(map[string][]string, len(set))
+	for db, mset := range set {
+		meases := make([]string, 0, len(mset))
+		for meas := range mset {
+			meases = append(meases, meas)
+		}
+		sort.Strings(meases)
+		measurements[db] = meases
+	}
+	return measurements
+}
+
+func backendNames(backends []*Backend) []string {
+	names := make([]string, len(backends))
+	for i, be := range backends {
+		names[i] = be.Name
+	}
+	return names
+}
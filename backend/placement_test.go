@@ -0,0 +1,45 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestVerifyPlacement(t *testing.T) {
+	cfg := &ProxyConfig{Circles: []*CircleConfig{{
+		Name:     "circle-1",
+		Backends: []*BackendConfig{{Name: "b1", Url: "http://b1"}, {Name: "b2", Url: "http://b2"}, {Name: "b3", Url: "http://b3"}},
+	}}}
+	cfg.setDefault()
+	backends := make([]*Backend, 0)
+	for _, bkcfg := range cfg.Circles[0].Backends {
+		backends = append(backends, NewSimpleBackend(bkcfg))
+	}
+	ip := &Proxy{Circles: []*Circle{newCircle(cfg.Circles[0], cfg, 0, backends)}, config: cfg}
+	export := func() *Placement {
+		cp := ip.circlePlacement(ip.Circles[0])
+		for _, mm := range []string{"cpu", "mem", "disk"} {
+			key := GetKey("db", mm)
+			cp.Keys[key] = backendNames(ip.Circles[0].GetReplicas(key))
+		}
+		return &Placement{HashKey: cfg.HashKey, Circles: []*CirclePlacement{cp}}
+	}
+
+	if diffs := ip.VerifyPlacement(export()); len(diffs) != 0 {
+		t.Errorf("placement not agreed: %v", diffs)
+	}
+	placement := export()
+	placement.Circles[0].Keys["db,cpu"] = []string{"other"}
+	if diffs := ip.VerifyPlacement(placement); len(diffs) != 1 {
+		t.Errorf("key difference not found: %v", diffs)
+	}
+	placement = export()
+	placement.Circles[0].VirtualNodes = 128
+	placement.Circles = append(placement.Circles, &CirclePlacement{Id: 1})
+	if diffs := ip.VerifyPlacement(placement); len(diffs) != 3 {
+		t.Errorf("ring differences not found: %v", diffs)
+	}
+}
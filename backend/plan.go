@@ -0,0 +1,171 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// TopologyPlan is the measurements moved by a backend change of circle, which is computed without any transfer,
+// the series are counted on the current backends and the bytes are estimated from the disk bytes of databases
+type TopologyPlan struct {
+	CircleId int         `json:"circle_id"` // nolint:golint
+	Moves    []*PlanMove `json:"moves"`
+	Spread   []string    `json:"spread"`
+	Series   int64       `json:"series"`
+	Bytes    int64       `json:"bytes"`
+}
+
+type PlanMove struct {
+	Db     string   `json:"db"`
+	Meas   string   `json:"meas"`
+	From   []string `json:"from"`
+	To     []string `json:"to"`
+	Series int64    `json:"series"`
+	Bytes  int64    `json:"bytes"`
+}
+
+// PlanAddBackend returns the plan of adding the backend to the circle, for the databases of dbs or all databases
+func (ip *Proxy) PlanAddBackend(circleId int, bkcfg *BackendConfig, dbs []string) (*TopologyPlan, error) { // nolint:golint
+	return ip.planBackends(circleId, addBackendConfig(bkcfg), dbs)
+}
+
+// PlanRemoveBackend returns the plan of removing the backend of name from the circle
+func (ip *Proxy) PlanRemoveBackend(circleId int, name string, dbs []string) (*TopologyPlan, error) { // nolint:golint
+	return ip.planBackends(circleId, removeBackendConfig(name), dbs)
+}
+
+func (ip *Proxy) planBackends(circleId int, update func([]*BackendConfig) ([]*BackendConfig, error), dbs []string) (*TopologyPlan, error) { // nolint:golint
+	ip.circlesLock.Lock()
+	cfg, err := ip.changeBackends(circleId, update)
+	if err != nil {
+		ip.circlesLock.Unlock()
+		return nil, err
+	}
+	old := ip.Circles[circleId]
+	planned := ip.rebuildCircle(cfg, circleId, func(bkcfg *BackendConfig, _ *ProxyConfig) *Backend {
+		return NewSimpleBackend(bkcfg)
+	})
+	ip.circlesLock.Unlock()
+
+	plan := &TopologyPlan{CircleId: circleId, Moves: make([]*PlanMove, 0), Spread: make([]string, 0)}
+	stats := NewPlanStats()
+	measurements := ip.collectMeasurements(old.Backends, dbs)
+	for _, db := range sortedKeys(measurements) {
+		if !ip.dbCircles.Contains(db, circleId) {
+			continue
+		}
+		// the databases spread by tags are on all backends, which are skipped by transfer
+		if ip.shardKeys.Spread(db) {
+			plan.Spread = append(plan.Spread, db)
+			continue
+		}
+		for _, meas := range measurements[db] {
+			key := ip.shardKeys.Key(db, meas, nil)
+			from, to := old.GetReplicas(key), planned.GetReplicas(key)
+			if reflect.DeepEqual(backendNames(from), backendNames(to)) {
+				continue
+			}
+			move := &PlanMove{Db: db, Meas: meas, From: backendNames(from), To: backendNames(to)}
+			for _, be := range from {
+				if be.IsActive() {
+					move.Series, move.Bytes = stats.Estimate(be, db, meas)
+					break
+				}
+			}
+			plan.Moves = append(plan.Moves, move)
+			plan.Series += move.Series
+			plan.Bytes += move.Bytes
+		}
+	}
+	return plan, nil
+}
+
+// PlanStats caches the series cardinalities and the disk bytes of databases queried from the backends
+type PlanStats struct {
+	series map[*Backend]map[string]map[string]int64
+	bytes  map[*Backend]map[string]int64
+	lock   sync.Mutex
+}
+
+func NewPlanStats() *PlanStats {
+	return &PlanStats{
+		series: make(map[*Backend]map[string]map[string]int64),
+		bytes:  make(map[*Backend]map[string]int64),
+	}
+}
+
+// Estimate returns the series of the measurement, and the bytes in proportion to the series of the database
+func (ps *PlanStats) Estimate(be *Backend, db, meas string) (series, bytes int64) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if ps.series[be] == nil {
+		ps.series[be] = make(map[string]map[string]int64)
+	}
+	if ps.series[be][db] == nil {
+		ps.series[be][db] = getSeriesCardinalities(be, db)
+	}
+	if ps.bytes[be] == nil {
+		ps.bytes[be] = getDiskBytes(be)
+	}
+	var total int64
+	for _, n := range ps.series[be][db] {
+		total += n
+	}
+	series = ps.series[be][db][meas]
+	if total > 0 {
+		bytes = int64(float64(ps.bytes[be][db]) * float64(series) / float64(total))
+	}
+	return
+}
+
+// getSeriesCardinalities returns the exact series cardinality of each measurement in the database
+func getSeriesCardinalities(be *Backend, db string) map[string]int64 {
+	cardinalities := make(map[string]int64)
+	body, err := be.QueryIQL("GET", db, "show series exact cardinality", "")
+	if err != nil {
+		return cardinalities
+	}
+	series, _ := SeriesFromResponseBytes(body)
+	for _, s := range series {
+		if len(s.Values) > 0 && len(s.Values[0]) > 0 {
+			cardinalities[s.Name], _ = toInt(s.Values[0][0])
+		}
+	}
+	return cardinalities
+}
+
+// getDiskBytes returns the disk bytes of each database summed from the shard stats
+func getDiskBytes(be *Backend) map[string]int64 {
+	bytes := make(map[string]int64)
+	body, err := be.QueryIQL("GET", "", "show stats for 'shard'", "")
+	if err != nil {
+		return bytes
+	}
+	series, _ := SeriesFromResponseBytes(body)
+	for _, s := range series {
+		for i, column := range s.Columns {
+			if column != "diskBytes" {
+				continue
+			}
+			for _, value := range s.Values {
+				n, _ := toInt(value[i])
+				bytes[s.Tags["database"]] += n
+			}
+		}
+	}
+	return bytes
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
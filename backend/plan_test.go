@@ -0,0 +1,67 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPlanBackends(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var series []string
+		switch q := req.FormValue("q"); q {
+		case "show databases":
+			series = append(series, `{"name":"databases","columns":["name"],"values":[["db"]]}`)
+		case "show measurements":
+			var values []string
+			for i := 0; i < 20; i++ {
+				values = append(values, fmt.Sprintf(`["m%d"]`, i))
+			}
+			series = append(series, fmt.Sprintf(`{"name":"measurements","columns":["name"],"values":[%s]}`, strings.Join(values, ",")))
+		case "show series exact cardinality":
+			for i := 0; i < 20; i++ {
+				series = append(series, fmt.Sprintf(`{"name":"m%d","columns":["count"],"values":[[2]]}`, i))
+			}
+		case "show stats for 'shard'":
+			series = append(series, `{"name":"shard","tags":{"database":"db"},"columns":["diskBytes"],"values":[[1000]]}`)
+		}
+		fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[%s]}]}`, strings.Join(series, ","))
+	}))
+	defer ts.Close()
+
+	cfg := &ProxyConfig{Circles: []*CircleConfig{{
+		Name:     "circle-1",
+		Backends: []*BackendConfig{{Name: "b1", Url: ts.URL}, {Name: "b2", Url: ts.URL}, {Name: "b3", Url: ts.URL}},
+	}}}
+	cfg.setDefault()
+	backends := make([]*Backend, 0)
+	for _, bkcfg := range cfg.Circles[0].Backends {
+		backends = append(backends, NewSimpleBackend(bkcfg))
+	}
+	ip := &Proxy{Circles: []*Circle{newCircle(cfg.Circles[0], cfg, 0, backends)}, config: cfg}
+
+	if _, err := ip.PlanRemoveBackend(0, "b4", nil); err != ErrBackendNotFound {
+		t.Fatalf("plan removing unknown backend error: %v", err)
+	}
+	plan, err := ip.PlanRemoveBackend(0, "b3", nil)
+	if err != nil {
+		t.Fatalf("plan error: %v", err)
+	}
+	if len(plan.Moves) == 0 || plan.Series != int64(2*len(plan.Moves)) || plan.Bytes != int64(50*len(plan.Moves)) {
+		t.Fatalf("plan moves: %d, series: %d, bytes: %d", len(plan.Moves), plan.Series, plan.Bytes)
+	}
+	for _, move := range plan.Moves {
+		if len(move.From) != 1 || move.From[0] != "b3" || move.To[0] == "b3" {
+			t.Errorf("move of %s from %v to %v", move.Meas, move.From, move.To)
+		}
+	}
+	if len(ip.Circles[0].Backends) != 3 {
+		t.Errorf("circle changed by plan")
+	}
+}
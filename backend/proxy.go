@@ -5,10 +5,13 @@
 package backend
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,8 +21,36 @@ import (
 )
 
 type Proxy struct {
-	Circles []*Circle
-	dbSet   util.Set
+	Circles       []*Circle // read by AllCircles, replaced under circlesLock
+	circlesLock   sync.RWMutex
+	config        *ProxyConfig
+	Etcd          *Etcd
+	dbSet         util.Set
+	dbLock        sync.RWMutex
+	keepPrecision bool
+	wal           *WAL
+	walLock       sync.RWMutex
+	WriteErrors   *WriteErrors
+	backfill      *Backfill
+	transforms    *Transforms
+	Queries       *Queries
+	Quota         *QueryQuota
+	RateLimiter   *RateLimiter
+	Templates     *QueryTemplates
+	limits        *QueryLimits
+	cqs           []*ContinuousQuery
+	readRouter    *ReadRouter
+	readRepair    *ReadRepair
+	queryTimeout  time.Duration
+	rules         QueryRules
+	metaCache     *MetaCache
+	hedgeDelay    time.Duration
+	shardKeys     ShardKeys
+	dbCircles     DBCircles
+	hints         *Hints
+	destructive   bool
+	mergeMaxSize  int
+	writeStats    WriteStats
 }
 
 func NewProxy(cfg *ProxyConfig) (ip *Proxy) {
@@ -29,19 +60,104 @@ func NewProxy(cfg *ProxyConfig) (ip *Proxy) {
 		return
 	}
 	ip = &Proxy{
-		Circles: make([]*Circle, len(cfg.Circles)),
-		dbSet:   util.NewSet(),
+		Circles:       make([]*Circle, len(cfg.Circles)),
+		config:        cfg,
+		dbSet:         util.NewSet(),
+		keepPrecision: cfg.KeepPrecision,
+		destructive:   cfg.AllowDestructive,
+		mergeMaxSize:  cfg.MergeMaxSize,
+		WriteErrors:   NewWriteErrors(),
+		Queries:       NewQueries(),
+		Quota:         NewQueryQuota(cfg),
+		RateLimiter:   NewRateLimiter(cfg),
+		Templates:     NewQueryTemplates(),
+		limits:        NewQueryLimits(cfg),
+		readRouter:    NewReadRouter(cfg),
+		readRepair:    NewReadRepair(cfg),
+		queryTimeout:  time.Duration(cfg.QueryTimeout) * time.Second,
+		metaCache:     NewMetaCache(cfg),
+		hedgeDelay:    time.Duration(cfg.HedgeDelay) * time.Millisecond,
+		shardKeys:     NewShardKeys(cfg),
+		dbCircles:     NewDBCircles(cfg),
+		Etcd:          NewEtcd(cfg),
+		hints:         NewHints(cfg),
 	}
 	for idx, circfg := range cfg.Circles {
 		ip.Circles[idx] = NewCircle(circfg, cfg, idx)
+		if cfg.ZoneAware {
+			ip.Circles[idx].avoidZones = ip.zonesBefore(idx)
+		}
 	}
 	for _, db := range cfg.DBList {
 		ip.dbSet.Add(db)
 	}
 	rand.Seed(time.Now().UnixNano())
+	ip.transforms, err = NewTransforms(cfg.Transforms)
+	if err != nil {
+		log.Fatalf("load transforms error: %s", err)
+		return
+	}
+	ip.rules, err = NewQueryRules(cfg.QueryRules)
+	if err != nil {
+		log.Fatalf("load query rules error: %s", err)
+		return
+	}
+	ip.backfill = NewBackfill(ip, cfg)
+	if cfg.WriteDurable {
+		ip.wal, err = NewWAL(filepath.Join(cfg.DataDir, "wal"))
+		if err != nil {
+			log.Fatalf("create wal error: %s", err)
+			return
+		}
+		ip.wal.Replay(func(db, rp, precision string, p []byte) {
+			ip.write(p, db, rp, precision)
+		})
+		go ip.checkpointWAL(time.Duration(cfg.FlushTime) * time.Second)
+	}
+	go ip.forwardHints(time.Duration(cfg.RewriteInterval) * time.Second)
+	if ip.Quota.HasMaxSeries() && len(ip.AllCircles()) > 0 {
+		go ip.refreshSeries(time.Duration(cfg.QuotaRefresh) * time.Second)
+	}
+	for _, cqcfg := range cfg.ContinuousQueries {
+		cq, err := NewContinuousQuery(cqcfg)
+		if err != nil {
+			log.Fatalf("create continuous query error: %s", err)
+			return
+		}
+		ip.cqs = append(ip.cqs, cq)
+		go ip.runContinuousQuery(cq)
+	}
 	return
 }
 
+// checkpointWAL removes the wal segments whose data have been flushed by all backends
+func (ip *Proxy) checkpointWAL(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		// wait for in-flight writes so that their points have been sent to backends
+		ip.walLock.Lock()
+		seq, ok, err := ip.wal.Rotate()
+		ip.walLock.Unlock()
+		if err != nil {
+			log.Printf("rotate wal error: %s", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		var wg sync.WaitGroup
+		for _, be := range ip.GetAllBackends() {
+			wg.Add(1)
+			go func(be *Backend) {
+				defer wg.Done()
+				be.Sync()
+			}(be)
+		}
+		wg.Wait()
+		ip.wal.Remove(seq)
+	}
+}
+
 func GetKey(db, meas string) string {
 	var b strings.Builder
 	b.Grow(len(db) + len(meas) + 1)
@@ -51,30 +167,359 @@ func GetKey(db, meas string) string {
 	return b.String()
 }
 
-func (ip *Proxy) GetBackends(key string) []*Backend {
-	backends := make([]*Backend, len(ip.Circles))
-	for i, circle := range ip.Circles {
-		backends[i] = circle.GetBackend(key)
+// AllCircles returns the circles published, which are replaced as a whole under lock rather than changed in place
+func (ip *Proxy) AllCircles() []*Circle {
+	ip.circlesLock.RLock()
+	defer ip.circlesLock.RUnlock()
+	return ip.Circles
+}
+
+// currentConfig returns the config of circles, which is replaced instead of changed in place under circlesLock
+func (ip *Proxy) currentConfig() *ProxyConfig {
+	ip.circlesLock.RLock()
+	defer ip.circlesLock.RUnlock()
+	return ip.config
+}
+
+// GetCircles returns the circles of the databases, which are all circles if the databases are not pinned
+func (ip *Proxy) GetCircles(dbs ...string) []*Circle {
+	return ip.dbCircles.Filter(ip.AllCircles(), dbs...)
+}
+
+// GetBackends returns the replicas of the key to write in the circles of db
+func (ip *Proxy) GetBackends(db, key string) []*Backend {
+	circles := ip.GetCircles(db)
+	backends := make([]*Backend, 0, len(circles))
+	for _, circle := range circles {
+		if circle.SkipWrite() {
+			continue
+		}
+		backends = append(backends, circle.GetWriteReplicas(key)...)
+	}
+	return backends
+}
+
+// GetBackendsByMeasurement returns the replicas of the measurement in the circles of db,
+// which are all the backends if the measurement is spread by tags
+func (ip *Proxy) GetBackendsByMeasurement(db, meas string) []*Backend {
+	var backends []*Backend
+	for _, circle := range ip.GetCircles(db) {
+		backends = append(backends, circle.GetReplicasByMeasurements(db, []string{meas})...)
 	}
 	return backends
 }
 
+// AddCircle checks the circle along with the existing circles and adds it at runtime, without saving it to config file
+func (ip *Proxy) AddCircle(circfg *CircleConfig) (circle *Circle, err error) {
+	if circle, err = ip.addCircle(circfg); err == nil {
+		ip.publishCircles()
+	}
+	return
+}
+
+func (ip *Proxy) addCircle(circfg *CircleConfig) (circle *Circle, err error) {
+	ip.circlesLock.Lock()
+	defer ip.circlesLock.Unlock()
+	cfg := *ip.config
+	cfg.Circles = append(append(make([]*CircleConfig, 0, len(ip.config.Circles)+1), ip.config.Circles...), circfg)
+	cfg.setDefault()
+	if err = cfg.checkConfig(); err != nil {
+		return
+	}
+	circle = NewCircle(circfg, &cfg, len(ip.Circles))
+	if cfg.ZoneAware {
+		circle.avoidZones = ip.zonesBefore(circle.CircleId)
+	}
+	ip.config = &cfg
+	// the circles are replaced instead of appended in place since they are still used by readers of the old ones
+	ip.Circles = append(append(make([]*Circle, 0, len(ip.Circles)+1), ip.Circles...), circle)
+	log.Printf("circle %d added: %d backends loaded, hash algorithm: %s, replicas: %d", circle.CircleId, len(circle.Backends), circfg.HashAlgorithm, circfg.Replicas)
+	return
+}
+
+// AddBackend adds the backend to the circle at runtime and saves it to config file, only the ring of circle is rebuilt
+func (ip *Proxy) AddBackend(circleId int, bkcfg *BackendConfig) (circle *Circle, err error) { // nolint:golint
+	circle, err = ip.updateBackends(circleId, addBackendConfig(bkcfg))
+	if err == nil {
+		ip.publishCircles()
+	}
+	return
+}
+
+// RemoveBackend removes the backend of name from the circle at runtime and saves it to config file,
+// the backend is not closed so that the points in flight and cached are still written before rebalance
+func (ip *Proxy) RemoveBackend(circleId int, name string) (circle *Circle, err error) { // nolint:golint
+	circle, err = ip.updateBackends(circleId, removeBackendConfig(name))
+	if err == nil {
+		ip.publishCircles()
+	}
+	return
+}
+
+func addBackendConfig(bkcfg *BackendConfig) func([]*BackendConfig) ([]*BackendConfig, error) {
+	return func(bkcfgs []*BackendConfig) ([]*BackendConfig, error) {
+		return append(append(make([]*BackendConfig, 0, len(bkcfgs)+1), bkcfgs...), bkcfg), nil
+	}
+}
+
+func removeBackendConfig(name string) func([]*BackendConfig) ([]*BackendConfig, error) {
+	return func(bkcfgs []*BackendConfig) ([]*BackendConfig, error) {
+		backends := make([]*BackendConfig, 0, len(bkcfgs))
+		for _, bkcfg := range bkcfgs {
+			if bkcfg.Name != name {
+				backends = append(backends, bkcfg)
+			}
+		}
+		if len(backends) == len(bkcfgs) {
+			return nil, ErrBackendNotFound
+		}
+		return backends, nil
+	}
+}
+
+// SyncCircles applies the circles changed by other proxies, the circles added are appended and the backends of
+// the existing circles are replaced, it returns the ids of circles updated and added, while removing is not supported
+func (ip *Proxy) SyncCircles(circfgs []*CircleConfig) (updated, added []int) {
+	if n := len(ip.AllCircles()); len(circfgs) < n {
+		log.Printf("sync circles error: %d circles less than %d, removing circles is not supported", len(circfgs), n)
+		return
+	}
+	for id, circfg := range circfgs {
+		if id >= len(ip.AllCircles()) {
+			if _, err := ip.addCircle(circfg); err != nil {
+				log.Printf("sync circles error: %s, circle: %d", err, id)
+				return
+			}
+			added = append(added, id)
+			continue
+		}
+		if sameBackends(ip.currentConfig().Circles[id].Backends, circfg.Backends) {
+			continue
+		}
+		_, err := ip.updateBackends(id, func([]*BackendConfig) ([]*BackendConfig, error) {
+			return circfg.Backends, nil
+		})
+		if err != nil {
+			log.Printf("sync circles error: %s, circle: %d", err, id)
+			return
+		}
+		updated = append(updated, id)
+	}
+	return
+}
+
+// publishCircles puts the circles to etcd so that the other proxies apply them
+func (ip *Proxy) publishCircles() {
+	if ip.Etcd == nil {
+		return
+	}
+	b, err := MarshalCircles(ip.currentConfig().Circles)
+	if err == nil {
+		err = ip.Etcd.Put(EtcdCircles, b)
+	}
+	if err != nil {
+		log.Printf("publish circles error: %s", err)
+	}
+}
+
+// SetDBList replaces the database whitelist at runtime
+func (ip *Proxy) SetDBList(dbs []string) {
+	dbSet := util.NewSet()
+	for _, db := range dbs {
+		dbSet.Add(db)
+	}
+	ip.dbLock.Lock()
+	defer ip.dbLock.Unlock()
+	ip.dbSet = dbSet
+}
+
+func sameBackends(a, b []*BackendConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Url != b[i].Url {
+			return false
+		}
+	}
+	return true
+}
+
+func (ip *Proxy) updateBackends(circleId int, update func([]*BackendConfig) ([]*BackendConfig, error)) (circle *Circle, err error) { // nolint:golint
+	ip.circlesLock.Lock()
+	defer ip.circlesLock.Unlock()
+	cfg, err := ip.changeBackends(circleId, update)
+	if err != nil {
+		return
+	}
+	if err = cfg.SaveCircles(); err != nil {
+		return
+	}
+	circle = ip.rebuildCircle(cfg, circleId, NewBackend)
+	ip.config = cfg
+	circles := append(make([]*Circle, 0, len(ip.Circles)), ip.Circles...)
+	circles[circleId] = circle
+	ip.Circles = circles
+	if cfg.ZoneAware {
+		// the placement of the later circles avoids the zones of this one
+		for _, c := range circles[circleId+1:] {
+			c.resetCache()
+		}
+	}
+	log.Printf("circle %d updated: %d backends loaded", circleId, len(circle.Backends))
+	return
+}
+
+// changeBackends returns the copy of config whose backends of the circle are updated and checked
+func (ip *Proxy) changeBackends(circleId int, update func([]*BackendConfig) ([]*BackendConfig, error)) (*ProxyConfig, error) { // nolint:golint
+	cfg := *ip.config
+	cfg.Circles = append(make([]*CircleConfig, 0, len(ip.config.Circles)), ip.config.Circles...)
+	circfg := *cfg.Circles[circleId]
+	var err error
+	if circfg.Backends, err = update(circfg.Backends); err != nil {
+		return nil, err
+	}
+	cfg.Circles[circleId] = &circfg
+	cfg.setDefault()
+	if err = cfg.checkConfig(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// rebuildCircle rebuilds the circle of the config, the existing backends are reused by name and the others are created
+func (ip *Proxy) rebuildCircle(cfg *ProxyConfig, circleId int, newBackend func(*BackendConfig, *ProxyConfig) *Backend) *Circle { // nolint:golint
+	circfg := cfg.Circles[circleId]
+	old := ip.Circles[circleId]
+	existing := make(map[string]*Backend)
+	for _, be := range old.Backends {
+		existing[be.Name] = be
+	}
+	backends := make([]*Backend, len(circfg.Backends))
+	for idx, bkcfg := range circfg.Backends {
+		if be, ok := existing[bkcfg.Name]; ok {
+			backends[idx] = be
+		} else {
+			backends[idx] = newBackend(bkcfg, cfg)
+		}
+	}
+	return old.rebuild(circfg, cfg, backends)
+}
+
+// zonesBefore returns the zones where the replicas of key are placed in the circles before circleId
+func (ip *Proxy) zonesBefore(circleId int) func(key string) map[string]bool { // nolint:golint
+	return func(key string) map[string]bool {
+		zones := make(map[string]bool)
+		circles := ip.AllCircles()
+		for _, circle := range circles[:circleId] {
+			for _, be := range circle.GetReplicas(key) {
+				if be.Zone != "" {
+					zones[be.Zone] = true
+				}
+			}
+		}
+		return zones
+	}
+}
+
 func (ip *Proxy) GetAllBackends() []*Backend {
+	circles := ip.AllCircles()
 	capacity := 0
-	for _, circle := range ip.Circles {
+	for _, circle := range circles {
 		capacity += len(circle.Backends)
 	}
 	backends := make([]*Backend, 0, capacity)
-	for _, circle := range ip.Circles {
+	for _, circle := range circles {
 		backends = append(backends, circle.Backends...)
 	}
 	return backends
 }
 
+// ReloadCerts reloads the client certificates of all backends including the cold tiers, the first error is returned
+func (ip *Proxy) ReloadCerts() (err error) {
+	for _, circle := range ip.AllCircles() {
+		backends := circle.Backends
+		if circle.Cold != nil {
+			backends = append(append(make([]*Backend, 0, len(backends)+len(circle.Cold.Backends)), backends...), circle.Cold.Backends...)
+		}
+		for _, be := range backends {
+			if rerr := be.ReloadCert(); rerr != nil && err == nil {
+				err = fmt.Errorf("backend %s: %s", be.Name, rerr)
+			}
+		}
+	}
+	return
+}
+
+// ReencryptBackends encrypts the usernames and passwords of the backends with auth_encrypt by the current cipher key,
+// including the ones by database, and saves them to config file. It returns the number of backends encrypted again, the secret references are skipped
+func (ip *Proxy) ReencryptBackends() (n int, err error) {
+	ip.circlesLock.Lock()
+	defer ip.circlesLock.Unlock()
+	cfg := *ip.config
+	cfg.Circles = make([]*CircleConfig, len(ip.config.Circles))
+	reencrypt := func(bkcfgs []*BackendConfig) ([]*BackendConfig, error) {
+		if bkcfgs == nil {
+			return nil, nil
+		}
+		backends := make([]*BackendConfig, len(bkcfgs))
+		for i, bkcfg := range bkcfgs {
+			backend := *bkcfg
+			backends[i] = &backend
+			if !backend.AuthEncrypt {
+				continue
+			}
+			values := []*string{&backend.Username, &backend.Password}
+			if backend.Credentials != nil {
+				backend.Credentials = make(Credentials, len(bkcfg.Credentials))
+				for db, crcfg := range bkcfg.Credentials {
+					credential := *crcfg
+					backend.Credentials[db] = &credential
+					values = append(values, &credential.Username, &credential.Password)
+				}
+			}
+			changed := false
+			for _, value := range values {
+				if IsSecretRef(*value) || util.IsCurrentCipher(*value) {
+					continue
+				}
+				if *value, err = util.AesReencrypt(*value); err != nil {
+					return nil, fmt.Errorf("backend %s: %s", backend.Name, err)
+				}
+				changed = true
+			}
+			if changed {
+				n++
+			}
+		}
+		return backends, nil
+	}
+	for i, circfg := range ip.config.Circles {
+		circle := *circfg
+		if circle.Backends, err = reencrypt(circfg.Backends); err != nil {
+			return
+		}
+		if circle.ColdBackends, err = reencrypt(circfg.ColdBackends); err != nil {
+			return
+		}
+		cfg.Circles[i] = &circle
+	}
+	if n == 0 {
+		return
+	}
+	if err = cfg.SaveCircles(); err != nil {
+		return
+	}
+	ip.config = &cfg
+	ip.publishCircles()
+	return
+}
+
 func (ip *Proxy) GetHealth(stats bool) []interface{} {
 	var wg sync.WaitGroup
-	health := make([]interface{}, len(ip.Circles))
-	for i, c := range ip.Circles {
+	circles := ip.AllCircles()
+	health := make([]interface{}, len(circles))
+	for i, c := range circles {
 		wg.Add(1)
 		go func(i int, c *Circle) {
 			defer wg.Done()
@@ -86,28 +531,44 @@ func (ip *Proxy) GetHealth(stats bool) []interface{} {
 }
 
 func (ip *Proxy) IsForbiddenDB(db string) bool {
+	ip.dbLock.RLock()
+	defer ip.dbLock.RUnlock()
 	return len(ip.dbSet) > 0 && !ip.dbSet[db]
 }
 
 func (ip *Proxy) QueryFlux(w http.ResponseWriter, req *http.Request, qr *QueryRequest) (err error) {
 	var bucket, meas string
+	var mms []string
 	if qr.Query != "" {
-		bucket, meas, err = ScanQuery(qr.Query)
+		bucket, err = ParseQueryBucket(qr.Query)
+		if err != nil {
+			return
+		}
+		// fan out to the backends of one circle if the measurements can't be determined
+		mms, _ = ParseQueryMeasurements(qr.Query)
 	} else if qr.Spec != nil {
 		bucket, meas, err = ScanSpec(qr.Spec)
-	}
-	if err != nil {
-		return
+		if bucket == "" && err != nil {
+			return
+		}
+		if meas != "" && err == nil {
+			mms = []string{meas}
+		}
 	}
 	if bucket == "" {
 		return ErrGetBucket
-	} else if ip.IsForbiddenDB(bucket) {
-		return fmt.Errorf("database forbidden: %s", bucket)
 	}
-	if meas == "" {
-		return ErrGetMeasurement
+	db := GetDatabaseFromBucket(bucket)
+	if ip.IsForbiddenDB(db) {
+		return fmt.Errorf("database forbidden: %s", db)
 	}
-	return QueryFlux(w, req, ip, bucket, meas)
+	if err = Authorize(req, db, PrivilegeRead); err != nil {
+		return
+	}
+	if len(mms) == 1 && !ip.shardKeys.Spread(db) {
+		return QueryFlux(w, req, ip, db, mms[0])
+	}
+	return QueryFluxMerged(w, req, ip, db, mms)
 }
 
 func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, err error) {
@@ -115,12 +576,47 @@ func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, e
 	if q == "" {
 		return nil, ErrEmptyQuery
 	}
+	stmts := SplitStatements(q)
+	// the rules are enforced before any backend is contacted
+	now := time.Now()
+	for _, stmt := range stmts {
+		if err = ip.rules.Check(stmt, now); err != nil {
+			return
+		}
+	}
+	if len(stmts) > 1 {
+		return QueryMultiQL(w, req, ip, stmts)
+	}
 
 	tokens, check, from := CheckQuery(q)
+	if stmt := GetHeadStmtFromTokens(tokens, 2); stmt == "show queries" {
+		return marshalResponse(w, req, ip.Queries.Series(queryOwner(req)))
+	} else if stmt == "kill query" {
+		return ip.killQuery(w, req, tokens)
+	} else if GetHeadStmtFromTokens(tokens, 3) == "show continuous queries" {
+		return marshalResponse(w, req, ip.ShowContinuousQueries())
+	} else if strings.ToLower(tokens[0]) == "explain" {
+		return ip.explainQuery(w, req, q)
+	}
 	if !check {
 		return nil, ErrIllegalQL
 	}
 
+	db, alterDb, err := ip.queryDatabase(req, tokens)
+	if err != nil {
+		return
+	}
+
+	req, rq, done := ip.Queries.Attach(req, db, q)
+	defer done()
+	body, err = ip.query(w, req, tokens, db, from, alterDb)
+	if err != nil && ip.Queries.Killed(rq) {
+		err = ErrQueryKilled
+	}
+	return
+}
+
+func (ip *Proxy) queryDatabase(req *http.Request, tokens []string) (db string, alterDb bool, err error) {
 	checkDb, showDb, alterDb, db := CheckDatabaseFromTokens(tokens)
 	if !checkDb {
 		db, _ = GetDatabaseFromTokens(tokens)
@@ -130,101 +626,233 @@ func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, e
 	}
 	if !showDb {
 		if db == "" {
-			return nil, ErrDatabaseNotFound
+			return "", false, ErrDatabaseNotFound
 		}
 		if ip.IsForbiddenDB(db) {
-			return nil, fmt.Errorf("database forbidden: %s", db)
+			return "", false, fmt.Errorf("database forbidden: %s", db)
 		}
 	}
+	// the select and show statements require read privilege, the others like select into, delete and drop require write
+	privilege := PrivilegeWrite
+	if CheckSelectOrShowFromTokens(tokens) && !CheckIntoFromTokens(tokens) {
+		privilege = PrivilegeRead
+	}
+	if db != "" {
+		if err = Authorize(req, db, privilege); err != nil {
+			return "", false, err
+		}
+	}
+	destructive := CheckDestructiveFromTokens(tokens)
+	if destructive {
+		if err = AuthorizeDestructive(req, db, ip.destructive); err != nil {
+			return "", false, err
+		}
+	}
+	// the databases of fully qualified measurements are checked as well for cross database queries
+	if dbs, _, err := GetSourcesFromTokens(tokens); err == nil {
+		for _, d := range dbs {
+			if d != "" && ip.IsForbiddenDB(d) {
+				return "", false, fmt.Errorf("database forbidden: %s", d)
+			}
+			if d != "" {
+				if err = Authorize(req, d, privilege); err != nil {
+					return "", false, err
+				}
+				if destructive {
+					if err = AuthorizeDestructive(req, d, ip.destructive); err != nil {
+						return "", false, err
+					}
+				}
+			}
+		}
+	}
+	return
+}
 
+func (ip *Proxy) query(w http.ResponseWriter, req *http.Request, tokens []string, db string, from, alterDb bool) (body []byte, err error) {
 	selectOrShow := CheckSelectOrShowFromTokens(tokens)
-	if selectOrShow && from {
+	if selectOrShow && from && CheckIntoFromTokens(tokens) {
+		return QueryIntoQL(w, req, ip, db)
+	} else if selectOrShow && from {
 		return QueryFromQL(w, req, ip, tokens, db)
 	} else if selectOrShow && !from {
 		return QueryShowQL(w, req, ip, tokens)
 	} else if CheckDeleteOrDropMeasurementFromTokens(tokens) {
+		defer ip.metaCache.Invalidate()
 		return QueryDeleteOrDropQL(w, req, ip, tokens, db)
+	} else if GetHeadStmtFromTokens(tokens, 2) == "drop shard" {
+		return QueryDropShardQL(w, req, ip, tokens)
 	} else if alterDb || CheckRetentionPolicyFromTokens(tokens) {
+		defer ip.metaCache.Invalidate()
 		return QueryAlterQL(w, req, ip)
 	}
 	return nil, ErrIllegalQL
 }
 
+func (ip *Proxy) killQuery(w http.ResponseWriter, req *http.Request, tokens []string) (body []byte, err error) {
+	if len(tokens) < 3 {
+		return nil, ErrIllegalQL
+	}
+	id, err := strconv.ParseInt(tokens[2], 10, 64)
+	if err != nil {
+		return nil, ErrIllegalQL
+	}
+	err = ip.Queries.Kill(id, queryOwner(req))
+	if err != nil {
+		return
+	}
+	return marshalResponse(w, req, ResponseFromResults([]*Result{{}}))
+}
+
 func (ip *Proxy) Write(p []byte, db, rp, precision string) (err error) {
-	var (
-		pos   int
-		block []byte
-	)
-	for pos < len(p) {
-		pos, block = ScanLine(p, pos)
-		pos++
-
-		if len(block) == 0 {
-			continue
-		}
-		start := SkipWhitespace(block, 0)
-		if start >= len(block) || block[start] == '#' {
-			continue
-		}
-		if block[len(block)-1] == '\n' {
-			block = block[:len(block)-1]
+	if ip.wal != nil {
+		ip.walLock.RLock()
+		defer ip.walLock.RUnlock()
+		err = ip.wal.Append(db, rp, precision, p)
+		if err != nil {
+			return
 		}
+	}
+	ip.writeStats.AddWrite(ip.write(p, db, rp, precision), len(p))
+	return
+}
 
-		line := make([]byte, len(block[start:]))
-		copy(line, block[start:])
+// WriteBackfill writes historical data with low priority, it's not covered by write_durable
+func (ip *Proxy) WriteBackfill(p []byte, db, rp, precision string) error {
+	return ip.backfill.Write(p, db, rp, precision)
+}
+
+// write returns the number of lines written
+func (ip *Proxy) write(p []byte, db, rp, precision string) (n int) {
+	ScanLines(p, func(line []byte) {
+		n++
 		ip.WriteRow(line, db, rp, precision)
-	}
+	})
 	return
 }
 
 func (ip *Proxy) WriteRow(line []byte, db, rp, precision string) {
+	ip.routeRow(line, db, rp, precision, func(be *Backend, point *LinePoint) {
+		err := be.WritePoint(point)
+		if err != nil {
+			ip.dropRow(line, db, rp, precision)
+			log.Printf("write data to buffer error: %s, url: %s, db: %s, rp: %s, precision: %s, line: %s", err, be.Url, db, rp, precision, string(line))
+		}
+	})
+}
+
+// dropRow counts the line failed to write to the buffer of backend
+func (ip *Proxy) dropRow(line []byte, db, rp, precision string) {
+	meas, _ := ScanKey(line)
+	ip.WriteErrors.Add(db, rp, precision, meas, ReasonBackendClosed, line)
+	ip.writeStats.AddDropped(ReasonBackendClosed, 1)
+}
+
+// routeRow calls fn with every backend to write of the circles and the point in the precision of circle, the
+// fallback replaces the owner with the hint recorded. It returns false if the line is dropped
+func (ip *Proxy) routeRow(line []byte, db, rp, precision string, fn func(be *Backend, point *LinePoint)) bool {
+	if line = ip.transforms.Apply(db, rp, precision, line); line == nil {
+		ip.writeStats.AddDropped(ReasonTransform, 1)
+		return false
+	}
+	var keepLine []byte
+	if ip.keepPrecision {
+		keepLine = AppendTime(line, precision)
+	}
 	nanoLine := AppendNano(line, precision)
+	key, ok := ip.checkRow(line, nanoLine, db, rp, precision)
+	if !ok {
+		return false
+	}
+
+	nanoPoint := &LinePoint{db, rp, "ns", nanoLine}
+	keepPoint := &LinePoint{db, rp, precision, keepLine}
+	for _, circle := range ip.GetCircles(db) {
+		if circle.SkipWrite() {
+			continue
+		}
+		point := nanoPoint
+		if !circle.NanoPrecision {
+			point = keepPoint
+		}
+		for _, be := range circle.GetWriteReplicas(key) {
+			if fallback := circle.GetFallback(be); fallback != nil {
+				ip.hint(circle, be, fallback, nanoLine, db, rp)
+				be = fallback
+			}
+			fn(be, point)
+		}
+	}
+	return true
+}
+
+// hint records the point written to the fallback, which is forwarded to the owner later
+func (ip *Proxy) hint(circle *Circle, owner, fallback *Backend, nanoLine []byte, db, rp string) {
+	meas, err := ScanKey(nanoLine)
+	if err != nil {
+		return
+	}
+	pos, _ := ScanTime(nanoLine)
+	ip.hints.Add(circle.CircleId, owner, fallback, db, rp, meas, BytesToInt64(nanoLine[pos+1:]))
+}
+
+// checkRow validates the line expanded to nanoseconds and returns the key to write
+func (ip *Proxy) checkRow(line, nanoLine []byte, db, rp, precision string) (key string, ok bool) {
 	meas, err := ScanKey(nanoLine)
 	if err != nil {
 		log.Printf("scan key error: %s", err)
+		ip.WriteErrors.Add(db, rp, precision, "", ReasonScanKey, line)
+		ip.writeStats.AddDropped(ReasonScanKey, 1)
 		return
 	}
 	if !RapidCheck(nanoLine[len(meas):]) {
 		log.Printf("invalid format, db: %s, rp: %s, precision: %s, line: %s", db, rp, precision, string(line))
+		ip.WriteErrors.Add(db, rp, precision, meas, ReasonInvalidFormat, line)
+		ip.writeStats.AddDropped(ReasonInvalidFormat, 1)
 		return
 	}
 
-	key := GetKey(db, meas)
-	backends := ip.GetBackends(key)
-	if len(backends) == 0 {
+	key = ip.shardKeys.Key(db, meas, func(tag string) string {
+		return ScanTagValue(nanoLine, tag)
+	})
+	if len(ip.GetBackends(db, key)) == 0 {
 		log.Printf("write data error: can't get backends, db: %s, meas: %s", db, meas)
+		ip.WriteErrors.Add(db, rp, precision, meas, ReasonNoBackends, line)
+		ip.writeStats.AddDropped(ReasonNoBackends, 1)
 		return
 	}
-
-	point := &LinePoint{db, rp, nanoLine}
-	for _, be := range backends {
-		err = be.WritePoint(point)
-		if err != nil {
-			log.Printf("write data to buffer error: %s, url: %s, db: %s, rp: %s, precision: %s, line: %s", err, be.Url, db, rp, precision, string(line))
-		}
-	}
+	return key, true
 }
 
 func (ip *Proxy) WritePoints(points []models.Point, db, rp string) error {
 	var err error
-	for _, pt := range points {
-		meas := string(pt.Name())
-		key := GetKey(db, meas)
-		backends := ip.GetBackends(key)
-		if len(backends) == 0 {
-			log.Printf("write point error: can't get backends, db: %s, meas: %s", db, meas)
-			err = ErrEmptyBackends
-			continue
+	if ip.wal != nil {
+		var buf bytes.Buffer
+		for _, pt := range points {
+			buf.WriteString(pt.String())
+			buf.WriteByte('\n')
 		}
-
-		point := &LinePoint{db, rp, []byte(pt.String())}
-		for _, be := range backends {
-			err = be.WritePoint(point)
-			if err != nil {
-				log.Printf("write point to buffer error: %s, url: %s, db: %s, rp: %s, point: %s", err, be.Url, db, rp, pt.String())
-			}
+		ip.walLock.RLock()
+		defer ip.walLock.RUnlock()
+		err = ip.wal.Append(db, rp, "ns", buf.Bytes())
+		if err != nil {
+			return err
 		}
 	}
+	size := 0
+	for _, pt := range points {
+		line := []byte(pt.String())
+		size += len(line) + 1
+		// the points are routed as the lines written, including the transforms, fallbacks and hints
+		ip.routeRow(line, db, rp, "ns", func(be *Backend, point *LinePoint) {
+			if werr := be.WritePoint(point); werr != nil {
+				err = werr
+				ip.dropRow(line, db, rp, "ns")
+				log.Printf("write point to buffer error: %s, url: %s, db: %s, rp: %s, point: %s", werr, be.Url, db, rp, line)
+			}
+		})
+	}
+	ip.writeStats.AddWrite(len(points), size)
 	return err
 }
 
@@ -233,7 +861,14 @@ func (ip *Proxy) ReadProm(w http.ResponseWriter, req *http.Request, db, metric s
 }
 
 func (ip *Proxy) Close() {
-	for _, c := range ip.Circles {
+	// the backfill is flushed to backends before they are closed
+	if ip.backfill != nil {
+		ip.backfill.Close()
+	}
+	for _, c := range ip.AllCircles() {
 		c.Close()
 	}
+	if ip.wal != nil {
+		ip.wal.Close()
+	}
 }
@@ -0,0 +1,106 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+var (
+	ErrQueryKilled   = errors.New("query killed")
+	ErrQueryNotFound = errors.New("no such query id")
+)
+
+type RunningQuery struct {
+	Id     int64 // nolint:golint
+	Query  string
+	Db     string
+	User   string
+	Start  time.Time
+	cancel context.CancelFunc
+	killed bool
+}
+
+// Queries tracks the in-flight queries, so that they can be listed and killed
+type Queries struct {
+	lock    sync.Mutex
+	next    int64
+	queries map[int64]*RunningQuery
+}
+
+func NewQueries() *Queries {
+	return &Queries{queries: make(map[int64]*RunningQuery)}
+}
+
+// Attach registers the query of the user authenticated and returns the request whose context is canceled when
+// the query is killed, the returned function must be called when the query finishes
+func (qs *Queries) Attach(req *http.Request, db, q string) (*http.Request, *RunningQuery, func()) {
+	ctx, cancel := context.WithCancel(req.Context())
+	qs.lock.Lock()
+	qs.next++
+	rq := &RunningQuery{Id: qs.next, Query: q, Db: db, User: GetUser(req), Start: time.Now(), cancel: cancel}
+	qs.queries[rq.Id] = rq
+	qs.lock.Unlock()
+	return req.WithContext(ctx), rq, func() {
+		qs.lock.Lock()
+		delete(qs.queries, rq.Id)
+		qs.lock.Unlock()
+		cancel()
+	}
+}
+
+// Kill kills the query of id, which must be run by the user unless the user is empty
+func (qs *Queries) Kill(id int64, user string) error {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+	rq, ok := qs.queries[id]
+	if !ok || (user != "" && rq.User != user) {
+		return ErrQueryNotFound
+	}
+	rq.killed = true
+	rq.cancel()
+	return nil
+}
+
+func (qs *Queries) Killed(rq *RunningQuery) bool {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+	return rq.killed
+}
+
+// List returns the running queries of the user ordered by id, or of all users if the user is empty
+func (qs *Queries) List(user string) []*RunningQuery {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+	list := make([]*RunningQuery, 0, len(qs.queries))
+	for _, rq := range qs.queries {
+		if user == "" || rq.User == user {
+			list = append(list, rq)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// Series returns the running queries of the user in the format of show queries
+func (qs *Queries) Series(user string) *Response {
+	list := qs.List(user)
+	values := make([][]interface{}, len(list))
+	for i, rq := range list {
+		duration := time.Since(rq.Start).Truncate(time.Microsecond).String()
+		values[i] = []interface{}{rq.Id, rq.Query, rq.Db, duration, "running"}
+	}
+	return ResponseFromSeries(models.Rows{{
+		Columns: []string{"qid", "query", "database", "duration", "status"},
+		Values:  values,
+	}})
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestQueriesKill(t *testing.T) {
+	qs := NewQueries()
+	req, _ := http.NewRequest("GET", "/query", nil)
+	req1, rq1, done1 := qs.Attach(req, "db", "select * from cpu")
+	_, rq2, done2 := qs.Attach(req, "db", "select * from mem")
+	defer done2()
+
+	if list := qs.List(""); len(list) != 2 || list[0] != rq1 || list[1] != rq2 {
+		t.Errorf("list wrong: %v", list)
+	}
+	if err := qs.Kill(rq1.Id, ""); err != nil {
+		t.Errorf("kill error: %s", err)
+	}
+	if req1.Context().Err() == nil || !qs.Killed(rq1) {
+		t.Errorf("query %d not killed", rq1.Id)
+	}
+	if qs.Killed(rq2) {
+		t.Errorf("query %d killed", rq2.Id)
+	}
+	done1()
+	if err := qs.Kill(rq1.Id, ""); err != ErrQueryNotFound {
+		t.Errorf("kill finished query: %v", err)
+	}
+	if list := qs.List(""); len(list) != 1 || list[0] != rq2 {
+		t.Errorf("list wrong: %v", list)
+	}
+}
+
+func TestQueriesOwner(t *testing.T) {
+	qs := NewQueries()
+	req, _ := http.NewRequest("GET", "/query", nil)
+	_, rq1, done1 := qs.Attach(WithUser(req, "alice"), "db", "select * from cpu")
+	defer done1()
+	_, rq2, done2 := qs.Attach(WithUser(req, "bob"), "db", "select * from mem")
+	defer done2()
+	tests := []struct {
+		name  string
+		req   *http.Request
+		list  int
+		kill  *RunningQuery
+		found bool
+	}{
+		{name: "admin", req: req, list: 2, kill: rq2, found: true},
+		{name: "own query", req: WithGrants(req, "alice", nil), list: 1, kill: rq1, found: true},
+		{name: "query of another user", req: WithGrants(req, "alice", nil), list: 1, kill: rq2},
+	}
+	for _, tt := range tests {
+		owner := queryOwner(tt.req)
+		if list := qs.List(owner); len(list) != tt.list {
+			t.Errorf("%s: list %d, want %d", tt.name, len(list), tt.list)
+		}
+		if err := qs.Kill(tt.kill.Id, owner); (err == nil) != tt.found {
+			t.Errorf("%s: kill %v, want found %t", tt.name, err, tt.found)
+		}
+	}
+}
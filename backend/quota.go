@@ -0,0 +1,342 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrInvalidQuota  = errors.New("invalid quotas, require non-negative max_series, write_rate, write_burst, max_concurrent and max_per_minute, and any of them")
+)
+
+// QuotaConfig limits the series of databases, the points written per second, the concurrent queries and the queries
+// per minute of the users, tenants and databases matched, the empty ones match all
+type QuotaConfig struct {
+	User          string  `mapstructure:"user"`
+	Tenant        string  `mapstructure:"tenant"`
+	Db            string  `mapstructure:"db"`
+	MaxSeries     int64   `mapstructure:"max_series"`
+	WriteRate     float64 `mapstructure:"write_rate"`
+	WriteBurst    int     `mapstructure:"write_burst"`
+	MaxConcurrent int     `mapstructure:"max_concurrent"`
+	MaxPerMinute  int     `mapstructure:"max_per_minute"`
+}
+
+// QuotaError is returned if the write or query exceeds the quota
+type QuotaError struct {
+	User   string
+	Db     string
+	Reason string
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s: %s of user %q on database %q", ErrQuotaExceeded, e.Reason, e.User, e.Db)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// QuotaUsage is the usage of a user on a database by the quota matched, which is reported by /quota
+type QuotaUsage struct {
+	User            string  `json:"user"`
+	Db              string  `json:"db"`
+	Quota           int     `json:"quota"`
+	MaxSeries       int64   `json:"max_series"`
+	Series          int64   `json:"series"`
+	WriteRate       float64 `json:"write_rate"`
+	Points          int64   `json:"points"`
+	PointsRejected  int64   `json:"points_rejected"`
+	MaxConcurrent   int     `json:"max_concurrent"`
+	MaxPerMinute    int     `json:"max_per_minute"`
+	Running         int     `json:"running"`
+	Queries         int64   `json:"queries"`
+	QueriesRejected int64   `json:"queries_rejected"`
+
+	tokens float64
+	last   time.Time
+	minute int64
+	count  int
+}
+
+type usageKey struct {
+	quota int
+	user  string
+	db    string
+}
+
+// QueryQuota enforces the quotas in order, the first quota matched applies. The query_max_concurrent and
+// query_max_per_minute are the defaults of the quotas without them, and the quota of the users and databases
+// not matched by any quota. The series of databases are refreshed from the database stats of the backends of first circle
+type QueryQuota struct {
+	quotas        []*QuotaConfig
+	maxConcurrent int
+	maxPerMinute  int
+	usages        map[usageKey]*QuotaUsage
+	series        map[string]int64
+	lock          sync.Mutex
+}
+
+// CheckQuotas checks the quotas
+func CheckQuotas(cfg *ProxyConfig) error {
+	for _, qcfg := range cfg.Quotas {
+		if qcfg == nil || qcfg.MaxSeries < 0 || qcfg.WriteRate < 0 || qcfg.WriteBurst < 0 || qcfg.MaxConcurrent < 0 || qcfg.MaxPerMinute < 0 {
+			return ErrInvalidQuota
+		}
+		if qcfg.MaxSeries == 0 && qcfg.WriteRate == 0 && qcfg.MaxConcurrent == 0 && qcfg.MaxPerMinute == 0 {
+			return ErrInvalidQuota
+		}
+	}
+	return nil
+}
+
+// NewQueryQuota returns nil if there is no quota
+func NewQueryQuota(cfg *ProxyConfig) *QueryQuota {
+	quotas := cfg.Quotas
+	if cfg.QueryMaxConcurrent > 0 || cfg.QueryMaxPerMinute > 0 {
+		quotas = append(append(make([]*QuotaConfig, 0, len(cfg.Quotas)+1), cfg.Quotas...), &QuotaConfig{})
+	}
+	if len(quotas) == 0 {
+		return nil
+	}
+	return &QueryQuota{
+		quotas:        quotas,
+		maxConcurrent: cfg.QueryMaxConcurrent,
+		maxPerMinute:  cfg.QueryMaxPerMinute,
+		usages:        make(map[usageKey]*QuotaUsage),
+		series:        make(map[string]int64),
+	}
+}
+
+// usage returns the usage of user on db by the first quota matched, or nil if no quota matches
+func (qq *QueryQuota) usage(user, tenant, db string, now time.Time) *QuotaUsage {
+	for i, qcfg := range qq.quotas {
+		if (qcfg.User != "" && qcfg.User != user) || (qcfg.Tenant != "" && qcfg.Tenant != tenant) || (qcfg.Db != "" && qcfg.Db != db) {
+			continue
+		}
+		key := usageKey{quota: i, user: user, db: db}
+		usage, ok := qq.usages[key]
+		if !ok {
+			qq.evict(now)
+			usage = &QuotaUsage{
+				User:          user,
+				Db:            db,
+				Quota:         i,
+				MaxSeries:     qcfg.MaxSeries,
+				WriteRate:     qcfg.WriteRate,
+				MaxConcurrent: qcfg.MaxConcurrent,
+				MaxPerMinute:  qcfg.MaxPerMinute,
+				tokens:        qq.burst(qcfg),
+				last:          now,
+			}
+			if usage.MaxConcurrent == 0 {
+				usage.MaxConcurrent = qq.maxConcurrent
+			}
+			if usage.MaxPerMinute == 0 {
+				usage.MaxPerMinute = qq.maxPerMinute
+			}
+			qq.usages[key] = usage
+		}
+		return usage
+	}
+	return nil
+}
+
+// burst defaults to the points of one second, and at least one point
+func (qq *QueryQuota) burst(qcfg *QuotaConfig) float64 {
+	if qcfg.WriteBurst > 0 {
+		return float64(qcfg.WriteBurst)
+	}
+	return math.Max(math.Ceil(qcfg.WriteRate), 1)
+}
+
+// evict removes the idle usages of the past minutes once there are too many
+func (qq *QueryQuota) evict(now time.Time) {
+	if len(qq.usages) < 10000 {
+		return
+	}
+	minute := now.Unix() / 60
+	for key, usage := range qq.usages {
+		if usage.Running == 0 && usage.minute != minute {
+			delete(qq.usages, key)
+		}
+	}
+}
+
+// AllowWrite takes the points of user on db from the quota, it's rejected if the series of db exceed
+// or the points exceed the rate, the batch larger than the burst is allowed once the bucket is full
+func (qq *QueryQuota) AllowWrite(user, tenant, db string, points int, now time.Time) error {
+	if qq == nil {
+		return nil
+	}
+	qq.lock.Lock()
+	defer qq.lock.Unlock()
+	usage := qq.usage(user, tenant, db, now)
+	if usage == nil {
+		return nil
+	}
+	usage.Series = qq.series[db]
+	if usage.MaxSeries > 0 && usage.Series >= usage.MaxSeries {
+		usage.PointsRejected += int64(points)
+		return &QuotaError{User: user, Db: db, Reason: fmt.Sprintf("%d series", usage.MaxSeries)}
+	}
+	if usage.WriteRate > 0 {
+		burst := qq.burst(qq.quotas[usage.Quota])
+		if elapsed := now.Sub(usage.last).Seconds(); elapsed > 0 {
+			usage.tokens = math.Min(usage.tokens+elapsed*usage.WriteRate, burst)
+			usage.last = now
+		}
+		if usage.tokens < float64(points) && usage.tokens < burst {
+			usage.PointsRejected += int64(points)
+			return &QuotaError{User: user, Db: db, Reason: fmt.Sprintf("%g points per second", usage.WriteRate)}
+		}
+		usage.tokens -= float64(points)
+	}
+	usage.Points += int64(points)
+	return nil
+}
+
+// Acquire takes a query of user on db from the quota, release must be called when the query is done
+func (qq *QueryQuota) Acquire(user, tenant, db string, now time.Time) (release func(), err error) {
+	if qq == nil {
+		return func() {}, nil
+	}
+	qq.lock.Lock()
+	defer qq.lock.Unlock()
+	usage := qq.usage(user, tenant, db, now)
+	if usage == nil {
+		return func() {}, nil
+	}
+	if minute := now.Unix() / 60; usage.minute != minute {
+		usage.minute, usage.count = minute, 0
+	}
+	if usage.MaxConcurrent > 0 && usage.Running >= usage.MaxConcurrent {
+		usage.QueriesRejected++
+		return nil, &QuotaError{User: user, Db: db, Reason: fmt.Sprintf("%d concurrent queries", usage.MaxConcurrent)}
+	}
+	if usage.MaxPerMinute > 0 && usage.count >= usage.MaxPerMinute {
+		usage.QueriesRejected++
+		return nil, &QuotaError{User: user, Db: db, Reason: fmt.Sprintf("%d queries per minute", usage.MaxPerMinute)}
+	}
+	usage.Running++
+	usage.Queries++
+	usage.count++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			qq.lock.Lock()
+			defer qq.lock.Unlock()
+			usage.Running--
+		})
+	}, nil
+}
+
+// SetSeries sets the series of databases
+func (qq *QueryQuota) SetSeries(series map[string]int64) {
+	qq.lock.Lock()
+	defer qq.lock.Unlock()
+	qq.series = series
+}
+
+// HasMaxSeries returns whether any quota limits the series
+func (qq *QueryQuota) HasMaxSeries() bool {
+	if qq == nil {
+		return false
+	}
+	for _, qcfg := range qq.quotas {
+		if qcfg.MaxSeries > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Usages returns the copies of usages sorted by quota, user and db
+func (qq *QueryQuota) Usages() []*QuotaUsage {
+	if qq == nil {
+		return []*QuotaUsage{}
+	}
+	qq.lock.Lock()
+	defer qq.lock.Unlock()
+	usages := make([]*QuotaUsage, 0, len(qq.usages))
+	for _, usage := range qq.usages {
+		u := *usage
+		u.Series = qq.series[u.Db]
+		usages = append(usages, &u)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Quota != usages[j].Quota {
+			return usages[i].Quota < usages[j].Quota
+		}
+		if usages[i].User != usages[j].User {
+			return usages[i].User < usages[j].User
+		}
+		return usages[i].Db < usages[j].Db
+	})
+	return usages
+}
+
+// CountPoints returns the number of points of line protocol, the empty lines and comments are not counted
+func CountPoints(p []byte) (n int) {
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line, p = p[:i], p[i+1:]
+		} else {
+			p = nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && line[0] != '#' {
+			n++
+		}
+	}
+	return
+}
+
+// refreshSeries refreshes the series of databases for the quotas every interval, the series are kept
+// if any backend fails
+func (ip *Proxy) refreshSeries(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		series, err := ip.getSeries()
+		if err != nil {
+			log.Printf("refresh series of quotas error: %s", err)
+			continue
+		}
+		ip.Quota.SetSeries(series)
+	}
+}
+
+// getSeries returns the series of each database summed from the database stats of the backends of first circle
+func (ip *Proxy) getSeries() (map[string]int64, error) {
+	series := make(map[string]int64)
+	for _, be := range ip.AllCircles()[0].Backends {
+		body, err := be.QueryIQL("GET", "", "show stats for 'database'", "")
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", be.Name, err)
+		}
+		rows, err := SeriesFromResponseBytes(body)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", be.Name, err)
+		}
+		for _, row := range rows {
+			for i, column := range row.Columns {
+				if column == "numSeries" && len(row.Values) > 0 {
+					n, _ := toInt(row.Values[0][i])
+					series[row.Tags["database"]] += n
+				}
+			}
+		}
+	}
+	return series, nil
+}
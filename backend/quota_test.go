@@ -0,0 +1,151 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQueryQuota(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	qq := NewQueryQuota(&ProxyConfig{QueryMaxConcurrent: 2, QueryMaxPerMinute: 3})
+	r1, err := qq.Acquire("alice", "", "db", now)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	r2, err := qq.Acquire("alice", "", "db", now)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if _, err = qq.Acquire("alice", "", "db", now); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("concurrent quota expected, got %v", err)
+	}
+	if r, err := qq.Acquire("bob", "", "db", now); err != nil {
+		t.Errorf("quota of other user: %v", err)
+	} else {
+		r()
+	}
+	r1()
+	r1()
+	r3, err := qq.Acquire("alice", "", "db", now)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	r2()
+	r3()
+	if _, err = qq.Acquire("alice", "", "db", now.Add(30*time.Second)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("per minute quota expected, got %v", err)
+	}
+	if r, err := qq.Acquire("alice", "", "db", now.Add(time.Minute)); err != nil {
+		t.Errorf("quota of next minute: %v", err)
+	} else {
+		r()
+	}
+	if qq := NewQueryQuota(&ProxyConfig{}); qq != nil {
+		t.Errorf("quota without limits: got %+v", qq)
+	}
+}
+
+func TestCheckQuotas(t *testing.T) {
+	tests := []struct {
+		name   string
+		quotas []*QuotaConfig
+		want   error
+	}{
+		{name: "empty", quotas: nil, want: nil},
+		{name: "quotas", quotas: []*QuotaConfig{{User: "alice", MaxConcurrent: 2}, {Db: "db1", MaxSeries: 1000, WriteRate: 100}}, want: nil},
+		{name: "no limit", quotas: []*QuotaConfig{{User: "alice"}}, want: ErrInvalidQuota},
+		{name: "negative", quotas: []*QuotaConfig{{User: "alice", MaxSeries: 10, WriteRate: -1}}, want: ErrInvalidQuota},
+		{name: "negative per minute", quotas: []*QuotaConfig{{User: "alice", MaxPerMinute: -1}}, want: ErrInvalidQuota},
+	}
+	for _, tt := range tests {
+		if got := CheckQuotas(&ProxyConfig{Quotas: tt.quotas}); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	qs := NewQueryQuota(&ProxyConfig{Quotas: []*QuotaConfig{
+		{User: "alice", Db: "db1", WriteRate: 10, WriteBurst: 20},
+		{Tenant: "t1", MaxConcurrent: 1},
+		{Db: "db2", MaxSeries: 100},
+	}, QueryMaxPerMinute: 2})
+
+	// the first quota matched applies
+	if err := qs.AllowWrite("alice", "", "db1", 15, now); err != nil {
+		t.Errorf("write within burst: %v", err)
+	}
+	if err := qs.AllowWrite("alice", "", "db1", 10, now); err == nil {
+		t.Error("write rate quota expected")
+	}
+	if err := qs.AllowWrite("alice", "", "db1", 10, now.Add(time.Second)); err != nil {
+		t.Errorf("write after refill: %v", err)
+	}
+	if err := qs.AllowWrite("alice", "", "db3", 1000, now); err != nil {
+		t.Errorf("write without quota: %v", err)
+	}
+
+	qs.SetSeries(map[string]int64{"db2": 100})
+	if err := qs.AllowWrite("bob", "", "db2", 1, now); err == nil {
+		t.Error("series quota expected")
+	}
+
+	release, err := qs.Acquire("bob", "t1", "db1", now)
+	if err != nil {
+		t.Fatalf("query within quota: %v", err)
+	}
+	if _, err = qs.Acquire("bob", "t1", "db1", now); err == nil {
+		t.Error("concurrent quota expected")
+	}
+	release()
+	release()
+	if release, err = qs.Acquire("bob", "t1", "db1", now); err != nil {
+		t.Errorf("query after release: %v", err)
+	} else {
+		release()
+	}
+
+	// the default per minute applies to the quota matched and the queries not matched by quotas
+	if _, err = qs.Acquire("bob", "t1", "db1", now); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("per minute quota expected, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if release, err = qs.Acquire("carol", "", "db3", now); err != nil {
+			t.Fatalf("query of default quota: %v", err)
+		}
+		release()
+	}
+	if _, err = qs.Acquire("carol", "", "db3", now); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("default per minute quota expected, got %v", err)
+	}
+
+	usages := qs.Usages()
+	if len(usages) != 5 {
+		t.Fatalf("got %d usages, want 5", len(usages))
+	}
+	if u := usages[0]; u.User != "alice" || u.Points != 25 || u.PointsRejected != 10 {
+		t.Errorf("write usage: got %+v", u)
+	}
+	if u := usages[1]; u.Queries != 2 || u.QueriesRejected != 2 || u.Running != 0 || u.MaxPerMinute != 2 {
+		t.Errorf("query usage: got %+v", u)
+	}
+	if u := usages[2]; u.Series != 100 || u.PointsRejected != 1 {
+		t.Errorf("series usage: got %+v", u)
+	}
+	if u := usages[4]; u.User != "carol" || u.Quota != 3 || u.Queries != 2 || u.QueriesRejected != 1 {
+		t.Errorf("default usage: got %+v", u)
+	}
+}
+
+func TestCountPoints(t *testing.T) {
+	p := []byte("# comment\ncpu value=1\n\n  mem value=2 1600000000\ndisk value=3")
+	if n := CountPoints(p); n != 3 {
+		t.Errorf("got %d, want 3", n)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+const (
+	RateLimitWrite = "write"
+	RateLimitQuery = "query"
+)
+
+type rateKey struct {
+	kind   string
+	client string
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits the requests of each client by token buckets, the client is the user authenticated or the ip,
+// the bucket of a kind is refilled at the rate per second up to the burst
+type RateLimiter struct {
+	rates   map[string]float64
+	bursts  map[string]float64
+	buckets map[rateKey]*tokenBucket
+	allowed map[string]int64
+	limited map[rateKey]int64
+	lock    sync.Mutex
+}
+
+func NewRateLimiter(cfg *ProxyConfig) *RateLimiter {
+	rl := &RateLimiter{
+		rates:   make(map[string]float64),
+		bursts:  make(map[string]float64),
+		buckets: make(map[rateKey]*tokenBucket),
+		allowed: make(map[string]int64),
+		limited: make(map[rateKey]int64),
+	}
+	if cfg.WriteRateLimit > 0 {
+		rl.rates[RateLimitWrite], rl.bursts[RateLimitWrite] = cfg.WriteRateLimit, float64(cfg.WriteRateBurst)
+	}
+	if cfg.QueryRateLimit > 0 {
+		rl.rates[RateLimitQuery], rl.bursts[RateLimitQuery] = cfg.QueryRateLimit, float64(cfg.QueryRateBurst)
+	}
+	return rl
+}
+
+// Allow takes a token of the client for the request of kind, it returns false if the bucket is empty
+func (rl *RateLimiter) Allow(kind, client string, now time.Time) bool {
+	rate, ok := rl.rates[kind]
+	if !ok {
+		return true
+	}
+	burst := rl.bursts[kind]
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	key := rateKey{kind: kind, client: client}
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		rl.evict(now)
+		bucket = &tokenBucket{tokens: burst, last: now}
+		rl.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens += elapsed * rate
+		if bucket.tokens > burst {
+			bucket.tokens = burst
+		}
+		bucket.last = now
+	}
+	if bucket.tokens < 1 {
+		rl.limited[key]++
+		return false
+	}
+	bucket.tokens--
+	rl.allowed[kind]++
+	return true
+}
+
+// evict removes the buckets refilled up to the burst once there are too many
+func (rl *RateLimiter) evict(now time.Time) {
+	if len(rl.buckets) < 10000 {
+		return
+	}
+	for key, bucket := range rl.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*rl.rates[key.kind] >= rl.bursts[key.kind] {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// WriteMetrics writes the counters of the requests allowed by kind, and rejected by kind and client
+// in the prometheus text format
+func (rl *RateLimiter) WriteMetrics(w io.Writer) {
+	if len(rl.rates) == 0 {
+		return
+	}
+	rl.lock.Lock()
+	kinds := make([]string, 0, len(rl.rates))
+	allowed := make(map[string]int64, len(rl.rates))
+	for kind := range rl.rates {
+		kinds = append(kinds, kind)
+		allowed[kind] = rl.allowed[kind]
+	}
+	keys := make([]rateKey, 0, len(rl.limited))
+	limited := make(map[rateKey]int64, len(rl.limited))
+	for key, n := range rl.limited {
+		keys = append(keys, key)
+		limited[key] = n
+	}
+	rl.lock.Unlock()
+	sort.Strings(kinds)
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].kind != keys[j].kind {
+			return keys[i].kind < keys[j].kind
+		}
+		return keys[i].client < keys[j].client
+	})
+
+	mw := &util.MetricWriter{W: w}
+	name := "influx_proxy_rate_limit_allowed_total"
+	mw.Header(name, "counter", "Number of requests allowed by the rate limit by kind.")
+	for _, kind := range kinds {
+		mw.Sample(name, float64(allowed[kind]), "kind", kind)
+	}
+	name = "influx_proxy_rate_limit_rejected_total"
+	mw.Header(name, "counter", "Number of requests rejected by the rate limit by kind and client.")
+	for _, key := range keys {
+		mw.Sample(name, float64(limited[key]), "kind", key.kind, "client", key.client)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	cfg := &ProxyConfig{WriteRateLimit: 2, WriteRateBurst: 3}
+	rl := NewRateLimiter(cfg)
+	now := time.Unix(1600000000, 0)
+	tests := []struct {
+		name   string
+		kind   string
+		client string
+		after  time.Duration
+		want   bool
+	}{
+		{name: "burst 1", kind: RateLimitWrite, client: "u1", want: true},
+		{name: "burst 2", kind: RateLimitWrite, client: "u1", want: true},
+		{name: "burst 3", kind: RateLimitWrite, client: "u1", want: true},
+		{name: "empty", kind: RateLimitWrite, client: "u1", want: false},
+		{name: "other client", kind: RateLimitWrite, client: "10.0.0.1", want: true},
+		{name: "unlimited kind", kind: RateLimitQuery, client: "u1", want: true},
+		{name: "refilled", kind: RateLimitWrite, client: "u1", after: 500 * time.Millisecond, want: true},
+		{name: "empty again", kind: RateLimitWrite, client: "u1", want: false},
+		{name: "refilled to burst", kind: RateLimitWrite, client: "u1", after: time.Hour, want: true},
+		{name: "burst 2 again", kind: RateLimitWrite, client: "u1", want: true},
+		{name: "burst 3 again", kind: RateLimitWrite, client: "u1", want: true},
+		{name: "empty at last", kind: RateLimitWrite, client: "u1", want: false},
+	}
+	for _, tt := range tests {
+		now = now.Add(tt.after)
+		if got := rl.Allow(tt.kind, tt.client, now); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	rl.WriteMetrics(&buf)
+	for _, line := range []string{
+		`influx_proxy_rate_limit_allowed_total{kind="write"} 8`,
+		`influx_proxy_rate_limit_rejected_total{kind="write",client="u1"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("metrics: %q not found in %s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+)
+
+const (
+	ReadRandom          = "random"
+	ReadRoundRobin      = "round-robin"
+	ReadLeastPending    = "least-pending"
+	ReadLowestLatency   = "lowest-latency"
+	ReadPreferredCircle = "preferred-circle"
+)
+
+const (
+	RolePrimary = "primary"
+	RoleStandby = "standby"
+)
+
+var (
+	ErrInvalidReadStrategy = errors.New("invalid read strategy, require random, round-robin, least-pending, lowest-latency or preferred-circle")
+	ErrInvalidCircleRole   = errors.New("invalid circle role, require primary or standby")
+)
+
+func CheckReadStrategy(strategy string) error {
+	switch strategy {
+	case ReadRandom, ReadRoundRobin, ReadLeastPending, ReadLowestLatency, ReadPreferredCircle:
+		return nil
+	}
+	return ErrInvalidReadStrategy
+}
+
+func CheckCircleRole(role string) error {
+	switch role {
+	case RolePrimary, RoleStandby:
+		return nil
+	}
+	return ErrInvalidCircleRole
+}
+
+// ReadRouter decides the order of circles to read by the strategy of database
+type ReadRouter struct {
+	counter         uint64
+	strategy        string
+	dbStrategy      map[string]string
+	preferredCircle int
+}
+
+func NewReadRouter(cfg *ProxyConfig) *ReadRouter {
+	return &ReadRouter{
+		strategy:        cfg.ReadStrategy,
+		dbStrategy:      cfg.DBReadStrategy,
+		preferredCircle: cfg.PreferredCircleId,
+	}
+}
+
+func (rr *ReadRouter) Strategy(db string) string {
+	if strategy, ok := rr.dbStrategy[db]; ok {
+		return strategy
+	}
+	return rr.strategy
+}
+
+// Order returns the circle ids in the order to read, backends returns the backends of circle to be read,
+// the standby circles always follow the primary ones so that they are read only if the primary ones are unavailable
+func (rr *ReadRouter) Order(circles []*Circle, db string, backends func(*Circle) []*Backend) []int {
+	n := len(circles)
+	order := rand.Perm(n)
+	switch rr.Strategy(db) {
+	case ReadRoundRobin:
+		start := int(atomic.AddUint64(&rr.counter, 1) % uint64(n))
+		for i := range order {
+			order[i] = (start + i) % n
+		}
+	case ReadLeastPending:
+		scores := make([]int64, n)
+		for i, circle := range circles {
+			for _, be := range backends(circle) {
+				scores[i] += be.QueryPending()
+			}
+		}
+		sort.SliceStable(order, func(i, j int) bool { return scores[order[i]] < scores[order[j]] })
+	case ReadLowestLatency:
+		scores := make([]int64, n)
+		for i, circle := range circles {
+			for _, be := range backends(circle) {
+				if latency := be.QueryLatency(); latency > scores[i] {
+					scores[i] = latency
+				}
+			}
+		}
+		sort.SliceStable(order, func(i, j int) bool { return scores[order[i]] < scores[order[j]] })
+	case ReadPreferredCircle:
+		for i, p := range order {
+			if circles[p].CircleId == rr.preferredCircle {
+				copy(order[1:i+1], order[:i])
+				order[0] = p
+				break
+			}
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return !circles[order[i]].Standby && circles[order[j]].Standby })
+	return order
+}
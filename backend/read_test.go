@@ -0,0 +1,75 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadRouterOrder(t *testing.T) {
+	circles := make([]*Circle, 3)
+	for i, score := range []int64{5, 1, 3} {
+		be := &Backend{HttpBackend: &HttpBackend{queryPending: score, queryLatency: 10 - score}}
+		circles[i] = &Circle{CircleId: i, Backends: []*Backend{be}}
+	}
+	backends := func(circle *Circle) []*Backend { return circle.Backends }
+	rr := &ReadRouter{
+		strategy:        ReadRandom,
+		dbStrategy:      map[string]string{"pending": ReadLeastPending, "latency": ReadLowestLatency, "preferred": ReadPreferredCircle, "rr": ReadRoundRobin},
+		preferredCircle: 2,
+	}
+	tests := []struct {
+		db   string
+		want []int
+	}{
+		{db: "pending", want: []int{1, 2, 0}},
+		{db: "latency", want: []int{0, 2, 1}},
+		{db: "rr", want: []int{1, 2, 0}},
+		{db: "rr", want: []int{2, 0, 1}},
+	}
+	for _, tt := range tests {
+		if got := rr.Order(circles, tt.db, backends); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("order wrong: %s, %v != %v", tt.db, got, tt.want)
+		}
+	}
+	if got := rr.Order(circles, "preferred", backends); got[0] != 2 || len(got) != 3 {
+		t.Errorf("order wrong: preferred, %v", got)
+	}
+	if got := rr.Order(circles, "random", backends); len(got) != 3 {
+		t.Errorf("order wrong: random, %v", got)
+	}
+}
+
+func TestReadRouterOrderStandby(t *testing.T) {
+	circles := make([]*Circle, 3)
+	for i, score := range []int64{5, 1, 3} {
+		be := &Backend{HttpBackend: &HttpBackend{queryPending: score}}
+		circles[i] = &Circle{CircleId: i, Backends: []*Backend{be}, Standby: i == 1}
+	}
+	backends := func(circle *Circle) []*Backend { return circle.Backends }
+	rr := &ReadRouter{
+		strategy:        ReadRandom,
+		dbStrategy:      map[string]string{"pending": ReadLeastPending, "preferred": ReadPreferredCircle},
+		preferredCircle: 1,
+	}
+	tests := []struct {
+		db   string
+		want []int
+	}{
+		{db: "pending", want: []int{2, 0, 1}},
+		{db: "preferred", want: nil},
+		{db: "random", want: nil},
+	}
+	for _, tt := range tests {
+		got := rr.Order(circles, tt.db, backends)
+		if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("order wrong: %s, %v != %v", tt.db, got, tt.want)
+		}
+		if len(got) != 3 || got[2] != 1 {
+			t.Errorf("standby circle not read last: %s, %v", tt.db, got)
+		}
+	}
+}
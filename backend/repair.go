@@ -0,0 +1,158 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+var groupIntervalRegexp = regexp.MustCompile(`(?i)group\s+by\s+.*time\s*\(\s*(\d+)(ns|us|u|µ|ms|s|m|h|d|w)`)
+
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"u":  time.Microsecond,
+	"µ":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// GetGroupInterval returns the interval of group by time, or 0 if the query doesn't group by time
+func GetGroupInterval(q string) time.Duration {
+	matches := groupIntervalRegexp.FindStringSubmatch(q)
+	if matches == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(matches[1], 10, 64)
+	return time.Duration(n) * durationUnits[strings.ToLower(matches[2])]
+}
+
+// ReadRepair compares the result of a sampled query with the replica in another circle in background,
+// and copies the points of the time range in both directions if they differ
+type ReadRepair struct {
+	ratio float64
+	sem   chan struct{}
+}
+
+func NewReadRepair(cfg *ProxyConfig) *ReadRepair {
+	return &ReadRepair{
+		ratio: cfg.ReadRepairRatio,
+		sem:   make(chan struct{}, 4),
+	}
+}
+
+func (rr *ReadRepair) Sample(ip *Proxy, q, db, rp, meas string, served *Backend) {
+	if rr.ratio <= 0 || rand.Float64() >= rr.ratio {
+		return
+	}
+	select {
+	case rr.sem <- struct{}{}:
+	default:
+		// skip the sample if too many repairs are running
+		return
+	}
+	go func() {
+		defer func() { <-rr.sem }()
+		rr.repair(ip, q, db, rp, meas, served)
+	}()
+}
+
+func (rr *ReadRepair) repair(ip *Proxy, q, db, rp, meas string, served *Backend) {
+	var other *Backend
+	for _, be := range ip.GetBackendsByMeasurement(db, meas) {
+		if be != served && be.IsActive() && !be.IsRewriting() {
+			other = be
+			break
+		}
+	}
+	if other == nil {
+		return
+	}
+	b1, err := served.QueryIQL("GET", db, q, "ns")
+	if err != nil {
+		return
+	}
+	b2, err := other.QueryIQL("GET", db, q, "ns")
+	if err != nil || bytes.Equal(b1, b2) {
+		return
+	}
+	s1, err := SeriesFromResponseBytes(b1)
+	if err != nil {
+		return
+	}
+	s2, err := SeriesFromResponseBytes(b2)
+	if err != nil {
+		return
+	}
+	start, end, ok := timeRange(append(s1, s2...))
+	if !ok {
+		return
+	}
+	if interval := GetGroupInterval(q); interval > 0 {
+		end += int64(interval)
+	} else {
+		end++
+	}
+	log.Printf("read repair: results differ, db: %s, rp: %s, meas: %s, start: %d, end: %d, backends: %s, %s", db, rp, meas, start, end, served.Url, other.Url)
+	rr.copy(served, other, db, rp, meas, start, end)
+	rr.copy(other, served, db, rp, meas, start, end)
+}
+
+func (rr *ReadRepair) copy(src, dst *Backend, db, rp, meas string, start, end int64) {
+	from := fmt.Sprintf("\"%s\"", util.EscapeIdentifier(meas))
+	if rp != "" {
+		from = fmt.Sprintf("\"%s\".%s", util.EscapeIdentifier(rp), from)
+	}
+	q := fmt.Sprintf("select * from %s where time >= %d and time < %d group by *", from, start, end)
+	body, err := src.QueryIQL("GET", db, q, "ns")
+	if err != nil {
+		log.Printf("read repair query error: %s, src: %s, db: %s, rp: %s, meas: %s", err, src.Url, db, rp, meas)
+		return
+	}
+	series, err := SeriesFromResponseBytes(body)
+	if err != nil {
+		return
+	}
+	fieldTypes, err := src.GetFieldTypes(db, rp, meas)
+	if err != nil {
+		return
+	}
+	p, n := SeriesToLines(series, &IntoTarget{Measurement: meas}, fieldTypes)
+	if n == 0 {
+		return
+	}
+	// the batch is saved to file and rewritten later if the write fails
+	dst.WriteBatch(db, rp, "ns", p)
+}
+
+func timeRange(series models.Rows) (start, end int64, ok bool) {
+	for _, serie := range series {
+		for _, value := range serie.Values {
+			t := timeOfValue(value)
+			if !ok || t < start {
+				start = t
+			}
+			if !ok || t > end {
+				end = t
+			}
+			ok = true
+		}
+	}
+	return
+}
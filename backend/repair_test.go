@@ -0,0 +1,39 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetGroupInterval(t *testing.T) {
+	tests := []struct {
+		q    string
+		want time.Duration
+	}{
+		{q: `select mean(v) from cpu group by time(1m)`, want: time.Minute},
+		{q: `SELECT mean(v) FROM cpu WHERE time > now() - 1d GROUP BY host, time( 2d ) fill(0)`, want: 48 * time.Hour},
+		{q: `select mean(v) from cpu group by time(500ms)`, want: 500 * time.Millisecond},
+		{q: `select v from cpu where time > now() - 1h group by host`, want: 0},
+	}
+	for _, tt := range tests {
+		if got := GetGroupInterval(tt.q); got != tt.want {
+			t.Errorf("interval wrong: %s, %s != %s", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestTimeRange(t *testing.T) {
+	s1, _ := SeriesFromResponseBytes([]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","v"],"values":[[30,1],[10,1]]}]}]}`))
+	s2, _ := SeriesFromResponseBytes([]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","v"],"values":[[20,1],[40,1]]}]}]}`))
+	start, end, ok := timeRange(append(s1, s2...))
+	if !ok || start != 10 || end != 40 {
+		t.Errorf("range wrong: %d, %d, %t", start, end, ok)
+	}
+	if _, _, ok = timeRange(nil); ok {
+		t.Errorf("range of empty series")
+	}
+}
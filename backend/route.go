@@ -0,0 +1,101 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var ErrInvalidRoutingRule = errors.New("invalid routing rule, require existing backends and db or measurement of exact name or valid /regexp/")
+
+// namePattern matches a name exactly, or by regexp if it's like /regexp/, the empty pattern matches any name
+type namePattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+func newNamePattern(s string) (np *namePattern, err error) {
+	np = &namePattern{name: s}
+	if IsRegexMeasurement(s) {
+		np.re, err = regexp.Compile(s[1 : len(s)-1])
+	}
+	return
+}
+
+func (np *namePattern) Match(name string) bool {
+	if np.re != nil {
+		return np.re.MatchString(name)
+	}
+	return np.name == "" || np.name == name
+}
+
+// RoutingRule pins the measurements matching db and measurement to the backends, instead of hashing
+type RoutingRule struct {
+	db       *namePattern
+	meas     *namePattern
+	backends []string
+}
+
+func NewRoutingRule(cfg *RoutingRuleConfig, names map[string]bool) (rule *RoutingRule, err error) {
+	if len(cfg.Backends) == 0 {
+		return nil, ErrInvalidRoutingRule
+	}
+	for _, name := range cfg.Backends {
+		if !names[name] {
+			return nil, ErrInvalidRoutingRule
+		}
+	}
+	rule = &RoutingRule{backends: cfg.Backends}
+	if rule.db, err = newNamePattern(cfg.Db); err != nil {
+		return nil, ErrInvalidRoutingRule
+	}
+	if rule.meas, err = newNamePattern(cfg.Measurement); err != nil {
+		return nil, ErrInvalidRoutingRule
+	}
+	return
+}
+
+// RoutingRules are checked in order and the first matched rule decides the backends
+type RoutingRules []*RoutingRule
+
+func NewRoutingRules(cfg *ProxyConfig) (rules RoutingRules, err error) {
+	names := make(map[string]bool)
+	for _, circle := range cfg.Circles {
+		for _, bkcfg := range circle.AllBackends() {
+			names[bkcfg.Name] = true
+		}
+	}
+	for _, rrcfg := range cfg.RoutingRules {
+		rule, err := NewRoutingRule(rrcfg, names)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+// Match returns the backend names of the first rule matching the key, or nil if no rule matches
+func (rules RoutingRules) Match(key string) []string {
+	if len(rules) == 0 {
+		return nil
+	}
+	// the key is db,measurement, or db only, or followed by tag values
+	db, meas := key, ""
+	if i := strings.IndexByte(key, ','); i >= 0 {
+		db, meas = key[:i], key[i+1:]
+		if j := strings.IndexByte(meas, ','); j >= 0 {
+			meas = meas[:j]
+		}
+	}
+	for _, rule := range rules {
+		if rule.db.Match(db) && rule.meas.Match(meas) {
+			return rule.backends
+		}
+	}
+	return nil
+}
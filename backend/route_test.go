@@ -0,0 +1,89 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoutingRules(t *testing.T) {
+	cfg := &ProxyConfig{
+		Circles: []*CircleConfig{
+			{Backends: []*BackendConfig{{Name: "b1"}, {Name: "b2"}, {Name: "b3"}}},
+		},
+		RoutingRules: []*RoutingRuleConfig{
+			{Db: "compliance", Backends: []string{"b1"}},
+			{Db: "/^app_.*/", Measurement: "audit", Backends: []string{"b2", "b3"}},
+			{Measurement: "/^secure_/", Backends: []string{"b3"}},
+		},
+	}
+	rules, err := NewRoutingRules(cfg)
+	if err != nil {
+		t.Fatalf("new routing rules error: %s", err)
+	}
+	tests := []struct {
+		name string
+		key  string
+		want []string
+	}{
+		{name: "exact db", key: "compliance,cpu", want: []string{"b1"}},
+		{name: "db only key", key: "compliance", want: []string{"b1"}},
+		{name: "regex db and measurement", key: "app_1,audit", want: []string{"b2", "b3"}},
+		{name: "regex db not matched measurement", key: "app_1,cpu", want: nil},
+		{name: "regex measurement", key: "db,secure_log", want: []string{"b3"}},
+		{name: "key with tags", key: "db,secure_log,host=a", want: []string{"b3"}},
+		{name: "no match", key: "db,cpu", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules.Match(tt.key); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRoutingRulesInvalid(t *testing.T) {
+	circles := []*CircleConfig{{Backends: []*BackendConfig{{Name: "b1"}}}}
+	tests := []struct {
+		name string
+		rule *RoutingRuleConfig
+	}{
+		{name: "no backends", rule: &RoutingRuleConfig{Db: "db"}},
+		{name: "unknown backend", rule: &RoutingRuleConfig{Db: "db", Backends: []string{"b2"}}},
+		{name: "invalid regexp", rule: &RoutingRuleConfig{Db: "/(/", Backends: []string{"b1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &ProxyConfig{Circles: circles, RoutingRules: []*RoutingRuleConfig{tt.rule}}
+			if _, err := NewRoutingRules(cfg); err != ErrInvalidRoutingRule {
+				t.Errorf("error = %v, want %v", err, ErrInvalidRoutingRule)
+			}
+		})
+	}
+}
+
+func TestCircleRoutedBackend(t *testing.T) {
+	circle := &Circle{router: NewHashRing(HashConsistent, 256), mapToBackend: make(map[string]*Backend)}
+	for i, name := range []string{"b1", "b2", "b3"} {
+		be := &Backend{HttpBackend: &HttpBackend{Name: name}}
+		circle.Backends = append(circle.Backends, be)
+		circle.addRouter(be, i, "idx")
+	}
+	circle.routingRules, _ = NewRoutingRules(&ProxyConfig{
+		Circles:      []*CircleConfig{{Backends: []*BackendConfig{{Name: "b1"}, {Name: "b2"}, {Name: "b3"}, {Name: "other"}}}},
+		RoutingRules: []*RoutingRuleConfig{{Db: "compliance", Backends: []string{"b2"}}, {Db: "remote", Backends: []string{"other"}}},
+	})
+	for _, mm := range []string{"cpu", "mem", "disk", "net"} {
+		if be := circle.GetBackend(GetKey("compliance", mm)); be.Name != "b2" {
+			t.Errorf("measurement %s routed to %s, want b2", mm, be.Name)
+		}
+		// the rule without backend in this circle falls back to hashing
+		if be := circle.GetBackend(GetKey("remote", mm)); be == nil {
+			t.Errorf("measurement %s not routed", mm)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+var ErrInvalidQueryRule = errors.New("invalid query rule, require name, action allow or deny, valid regexp match and window HH:MM-HH:MM")
+
+// QueryDeniedError is returned if the query is rejected by a query rule
+type QueryDeniedError struct {
+	Rule    string
+	Message string
+}
+
+func (e *QueryDeniedError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("query denied by rule %s: %s", e.Rule, e.Message)
+	}
+	return fmt.Sprintf("query denied by rule %s", e.Rule)
+}
+
+// QueryRule allows or denies the queries matching match but not unless, it's skipped in the maintenance window
+type QueryRule struct {
+	name      string
+	allow     bool
+	match     *regexp.Regexp
+	unless    *regexp.Regexp
+	window    [2]int
+	hasWindow bool
+	message   string
+}
+
+func NewQueryRule(cfg *QueryRuleConfig) (rule *QueryRule, err error) {
+	if cfg.Name == "" || (cfg.Action != "allow" && cfg.Action != "deny") {
+		return nil, ErrInvalidQueryRule
+	}
+	rule = &QueryRule{name: cfg.Name, allow: cfg.Action == "allow", message: cfg.Message}
+	// keywords of influxql are case-insensitive
+	if rule.match, err = regexp.Compile("(?is)" + cfg.Match); err != nil {
+		return nil, ErrInvalidQueryRule
+	}
+	if cfg.Unless != "" {
+		if rule.unless, err = regexp.Compile("(?is)" + cfg.Unless); err != nil {
+			return nil, ErrInvalidQueryRule
+		}
+	}
+	if cfg.MaintenanceWindow != "" {
+		var h1, m1, h2, m2 int
+		n, _ := fmt.Sscanf(cfg.MaintenanceWindow, "%d:%d-%d:%d", &h1, &m1, &h2, &m2)
+		if n != 4 || h1 < 0 || h1 > 23 || h2 < 0 || h2 > 23 || m1 < 0 || m1 > 59 || m2 < 0 || m2 > 59 {
+			return nil, ErrInvalidQueryRule
+		}
+		rule.window = [2]int{h1*60 + m1, h2*60 + m2}
+		rule.hasWindow = true
+	}
+	return
+}
+
+func (rule *QueryRule) inWindow(now time.Time) bool {
+	if !rule.hasWindow {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	start, end := rule.window[0], rule.window[1]
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	// the window crosses midnight
+	return minute >= start || minute < end
+}
+
+func (rule *QueryRule) Match(q string, now time.Time) bool {
+	return rule.match.MatchString(q) && (rule.unless == nil || !rule.unless.MatchString(q)) && !rule.inWindow(now)
+}
+
+// QueryRules are checked in order, the first matched rule decides whether the query is allowed
+type QueryRules []*QueryRule
+
+func NewQueryRules(cfgs []*QueryRuleConfig) (rules QueryRules, err error) {
+	for _, cfg := range cfgs {
+		rule, err := NewQueryRule(cfg)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func (rules QueryRules) Check(q string, now time.Time) error {
+	for _, rule := range rules {
+		if rule.Match(q, now) {
+			if rule.allow {
+				return nil
+			}
+			return &QueryDeniedError{Rule: rule.name, Message: rule.message}
+		}
+	}
+	return nil
+}
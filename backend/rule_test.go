@@ -0,0 +1,60 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryRules(t *testing.T) {
+	rules, err := NewQueryRules([]*QueryRuleConfig{
+		{Name: "select-star", Action: "deny", Match: `^select\s+\*`, Unless: `\swhere\s.*time\s*[<>=]`, Message: "time predicate required"},
+		{Name: "drop", Action: "deny", Match: `^drop\s`, MaintenanceWindow: "23:00-02:00"},
+		{Name: "admin", Action: "allow", Match: `^(create|alter)\s`},
+		{Name: "others", Action: "deny", Match: `^(create|alter|delete)\s`},
+	})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	day := time.Date(2021, 6, 1, 12, 0, 0, 0, time.Local)
+	night := time.Date(2021, 6, 1, 1, 30, 0, 0, time.Local)
+	tests := []struct {
+		name   string
+		q      string
+		now    time.Time
+		denied string
+	}{
+		{name: "select star", q: "SELECT * FROM cpu", now: day, denied: "select-star"},
+		{name: "select star with time", q: "select * from cpu where time > now() - 1h", now: day},
+		{name: "select field", q: "select value from cpu", now: day},
+		{name: "drop by day", q: "DROP MEASUREMENT cpu", now: day, denied: "drop"},
+		{name: "drop in window", q: "drop measurement cpu", now: night},
+		{name: "allowed", q: "create database db", now: day},
+		{name: "denied", q: "delete from cpu", now: day, denied: "others"},
+	}
+	for _, tt := range tests {
+		err := rules.Check(tt.q, tt.now)
+		if tt.denied == "" && err != nil {
+			t.Errorf("%v: unexpected error %s", tt.name, err)
+		} else if tt.denied != "" {
+			if de, ok := err.(*QueryDeniedError); !ok || de.Rule != tt.denied {
+				t.Errorf("%v: got %v, want denied by %s", tt.name, err, tt.denied)
+			}
+		}
+	}
+
+	invalid := []*QueryRuleConfig{
+		{Name: "action", Action: "reject", Match: ".*"},
+		{Name: "regexp", Action: "deny", Match: "("},
+		{Name: "window", Action: "deny", Match: ".*", MaintenanceWindow: "25:00-02:00"},
+		{Action: "deny", Match: ".*"},
+	}
+	for _, cfg := range invalid {
+		if _, err := NewQueryRule(cfg); err != ErrInvalidQueryRule {
+			t.Errorf("%v: got %v, want %v", cfg.Name, err, ErrInvalidQueryRule)
+		}
+	}
+}
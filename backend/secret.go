@@ -0,0 +1,245 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	secretEnv   = "env:"
+	secretFile  = "file:"
+	secretVault = "vault:"
+)
+
+var (
+	ErrInvalidSecret  = errors.New("invalid secret reference, require env:<name>, file:<path> or vault:<path>#<key>, and vault_addr and vault_token for vault")
+	ErrSecretNotFound = errors.New("secret not found")
+)
+
+var (
+	// vault resolves the references of vault, which is set by config
+	vault *vaultClient
+	// secretRefresh is the interval to refresh the secrets of files and vault, which is set by config
+	secretRefresh time.Duration
+)
+
+type vaultClient struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+// InitSecrets sets the vault and the refresh interval of secrets by config, vault_addr and vault_token default
+// to the environment variables VAULT_ADDR and VAULT_TOKEN, and vault_token may be a reference of env or file
+func InitSecrets(cfg *ProxyConfig) error {
+	secretRefresh = time.Duration(cfg.SecretRefresh) * time.Second
+	addr, token := cfg.VaultAddr, cfg.VaultToken
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if strings.HasPrefix(token, secretVault) {
+		return ErrInvalidSecret
+	}
+	token, err := ResolveSecret(token)
+	if err != nil {
+		return err
+	}
+	vault = nil
+	if addr != "" && token != "" {
+		vault = &vaultClient{addr: strings.TrimSuffix(addr, "/"), token: token, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return nil
+}
+
+// IsSecretRef returns whether the value is a secret reference
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, secretEnv) || strings.HasPrefix(value, secretFile) || strings.HasPrefix(value, secretVault)
+}
+
+// CheckSecret checks the value is a valid secret reference if it's one
+func CheckSecret(value string) error {
+	switch {
+	case strings.HasPrefix(value, secretEnv):
+		if value == secretEnv {
+			return ErrInvalidSecret
+		}
+	case strings.HasPrefix(value, secretFile):
+		if value == secretFile {
+			return ErrInvalidSecret
+		}
+	case strings.HasPrefix(value, secretVault):
+		path, key := splitVaultRef(value)
+		if path == "" || key == "" || vault == nil {
+			return ErrInvalidSecret
+		}
+	}
+	return nil
+}
+
+func splitVaultRef(value string) (path, key string) {
+	ref := strings.TrimPrefix(value, secretVault)
+	if i := strings.LastIndexByte(ref, '#'); i >= 0 {
+		return strings.Trim(ref[:i], "/"), ref[i+1:]
+	}
+	return strings.Trim(ref, "/"), ""
+}
+
+// ResolveSecret returns the secret of the reference, env:<name> of the environment variable, file:<path> of the
+// file content without the trailing newline, and vault:<path>#<key> of the key of vault kv version 1 or 2,
+// the value which is not a reference is returned as it is
+func ResolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretEnv):
+		secret, ok := os.LookupEnv(strings.TrimPrefix(value, secretEnv))
+		if !ok {
+			return "", fmt.Errorf("%w: %s", ErrSecretNotFound, value)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, secretFile):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(value, secretFile))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case strings.HasPrefix(value, secretVault):
+		if vault == nil {
+			return "", ErrInvalidSecret
+		}
+		path, key := splitVaultRef(value)
+		return vault.read(path, key)
+	}
+	return value, nil
+}
+
+func (vc *vaultClient) read(path, key string) (string, error) {
+	req, err := http.NewRequest("GET", vc.addr+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", vc.token)
+	resp, err := vc.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault read %s status code: %d", path, resp.StatusCode)
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	data := body.Data
+	// the secret of kv version 2 is nested in data with metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	secret, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("%w: %s#%s", ErrSecretNotFound, path, key)
+	}
+	return secret, nil
+}
+
+// Secret is a config value which may be a secret reference, the secret of file or vault is refreshed
+// in background once it's read secret_refresh after fetched
+type Secret struct {
+	ref        string
+	value      atomic.Value
+	fetched    int64
+	refreshing int32
+}
+
+// NewSecret returns the secret resolved from the value, the secret failed to resolve is empty along with
+// the error, and it's retried on refresh
+func NewSecret(value string) (*Secret, error) {
+	s := &Secret{ref: value}
+	s.value.Store("")
+	return s, s.resolve()
+}
+
+func (s *Secret) resolve() error {
+	value, err := ResolveSecret(s.ref)
+	atomic.StoreInt64(&s.fetched, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	s.value.Store(value)
+	return nil
+}
+
+// Value returns the current secret, the secret failed to refresh is kept
+func (s *Secret) Value() string {
+	if s == nil {
+		return ""
+	}
+	refreshable := strings.HasPrefix(s.ref, secretFile) || strings.HasPrefix(s.ref, secretVault)
+	if refreshable && secretRefresh > 0 && time.Since(time.Unix(0, atomic.LoadInt64(&s.fetched))) >= secretRefresh &&
+		atomic.CompareAndSwapInt32(&s.refreshing, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&s.refreshing, 0)
+			if err := s.resolve(); err != nil {
+				log.Printf("refresh secret %s error: %s", s.ref, err)
+			}
+		}()
+	}
+	return s.value.Load().(string)
+}
+
+// resolveSecrets resolves the secret references of the credentials of proxy, the ones of backends
+// and certificates are resolved once used so that they are refreshed
+func (cfg *ProxyConfig) resolveSecrets() (err error) {
+	for _, value := range []*string{&cfg.Username, &cfg.Password, &cfg.SharedSecret, &cfg.CipherKey, &cfg.MaskSalt} {
+		if *value, err = ResolveSecret(*value); err != nil {
+			return
+		}
+	}
+	for i, key := range cfg.CipherOldKeys {
+		if cfg.CipherOldKeys[i], err = ResolveSecret(key); err != nil {
+			return
+		}
+	}
+	for _, user := range cfg.Users {
+		if user.Password, err = ResolveSecret(user.Password); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// checkSecrets checks the secret references of config
+func (cfg *ProxyConfig) checkSecrets() error {
+	values := []string{cfg.Username, cfg.Password, cfg.SharedSecret, cfg.CipherKey, cfg.MaskSalt, cfg.HTTPSCert, cfg.HTTPSKey}
+	values = append(values, cfg.CipherOldKeys...)
+	for _, user := range cfg.Users {
+		values = append(values, user.Password)
+	}
+	for _, circle := range cfg.Circles {
+		for _, backend := range circle.AllBackends() {
+			values = append(values, backend.Username, backend.Password, backend.TLSCert, backend.TLSKey)
+		}
+	}
+	for _, value := range values {
+		if err := CheckSecret(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestVault(t *testing.T, secrets map[string]string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, ok := secrets[req.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { vault, secretRefresh = nil, 0 })
+	if err := InitSecrets(&ProxyConfig{VaultAddr: server.URL + "/", VaultToken: "env:TEST_VAULT_TOKEN"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveSecret(t *testing.T) {
+	os.Setenv("TEST_VAULT_TOKEN", "token")
+	os.Setenv("TEST_SECRET_PASSWORD", "env-secret")
+	defer os.Unsetenv("TEST_VAULT_TOKEN")
+	defer os.Unsetenv("TEST_SECRET_PASSWORD")
+	file := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(file, []byte("file-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	newTestVault(t, map[string]string{
+		"/v1/kv/influxdb":             `{"data":{"password":"kv1-secret"}}`,
+		"/v1/secret/data/influxdb":    `{"data":{"data":{"password":"kv2-secret"},"metadata":{"version":1}}}`,
+		"/v1/secret/data/influxdb-nn": `{"data":{"data":{"username":"u1"}}}`,
+	})
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", value: "plain-secret", want: "plain-secret"},
+		{name: "env", value: "env:TEST_SECRET_PASSWORD", want: "env-secret"},
+		{name: "env not found", value: "env:TEST_SECRET_NOT_FOUND", wantErr: true},
+		{name: "file", value: "file:" + file, want: "file-secret"},
+		{name: "file not found", value: "file:" + file + ".nn", wantErr: true},
+		{name: "vault kv1", value: "vault:kv/influxdb#password", want: "kv1-secret"},
+		{name: "vault kv2", value: "vault:secret/data/influxdb#password", want: "kv2-secret"},
+		{name: "vault key not found", value: "vault:secret/data/influxdb-nn#password", wantErr: true},
+		{name: "vault path not found", value: "vault:secret/data/nn#password", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ResolveSecret(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %t", tt.name, err, tt.wantErr)
+		} else if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckSecret(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		vault bool
+		want  error
+	}{
+		{name: "plain", value: "secret", want: nil},
+		{name: "env", value: "env:PASSWORD", want: nil},
+		{name: "empty env", value: "env:", want: ErrInvalidSecret},
+		{name: "empty file", value: "file:", want: ErrInvalidSecret},
+		{name: "vault", value: "vault:kv/influxdb#password", vault: true, want: nil},
+		{name: "vault without key", value: "vault:kv/influxdb", vault: true, want: ErrInvalidSecret},
+		{name: "vault without addr", value: "vault:kv/influxdb#password", want: ErrInvalidSecret},
+	}
+	defer func() { vault = nil }()
+	for _, tt := range tests {
+		vault = nil
+		if tt.vault {
+			vault = &vaultClient{}
+		}
+		if got := CheckSecret(tt.value); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSecretRefresh(t *testing.T) {
+	defer func() { secretRefresh = 0 }()
+	secretRefresh = time.Millisecond
+	file := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(file, []byte("v1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSecret("file:" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Value(); got != "v1" {
+		t.Fatalf("got %q, want v1", got)
+	}
+	if err = ioutil.WriteFile(file, []byte("v2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Value() != "v2" {
+		if time.Now().After(deadline) {
+			t.Fatal("secret not refreshed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// the secret failed to refresh is kept
+	os.Remove(file)
+	time.Sleep(20 * time.Millisecond)
+	if got := s.Value(); got != "v2" {
+		t.Errorf("removed: got %q, want v2", got)
+	}
+}
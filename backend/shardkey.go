@@ -0,0 +1,92 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	ShardByDb          = "db"
+	ShardByMeasurement = "measurement"
+)
+
+var (
+	ErrInvalidShardKey = errors.New("invalid db_shard_key, require db, db,measurement or db,measurement,<tag keys> comma-separated")
+	ErrSpreadByTags    = errors.New("not supported for the database sharded by tags")
+)
+
+// ShardKey decides the key of points to shard: db only, db and measurement, or db, measurement and the values of tags
+type ShardKey struct {
+	Measurement bool
+	Tags        []string
+}
+
+func CheckShardKey(s string) error {
+	parts := strings.Split(s, ",")
+	if strings.TrimSpace(parts[0]) != ShardByDb {
+		return ErrInvalidShardKey
+	}
+	if len(parts) > 1 && strings.TrimSpace(parts[1]) != ShardByMeasurement {
+		return ErrInvalidShardKey
+	}
+	for i := 2; i < len(parts); i++ {
+		if tag := strings.TrimSpace(parts[i]); tag == "" || tag == ShardByDb || tag == ShardByMeasurement {
+			return ErrInvalidShardKey
+		}
+	}
+	return nil
+}
+
+func ParseShardKey(s string) *ShardKey {
+	parts := strings.Split(s, ",")
+	sk := &ShardKey{Measurement: len(parts) > 1}
+	for i := 2; i < len(parts); i++ {
+		sk.Tags = append(sk.Tags, strings.TrimSpace(parts[i]))
+	}
+	return sk
+}
+
+// ShardKeys are the shard keys by db, the db not configured is sharded by db and measurement
+type ShardKeys map[string]*ShardKey
+
+func NewShardKeys(cfg *ProxyConfig) ShardKeys {
+	sks := make(ShardKeys, len(cfg.DBShardKey))
+	for db, s := range cfg.DBShardKey {
+		sks[db] = ParseShardKey(s)
+	}
+	return sks
+}
+
+// Spread returns true if the measurements of db are spread across the backends by tags
+func (sks ShardKeys) Spread(db string) bool {
+	sk, ok := sks[db]
+	return ok && len(sk.Tags) > 0
+}
+
+// Key returns the key to shard, tag returns the value of tag key of point and is only called if db is sharded by tags
+func (sks ShardKeys) Key(db, meas string, tag func(string) string) string {
+	sk, ok := sks[db]
+	if !ok {
+		return GetKey(db, meas)
+	}
+	if !sk.Measurement {
+		return db
+	}
+	key := GetKey(db, meas)
+	if len(sk.Tags) == 0 || tag == nil {
+		return key
+	}
+	var b strings.Builder
+	b.WriteString(key)
+	for _, k := range sk.Tags {
+		b.WriteString(",")
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(tag(k))
+	}
+	return b.String()
+}
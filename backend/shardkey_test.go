@@ -0,0 +1,86 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestCheckShardKey(t *testing.T) {
+	tests := []struct {
+		name string
+		sk   string
+		ok   bool
+	}{
+		{name: "db", sk: "db", ok: true},
+		{name: "measurement", sk: "db,measurement", ok: true},
+		{name: "tags", sk: "db, measurement, host, region", ok: true},
+		{name: "no db", sk: "measurement", ok: false},
+		{name: "tags without measurement", sk: "db,host", ok: false},
+		{name: "empty tag", sk: "db,measurement,", ok: false},
+		{name: "empty", sk: "", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckShardKey(tt.sk); (err == nil) != tt.ok {
+				t.Errorf("CheckShardKey() error = %v, ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestShardKeys(t *testing.T) {
+	sks := NewShardKeys(&ProxyConfig{DBShardKey: map[string]string{
+		"db1": "db",
+		"db2": "db,measurement",
+		"db3": "db,measurement,host,region",
+	}})
+	line := []byte(`cpu,host=server\ 01,region=us-west,zone=a value=1 1000`)
+	tag := func(k string) string { return ScanTagValue(line, k) }
+	tests := []struct {
+		name   string
+		db     string
+		key    string
+		spread bool
+	}{
+		{name: "default", db: "db0", key: "db0,cpu"},
+		{name: "db", db: "db1", key: "db1"},
+		{name: "measurement", db: "db2", key: "db2,cpu"},
+		{name: "tags", db: "db3", key: "db3,cpu,host=server 01,region=us-west", spread: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if key := sks.Key(tt.db, "cpu", tag); key != tt.key {
+				t.Errorf("Key() = %s, want %s", key, tt.key)
+			}
+			if spread := sks.Spread(tt.db); spread != tt.spread {
+				t.Errorf("Spread() = %v, want %v", spread, tt.spread)
+			}
+		})
+	}
+}
+
+func TestScanTagValue(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		key  string
+		want string
+	}{
+		{name: "first", line: "cpu,host=a,region=b value=1", key: "host", want: "a"},
+		{name: "last", line: "cpu,host=a,region=b value=1", key: "region", want: "b"},
+		{name: "missing", line: "cpu,host=a value=1", key: "region", want: ""},
+		{name: "no tags", line: "cpu value=1", key: "host", want: ""},
+		{name: "field", line: "cpu,host=a value=1", key: "value", want: ""},
+		{name: "escaped", line: `cpu\,x,host\ name=a\,b\=c value=1`, key: "host name", want: "a,b=c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ScanTagValue([]byte(tt.line), tt.key); got != tt.want {
+				t.Errorf("ScanTagValue() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
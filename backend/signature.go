@@ -0,0 +1,137 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeaderSignature is the hmac signature of request like keyid=k1,ts=1600000000,sig=<hex>
+const HeaderSignature = "X-Influxdb-Proxy-Signature"
+
+var (
+	ErrInvalidHmacKey       = errors.New("invalid hmac keys, require key ids without comma or equal sign and keys, hmac_required requires keys")
+	ErrSignatureRequired    = errors.New("hmac signature required")
+	ErrInvalidSignature     = errors.New("invalid hmac signature")
+	ErrUnknownSignatureKey  = errors.New("unknown hmac signature key id")
+	ErrSignatureExpired     = errors.New("hmac signature timestamp out of window")
+	ErrSignatureMismatched  = errors.New("hmac signature mismatched")
+	errSignatureKeyNotFound = errors.New("hmac signature key not found")
+)
+
+// HmacVerifier verifies the hmac signatures of writes, which are signed by the keys of key ids
+type HmacVerifier struct {
+	keys     map[string]*Secret
+	required bool
+	window   time.Duration
+}
+
+// CheckHmac checks the hmac keys, whose keys are plain or secret references
+func CheckHmac(cfg *ProxyConfig) error {
+	if cfg.HmacRequired && len(cfg.HmacKeys) == 0 {
+		return ErrInvalidHmacKey
+	}
+	for id, key := range cfg.HmacKeys {
+		if id == "" || strings.ContainsAny(id, ",=") || key == "" {
+			return ErrInvalidHmacKey
+		}
+		if err := CheckSecret(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewHmacVerifier returns nil if there is no hmac key
+func NewHmacVerifier(cfg *ProxyConfig) *HmacVerifier {
+	if len(cfg.HmacKeys) == 0 {
+		return nil
+	}
+	v := &HmacVerifier{
+		keys:     make(map[string]*Secret),
+		required: cfg.HmacRequired,
+		window:   time.Duration(cfg.HmacWindow) * time.Second,
+	}
+	for id, key := range cfg.HmacKeys {
+		secret, err := NewSecret(key)
+		if err != nil {
+			log.Printf("hmac key %s error: %s", id, err)
+		}
+		v.keys[id] = secret
+	}
+	return v
+}
+
+// SignRequest returns the hmac signature over the method, the path with query, the sha256 of body and the timestamp
+func SignRequest(key, method, uri string, body []byte, ts int64) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d", method, uri, hex.EncodeToString(sum[:]), ts)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureHeader returns the value of signature header of request signed by the key of key id
+func SignatureHeader(id, key, method, uri string, body []byte, ts int64) string {
+	return fmt.Sprintf("keyid=%s,ts=%d,sig=%s", id, ts, SignRequest(key, method, uri, body, ts))
+}
+
+// Verify verifies the signature of request with its body, the request without signature is verified
+// only if the signature isn't required
+func (v *HmacVerifier) Verify(req *http.Request, body []byte, now time.Time) error {
+	if v == nil {
+		return nil
+	}
+	header := req.Header.Get(HeaderSignature)
+	if header == "" {
+		if v.required {
+			return ErrSignatureRequired
+		}
+		return nil
+	}
+	var id, ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return ErrInvalidSignature
+		}
+		switch kv[0] {
+		case "keyid":
+			id = kv[1]
+		case "ts":
+			ts = kv[1]
+		case "sig":
+			sig = kv[1]
+		}
+	}
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if id == "" || sig == "" || err != nil {
+		return ErrInvalidSignature
+	}
+	secret, ok := v.keys[id]
+	if !ok {
+		return ErrUnknownSignatureKey
+	}
+	if d := now.Sub(time.Unix(timestamp, 0)); d > v.window || d < -v.window {
+		return ErrSignatureExpired
+	}
+	key := secret.Value()
+	if key == "" {
+		return errSignatureKeyNotFound
+	}
+	want := SignRequest(key, req.Method, req.URL.RequestURI(), body, timestamp)
+	if !hmac.Equal([]byte(strings.ToLower(sig)), []byte(want)) {
+		return ErrSignatureMismatched
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckHmac(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *ProxyConfig
+		want error
+	}{
+		{
+			name: "empty",
+			cfg:  &ProxyConfig{},
+			want: nil,
+		},
+		{
+			name: "keys",
+			cfg:  &ProxyConfig{HmacKeys: map[string]string{"k1": "secret", "k2": "env:HMAC_KEY"}, HmacRequired: true},
+			want: nil,
+		},
+		{
+			name: "required without keys",
+			cfg:  &ProxyConfig{HmacRequired: true},
+			want: ErrInvalidHmacKey,
+		},
+		{
+			name: "invalid key id",
+			cfg:  &ProxyConfig{HmacKeys: map[string]string{"k1,k2": "secret"}},
+			want: ErrInvalidHmacKey,
+		},
+		{
+			name: "empty key",
+			cfg:  &ProxyConfig{HmacKeys: map[string]string{"k1": ""}},
+			want: ErrInvalidHmacKey,
+		},
+		{
+			name: "invalid secret",
+			cfg:  &ProxyConfig{HmacKeys: map[string]string{"k1": "file:"}},
+			want: ErrInvalidSecret,
+		},
+	}
+	for _, tt := range tests {
+		if got := CheckHmac(tt.cfg); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHmacVerify(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	body := []byte("cpu value=1")
+	uri := "/write?db=db1"
+	sign := func(id, key string, ts int64) string {
+		return SignatureHeader(id, key, "POST", uri, body, ts)
+	}
+	tests := []struct {
+		name      string
+		required  bool
+		signature string
+		uri       string
+		want      error
+	}{
+		{
+			name:      "valid",
+			signature: sign("k1", "secret1", now.Unix()),
+			want:      nil,
+		},
+		{
+			name:      "valid by another key",
+			signature: sign("k2", "secret2", now.Unix()-60),
+			want:      nil,
+		},
+		{
+			name: "unsigned",
+			want: nil,
+		},
+		{
+			name:     "unsigned but required",
+			required: true,
+			want:     ErrSignatureRequired,
+		},
+		{
+			name:      "malformed",
+			signature: "keyid=k1,sig",
+			want:      ErrInvalidSignature,
+		},
+		{
+			name:      "unknown key",
+			signature: sign("k3", "secret1", now.Unix()),
+			want:      ErrUnknownSignatureKey,
+		},
+		{
+			name:      "expired",
+			signature: sign("k1", "secret1", now.Unix()-301),
+			want:      ErrSignatureExpired,
+		},
+		{
+			name:      "wrong key",
+			signature: sign("k1", "secret2", now.Unix()),
+			want:      ErrSignatureMismatched,
+		},
+		{
+			name:      "another db",
+			signature: sign("k1", "secret1", now.Unix()),
+			uri:       "/write?db=db2",
+			want:      ErrSignatureMismatched,
+		},
+	}
+	for _, tt := range tests {
+		v := NewHmacVerifier(&ProxyConfig{HmacKeys: map[string]string{"k1": "secret1", "k2": "secret2"}, HmacRequired: tt.required, HmacWindow: 300})
+		if tt.uri == "" {
+			tt.uri = uri
+		}
+		req := httptest.NewRequest("POST", tt.uri, strings.NewReader(string(body)))
+		if tt.signature != "" {
+			req.Header.Set(HeaderSignature, tt.signature)
+		}
+		if got := v.Verify(req, body, now); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
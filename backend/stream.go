@@ -0,0 +1,54 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io"
+	"net/http"
+)
+
+// StreamWriter lets the response of a single backend be copied to client as it arrives instead of being buffered,
+// Streamed reports whether the response has been written
+type StreamWriter struct {
+	http.ResponseWriter
+	Streamed bool
+}
+
+func NewStreamWriter(w http.ResponseWriter) *StreamWriter {
+	return &StreamWriter{ResponseWriter: w}
+}
+
+// ReadFrom copies r to the client and flushes after each read, so that chunked responses are passed through in chunks
+func (sw *StreamWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	flusher, _ := sw.ResponseWriter.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		nr, rerr := r.Read(buf)
+		if nr > 0 {
+			nw, werr := sw.ResponseWriter.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// unstream returns the underlying writer, the responses of sub-queries must be buffered to be processed
+func unstream(w http.ResponseWriter) http.ResponseWriter {
+	if sw, ok := w.(*StreamWriter); ok {
+		return sw.ResponseWriter
+	}
+	return w
+}
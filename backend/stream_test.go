@@ -0,0 +1,50 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("q") == "select * from bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"bad query"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer ts.Close()
+	hb := NewSimpleHttpBackend(&BackendConfig{Name: "influxdb", Url: ts.URL})
+
+	tests := []struct {
+		name     string
+		q        string
+		err      string
+		streamed bool
+		body     string
+	}{
+		{name: "ok", q: "select * from cpu", streamed: true, body: `{"results":[{"statement_id":0}]}`},
+		{name: "error", q: "select * from bad", err: "bad query"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		sw := NewStreamWriter(rec)
+		req := httptest.NewRequest("GET", "/query", nil)
+		req.RequestURI = ""
+		req.Form = map[string][]string{"db": {"db"}, "q": {tt.q}}
+		err := hb.QueryStream(req, sw)
+		if (err != nil && err.Error() != tt.err) || (err == nil && tt.err != "") {
+			t.Errorf("%v: got error %v, want %q", tt.name, err, tt.err)
+		}
+		if sw.Streamed != tt.streamed || rec.Body.String() != tt.body {
+			t.Errorf("%v: got streamed %v body %q, want %v %q", tt.name, sw.Streamed, rec.Body.String(), tt.streamed, tt.body)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+const (
+	ParamString     = "string"
+	ParamIdentifier = "identifier"
+	ParamInteger    = "integer"
+	ParamFloat      = "float"
+	ParamBoolean    = "boolean"
+	ParamDuration   = "duration"
+	ParamTime       = "time"
+)
+
+var (
+	ErrInvalidQueryTemplate  = errors.New("invalid query template, require name, db, query and params of type string, identifier, integer, float, boolean, duration or time")
+	ErrQueryTemplateNotFound = errors.New("query template not found")
+)
+
+var (
+	templateNameRegexp  = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	templateParamRegexp = regexp.MustCompile(`\$([A-Za-z_][A-Za-z0-9_]*)`)
+	durationParamRegexp = regexp.MustCompile(`^\d+(ns|us|u|µ|ms|s|m|h|d|w)$`)
+
+	stringParamEscaper     = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	identifierParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// reservedParams are the query parameters of /query which can't be used as the template params
+var reservedParams = util.NewSet("name", "q", "db", "rp", "u", "p", "epoch", "chunked", "chunk_size", "pretty", "trace", "precision")
+
+// QueryTemplate is a named query whose $params are substituted by the values of declared types
+type QueryTemplate struct {
+	Name   string            `json:"name"`
+	Db     string            `json:"db"`
+	Query  string            `json:"query"`
+	Params map[string]string `json:"params"`
+}
+
+// Check returns an error if the template is malformed or uses params not declared
+func (qt *QueryTemplate) Check() error {
+	if !templateNameRegexp.MatchString(qt.Name) || qt.Db == "" || strings.TrimSpace(qt.Query) == "" {
+		return ErrInvalidQueryTemplate
+	}
+	for name, typ := range qt.Params {
+		if reservedParams[name] {
+			return fmt.Errorf("reserved param of query template: %s", name)
+		}
+		switch typ {
+		case ParamString, ParamIdentifier, ParamInteger, ParamFloat, ParamBoolean, ParamDuration, ParamTime:
+		default:
+			return ErrInvalidQueryTemplate
+		}
+	}
+	for _, match := range templateParamRegexp.FindAllStringSubmatch(qt.Query, -1) {
+		if _, ok := qt.Params[match[1]]; !ok {
+			return fmt.Errorf("undeclared param of query template: %s", match[1])
+		}
+	}
+	return nil
+}
+
+// Render returns the query with the params substituted by the values, each value is checked and quoted by its type
+func (qt *QueryTemplate) Render(values url.Values) (q string, err error) {
+	literals := make(map[string]string, len(qt.Params))
+	for name, typ := range qt.Params {
+		if _, ok := values[name]; !ok {
+			return "", fmt.Errorf("missing param of query template: %s", name)
+		}
+		literal, err := paramLiteral(typ, values.Get(name))
+		if err != nil {
+			return "", fmt.Errorf("invalid param of query template: %s, require %s", name, typ)
+		}
+		literals[name] = literal
+	}
+	q = templateParamRegexp.ReplaceAllStringFunc(qt.Query, func(param string) string {
+		return literals[param[1:]]
+	})
+	return
+}
+
+func paramLiteral(typ, value string) (string, error) {
+	switch typ {
+	case ParamString:
+		return "'" + stringParamEscaper.Replace(value) + "'", nil
+	case ParamIdentifier:
+		return "\"" + identifierParamEscaper.Replace(value) + "\"", nil
+	case ParamInteger:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(n, 10), nil
+	case ParamFloat:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return "", ErrInvalidQueryTemplate
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	case ParamBoolean:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(b), nil
+	case ParamDuration:
+		if !durationParamRegexp.MatchString(value) {
+			return "", ErrInvalidQueryTemplate
+		}
+		return value, nil
+	case ParamTime:
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return "", err
+		}
+		return "'" + t.UTC().Format(time.RFC3339Nano) + "'", nil
+	}
+	return "", ErrInvalidQueryTemplate
+}
+
+// QueryTemplates are the query templates registered by name
+type QueryTemplates struct {
+	templates map[string]*QueryTemplate
+	lock      sync.RWMutex
+}
+
+func NewQueryTemplates() *QueryTemplates {
+	return &QueryTemplates{templates: make(map[string]*QueryTemplate)}
+}
+
+// Register adds the template or replaces the one of the same name
+func (qts *QueryTemplates) Register(qt *QueryTemplate) error {
+	if err := qt.Check(); err != nil {
+		return err
+	}
+	qts.lock.Lock()
+	defer qts.lock.Unlock()
+	qts.templates[qt.Name] = qt
+	return nil
+}
+
+func (qts *QueryTemplates) Delete(name string) error {
+	qts.lock.Lock()
+	defer qts.lock.Unlock()
+	if _, ok := qts.templates[name]; !ok {
+		return ErrQueryTemplateNotFound
+	}
+	delete(qts.templates, name)
+	return nil
+}
+
+func (qts *QueryTemplates) Get(name string) (*QueryTemplate, error) {
+	qts.lock.RLock()
+	defer qts.lock.RUnlock()
+	qt, ok := qts.templates[name]
+	if !ok {
+		return nil, ErrQueryTemplateNotFound
+	}
+	return qt, nil
+}
+
+// List returns the templates sorted by name
+func (qts *QueryTemplates) List() []*QueryTemplate {
+	qts.lock.RLock()
+	defer qts.lock.RUnlock()
+	list := make([]*QueryTemplate, 0, len(qts.templates))
+	for _, qt := range qts.templates {
+		list = append(list, qt)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
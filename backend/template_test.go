@@ -0,0 +1,117 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestQueryTemplateCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		qt   *QueryTemplate
+		ok   bool
+	}{
+		{name: "valid", qt: &QueryTemplate{Name: "cpu", Db: "db", Query: "select * from cpu where host = $host", Params: map[string]string{"host": ParamString}}, ok: true},
+		{name: "no params", qt: &QueryTemplate{Name: "cpu", Db: "db", Query: "select * from cpu limit 10"}, ok: true},
+		{name: "invalid name", qt: &QueryTemplate{Name: "cpu report", Db: "db", Query: "select * from cpu"}, ok: false},
+		{name: "no db", qt: &QueryTemplate{Name: "cpu", Query: "select * from cpu"}, ok: false},
+		{name: "undeclared param", qt: &QueryTemplate{Name: "cpu", Db: "db", Query: "select * from cpu where host = $host"}, ok: false},
+		{name: "invalid type", qt: &QueryTemplate{Name: "cpu", Db: "db", Query: "select * from cpu where host = $host", Params: map[string]string{"host": "regex"}}, ok: false},
+		{name: "reserved param", qt: &QueryTemplate{Name: "cpu", Db: "db", Query: "select * from cpu where host = $q", Params: map[string]string{"q": ParamString}}, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.qt.Check(); (err == nil) != tt.ok {
+				t.Errorf("Check() error = %v, ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestQueryTemplateRender(t *testing.T) {
+	qt := &QueryTemplate{
+		Name:  "report",
+		Db:    "db",
+		Query: "select mean($field) from cpu where host = $host and time > $start and time < now() - $offset and value > $min limit $limit",
+		Params: map[string]string{
+			"field":  ParamIdentifier,
+			"host":   ParamString,
+			"start":  ParamTime,
+			"offset": ParamDuration,
+			"min":    ParamFloat,
+			"limit":  ParamInteger,
+		},
+	}
+	tests := []struct {
+		name   string
+		values url.Values
+		want   string
+		ok     bool
+	}{
+		{
+			name:   "valid",
+			values: url.Values{"field": {"usage"}, "host": {"server01"}, "start": {"2021-01-01T00:00:00+08:00"}, "offset": {"1h"}, "min": {"0.5"}, "limit": {"10"}},
+			want:   `select mean("usage") from cpu where host = 'server01' and time > '2020-12-31T16:00:00Z' and time < now() - 1h and value > 0.5 limit 10`,
+			ok:     true,
+		},
+		{
+			name:   "escaped",
+			values: url.Values{"field": {`a"b`}, "host": {`x' or 'a'='a`}, "start": {"2021-01-01T00:00:00Z"}, "offset": {"1h"}, "min": {"1"}, "limit": {"1"}},
+			want:   `select mean("a\"b") from cpu where host = 'x\' or \'a\'=\'a' and time > '2021-01-01T00:00:00Z' and time < now() - 1h and value > 1 limit 1`,
+			ok:     true,
+		},
+		{
+			name:   "missing param",
+			values: url.Values{"field": {"usage"}, "host": {"server01"}},
+			ok:     false,
+		},
+		{
+			name:   "invalid integer",
+			values: url.Values{"field": {"usage"}, "host": {"server01"}, "start": {"2021-01-01T00:00:00Z"}, "offset": {"1h"}, "min": {"1"}, "limit": {"1; drop database db"}},
+			ok:     false,
+		},
+		{
+			name:   "invalid duration",
+			values: url.Values{"field": {"usage"}, "host": {"server01"}, "start": {"2021-01-01T00:00:00Z"}, "offset": {"1h)"}, "min": {"1"}, "limit": {"1"}},
+			ok:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := qt.Render(tt.values)
+			if (err == nil) != tt.ok {
+				t.Errorf("Render() error = %v, ok %v", err, tt.ok)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Render() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryTemplates(t *testing.T) {
+	qts := NewQueryTemplates()
+	if err := qts.Register(&QueryTemplate{Name: "b", Db: "db", Query: "select * from cpu"}); err != nil {
+		t.Fatalf("register error: %s", err)
+	}
+	if err := qts.Register(&QueryTemplate{Name: "a", Db: "db", Query: "select * from mem"}); err != nil {
+		t.Fatalf("register error: %s", err)
+	}
+	if list := qts.List(); len(list) != 2 || list[0].Name != "a" || list[1].Name != "b" {
+		t.Errorf("list wrong: %v", list)
+	}
+	if err := qts.Delete("a"); err != nil {
+		t.Errorf("delete error: %s", err)
+	}
+	if _, err := qts.Get("a"); err != ErrQueryTemplateNotFound {
+		t.Errorf("get error = %v, want %v", err, ErrQueryTemplateNotFound)
+	}
+	if err := qts.Delete("a"); err != ErrQueryTemplateNotFound {
+		t.Errorf("delete error = %v, want %v", err, ErrQueryTemplateNotFound)
+	}
+}
@@ -0,0 +1,388 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+var ErrInvalidTenant = errors.New("invalid tenants, require unique names, prefixes of letters, digits and underscores not prefixing each other, and users in one tenant at most")
+
+var (
+	tenantPrefixRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	fluxBucketRegexp   = regexp.MustCompile(`(\bbucket\s*:\s*)"`)
+	fluxDeniedRegexp   = regexp.MustCompile(`\bbucketID\s*:|\bbuckets\s*\(`)
+)
+
+// TenantDeniedCmds are the statements of server or proxy across tenants, which are denied for the tenants
+var TenantDeniedCmds = util.NewSet(
+	"show stats",
+	"show diagnostics",
+	"show shards",
+	"drop shard",
+	"show queries",
+	"kill query",
+	"show continuous queries",
+)
+
+type TenantConfig struct {
+	Name   string   `mapstructure:"name"`
+	Prefix string   `mapstructure:"prefix"`
+	Users  []string `mapstructure:"users"`
+}
+
+// TenantError is returned if the statement is denied for the tenant
+type TenantError struct {
+	Tenant    string
+	Statement string
+}
+
+func (e *TenantError) Error() string {
+	return fmt.Sprintf("statement %s not allowed for tenant %s", e.Statement, e.Tenant)
+}
+
+// Tenant scopes the databases of its users by the prefix, the databases are named without the prefix by the users
+type Tenant struct {
+	Name   string
+	Prefix string
+}
+
+// Tenants maps the users to their tenants
+type Tenants struct {
+	users map[string]*Tenant
+}
+
+// NewTenants returns nil if there is no tenant
+func NewTenants(cfg *ProxyConfig) *Tenants {
+	if len(cfg.Tenants) == 0 {
+		return nil
+	}
+	ts := &Tenants{users: make(map[string]*Tenant)}
+	for _, tcfg := range cfg.Tenants {
+		tenant := &Tenant{Name: tcfg.Name, Prefix: tcfg.Prefix}
+		for _, user := range tcfg.Users {
+			ts.users[user] = tenant
+		}
+	}
+	return ts
+}
+
+// CheckTenants checks the tenants, whose prefixes are not prefixing each other so that no tenant can reach the others
+func CheckTenants(cfg *ProxyConfig) error {
+	names := util.NewSet()
+	users := util.NewSet()
+	for i, tcfg := range cfg.Tenants {
+		if tcfg == nil || tcfg.Name == "" || names[tcfg.Name] || !tenantPrefixRegexp.MatchString(tcfg.Prefix) {
+			return ErrInvalidTenant
+		}
+		names.Add(tcfg.Name)
+		for _, other := range cfg.Tenants[:i] {
+			if strings.HasPrefix(tcfg.Prefix, other.Prefix) || strings.HasPrefix(other.Prefix, tcfg.Prefix) {
+				return ErrInvalidTenant
+			}
+		}
+		for _, user := range tcfg.Users {
+			if user == "" || users[user] {
+				return ErrInvalidTenant
+			}
+			users.Add(user)
+		}
+	}
+	return nil
+}
+
+// Lookup returns the tenant of the user, or nil if the user isn't in any tenant
+func (ts *Tenants) Lookup(user string) *Tenant {
+	if ts == nil {
+		return nil
+	}
+	return ts.users[user]
+}
+
+type tenantKey struct{}
+
+// WithTenant returns the request scoped by the tenant of the user authenticated
+func WithTenant(req *http.Request, tenant *Tenant) *http.Request {
+	if tenant == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), tenantKey{}, tenant))
+}
+
+// GetTenant returns the tenant of request, or nil if it isn't scoped
+func GetTenant(req *http.Request) *Tenant {
+	tenant, _ := req.Context().Value(tenantKey{}).(*Tenant)
+	return tenant
+}
+
+// TenantName returns the name of the tenant of request, or empty if it isn't scoped
+func TenantName(req *http.Request) string {
+	if tenant := GetTenant(req); tenant != nil {
+		return tenant.Name
+	}
+	return ""
+}
+
+// DB returns the database of backends, the empty one is kept
+func (t *Tenant) DB(db string) string {
+	if t == nil || db == "" {
+		return db
+	}
+	return t.Prefix + db
+}
+
+// ScopeQuery rewrites the databases of the influxql statements with the prefix, including the fully qualified
+// sources of from and into, and the databases of on and database clauses. The statements across tenants are denied
+func (t *Tenant) ScopeQuery(q string) (string, error) {
+	for _, stmt := range SplitStatements(q) {
+		tokens := ScanTokens(stmt, 3)
+		if len(tokens) == 0 {
+			continue
+		}
+		for _, n := range []int{2, 3} {
+			if head := GetHeadStmtFromTokens(tokens, n); TenantDeniedCmds[head] {
+				return "", &TenantError{Tenant: t.Name, Statement: head}
+			}
+		}
+	}
+
+	return t.scope(q), nil
+}
+
+// scope rewrites the databases of the query, the quoted identifiers, strings, regexes and comments are kept
+// as they are, so that the keywords in them are not taken
+func (t *Tenant) scope(q string) string {
+	var b strings.Builder
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == '"' || c == '\'' || c == '/' && prevNonSpace(q, i) == '~':
+			end := skipQuoted(q, i)
+			b.WriteString(q[i:end])
+			i = end
+		case isComment(q, i):
+			end := skipSpace(q, i)
+			b.WriteString(q[i:end])
+			i = end
+		case isWordChar(c):
+			end := i
+			for end < len(q) && isWordChar(q[end]) {
+				end++
+			}
+			b.WriteString(q[i:end])
+			word := strings.ToLower(q[i:end])
+			i = end
+			// the keywords are reserved, so they're not identifiers unless quoted
+			if word == "from" || word == "into" {
+				i = t.scopeSources(&b, q, i, word == "from")
+			} else if word == "on" || word == "database" {
+				start := skipSpace(q, i)
+				b.WriteString(q[i:start])
+				i = t.scopeIdent(&b, q, start)
+			}
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// scopeSources rewrites the sources at i, separated by commas if multiple, and returns the end of them
+func (t *Tenant) scopeSources(b *strings.Builder, q string, i int, multiple bool) int {
+	for {
+		start := skipSpace(q, i)
+		b.WriteString(q[i:start])
+		i = start
+		if i == len(q) {
+			return i
+		}
+		if q[i] == '(' {
+			end := skipParen(q, i)
+			b.WriteByte('(')
+			b.WriteString(t.scope(q[i+1 : end-1]))
+			b.WriteByte(')')
+			i = end
+		} else if q[i] == '/' {
+			end := skipQuoted(q, i)
+			b.WriteString(q[i:end])
+			i = end
+		} else {
+			i = t.scopeSource(b, q, i)
+		}
+		next := skipSpace(q, i)
+		if !multiple || next == len(q) || q[next] != ',' {
+			return i
+		}
+		b.WriteString(q[i : next+1])
+		i = next + 1
+	}
+}
+
+// scopeSource prefixes the database of the fully qualified source at i like db.rp.mm or db..mm
+func (t *Tenant) scopeSource(b *strings.Builder, q string, i int) int {
+	var segments []int
+	end := i
+	for {
+		segments = append(segments, end)
+		end = skipIdent(q, end)
+		if end == len(q) || q[end] != '.' {
+			break
+		}
+		end++
+	}
+	if len(segments) == 3 && segments[1] > segments[0]+1 {
+		t.scopeIdent(b, q, i)
+		b.WriteString(q[skipIdent(q, i):end])
+	} else {
+		b.WriteString(q[i:end])
+	}
+	return end
+}
+
+// scopeIdent prefixes the identifier at i, quoted or not, and returns the end of it
+func (t *Tenant) scopeIdent(b *strings.Builder, q string, i int) int {
+	end := skipIdent(q, i)
+	if end == i {
+		return i
+	}
+	if q[i] == '"' || q[i] == '\'' {
+		b.WriteByte(q[i])
+		b.WriteString(t.Prefix)
+		b.WriteString(q[i+1 : end])
+	} else {
+		b.WriteString(t.Prefix)
+		b.WriteString(q[i:end])
+	}
+	return end
+}
+
+// ScopeFlux rewrites the buckets of the flux query with the prefix, the other ways to reach buckets are denied
+func (t *Tenant) ScopeFlux(q string) (string, error) {
+	if stmt := fluxDeniedRegexp.FindString(q); stmt != "" {
+		return "", &TenantError{Tenant: t.Name, Statement: stmt}
+	}
+	return fluxBucketRegexp.ReplaceAllString(q, `${1}"`+t.Prefix), nil
+}
+
+// scopeDatabases returns the copy of the response of show databases with the databases of the tenant of request,
+// whose prefix is trimmed, the other responses are returned as they are
+func scopeDatabases(req *http.Request, rsp *Response) *Response {
+	tenant := GetTenant(req)
+	if tenant == nil || GetHeadStmtFromTokens(ScanTokens(req.FormValue("q"), 2), 2) != "show databases" {
+		return rsp
+	}
+	scoped := &Response{Err: rsp.Err}
+	for _, result := range rsp.Results {
+		sr := *result
+		sr.Series = nil
+		for _, serie := range result.Series {
+			row := &models.Row{Name: serie.Name, Tags: serie.Tags, Columns: serie.Columns, Partial: serie.Partial}
+			for _, value := range serie.Values {
+				if db, ok := value[0].(string); ok && strings.HasPrefix(db, tenant.Prefix) {
+					row.Values = append(row.Values, append([]interface{}{strings.TrimPrefix(db, tenant.Prefix)}, value[1:]...))
+				}
+			}
+			sr.Series = append(sr.Series, row)
+		}
+		scoped.Results = append(scoped.Results, &sr)
+	}
+	return scoped
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func isComment(q string, i int) bool {
+	return i+1 < len(q) && (q[i] == '-' && q[i+1] == '-' || q[i] == '/' && q[i+1] == '*')
+}
+
+// skipSpace returns the end of the whitespaces and comments at i
+func skipSpace(q string, i int) int {
+	for i < len(q) {
+		switch {
+		case q[i] == ' ' || q[i] == '\t' || q[i] == '\n' || q[i] == '\r':
+			i++
+		case isComment(q, i) && q[i] == '-':
+			if end := strings.IndexByte(q[i:], '\n'); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(q)
+			}
+		case isComment(q, i):
+			if end := strings.Index(q[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(q)
+			}
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipParen returns the end of the parenthesis at i, the quoted ones inside are skipped
+func skipParen(q string, i int) int {
+	depth := 0
+	for i < len(q) {
+		switch q[i] {
+		case '"', '\'':
+			i = skipQuoted(q, i)
+			continue
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+		i++
+	}
+	return len(q)
+}
+
+// skipQuoted returns the end of the quoted identifier, string or regex at i, the escaped quotes are skipped
+func skipQuoted(q string, i int) int {
+	quote := q[i]
+	for j := i + 1; j < len(q); j++ {
+		if q[j] == '\\' {
+			j++
+		} else if q[j] == quote {
+			return j + 1
+		}
+	}
+	return len(q)
+}
+
+// skipIdent returns the end of the identifier at i, quoted or not
+func skipIdent(q string, i int) int {
+	if i < len(q) && (q[i] == '"' || q[i] == '\'') {
+		return skipQuoted(q, i)
+	}
+	for i < len(q) && isWordChar(q[i]) {
+		i++
+	}
+	return i
+}
+
+func prevNonSpace(q string, i int) byte {
+	for i--; i >= 0; i-- {
+		if q[i] != ' ' && q[i] != '\t' && q[i] != '\n' && q[i] != '\r' {
+			return q[i]
+		}
+	}
+	return 0
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+func TestCheckTenants(t *testing.T) {
+	tests := []struct {
+		name    string
+		tenants []*TenantConfig
+		want    error
+	}{
+		{
+			name:    "empty",
+			tenants: nil,
+			want:    nil,
+		},
+		{
+			name:    "tenants",
+			tenants: []*TenantConfig{{Name: "t1", Prefix: "t1_", Users: []string{"u1", "u2"}}, {Name: "t2", Prefix: "t2_", Users: []string{"u3"}}},
+			want:    nil,
+		},
+		{
+			name:    "empty name",
+			tenants: []*TenantConfig{{Prefix: "t1_"}},
+			want:    ErrInvalidTenant,
+		},
+		{
+			name:    "duplicate name",
+			tenants: []*TenantConfig{{Name: "t1", Prefix: "t1_"}, {Name: "t1", Prefix: "t2_"}},
+			want:    ErrInvalidTenant,
+		},
+		{
+			name:    "invalid prefix",
+			tenants: []*TenantConfig{{Name: "t1", Prefix: "t1."}},
+			want:    ErrInvalidTenant,
+		},
+		{
+			name:    "prefix of another",
+			tenants: []*TenantConfig{{Name: "t1", Prefix: "team_"}, {Name: "t2", Prefix: "team_a_"}},
+			want:    ErrInvalidTenant,
+		},
+		{
+			name:    "user in tenants",
+			tenants: []*TenantConfig{{Name: "t1", Prefix: "t1_", Users: []string{"u1"}}, {Name: "t2", Prefix: "t2_", Users: []string{"u1"}}},
+			want:    ErrInvalidTenant,
+		},
+	}
+	for _, tt := range tests {
+		if got := CheckTenants(&ProxyConfig{Tenants: tt.tenants}); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTenantScopeQuery(t *testing.T) {
+	tenant := &Tenant{Name: "t1", Prefix: "t1_"}
+	tests := []struct {
+		name string
+		q    string
+		want string
+		err  bool
+	}{
+		{
+			name: "select",
+			q:    "select value from cpu where host = 'from db.rp.mm'",
+			want: "select value from cpu where host = 'from db.rp.mm'",
+		},
+		{
+			name: "fully qualified",
+			q:    `SELECT * FROM db1.autogen.cpu, "db2".."mem", rp.disk`,
+			want: `SELECT * FROM t1_db1.autogen.cpu, "t1_db2".."mem", rp.disk`,
+		},
+		{
+			name: "regex",
+			q:    "select * from db1../cpu.*/ where host =~ /from db2..mm/",
+			want: "select * from t1_db1../cpu.*/ where host =~ /from db2..mm/",
+		},
+		{
+			name: "subquery",
+			q:    "select mean(v) from (select v from db1..cpu), db2..mem",
+			want: "select mean(v) from (select v from t1_db1..cpu), t1_db2..mem",
+		},
+		{
+			name: "into",
+			q:    "select * into db2.autogen.cpu from db1..cpu group by *",
+			want: "select * into t1_db2.autogen.cpu from t1_db1..cpu group by *",
+		},
+		{
+			name: "on",
+			q:    `show measurements on db1; create retention policy rp on "db2" duration 1d replication 1`,
+			want: `show measurements on t1_db1; create retention policy rp on "t1_db2" duration 1d replication 1`,
+		},
+		{
+			name: "database",
+			q:    "create database db1; drop database db2",
+			want: "create database t1_db1; drop database t1_db2",
+		},
+		{
+			name: "comment",
+			q:    "select * -- it's\nfrom/* from db3..cpu */db1..cpu",
+			want: "select * -- it's\nfrom/* from db3..cpu */t1_db1..cpu",
+		},
+		{
+			name: "show stats",
+			q:    "show stats",
+			err:  true,
+		},
+		{
+			name: "show continuous queries",
+			q:    "show databases; show continuous queries",
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := tenant.ScopeQuery(tt.q)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+		} else if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTenantScopeFlux(t *testing.T) {
+	tenant := &Tenant{Name: "t1", Prefix: "t1_"}
+	got, err := tenant.ScopeFlux(`from(bucket: "db1/autogen") |> range(start: -1h)`)
+	if err != nil || got != `from(bucket: "t1_db1/autogen") |> range(start: -1h)` {
+		t.Errorf("got %s, %v", got, err)
+	}
+	if _, err = tenant.ScopeFlux(`buckets() |> yield()`); err == nil {
+		t.Error("buckets not denied")
+	}
+	if _, err = tenant.ScopeFlux(`from(bucketID: "0123")`); err == nil {
+		t.Error("bucket id not denied")
+	}
+}
+
+func TestScopeDatabases(t *testing.T) {
+	rsp := ResponseFromSeries(models.Rows{{
+		Name:    "databases",
+		Columns: []string{"name"},
+		Values:  [][]interface{}{{"_internal"}, {"t1_db1"}, {"t2_db1"}, {"t1_db2"}},
+	}})
+	req := &http.Request{Form: url.Values{"q": []string{"SHOW DATABASES"}}}
+	if got := scopeDatabases(req, rsp); got != rsp {
+		t.Error("response scoped without tenant")
+	}
+	req = WithTenant(req, &Tenant{Name: "t1", Prefix: "t1_"})
+	got := scopeDatabases(req, rsp)
+	values := got.Results[0].Series[0].Values
+	if len(values) != 2 || values[0][0] != "db1" || values[1][0] != "db2" {
+		t.Errorf("got %v", values)
+	}
+	if len(rsp.Results[0].Series[0].Values) != 4 {
+		t.Error("response cached is changed")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	timeUpperRegexp = regexp.MustCompile(`(?i)\btime\s*<=?\s*(now\(\)(\s*-\s*(\d+)(ns|us|u|µ|ms|s|m|h|d|w))?|'[^']*'|\d+(ns|us|u|µ|ms|s|m|h|d|w)?)`)
+	orRegexp        = regexp.MustCompile(`(?i)\sor\s`)
+	subqueryRegexp  = regexp.MustCompile(`(?i)\(\s*select\s`)
+)
+
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02"}
+
+// GetTimeUpperBound returns the latest upper bound of time like time < '2021-01-01T00:00:00Z' or time < now() - 30d
+// in the query, the zero time is returned if the query may read data without upper bound, e.g. the time conditions
+// are combined with or, or the query has subqueries
+func GetTimeUpperBound(q string, now time.Time) (end time.Time) {
+	if orRegexp.MatchString(q) || subqueryRegexp.MatchString(q) {
+		return
+	}
+	for _, match := range timeUpperRegexp.FindAllStringSubmatch(q, -1) {
+		t, ok := parseTimeLiteral(match, now)
+		if !ok {
+			return time.Time{}
+		}
+		if t.After(end) {
+			end = t
+		}
+	}
+	return
+}
+
+func parseTimeLiteral(match []string, now time.Time) (time.Time, bool) {
+	literal := match[1]
+	switch {
+	case strings.HasPrefix(strings.ToLower(literal), "now()"):
+		if match[3] == "" {
+			return now, true
+		}
+		n, err := strconv.ParseInt(match[3], 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return now.Add(-time.Duration(n) * durationUnits[strings.ToLower(match[4])]), true
+	case literal[0] == '\'':
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, literal[1:len(literal)-1]); err == nil {
+				return t, true
+			}
+		}
+		return time.Time{}, false
+	default:
+		unit := time.Nanosecond
+		if match[5] != "" {
+			unit = durationUnits[strings.ToLower(match[5])]
+			literal = strings.TrimSuffix(literal, match[5])
+		}
+		n, err := strconv.ParseInt(literal, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(0, n*int64(unit)), true
+	}
+}
+
+// Tier returns the cold tier of circle if the data before end is cold, otherwise the circle itself
+func (ic *Circle) Tier(end time.Time) *Circle {
+	if ic.Cold == nil || end.IsZero() || !end.Before(time.Now().Add(-ic.coldAfter)) {
+		return ic
+	}
+	return ic.Cold
+}
+
+// readTiers returns the tier of each circle of the databases to read the query
+func (ip *Proxy) readTiers(req *http.Request, dbs ...string) []*Circle {
+	end := GetTimeUpperBound(req.FormValue("q"), time.Now())
+	circles := ip.GetCircles(dbs...)
+	tiers := make([]*Circle, len(circles))
+	for i, circle := range circles {
+		tiers[i] = circle.Tier(end)
+	}
+	return tiers
+}
+
+// allTiers returns the hot and cold tiers of all circles of db
+func (ip *Proxy) allTiers(db string) []*Circle {
+	var circles []*Circle
+	for _, circle := range ip.GetCircles(db) {
+		circles = append(circles, circle)
+		if circle.Cold != nil {
+			circles = append(circles, circle.Cold)
+		}
+	}
+	return circles
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetTimeUpperBound(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		q    string
+		want time.Time
+	}{
+		{name: "rfc3339", q: `select * from cpu where time < '2021-01-01T00:00:00Z'`, want: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "date", q: `select * from cpu where time >= '2020-01-01' and time <= '2020-02-01'`, want: time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "now minus", q: `select * from cpu where time > now() - 60d and time < now() - 30d`, want: now.Add(-30 * 24 * time.Hour)},
+		{name: "now", q: `select * from cpu where time > now() - 1h and time < now()`, want: now},
+		{name: "nanoseconds", q: `select * from cpu where time < 1600000000000000000`, want: time.Unix(1600000000, 0)},
+		{name: "seconds", q: `select * from cpu where time<1600000000s`, want: time.Unix(1600000000, 0)},
+		{name: "latest of several", q: `select * from cpu where time < '2020-01-01T00:00:00Z' and time < '2020-03-01T00:00:00Z'`, want: time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "lower bound only", q: `select * from cpu where time > now() - 1h`, want: time.Time{}},
+		{name: "no where", q: `select * from cpu`, want: time.Time{}},
+		{name: "or", q: `select * from cpu where time < '2020-01-01T00:00:00Z' or host = 'a'`, want: time.Time{}},
+		{name: "subquery", q: `select mean(v) from (select * from cpu) where time < '2020-01-01T00:00:00Z'`, want: time.Time{}},
+		{name: "invalid time", q: `select * from cpu where time < 'yesterday'`, want: time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetTimeUpperBound(tt.q, now); !got.Equal(tt.want) {
+				t.Errorf("GetTimeUpperBound() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCircleTier(t *testing.T) {
+	cold := &Circle{Name: "circle-1-cold"}
+	circle := &Circle{Name: "circle-1", Cold: cold, coldAfter: 30 * 24 * time.Hour}
+	now := time.Now()
+	tests := []struct {
+		name string
+		end  time.Time
+		want *Circle
+	}{
+		{name: "unbounded", end: time.Time{}, want: circle},
+		{name: "recent", end: now.Add(-time.Hour), want: circle},
+		{name: "cold", end: now.Add(-31 * 24 * time.Hour), want: cold},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := circle.Tier(tt.end); got != tt.want {
+				t.Errorf("Tier() = %s, want %s", got.Name, tt.want.Name)
+			}
+		})
+	}
+	if got := cold.Tier(now.Add(-365 * 24 * time.Hour)); got != cold {
+		t.Errorf("circle without cold tier returned %s", got.Name)
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+var (
+	ErrInvalidClientAuth = errors.New("invalid https_client_auth, require none, optional or require, and https_client_ca unless none")
+	ErrInvalidCA         = errors.New("invalid ca file, require pem certificates")
+	ErrInvalidBackendTLS = errors.New("invalid backend tls, require both tls_cert and tls_key or neither")
+	ErrInvalidTLSVersion = errors.New("invalid https tls version, require 1.0, 1.1, 1.2 or 1.3, and https_min_version not above https_max_version")
+	ErrInvalidCipher     = errors.New("invalid https cipher suite, require the names like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	ErrInvalidCurve      = errors.New("invalid https curve, require X25519, P256, P384 or P521")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// CertCheckInterval is the min interval to check the certificate files changed on handshakes
+var CertCheckInterval = time.Minute
+
+// CertReloader keeps the certificate of the cert and key files, which is reloaded once the files are changed,
+// so that the certificates are rotated without restart, the cert and key may also be secret references of pem
+type CertReloader struct {
+	certFile   string
+	keyFile    string
+	certSecret *Secret
+	keySecret  *Secret
+	cert       *tls.Certificate
+	stamp      string
+	checked    time.Time
+	lock       sync.Mutex
+}
+
+// NewCertReloader returns the reloader of the certificate loaded from the cert and key files or secret references
+func NewCertReloader(certFile, keyFile string) (cr *CertReloader, err error) {
+	cr = &CertReloader{certFile: certFile, keyFile: keyFile}
+	if IsSecretRef(certFile) {
+		if cr.certSecret, err = NewSecret(certFile); err != nil {
+			return nil, err
+		}
+	}
+	if IsSecretRef(keyFile) {
+		if cr.keySecret, err = NewSecret(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	if err = cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload loads the certificate from the files and secrets, the current one is kept if failed
+func (cr *CertReloader) Reload() error {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	for _, secret := range []*Secret{cr.certSecret, cr.keySecret} {
+		if secret != nil {
+			if err := secret.resolve(); err != nil {
+				return err
+			}
+		}
+	}
+	return cr.load(time.Now())
+}
+
+func (cr *CertReloader) load(now time.Time) error {
+	stamp := cr.currentStamp()
+	certPEM, err := readPEM(cr.certFile, cr.certSecret)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := readPEM(cr.keyFile, cr.keySecret)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	cr.cert, cr.stamp, cr.checked = &cert, stamp, now
+	return nil
+}
+
+func readPEM(file string, secret *Secret) ([]byte, error) {
+	if secret != nil {
+		return []byte(secret.Value()), nil
+	}
+	return ioutil.ReadFile(file)
+}
+
+// currentStamp returns the mod times of the files and the values of the secrets to detect changes,
+// the symlinks are followed as the secrets mounted by kubernetes
+func (cr *CertReloader) currentStamp() string {
+	var stamp strings.Builder
+	for _, src := range []struct {
+		file   string
+		secret *Secret
+	}{{cr.certFile, cr.certSecret}, {cr.keyFile, cr.keySecret}} {
+		if src.secret != nil {
+			stamp.WriteString(src.secret.Value())
+		} else if fi, err := os.Stat(src.file); err == nil {
+			stamp.WriteString(strconv.FormatInt(fi.ModTime().UnixNano(), 10))
+		}
+		stamp.WriteByte('\n')
+	}
+	return stamp.String()
+}
+
+// certificate returns the current certificate, which is reloaded if the files or secrets are changed since checked CertCheckInterval ago
+func (cr *CertReloader) certificate() *tls.Certificate {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	now := time.Now()
+	if now.Sub(cr.checked) >= CertCheckInterval {
+		cr.checked = now
+		if cr.currentStamp() != cr.stamp {
+			if err := cr.load(now); err != nil {
+				log.Printf("reload certificate %s error: %s", cr.certFile, err)
+			} else {
+				log.Printf("certificate %s reloaded", cr.certFile)
+			}
+		}
+	}
+	return cr.cert
+}
+
+// GetCertificate returns the certificate for tls.Config of server
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.certificate(), nil
+}
+
+// GetClientCertificate returns the certificate for tls.Config of client
+func (cr *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return cr.certificate(), nil
+}
+
+// CheckClientAuth checks the client auth of https
+func CheckClientAuth(cfg *ProxyConfig) error {
+	switch cfg.HTTPSClientAuth {
+	case ClientAuthNone:
+		return nil
+	case ClientAuthOptional, ClientAuthRequire:
+		if cfg.HTTPSClientCA == "" {
+			return ErrInvalidClientAuth
+		}
+		return nil
+	}
+	return ErrInvalidClientAuth
+}
+
+// CheckServerTLS checks the tls versions, cipher suites and curves of https
+func CheckServerTLS(cfg *ProxyConfig) error {
+	return setServerTLS(&tls.Config{}, cfg)
+}
+
+// setServerTLS sets the tls versions, and the cipher suites and curves which are the defaults of go if empty,
+// the cipher suites only apply to tls 1.2 and below since the ones of tls 1.3 aren't configurable
+func setServerTLS(tlsConfig *tls.Config, cfg *ProxyConfig) error {
+	var ok bool
+	if cfg.HTTPSMinVersion != "" {
+		if tlsConfig.MinVersion, ok = tlsVersions[cfg.HTTPSMinVersion]; !ok {
+			return ErrInvalidTLSVersion
+		}
+	}
+	if cfg.HTTPSMaxVersion != "" {
+		if tlsConfig.MaxVersion, ok = tlsVersions[cfg.HTTPSMaxVersion]; !ok || tlsConfig.MaxVersion < tlsConfig.MinVersion {
+			return ErrInvalidTLSVersion
+		}
+	}
+	suites := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+	tlsConfig.CipherSuites = nil
+	for _, name := range cfg.HTTPSCipherSuites {
+		id, ok := suites[name]
+		if !ok {
+			return ErrInvalidCipher
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	tlsConfig.CurvePreferences = nil
+	for _, name := range cfg.HTTPSCurves {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return ErrInvalidCurve
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+	}
+	return nil
+}
+
+// LoadCertPool returns the pool of the pem certificates of file
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, ErrInvalidCA
+	}
+	return pool, nil
+}
+
+// NewServerTLSConfig returns the tls config of https and the reloader of https_cert and https_key,
+// the client certificates are verified by https_client_ca
+func NewServerTLSConfig(cfg *ProxyConfig) (*tls.Config, *CertReloader, error) {
+	cr, err := NewCertReloader(cfg.HTTPSCert, cfg.HTTPSKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{GetCertificate: cr.GetCertificate}
+	if err = setServerTLS(tlsConfig, cfg); err != nil {
+		return nil, nil, err
+	}
+	if cfg.HTTPSClientAuth == ClientAuthNone {
+		return tlsConfig, cr, nil
+	}
+	pool, err := LoadCertPool(cfg.HTTPSClientCA)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig.ClientCAs = pool
+	if cfg.HTTPSClientAuth == ClientAuthRequire {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, cr, nil
+}
+
+// NewBackendTLSConfig returns the tls config to the backend, whose certificate is verified by tls_ca or the
+// system roots unless tls_skip_verify, and the certificate of tls_cert is presented if the backend requires,
+// the reloader of tls_cert and tls_key is nil without tls_cert
+func NewBackendTLSConfig(cfg *BackendConfig) (*tls.Config, *CertReloader, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.SkipVerify}
+	if cfg.TLSCA != "" {
+		pool, err := LoadCertPool(cfg.TLSCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, nil, ErrInvalidBackendTLS
+	}
+	if cfg.TLSCert == "" {
+		return tlsConfig, nil, nil
+	}
+	cr, err := NewCertReloader(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig.GetClientCertificate = cr.GetClientCertificate
+	return tlsConfig, cr, nil
+}
+
+// CertIdentities returns the common name and the subject alternative names of the verified client certificate
+func CertIdentities(state *tls.ConnectionState) []string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	var ids []string
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	return ids
+}
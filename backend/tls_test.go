@@ -0,0 +1,338 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckClientAuth(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *ProxyConfig
+		err  error
+	}{
+		{name: "none", cfg: &ProxyConfig{HTTPSClientAuth: ClientAuthNone}},
+		{name: "require", cfg: &ProxyConfig{HTTPSClientAuth: ClientAuthRequire, HTTPSClientCA: "ca.pem"}},
+		{name: "optional", cfg: &ProxyConfig{HTTPSClientAuth: ClientAuthOptional, HTTPSClientCA: "ca.pem"}},
+		{name: "no ca", cfg: &ProxyConfig{HTTPSClientAuth: ClientAuthRequire}, err: ErrInvalidClientAuth},
+		{name: "invalid", cfg: &ProxyConfig{HTTPSClientAuth: "verify", HTTPSClientCA: "ca.pem"}, err: ErrInvalidClientAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckClientAuth(tt.cfg); err != tt.err {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert returns the certificate of template signed by parent, or self-signed if parent is nil
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Minute)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key in pem to dir and returns the files
+func (tc *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	kb, err := x509.MarshalECPrivateKey(tc.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func newTestCA(t *testing.T) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "ca"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "proxy"}}, ca).write(t, dir, "proxy")
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := ioutil.WriteFile(invalid, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  *ProxyConfig
+		auth tls.ClientAuthType
+		err  error
+	}{
+		{name: "none", cfg: &ProxyConfig{HTTPSClientAuth: ClientAuthNone}, auth: tls.NoClientCert},
+		{name: "require", cfg: &ProxyConfig{HTTPSClientAuth: ClientAuthRequire, HTTPSClientCA: caFile}, auth: tls.RequireAndVerifyClientCert},
+		{name: "optional", cfg: &ProxyConfig{HTTPSClientAuth: ClientAuthOptional, HTTPSClientCA: caFile}, auth: tls.VerifyClientCertIfGiven},
+		{name: "invalid ca", cfg: &ProxyConfig{HTTPSClientAuth: ClientAuthRequire, HTTPSClientCA: invalid}, err: ErrInvalidCA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.HTTPSCert, tt.cfg.HTTPSKey = certFile, keyFile
+			tlsConfig, _, err := NewServerTLSConfig(tt.cfg)
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err == nil && tlsConfig.ClientAuth != tt.auth {
+				t.Errorf("got client auth %v, want %v", tlsConfig.ClientAuth, tt.auth)
+			}
+		})
+	}
+}
+
+func TestCheckServerTLS(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *ProxyConfig
+		want error
+	}{
+		{
+			name: "default",
+			cfg:  &ProxyConfig{},
+			want: nil,
+		},
+		{
+			name: "versions",
+			cfg:  &ProxyConfig{HTTPSMinVersion: "1.2", HTTPSMaxVersion: "1.3"},
+			want: nil,
+		},
+		{
+			name: "ciphers and curves",
+			cfg:  &ProxyConfig{HTTPSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, HTTPSCurves: []string{"X25519", "P256"}},
+			want: nil,
+		},
+		{
+			name: "invalid version",
+			cfg:  &ProxyConfig{HTTPSMinVersion: "1.4"},
+			want: ErrInvalidTLSVersion,
+		},
+		{
+			name: "min above max",
+			cfg:  &ProxyConfig{HTTPSMinVersion: "1.3", HTTPSMaxVersion: "1.2"},
+			want: ErrInvalidTLSVersion,
+		},
+		{
+			name: "invalid cipher",
+			cfg:  &ProxyConfig{HTTPSCipherSuites: []string{"RC4"}},
+			want: ErrInvalidCipher,
+		},
+		{
+			name: "invalid curve",
+			cfg:  &ProxyConfig{HTTPSCurves: []string{"P224"}},
+			want: ErrInvalidCurve,
+		},
+	}
+	for _, tt := range tests {
+		if got := CheckServerTLS(tt.cfg); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	tlsConfig := &tls.Config{}
+	cfg := &ProxyConfig{HTTPSMinVersion: "1.2", HTTPSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, HTTPSCurves: []string{"P384"}}
+	if err := setServerTLS(tlsConfig, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.MaxVersion != 0 {
+		t.Errorf("got versions %x-%x", tlsConfig.MinVersion, tlsConfig.MaxVersion)
+	}
+	if len(tlsConfig.CipherSuites) != 1 || tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("got cipher suites %v", tlsConfig.CipherSuites)
+	}
+	if len(tlsConfig.CurvePreferences) != 1 || tlsConfig.CurvePreferences[0] != tls.CurveP384 {
+		t.Errorf("got curves %v", tlsConfig.CurvePreferences)
+	}
+}
+
+func TestNewBackendTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile, _ := ca.write(t, dir, "ca")
+	server := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "influxdb"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	certFile, keyFile := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca).write(t, dir, "client")
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		name string
+		cfg  *BackendConfig
+		err  error
+		ok   bool
+	}{
+		{name: "mutual tls", cfg: &BackendConfig{TLSCA: caFile, TLSCert: certFile, TLSKey: keyFile}, ok: true},
+		{name: "skip verify", cfg: &BackendConfig{TLSCert: certFile, TLSKey: keyFile, SkipVerify: true}, ok: true},
+		{name: "unknown ca", cfg: &BackendConfig{TLSCert: certFile, TLSKey: keyFile}},
+		{name: "no cert", cfg: &BackendConfig{TLSCA: caFile}},
+		{name: "no key", cfg: &BackendConfig{TLSCA: caFile, TLSCert: certFile}, err: ErrInvalidBackendTLS},
+		{name: "invalid ca", cfg: &BackendConfig{TLSCA: keyFile}, err: ErrInvalidCA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, _, err := NewBackendTLSConfig(tt.cfg)
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			client := &http.Client{Transport: newTransport(tlsConfig), Timeout: 5 * time.Second}
+			resp, err := client.Get(ts.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("got error %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	defer func(interval time.Duration) { CertCheckInterval = interval }(CertCheckInterval)
+	CertCheckInterval = 0
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "v1"}}, ca).write(t, dir, "proxy")
+	cr, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, _ := cr.GetCertificate(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	touch := func(d time.Duration) {
+		for _, file := range []string{certFile, keyFile} {
+			if err := os.Chtimes(file, time.Now().Add(d), time.Now().Add(d)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "v2"}}, ca).write(t, dir, "proxy")
+	touch(time.Minute)
+	if cn := commonName(); cn != "v2" {
+		t.Errorf("changed: got %s, want v2", cn)
+	}
+	if err = ioutil.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(2 * time.Minute)
+	if cn := commonName(); cn != "v2" {
+		t.Errorf("invalid: got %s, want v2", cn)
+	}
+	if err = cr.Reload(); err == nil {
+		t.Error("reload invalid: got no error")
+	}
+	newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "v3"}}, ca).write(t, dir, "proxy")
+	if err = cr.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cn := commonName(); cn != "v3" {
+		t.Errorf("reload: got %s, want v3", cn)
+	}
+}
+
+func TestCertIdentities(t *testing.T) {
+	u, _ := url.Parse("spiffe://example.com/u3")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "u1"},
+		DNSNames:       []string{"u2.example.com"},
+		EmailAddresses: []string{"u1@example.com"},
+		URIs:           []*url.URL{u},
+	}
+	tests := []struct {
+		name  string
+		state *tls.ConnectionState
+		want  []string
+	}{
+		{name: "plain", state: nil},
+		{name: "unverified", state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+		{name: "verified", state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, want: []string{"u1", "u2.example.com", "u1@example.com", "spiffe://example.com/u3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CertIdentities(tt.state); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
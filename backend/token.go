@@ -0,0 +1,187 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+// TokenPrefix is the prefix of api tokens, which are sent as the bearer tokens
+const TokenPrefix = "ipt_"
+
+const (
+	ScopeHealth        = "health"
+	ScopeReload        = "reload"
+	ScopeTransferRead  = "transfer:read"
+	ScopeTransferWrite = "transfer:write"
+	ScopeBackendWrite  = "backend:write"
+)
+
+// TokenScopes are the management capabilities granted to api tokens, the users and tokens are never managed by tokens
+var TokenScopes = util.NewSet(ScopeHealth, ScopeReload, ScopeTransferRead, ScopeTransferWrite, ScopeBackendWrite)
+
+var (
+	ErrInvalidScope  = errors.New("invalid scopes, require health, reload, transfer:read, transfer:write or backend:write")
+	ErrInvalidAPIKey = errors.New("invalid api token")
+	ErrTokenNotFound = errors.New("api token not found")
+	ErrScopeDenied   = errors.New("api token scope not granted")
+)
+
+// TokenInfo is the api token listed without the token, which is only returned on creation
+type TokenInfo struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Scopes  []string `json:"scopes"`
+	Created int64    `json:"created"`
+}
+
+// tokenConfig is the api token saved with the sha256 of token
+type tokenConfig struct {
+	TokenInfo
+	Hash string `json:"hash"`
+}
+
+// Tokens verifies the api tokens of management by scopes, which are managed by api and saved to tokens.json
+// under data dir, only the sha256 of tokens are saved
+type Tokens struct {
+	path   string
+	tokens map[string]*tokenConfig
+	lock   sync.RWMutex
+}
+
+func NewTokens(cfg *ProxyConfig) *Tokens {
+	ts := &Tokens{
+		path:   filepath.Join(cfg.DataDir, "tokens.json"),
+		tokens: make(map[string]*tokenConfig),
+	}
+	if err := ts.load(); err != nil {
+		log.Printf("load tokens error: %s", err)
+	}
+	return ts
+}
+
+// IsToken returns whether the bearer token is an api token
+func IsToken(token string) bool {
+	return strings.HasPrefix(token, TokenPrefix)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (ts *Tokens) load() error {
+	b, err := ioutil.ReadFile(ts.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var tokens []*tokenConfig
+	if err = json.Unmarshal(b, &tokens); err != nil {
+		return err
+	}
+	for _, tc := range tokens {
+		ts.tokens[tc.Hash] = tc
+	}
+	return nil
+}
+
+func (ts *Tokens) save() error {
+	tokens := make([]*tokenConfig, 0, len(ts.tokens))
+	for _, tc := range ts.tokens {
+		tokens = append(tokens, tc)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	b, err := json.MarshalIndent(tokens, "", "    ")
+	if err != nil {
+		return err
+	}
+	util.MakeDir(filepath.Dir(ts.path))
+	return ioutil.WriteFile(ts.path, b, 0600)
+}
+
+// Create creates the api token with the scopes and saves the tokens, the token is returned only once
+func (ts *Tokens) Create(name string, scopes []string, now time.Time) (*TokenInfo, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", ErrInvalidScope
+	}
+	for _, scope := range scopes {
+		if !TokenScopes[scope] {
+			return nil, "", ErrInvalidScope
+		}
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	token := TokenPrefix + hex.EncodeToString(b)
+	hash := hashToken(token)
+	tc := &tokenConfig{TokenInfo: TokenInfo{ID: hash[:12], Name: name, Scopes: scopes, Created: now.Unix()}, Hash: hash}
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.tokens[hash] = tc
+	if err := ts.save(); err != nil {
+		delete(ts.tokens, hash)
+		return nil, "", err
+	}
+	return &tc.TokenInfo, token, nil
+}
+
+// Verify returns the api token if it exists and has the scope
+func (ts *Tokens) Verify(token, scope string) (*TokenInfo, error) {
+	ts.lock.RLock()
+	tc, ok := ts.tokens[hashToken(token)]
+	ts.lock.RUnlock()
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	for _, s := range tc.Scopes {
+		if s == scope {
+			return &tc.TokenInfo, nil
+		}
+	}
+	return &tc.TokenInfo, ErrScopeDenied
+}
+
+// List returns the api tokens sorted by id
+func (ts *Tokens) List() []*TokenInfo {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+	tokens := make([]*TokenInfo, 0, len(ts.tokens))
+	for _, tc := range ts.tokens {
+		tokens = append(tokens, &tc.TokenInfo)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	return tokens
+}
+
+// Delete deletes the api token by id, and saves the tokens
+func (ts *Tokens) Delete(id string) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for hash, tc := range ts.tokens {
+		if tc.ID == id {
+			delete(ts.tokens, hash)
+			return ts.save()
+		}
+	}
+	return ErrTokenNotFound
+}
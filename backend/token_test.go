@@ -0,0 +1,73 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &ProxyConfig{DataDir: dir}
+	ts := NewTokens(cfg)
+	if _, _, err = ts.Create("ci", nil, time.Now()); err != ErrInvalidScope {
+		t.Errorf("create without scopes: got %v", err)
+	}
+	if _, _, err = ts.Create("ci", []string{"admin"}, time.Now()); err != ErrInvalidScope {
+		t.Errorf("create with invalid scope: got %v", err)
+	}
+	info, token, err := ts.Create("ci", []string{ScopeTransferRead, ScopeHealth}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsToken(token) {
+		t.Errorf("token without prefix: %s", token)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "tokens.json"))
+	if err != nil || strings.Contains(string(b), token) {
+		t.Errorf("token saved: %s, %v", b, err)
+	}
+
+	// the tokens are loaded again
+	ts = NewTokens(cfg)
+	tests := []struct {
+		name  string
+		token string
+		scope string
+		want  error
+	}{
+		{name: "granted", token: token, scope: ScopeTransferRead, want: nil},
+		{name: "denied", token: token, scope: ScopeTransferWrite, want: ErrScopeDenied},
+		{name: "invalid", token: TokenPrefix + "invalid", scope: ScopeHealth, want: ErrInvalidAPIKey},
+	}
+	for _, tt := range tests {
+		if _, err := ts.Verify(tt.token, tt.scope); err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if tokens := ts.List(); len(tokens) != 1 || tokens[0].ID != info.ID || tokens[0].Name != "ci" {
+		t.Errorf("list: got %+v", tokens)
+	}
+
+	if err = ts.Delete(info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = ts.Delete(info.ID); err != ErrTokenNotFound {
+		t.Errorf("delete again: got %v", err)
+	}
+	if _, err = ts.Verify(token, ScopeHealth); err != ErrInvalidAPIKey {
+		t.Errorf("verify deleted: got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type traceKey struct{}
+
+// TraceSpan is the timing of one backend contacted by the query, queue is the time from the query
+// arriving at the proxy to the request being sent to the backend
+type TraceSpan struct {
+	Backend string
+	Url     string // nolint:golint
+	Queue   time.Duration
+	Latency time.Duration
+}
+
+// QueryTrace records the backends contacted by a query and the time spent merging their results
+type QueryTrace struct {
+	start time.Time
+	spans []*TraceSpan
+	merge time.Duration
+	lock  sync.Mutex
+}
+
+// WithQueryTrace returns the request carrying a new trace
+func WithQueryTrace(req *http.Request) (*http.Request, *QueryTrace) {
+	qt := &QueryTrace{start: time.Now()}
+	return req.WithContext(context.WithValue(req.Context(), traceKey{}, qt)), qt
+}
+
+// GetQueryTrace returns the trace of request, or nil if the query isn't traced
+func GetQueryTrace(req *http.Request) *QueryTrace {
+	qt, _ := req.Context().Value(traceKey{}).(*QueryTrace)
+	return qt
+}
+
+// traceBackend adds the span of backend started at start to the trace of request, it's used with defer
+func traceBackend(req *http.Request, hb *HttpBackend, start time.Time) {
+	if qt := GetQueryTrace(req); qt != nil {
+		qt.lock.Lock()
+		defer qt.lock.Unlock()
+		qt.spans = append(qt.spans, &TraceSpan{Backend: hb.Name, Url: hb.Url, Queue: start.Sub(qt.start), Latency: time.Since(start)})
+	}
+}
+
+// traceMerge adds the time of merging results started at start to the trace of request, it's used with defer
+func traceMerge(req *http.Request, start time.Time) {
+	if qt := GetQueryTrace(req); qt != nil {
+		qt.lock.Lock()
+		defer qt.lock.Unlock()
+		qt.merge += time.Since(start)
+	}
+}
+
+func (qt *QueryTrace) Spans() []*TraceSpan {
+	qt.lock.Lock()
+	defer qt.lock.Unlock()
+	return append([]*TraceSpan{}, qt.spans...)
+}
+
+func (qt *QueryTrace) String() string {
+	qt.lock.Lock()
+	defer qt.lock.Unlock()
+	items := make([]string, 0, len(qt.spans)+2)
+	for _, span := range qt.spans {
+		items = append(items, fmt.Sprintf("backend=%s url=%s queue=%s latency=%s", span.Backend, span.Url, span.Queue, span.Latency))
+	}
+	items = append(items, fmt.Sprintf("merge=%s", qt.merge), fmt.Sprintf("total=%s", time.Since(qt.start)))
+	return strings.Join(items, "; ")
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQueryTrace(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer ts.Close()
+	hb := NewSimpleHttpBackend(&BackendConfig{Name: "influxdb", Url: ts.URL})
+
+	req := httptest.NewRequest("GET", "/query", nil)
+	if GetQueryTrace(req) != nil {
+		t.Fatalf("trace expected to be nil")
+	}
+	req, qt := WithQueryTrace(req)
+	req.RequestURI = ""
+	req.Form = map[string][]string{"db": {"db"}, "q": {"select * from cpu"}}
+	QueryInParallel([]*Backend{{HttpBackend: hb}, {HttpBackend: hb}}, req, nil, false)
+
+	spans := qt.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	for _, span := range spans {
+		if span.Backend != "influxdb" || span.Url != ts.URL || span.Latency <= 0 {
+			t.Errorf("unexpected span %+v", span)
+		}
+	}
+	if s := qt.String(); strings.Count(s, "backend=influxdb") != 2 || !strings.Contains(s, "merge=") {
+		t.Errorf("unexpected trace %s", s)
+	}
+}
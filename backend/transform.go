@@ -0,0 +1,108 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"plugin"
+	"sync"
+)
+
+var (
+	ErrEmptyTransform   = errors.New("transform requires either name or plugin")
+	ErrInvalidTransform = errors.New("plugin symbol Transform must be func(db, rp, precision string, line []byte) []byte")
+)
+
+// TransformFunc mutates a line protocol point of the db before it is written, returning nil drops the point
+type TransformFunc func(db, rp, precision string, line []byte) []byte
+
+var (
+	transformsLock sync.RWMutex
+	transforms     = make(map[string]TransformFunc)
+)
+
+// RegisterTransform makes a compiled-in transform available by name for the transforms config
+func RegisterTransform(name string, fn TransformFunc) {
+	transformsLock.Lock()
+	defer transformsLock.Unlock()
+	transforms[name] = fn
+}
+
+func lookupTransform(name string) (TransformFunc, bool) {
+	transformsLock.RLock()
+	defer transformsLock.RUnlock()
+	fn, ok := transforms[name]
+	return fn, ok
+}
+
+// LoadTransform returns the registered transform by name, or loads the Transform symbol from a go plugin
+func LoadTransform(cfg *TransformConfig) (TransformFunc, error) {
+	if cfg.Name != "" {
+		fn, ok := lookupTransform(cfg.Name)
+		if !ok {
+			return nil, fmt.Errorf("transform not registered: %s", cfg.Name)
+		}
+		return fn, nil
+	}
+	if cfg.Plugin == "" {
+		return nil, ErrEmptyTransform
+	}
+	p, err := plugin.Open(cfg.Plugin)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup("Transform")
+	if err != nil {
+		return nil, err
+	}
+	switch fn := sym.(type) {
+	case func(string, string, string, []byte) []byte:
+		return fn, nil
+	case *func(string, string, string, []byte) []byte:
+		return *fn, nil
+	}
+	return nil, ErrInvalidTransform
+}
+
+// Transforms applies the transforms configured for each db, and the ones for all dbs with empty db
+type Transforms struct {
+	byDb map[string][]TransformFunc
+	all  []TransformFunc
+}
+
+func NewTransforms(cfgs []*TransformConfig) (ts *Transforms, err error) {
+	ts = &Transforms{byDb: make(map[string][]TransformFunc)}
+	for _, cfg := range cfgs {
+		fn, err := LoadTransform(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Db == "" {
+			ts.all = append(ts.all, fn)
+		} else {
+			ts.byDb[cfg.Db] = append(ts.byDb[cfg.Db], fn)
+		}
+	}
+	return
+}
+
+func (ts *Transforms) Empty() bool {
+	return len(ts.all) == 0 && len(ts.byDb) == 0
+}
+
+func (ts *Transforms) Apply(db, rp, precision string, line []byte) []byte {
+	for _, fn := range ts.all {
+		if line = fn(db, rp, precision, line); line == nil {
+			return nil
+		}
+	}
+	for _, fn := range ts.byDb[db] {
+		if line = fn(db, rp, precision, line); line == nil {
+			return nil
+		}
+	}
+	return line
+}
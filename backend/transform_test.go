@@ -0,0 +1,48 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTransforms(t *testing.T) {
+	RegisterTransform("test-tag", func(db, rp, precision string, line []byte) []byte {
+		i := bytes.IndexByte(line, ' ')
+		return append(append(append([]byte{}, line[:i]...), ",env=prod"...), line[i:]...)
+	})
+	RegisterTransform("test-drop", func(db, rp, precision string, line []byte) []byte {
+		if bytes.HasPrefix(line, []byte("debug")) {
+			return nil
+		}
+		return line
+	})
+	ts, err := NewTransforms([]*TransformConfig{{Name: "test-drop"}, {Db: "db1", Name: "test-tag"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		db   string
+		line string
+		want []byte
+	}{
+		{name: "test1", db: "db1", line: "cpu value=1 1", want: []byte("cpu,env=prod value=1 1")},
+		{name: "test2", db: "db2", line: "cpu value=1 1", want: []byte("cpu value=1 1")},
+		{name: "test3", db: "db1", line: "debug value=1 1", want: nil},
+	}
+	for _, tt := range tests {
+		got := ts.Apply(tt.db, "", "ns", []byte(tt.line))
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%v: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	_, err = NewTransforms([]*TransformConfig{{Name: "not-exist"}})
+	if err == nil {
+		t.Errorf("unregistered transform: want error")
+	}
+}
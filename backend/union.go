@@ -0,0 +1,162 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+var limitRegexp = regexp.MustCompile(`(?i)\s+(limit|offset|slimit|soffset)\s+(\d+)`)
+
+// ShowLimits are the limit and offset of values per series, and slimit and soffset of series
+type ShowLimits struct {
+	Limit   int
+	Offset  int
+	SLimit  int
+	SOffset int
+}
+
+// StripLimits removes limit, offset, slimit and soffset from the query so that they are applied after union
+func StripLimits(q string) (string, *ShowLimits) {
+	sl := &ShowLimits{}
+	for _, match := range limitRegexp.FindAllStringSubmatch(q, -1) {
+		n, _ := strconv.Atoi(match[2])
+		switch strings.ToLower(match[1]) {
+		case "limit":
+			sl.Limit = n
+		case "offset":
+			sl.Offset = n
+		case "slimit":
+			sl.SLimit = n
+		case "soffset":
+			sl.SOffset = n
+		}
+	}
+	return limitRegexp.ReplaceAllString(q, ""), sl
+}
+
+// UnionResponses returns the sorted and deduplicated union of the series and values of the show queries
+func UnionResponses(bodies [][]byte, sl *ShowLimits) (rsp *Response, err error) {
+	var keys []string
+	groups := make(map[string]*models.Row)
+	seen := make(map[string]map[string]bool)
+	for _, b := range bodies {
+		_series, err := SeriesFromResponseBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		for _, serie := range _series {
+			key := seriesKey(serie)
+			row, ok := groups[key]
+			if !ok {
+				row = &models.Row{Name: serie.Name, Tags: serie.Tags, Columns: serie.Columns}
+				groups[key] = row
+				seen[key] = make(map[string]bool)
+				keys = append(keys, key)
+			}
+			for _, value := range serie.Values {
+				vkey := valueKey(value)
+				if !seen[key][vkey] {
+					seen[key][vkey] = true
+					row.Values = append(row.Values, value)
+				}
+			}
+		}
+	}
+	sort.Strings(keys)
+	keys = paginate(keys, sl.SOffset, sl.SLimit)
+	series := make(models.Rows, 0, len(keys))
+	for _, key := range keys {
+		row := groups[key]
+		sort.Slice(row.Values, func(i, j int) bool { return valueKey(row.Values[i]) < valueKey(row.Values[j]) })
+		if sl.Offset > 0 || sl.Limit > 0 {
+			start, end := bounds(len(row.Values), sl.Offset, sl.Limit)
+			row.Values = row.Values[start:end]
+		}
+		if len(row.Values) > 0 {
+			series = append(series, row)
+		}
+	}
+	return ResponseFromSeries(series), nil
+}
+
+func valueKey(value []interface{}) string {
+	strs := make([]string, len(value))
+	for i, v := range value {
+		strs[i] = util.CastString(v)
+	}
+	return strings.Join(strs, "\x00")
+}
+
+func paginate(keys []string, offset, limit int) []string {
+	start, end := bounds(len(keys), offset, limit)
+	return keys[start:end]
+}
+
+func bounds(n, offset, limit int) (start, end int) {
+	start, end = offset, n
+	if start > n {
+		start = n
+	}
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+	return
+}
+
+// QueryUnionQL queries show series, tag keys or tag values from all backends of one circle and returns the union
+func QueryUnionQL(w http.ResponseWriter, req *http.Request, ip *Proxy, backends []*Backend) (body []byte, err error) {
+	if body, ok := marshalCached(w, req, ip); ok {
+		return body, nil
+	}
+	// remove support of query parameter `chunked`
+	req.Form.Del("chunked")
+	origin := req.FormValue("q")
+	q, sl := StripLimits(strings.TrimSpace(origin))
+	req.Form.Set("q", q)
+	if backends == nil {
+		circles := ip.GetCircles(req.FormValue("db"))
+		perms := ip.readRouter.Order(circles, req.FormValue("db"), func(circle *Circle) []*Backend {
+			return circle.Backends
+		})
+		for _, p := range perms {
+			if queryable(circles[p].Backends) {
+				backends = circles[p].Backends
+				break
+			}
+		}
+	}
+	if backends == nil {
+		// no circle is fully available, the union of all active backends is still complete if each backend has a replica
+		backends = ip.GetAllBackends()
+	}
+	bodies, inactive, err := QueryInParallel(backends, req, w, true)
+	if err != nil {
+		return
+	}
+	if inactive > 0 {
+		log.Printf("query: %s, inactive: %d/%d backends unavailable", q, inactive, inactive+len(bodies))
+		if len(bodies) == 0 {
+			return nil, ErrBackendsUnavailable
+		}
+	}
+	merged := time.Now()
+	rsp, err := UnionResponses(bodies, sl)
+	traceMerge(req, merged)
+	if err != nil {
+		return
+	}
+	ip.metaCache.Set(req.FormValue("db"), origin, rsp)
+	return marshalResponse(w, req, rsp)
+}
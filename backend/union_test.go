@@ -0,0 +1,62 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+func TestStripLimits(t *testing.T) {
+	q, sl := StripLimits(`SHOW TAG VALUES WITH KEY = "host" WHERE "region" = 'limit 1' LIMIT 10 OFFSET 5 SLIMIT 2 soffset 1`)
+	if q != `SHOW TAG VALUES WITH KEY = "host" WHERE "region" = 'limit 1'` {
+		t.Errorf("query wrong: %s", q)
+	}
+	if !reflect.DeepEqual(sl, &ShowLimits{Limit: 10, Offset: 5, SLimit: 2, SOffset: 1}) {
+		t.Errorf("limits wrong: %+v", sl)
+	}
+}
+
+func TestUnionResponses(t *testing.T) {
+	bodies := [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"mem","columns":["key","value"],"values":[["host","c"]]},{"name":"cpu","columns":["key","value"],"values":[["host","b"],["host","a"]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["key","value"],"values":[["host","a"],["host","d"]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0}]}`),
+	}
+	tests := []struct {
+		name string
+		sl   *ShowLimits
+		want string
+	}{
+		{
+			name: "union",
+			sl:   &ShowLimits{},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["key","value"],"values":[["host","a"],["host","b"],["host","d"]]},{"name":"mem","columns":["key","value"],"values":[["host","c"]]}]}]}`,
+		},
+		{
+			name: "limit and offset",
+			sl:   &ShowLimits{Limit: 1, Offset: 1},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["key","value"],"values":[["host","b"]]}]}]}`,
+		},
+		{
+			name: "slimit and soffset",
+			sl:   &ShowLimits{SLimit: 1, SOffset: 1},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"mem","columns":["key","value"],"values":[["host","c"]]}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp, err := UnionResponses(bodies, tt.sl)
+			if err != nil {
+				t.Fatalf("error: %s", err)
+			}
+			if got := string(util.MarshalJSON(rsp, false)); got != tt.want+"\n" {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
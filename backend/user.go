@@ -0,0 +1,450 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	UserSourceConfig = "config"
+	UserSourceApi    = "api" // nolint:golint
+)
+
+var (
+	ErrEmptyUsername  = errors.New("username cannot be empty")
+	ErrDuplicatedUser = errors.New("username duplicated")
+	ErrUserNotFound   = errors.New("user not found")
+	ErrUserInConfig   = errors.New("user in config file cannot be changed")
+	ErrEmptyPassword  = errors.New("password cannot be empty")
+	ErrInvalidBcrypt  = errors.New("invalid bcrypt hash of password")
+)
+
+// maxBcryptVerified is the max number of the passwords verified by bcrypt hashes to remember, since bcrypt
+// is too slow to verify every request
+const maxBcryptVerified = 1024
+
+type UserConfig struct {
+	Username string `mapstructure:"username" json:"username"`
+	Password string `mapstructure:"password" json:"password"`
+	Admin    bool   `mapstructure:"admin" json:"admin"`
+	Grants   Grants `mapstructure:"grants" json:"grants"`
+}
+
+// UserInfo is the user listed without password
+type UserInfo struct {
+	Username string `json:"username"`
+	Source   string `json:"source"`
+	Admin    bool   `json:"admin"`
+	Grants   Grants `json:"grants"`
+}
+
+// Users authenticates the clients by the users of config file, including the legacy username and password,
+// and the users managed by api, which are saved to users.json under data dir. The usernames are encrypted
+// as the config file if auth_encrypt is enabled, and the passwords of users managed by api are bcrypt hashes
+type Users struct {
+	path    string
+	encrypt bool
+	config  map[string]*UserConfig
+	stored  map[string]*UserConfig
+	ldap    *Ldap
+	lock    sync.RWMutex
+
+	// verified are the sha256 of the bcrypt hashes with the passwords verified
+	verified     util.Set
+	verifiedLock sync.Mutex
+}
+
+func NewUsers(cfg *ProxyConfig) *Users {
+	us := &Users{
+		path:    filepath.Join(cfg.DataDir, "users.json"),
+		encrypt: cfg.AuthEncrypt,
+		config:  make(map[string]*UserConfig),
+		stored:  make(map[string]*UserConfig),
+		ldap:    NewLdap(cfg),
+
+		verified: util.NewSet(),
+	}
+	if cfg.Username != "" || cfg.Password != "" {
+		// the legacy user is admin as before
+		us.config[us.key(cfg.Username)] = &UserConfig{Username: cfg.Username, Password: cfg.Password, Admin: true}
+	}
+	for _, user := range cfg.Users {
+		us.config[us.key(user.Username)] = user
+	}
+	if err := us.load(); err != nil {
+		log.Printf("load users error: %s", err)
+	}
+	return us
+}
+
+// CheckUsers checks the users of config file, the legacy username isn't required if password is set
+func CheckUsers(cfg *ProxyConfig) error {
+	set := util.NewSet()
+	if cfg.Username != "" || cfg.Password != "" {
+		set.Add(cfg.Username)
+	}
+	if IsBcrypt(cfg.Password) {
+		if _, err := bcrypt.Cost([]byte(cfg.Password)); err != nil {
+			return ErrInvalidBcrypt
+		}
+	}
+	for _, user := range cfg.Users {
+		if user.Username == "" {
+			return ErrEmptyUsername
+		}
+		if set[user.Username] {
+			return ErrDuplicatedUser
+		}
+		set.Add(user.Username)
+		if IsBcrypt(user.Password) {
+			if _, err := bcrypt.Cost([]byte(user.Password)); err != nil {
+				return ErrInvalidBcrypt
+			}
+		}
+		for _, privilege := range user.Grants {
+			if err := CheckPrivilege(privilege); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (us *Users) load() error {
+	b, err := ioutil.ReadFile(us.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var users []*UserConfig
+	if err = json.Unmarshal(b, &users); err != nil {
+		return err
+	}
+	hashed := false
+	for _, user := range users {
+		key := us.key(user.Username)
+		if _, ok := us.config[key]; ok {
+			continue
+		}
+		// the passwords saved before in plain or encrypted text are replaced by bcrypt hashes
+		if !IsBcrypt(user.Password) {
+			if err = us.hashStored(user); err != nil {
+				log.Printf("hash password of user %s error: %s", key, err)
+			} else {
+				hashed = true
+			}
+		}
+		us.stored[key] = user
+	}
+	if hashed {
+		return us.save()
+	}
+	return nil
+}
+
+// hashStored replaces the password of user saved before in plain or encrypted text by its bcrypt hash
+func (us *Users) hashStored(user *UserConfig) error {
+	password := user.Password
+	if us.encrypt {
+		var err error
+		if password, err = util.AesDecryptChecked(password); err != nil {
+			return err
+		}
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	user.Password = hash
+	return nil
+}
+
+// hashPassword returns the bcrypt hash of password, so that the users saved don't reveal usable credentials
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func (us *Users) save() error {
+	users := make([]*UserConfig, 0, len(us.stored))
+	for _, user := range us.stored {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	b, err := json.MarshalIndent(users, "", "    ")
+	if err != nil {
+		return err
+	}
+	util.MakeDir(filepath.Dir(us.path))
+	return ioutil.WriteFile(us.path, b, 0600)
+}
+
+func (us *Users) trans(text string) string {
+	if us.encrypt {
+		return util.AesEncrypt(text)
+	}
+	return text
+}
+
+// key returns the key of the username in config file or users.json, which is the username decrypted, since
+// the same usernames are encrypted differently by random ivs or old keys
+func (us *Users) key(username string) string {
+	if us.encrypt {
+		if key, err := util.AesDecryptChecked(username); err == nil {
+			return key
+		}
+	}
+	return username
+}
+
+// IsBcrypt returns whether the password is a bcrypt hash like $2a$10$..., which isn't encrypted
+func IsBcrypt(password string) bool {
+	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
+}
+
+// match returns whether the password matches the one of user, the bcrypt hash is compared by bcrypt,
+// and the encrypted one is decrypted since it may be encrypted by an old key
+func (us *Users) match(password string, user *UserConfig) bool {
+	expected := user.Password
+	if IsBcrypt(expected) {
+		return us.matchBcrypt(password, expected)
+	}
+	if us.encrypt {
+		var err error
+		if expected, err = util.AesDecryptChecked(expected); err != nil {
+			return false
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+// matchBcrypt compares the password with the bcrypt hash, the ones verified are remembered by sha256
+func (us *Users) matchBcrypt(password, hash string) bool {
+	sum := sha256.Sum256([]byte(hash + "\x00" + password))
+	key := string(sum[:])
+	us.verifiedLock.Lock()
+	ok := us.verified[key]
+	us.verifiedLock.Unlock()
+	if ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	us.verifiedLock.Lock()
+	if len(us.verified) >= maxBcryptVerified {
+		us.verified = util.NewSet()
+	}
+	us.verified.Add(key)
+	us.verifiedLock.Unlock()
+	return true
+}
+
+// Enabled returns whether any user exists, the clients are not authenticated without users
+func (us *Users) Enabled() bool {
+	us.lock.RLock()
+	defer us.lock.RUnlock()
+	return len(us.config) > 0 || len(us.stored) > 0 || us.ldap != nil
+}
+
+func (us *Users) get(username string) *UserConfig {
+	if user, ok := us.config[username]; ok {
+		return user
+	}
+	return us.stored[username]
+}
+
+// Authenticate returns the user and whether the username and password match, the user returned
+// is never changed, since Set, SetAdmin, Grant and Revoke replace it. The user not found is
+// authenticated by ldap if enabled
+func (us *Users) Authenticate(username, password string) (*UserConfig, bool) {
+	us.lock.RLock()
+	user := us.get(username)
+	us.lock.RUnlock()
+	if user == nil {
+		return us.authenticateLdap(username, password)
+	}
+	if !us.match(password, user) {
+		return nil, false
+	}
+	return user, true
+}
+
+func (us *Users) authenticateLdap(username, password string) (*UserConfig, bool) {
+	if us.ldap == nil {
+		return nil, false
+	}
+	user, err := us.ldap.Authenticate(username, password)
+	if err != nil {
+		log.Printf("ldap authenticate error: %s, username: %s", err, username)
+		return nil, false
+	}
+	return user, true
+}
+
+// Lookup returns the user authenticated without password, like the username of jwt token
+func (us *Users) Lookup(username string) (*UserConfig, bool) {
+	us.lock.RLock()
+	defer us.lock.RUnlock()
+	user := us.get(username)
+	if user == nil {
+		return nil, false
+	}
+	return user, true
+}
+
+// List returns the users sorted by username
+func (us *Users) List() []*UserInfo {
+	us.lock.RLock()
+	defer us.lock.RUnlock()
+	users := make([]*UserInfo, 0, len(us.config)+len(us.stored))
+	for source, m := range map[string]map[string]*UserConfig{UserSourceConfig: us.config, UserSourceApi: us.stored} {
+		for username, user := range m {
+			users = append(users, &UserInfo{Username: username, Source: source, Admin: user.Admin, Grants: user.Grants})
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// Set creates the user managed by api or changes its password keeping the admin and grants, and saves the users
+func (us *Users) Set(username, password string) error {
+	if username == "" {
+		return ErrEmptyUsername
+	}
+	if password == "" {
+		return ErrEmptyPassword
+	}
+	// the password is hashed out of lock since bcrypt is slow by design
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	us.lock.Lock()
+	defer us.lock.Unlock()
+	if _, ok := us.config[username]; ok {
+		return ErrUserInConfig
+	}
+	user := &UserConfig{Username: us.trans(username), Password: hash}
+	if old, ok := us.stored[username]; ok {
+		user.Admin = old.Admin
+		user.Grants = old.Grants
+	}
+	us.stored[username] = user
+	return us.save()
+}
+
+// Grant grants the privilege on db to the user managed by api, and saves the users
+func (us *Users) Grant(username, db, privilege string) error {
+	if db == "" {
+		return ErrDatabaseNotFound
+	}
+	if err := CheckPrivilege(privilege); err != nil {
+		return err
+	}
+	return us.update(username, func(user *UserConfig) {
+		if user.Grants == nil {
+			user.Grants = make(Grants)
+		}
+		user.Grants[db] = privilege
+	})
+}
+
+// Revoke revokes the privilege on db from the user managed by api, and saves the users. The user whose grants
+// are all revoked is allowed on no database
+func (us *Users) Revoke(username, db string) error {
+	return us.update(username, func(user *UserConfig) {
+		if user.Grants == nil {
+			user.Grants = make(Grants)
+		}
+		delete(user.Grants, db)
+	})
+}
+
+// SetAdmin sets whether the user managed by api is admin, and saves the users
+func (us *Users) SetAdmin(username string, admin bool) error {
+	return us.update(username, func(user *UserConfig) {
+		user.Admin = admin
+	})
+}
+
+// update replaces the user with a copy changed by fn
+func (us *Users) update(username string, fn func(*UserConfig)) error {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+	if _, ok := us.config[username]; ok {
+		return ErrUserInConfig
+	}
+	old, ok := us.stored[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	user := &UserConfig{Username: old.Username, Password: old.Password, Admin: old.Admin, Grants: old.Grants.copy()}
+	fn(user)
+	us.stored[username] = user
+	return us.save()
+}
+
+// Delete deletes the user managed by api, and saves the users
+func (us *Users) Delete(username string) error {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+	if _, ok := us.config[username]; ok {
+		return ErrUserInConfig
+	}
+	if _, ok := us.stored[username]; !ok {
+		return ErrUserNotFound
+	}
+	delete(us.stored, username)
+	return us.save()
+}
+
+// Reencrypt encrypts the usernames of the users managed by api by the current cipher key, and saves the users.
+// The passwords are bcrypt hashes which aren't encrypted. It returns the number of users encrypted again, the
+// users of config file are not changed, which are encrypted again by /encrypt and updated in the file by hand
+func (us *Users) Reencrypt() (n int, err error) {
+	if !us.encrypt {
+		return
+	}
+	us.lock.Lock()
+	defer us.lock.Unlock()
+	for key, old := range us.stored {
+		if util.IsCurrentCipher(old.Username) && IsBcrypt(old.Password) {
+			continue
+		}
+		user := &UserConfig{Password: old.Password, Admin: old.Admin, Grants: old.Grants}
+		if user.Username, err = util.AesReencrypt(old.Username); err != nil {
+			return
+		}
+		// the password not hashed on load is never encrypted again
+		if !IsBcrypt(old.Password) {
+			if err = us.hashStored(user); err != nil {
+				return
+			}
+		}
+		us.stored[key] = user
+		n++
+	}
+	if n > 0 {
+		err = us.save()
+	}
+	return
+}
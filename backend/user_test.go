@@ -0,0 +1,389 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckUsers(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *ProxyConfig
+		want error
+	}{
+		{
+			name: "none",
+			cfg:  &ProxyConfig{},
+		},
+		{
+			name: "users",
+			cfg:  &ProxyConfig{Username: "admin", Password: "pass", Users: []*UserConfig{{Username: "u1", Password: "p1"}}},
+		},
+		{
+			name: "empty",
+			cfg:  &ProxyConfig{Users: []*UserConfig{{Password: "p1"}}},
+			want: ErrEmptyUsername,
+		},
+		{
+			name: "invalid privilege",
+			cfg:  &ProxyConfig{Users: []*UserConfig{{Username: "u1", Password: "p1", Grants: Grants{"db1": "admin"}}}},
+			want: ErrInvalidPrivilege,
+		},
+		{
+			name: "duplicated",
+			cfg:  &ProxyConfig{Username: "u1", Users: []*UserConfig{{Username: "u1", Password: "p1"}}},
+			want: ErrDuplicatedUser,
+		},
+		{
+			name: "invalid bcrypt",
+			cfg:  &ProxyConfig{Users: []*UserConfig{{Username: "u1", Password: "$2a$10$invalid"}}},
+			want: ErrInvalidBcrypt,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckUsers(tt.cfg); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &ProxyConfig{DataDir: dir, Username: "admin", Password: "pass", Users: []*UserConfig{{Username: "u1", Password: "p1"}}}
+	us := NewUsers(cfg)
+	if !us.Enabled() {
+		t.Fatal("users not enabled")
+	}
+	if err := us.Set("u2", "p2"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     bool
+	}{
+		{name: "legacy", username: "admin", password: "pass", want: true},
+		{name: "config", username: "u1", password: "p1", want: true},
+		{name: "api", username: "u2", password: "p2", want: true},
+		{name: "wrong password", username: "u1", password: "p2"},
+		{name: "unknown", username: "u3", password: "p3"},
+		{name: "empty", username: "", password: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := us.Authenticate(tt.username, tt.password); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+
+	if err := us.Set("u1", "p3"); err != ErrUserInConfig {
+		t.Errorf("set config user: got %v", err)
+	}
+	if err := us.Set("u3", ""); err != ErrEmptyPassword {
+		t.Errorf("set empty password: got %v", err)
+	}
+	if err := us.Delete("u3"); err != ErrUserNotFound {
+		t.Errorf("delete unknown user: got %v", err)
+	}
+	if err := us.Set("u3", "p3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Delete("u2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the users managed by api are loaded after restart
+	us = NewUsers(cfg)
+	_, ok3 := us.Authenticate("u3", "p3")
+	_, ok2 := us.Authenticate("u2", "p2")
+	if !ok3 || ok2 {
+		t.Errorf("users not reloaded: %+v", us.List())
+	}
+	users := us.List()
+	if len(users) != 3 || users[0].Username != "admin" || users[2].Username != "u3" || users[2].Source != UserSourceApi {
+		t.Errorf("list: got %+v", users)
+	}
+}
+
+func TestUsersEncrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &ProxyConfig{DataDir: dir, AuthEncrypt: true, Users: []*UserConfig{{Username: util.AesEncrypt("u1"), Password: util.AesEncrypt("p1")}}}
+	us := NewUsers(cfg)
+	if err := us.Set("u2", "p2"); err != nil {
+		t.Fatal(err)
+	}
+	_, ok1 := us.Authenticate("u1", "p1")
+	_, ok2 := us.Authenticate("u2", "p2")
+	_, okEncrypted := us.Authenticate(util.AesEncrypt("u1"), util.AesEncrypt("p1"))
+	if !ok1 || !ok2 || okEncrypted {
+		t.Error("encrypted users not authenticated")
+	}
+	users := us.List()
+	if len(users) != 2 || users[0].Username != "u1" || users[1].Username != "u2" {
+		t.Errorf("list: got %+v", users)
+	}
+	if util.AesEncrypt("u1") == util.AesEncrypt("u1") {
+		t.Error("same texts encrypted by the same iv")
+	}
+
+	// the users encrypted by the iv of key before the random ivs are still authenticated
+	cfg = &ProxyConfig{DataDir: dir, AuthEncrypt: true, Users: []*UserConfig{{Username: "9G3aMBx0lDXTdRRMjh!sBA", Password: "T2q0i8sM!hDpRtOocHPnXQ"}}}
+	if _, ok := NewUsers(cfg).Authenticate("u1", "p1"); !ok {
+		t.Error("user encrypted without version not authenticated")
+	}
+}
+
+func TestUsersBcrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("p1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the bcrypt hash isn't decrypted even if auth_encrypt is enabled
+	for _, encrypt := range []bool{false, true} {
+		username := "u1"
+		if encrypt {
+			username = util.AesEncrypt(username)
+		}
+		cfg := &ProxyConfig{DataDir: dir, AuthEncrypt: encrypt, Users: []*UserConfig{{Username: username, Password: string(hash)}}}
+		if err := CheckUsers(cfg); err != nil {
+			t.Fatal(err)
+		}
+		us := NewUsers(cfg)
+		for i := 0; i < 2; i++ {
+			_, ok := us.Authenticate("u1", "p1")
+			_, okWrong := us.Authenticate("u1", "p2")
+			_, okHash := us.Authenticate("u1", string(hash))
+			if !ok || okWrong || okHash {
+				t.Errorf("encrypt %t: bcrypt user not authenticated", encrypt)
+			}
+		}
+	}
+}
+
+func TestUsersHashStored(t *testing.T) {
+	tests := []struct {
+		name     string
+		encrypt  bool
+		username string
+		password string
+	}{
+		{name: "plain", username: "u1", password: "p1"},
+		{name: "encrypted", encrypt: true, username: util.AesEncrypt("u1"), password: util.AesEncrypt("p1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "users")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			// the users.json saved before with the passwords in plain or encrypted text
+			b, _ := json.Marshal([]*UserConfig{{Username: tt.username, Password: tt.password}})
+			path := filepath.Join(dir, "users.json")
+			if err = ioutil.WriteFile(path, b, 0600); err != nil {
+				t.Fatal(err)
+			}
+			us := NewUsers(&ProxyConfig{DataDir: dir, AuthEncrypt: tt.encrypt})
+			if _, ok := us.Authenticate("u1", "p1"); !ok {
+				t.Error("user saved before not authenticated")
+			}
+			var users []*UserConfig
+			if b, err = ioutil.ReadFile(path); err != nil {
+				t.Fatal(err)
+			}
+			if err = json.Unmarshal(b, &users); err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != 1 || !IsBcrypt(users[0].Password) || users[0].Username != tt.username {
+				t.Errorf("users saved: got %s", b)
+			}
+		})
+	}
+}
+
+func TestUsersGrant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &ProxyConfig{DataDir: dir, Users: []*UserConfig{{Username: "u1", Password: "p1", Grants: Grants{"db1": PrivilegeRead}}}}
+	us := NewUsers(cfg)
+	if user, _ := us.Authenticate("u1", "p1"); !user.Grants.Allows("db1", PrivilegeRead) || user.Grants.Allows("db1", PrivilegeWrite) {
+		t.Errorf("config grants: got %v", user.Grants)
+	}
+	if err := us.Grant("u1", "db2", PrivilegeAll); err != ErrUserInConfig {
+		t.Errorf("grant config user: got %v", err)
+	}
+	if err := us.Set("u2", "p2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Grant("u2", "db1", "admin"); err != ErrInvalidPrivilege {
+		t.Errorf("grant invalid privilege: got %v", err)
+	}
+	if err := us.Grant("u3", "db1", PrivilegeRead); err != ErrUserNotFound {
+		t.Errorf("grant unknown user: got %v", err)
+	}
+	before, _ := us.Authenticate("u2", "p2")
+	if err := us.Grant("u2", "db1", PrivilegeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Grant("u2", "db2", PrivilegeAll); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Revoke("u2", "db2"); err != nil {
+		t.Fatal(err)
+	}
+	if before.Grants != nil {
+		t.Errorf("grants authenticated before changed: got %v", before.Grants)
+	}
+
+	// the grants are kept after the password is changed and after restart
+	if err := us.Set("u2", "p3"); err != nil {
+		t.Fatal(err)
+	}
+	us = NewUsers(cfg)
+	user, ok := us.Authenticate("u2", "p3")
+	if !ok || len(user.Grants) != 1 || user.Grants["db1"] != PrivilegeWrite {
+		t.Errorf("grants not kept: got %v", user.Grants)
+	}
+}
+
+func TestUsersAdmin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &ProxyConfig{DataDir: dir, Username: "admin", Password: "pass", Users: []*UserConfig{{Username: "u1", Password: "p1"}, {Username: "u2", Password: "p2", Admin: true}}}
+	us := NewUsers(cfg)
+	if err := us.Set("u3", "p3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.SetAdmin("u1", true); err != ErrUserInConfig {
+		t.Errorf("set admin of config user: got %v", err)
+	}
+	if err := us.SetAdmin("u3", true); err != nil {
+		t.Fatal(err)
+	}
+	// the admin is kept after the password is changed
+	if err := us.Set("u3", "p4"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     bool
+	}{
+		{name: "legacy", username: "admin", password: "pass", want: true},
+		{name: "config", username: "u1", password: "p1"},
+		{name: "config admin", username: "u2", password: "p2", want: true},
+		{name: "api admin", username: "u3", password: "p4", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, ok := us.Authenticate(tt.username, tt.password)
+			if !ok || user.Admin != tt.want {
+				t.Errorf("got %v, %t, want admin %t", user, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsersReencrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer util.SetCipherKeys("", nil)
+
+	cfg := &ProxyConfig{DataDir: dir, AuthEncrypt: true, Users: []*UserConfig{{Username: util.AesEncrypt("u1"), Password: util.AesEncrypt("p1")}}}
+	us := NewUsers(cfg)
+	if err = us.Set("u2", "p2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the users encrypted by the old key are still authenticated after rotation
+	if err = util.SetCipherKeys("0123456789abcdef", []string{"fedcba9876543210"}); err != nil {
+		t.Fatal(err)
+	}
+	us = NewUsers(cfg)
+	_, ok1 := us.Authenticate("u1", "p1")
+	_, ok2 := us.Authenticate("u2", "p2")
+	_, okWrong := us.Authenticate("u2", "crypto/cipher: unknown key")
+	if !ok1 || !ok2 || okWrong {
+		t.Errorf("rotated: got %t, %t, %t", ok1, ok2, okWrong)
+	}
+	if n, err := us.Reencrypt(); err != nil || n != 1 {
+		t.Fatalf("reencrypt: got %d, %v", n, err)
+	}
+	if n, err := us.Reencrypt(); err != nil || n != 0 {
+		t.Errorf("reencrypt again: got %d, %v", n, err)
+	}
+
+	// the users saved hold no password recoverable by any cipher key
+	b, err := ioutil.ReadFile(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []*UserConfig
+	if err = json.Unmarshal(b, &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || !IsBcrypt(users[0].Password) {
+		t.Fatalf("password saved not hashed: %s", b)
+	}
+	if password, err := util.AesDecryptChecked(users[0].Password); err == nil {
+		t.Errorf("password saved decrypted: %s", password)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(users[0].Password), []byte("p2")) != nil {
+		t.Errorf("password saved not the hash of p2: %s", b)
+	}
+
+	// the users saved are encrypted by the new key without the old one after restart
+	if err = util.SetCipherKeys("0123456789abcdef", nil); err != nil {
+		t.Fatal(err)
+	}
+	us = NewUsers(&ProxyConfig{DataDir: dir, AuthEncrypt: true})
+	if _, ok := us.Authenticate("u2", "p2"); !ok {
+		t.Error("reencrypted user not authenticated")
+	}
+	if users := us.List(); len(users) != 1 || users[0].Username != "u2" {
+		t.Errorf("list: got %+v", users)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+const walSuffix = ".wal"
+
+// WAL persists incoming write batches before they are acknowledged, it is split into segments
+// which are removed after all backends have flushed the data written before them
+type WAL struct {
+	lock  sync.Mutex
+	dir   string
+	seq   int
+	size  int64
+	file  *os.File
+	older []int
+}
+
+func NewWAL(dir string) (wal *WAL, err error) {
+	err = util.MakeDir(dir)
+	if err != nil {
+		return
+	}
+	wal = &WAL{dir: dir}
+	wal.older, err = wal.segments()
+	if err != nil {
+		return
+	}
+	if len(wal.older) > 0 {
+		wal.seq = wal.older[len(wal.older)-1]
+	}
+	err = wal.open(wal.seq + 1)
+	return
+}
+
+func (wal *WAL) segments() (seqs []int, err error) {
+	files, err := ioutil.ReadDir(wal.dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), walSuffix) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(f.Name(), walSuffix))
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return
+}
+
+func (wal *WAL) path(seq int) string {
+	return filepath.Join(wal.dir, fmt.Sprintf("%016d%s", seq, walSuffix))
+}
+
+func (wal *WAL) open(seq int) (err error) {
+	file, err := os.OpenFile(wal.path(seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("open wal error: %s", err)
+		return
+	}
+	wal.file = file
+	wal.seq = seq
+	wal.size = 0
+	return
+}
+
+// Append writes the batch and fsyncs it before returning
+func (wal *WAL) Append(db, rp, precision string, p []byte) (err error) {
+	b := bytes.Join([][]byte{[]byte(url.QueryEscape(db)), []byte(url.QueryEscape(rp)), []byte(url.QueryEscape(precision)), p}, []byte{' '})
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	err = binary.Write(wal.file, binary.BigEndian, uint32(len(b)))
+	if err != nil {
+		log.Print("write wal length error: ", err)
+		return
+	}
+	n, err := wal.file.Write(b)
+	if err != nil {
+		log.Print("write wal error: ", err)
+		return
+	}
+	if n != len(b) {
+		return io.ErrShortWrite
+	}
+	err = wal.file.Sync()
+	if err != nil {
+		log.Print("sync wal error: ", err)
+		return
+	}
+	wal.size += int64(4 + len(b))
+	return
+}
+
+// Replay calls fn for every batch in the segments left by the last run, a segment is truncated at the first
+// record whose length exceeds the rest of file or whose data is short, which is left by a crash or corruption
+func (wal *WAL) Replay(fn func(db, rp, precision string, p []byte)) {
+	for _, seq := range wal.older {
+		file, err := os.Open(wal.path(seq))
+		if err != nil {
+			log.Printf("open wal error: %s", err)
+			continue
+		}
+		info, err := file.Stat()
+		if err != nil {
+			log.Printf("stat wal error: %s", err)
+			file.Close()
+			continue
+		}
+		count := 0
+		var offset int64
+		for {
+			var length uint32
+			err = binary.Read(file, binary.BigEndian, &length)
+			if err == io.EOF {
+				break
+			}
+			if err == nil && int64(length) > info.Size()-offset-4 {
+				err = fmt.Errorf("invalid record length %d at offset %d", length, offset)
+			}
+			var b []byte
+			if err == nil {
+				b = make([]byte, length)
+				_, err = io.ReadFull(file, b)
+			}
+			if err != nil {
+				if terr := os.Truncate(wal.path(seq), offset); terr != nil {
+					log.Printf("truncate wal error: %s", terr)
+				}
+				break
+			}
+			offset += int64(4 + length)
+			items := bytes.SplitN(b, []byte{' '}, 4)
+			if len(items) < 4 {
+				log.Print("replay wal invalid data with length: ", len(items))
+				continue
+			}
+			db, _ := url.QueryUnescape(string(items[0]))
+			rp, _ := url.QueryUnescape(string(items[1]))
+			precision, _ := url.QueryUnescape(string(items[2]))
+			fn(db, rp, precision, items[3])
+			count++
+		}
+		file.Close()
+		if err != nil && err != io.EOF {
+			log.Printf("replay wal truncated: %s, %s", wal.path(seq), err)
+		}
+		log.Printf("replay wal: %s, %d batches", wal.path(seq), count)
+	}
+}
+
+// Rotate starts a new segment and returns its sequence, ok is false if there is nothing to checkpoint
+func (wal *WAL) Rotate() (seq int, ok bool, err error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if wal.size == 0 {
+		return wal.seq, len(wal.older) > 0, nil
+	}
+	err = wal.file.Close()
+	if err != nil {
+		log.Printf("close wal error: %s", err)
+	}
+	wal.older = append(wal.older, wal.seq)
+	err = wal.open(wal.seq + 1)
+	return wal.seq, true, err
+}
+
+// Remove deletes all segments before seq
+func (wal *WAL) Remove(seq int) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	var older []int
+	for _, s := range wal.older {
+		if s >= seq {
+			older = append(older, s)
+			continue
+		}
+		err := os.Remove(wal.path(s))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("remove wal error: %s", err)
+			older = append(older, s)
+		}
+	}
+	wal.older = older
+}
+
+func (wal *WAL) Close() {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	wal.file.Close()
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWALReplayCorrupt(t *testing.T) {
+	tests := []struct {
+		name  string
+		tail  []byte
+		count int
+	}{
+		{name: "intact", count: 2},
+		{name: "huge length", tail: []byte{0xff, 0xff, 0xff, 0xf0, 'x'}, count: 2},
+		{name: "short data", tail: []byte{0, 0, 0, 10, 'd', 'b'}, count: 2},
+		{name: "short length", tail: []byte{0, 0}, count: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			wal, err := NewWAL(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wal.Append("db1", "rp1", "ns", []byte("cpu value=1"))
+			wal.Append("db1", "rp1", "ns", []byte("cpu value=2"))
+			path := wal.path(wal.seq)
+			wal.Close()
+			info, _ := os.Stat(path)
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(tt.tail)
+			f.Close()
+
+			wal, err = NewWAL(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+			count := 0
+			wal.Replay(func(db, rp, precision string, p []byte) {
+				if db != "db1" || rp != "rp1" || precision != "ns" {
+					t.Errorf("got %s %s %s", db, rp, precision)
+				}
+				count++
+			})
+			if count != tt.count {
+				t.Errorf("got %d batches, want %d", count, tt.count)
+			}
+			if after, _ := os.Stat(path); after.Size() != info.Size() {
+				t.Errorf("got size %d, want truncated to %d", after.Size(), info.Size())
+			}
+		})
+	}
+}
+
+func TestSyncExitedWorker(t *testing.T) {
+	ib := &Backend{chSync: make(chan chan struct{}), chClosed: make(chan struct{})}
+	ib.running.Store(true)
+	close(ib.chClosed)
+	done := make(chan struct{})
+	go func() {
+		ib.Sync()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sync blocked on exited worker")
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ReasonScanKey       = "scan_key"
+	ReasonInvalidFormat = "invalid_format"
+	ReasonNoBackends    = "no_backends"
+	ReasonForbiddenDB   = "forbidden_db"
+
+	maxWriteErrorSamples = 100
+	maxWriteErrorLine    = 1024
+	maxWriteErrorKeys    = 1000
+
+	// WriteErrorOther is the db and measurement which the counts beyond the max keys are folded into
+	WriteErrorOther = "_other"
+
+	ConflictSkip = "skip"
+	ConflictCast = "cast"
+)
+
+var (
+	fieldTypeConflictRegexp = regexp.MustCompile(`field type conflict: input field "(.+?)" on measurement "(.+?)" is type (\w+), already exists as type (\w+)`)
+	droppedRegexp           = regexp.MustCompile(`dropped=(\d+)`)
+)
+
+// FieldTypeConflictError is the bad request of the points whose field type differs from the existing one on backend,
+// the other points of the batch are written. The backend reports only the first field conflicted
+type FieldTypeConflictError struct {
+	Measurement string `json:"measurement"`
+	Field       string `json:"field"`
+	Type        string `json:"type"`
+	Existing    string `json:"existing"`
+	Dropped     int    `json:"dropped"`
+}
+
+func (e *FieldTypeConflictError) Error() string {
+	return fmt.Sprintf("field type conflict: input field \"%s\" on measurement \"%s\" is type %s, already exists as type %s dropped=%d",
+		e.Field, e.Measurement, e.Type, e.Existing, e.Dropped)
+}
+
+// Unwrap makes the conflict a bad request
+func (e *FieldTypeConflictError) Unwrap() error {
+	return ErrBadRequest
+}
+
+// ParseFieldTypeConflict returns the field type conflict of the error response of write, or nil if not a conflict
+func ParseFieldTypeConflict(body []byte) *FieldTypeConflictError {
+	msg := string(body)
+	var rsp struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &rsp) == nil && rsp.Error != "" {
+		msg = rsp.Error
+	}
+	matches := fieldTypeConflictRegexp.FindStringSubmatch(msg)
+	if matches == nil {
+		return nil
+	}
+	e := &FieldTypeConflictError{Field: matches[1], Measurement: matches[2], Type: matches[3], Existing: matches[4]}
+	if dropped := droppedRegexp.FindStringSubmatch(msg); dropped != nil {
+		e.Dropped, _ = strconv.Atoi(dropped[1])
+	}
+	return e
+}
+
+type WriteErrorSample struct {
+	Time        time.Time `json:"time"`
+	Db          string    `json:"db"`
+	Rp          string    `json:"rp"`
+	Precision   string    `json:"precision"`
+	Measurement string    `json:"measurement"`
+	Reason      string    `json:"reason"`
+	Line        string    `json:"line"`
+}
+
+// WriteErrors counts the dropped lines by db, measurement and reason, and keeps the recent samples. The db and
+// measurement are given by clients, so the counts of new ones beyond the max keys are folded into _other
+type WriteErrors struct {
+	lock    sync.Mutex
+	counts  map[string]map[string]map[string]int64
+	keys    int
+	samples []*WriteErrorSample
+	next    int
+}
+
+func NewWriteErrors() *WriteErrors {
+	return &WriteErrors{
+		counts:  make(map[string]map[string]map[string]int64),
+		samples: make([]*WriteErrorSample, 0, maxWriteErrorSamples),
+	}
+}
+
+func (we *WriteErrors) Add(db, rp, precision, meas, reason string, line []byte) {
+	if len(line) > maxWriteErrorLine {
+		line = line[:maxWriteErrorLine]
+	}
+	sample := &WriteErrorSample{
+		Time:        time.Now(),
+		Db:          db,
+		Rp:          rp,
+		Precision:   precision,
+		Measurement: meas,
+		Reason:      reason,
+		Line:        string(line),
+	}
+
+	we.lock.Lock()
+	defer we.lock.Unlock()
+	if _, ok := we.counts[db][meas]; !ok && we.keys >= maxWriteErrorKeys {
+		db, meas = WriteErrorOther, WriteErrorOther
+	}
+	if _, ok := we.counts[db]; !ok {
+		we.counts[db] = make(map[string]map[string]int64)
+	}
+	if _, ok := we.counts[db][meas]; !ok {
+		we.counts[db][meas] = make(map[string]int64)
+		we.keys++
+	}
+	we.counts[db][meas][reason]++
+	if len(we.samples) < maxWriteErrorSamples {
+		we.samples = append(we.samples, sample)
+	} else {
+		we.samples[we.next] = sample
+	}
+	we.next = (we.next + 1) % maxWriteErrorSamples
+}
+
+// Counts returns a copy of counts as db -> measurement -> reason -> count
+func (we *WriteErrors) Counts() map[string]map[string]map[string]int64 {
+	we.lock.Lock()
+	defer we.lock.Unlock()
+	counts := make(map[string]map[string]map[string]int64, len(we.counts))
+	for db, mm := range we.counts {
+		counts[db] = make(map[string]map[string]int64, len(mm))
+		for meas, rm := range mm {
+			counts[db][meas] = make(map[string]int64, len(rm))
+			for reason, n := range rm {
+				counts[db][meas][reason] = n
+			}
+		}
+	}
+	return counts
+}
+
+// Samples returns the recent samples from newest to oldest
+func (we *WriteErrors) Samples() []*WriteErrorSample {
+	we.lock.Lock()
+	defer we.lock.Unlock()
+	n := len(we.samples)
+	samples := make([]*WriteErrorSample, 0, n)
+	for i := 1; i <= n; i++ {
+		samples = append(samples, we.samples[(we.next-i+n)%n])
+	}
+	return samples
+}
+
+func (we *WriteErrors) Reset() {
+	we.lock.Lock()
+	defer we.lock.Unlock()
+	we.counts = make(map[string]map[string]map[string]int64)
+	we.keys = 0
+	we.samples = make([]*WriteErrorSample, 0, maxWriteErrorSamples)
+	we.next = 0
+}
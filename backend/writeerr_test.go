@@ -0,0 +1,115 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+func TestWriteErrors(t *testing.T) {
+	we := NewWriteErrors()
+	for i := 0; i < maxWriteErrorSamples+10; i++ {
+		we.Add("db", "", "ns", "cpu", ReasonInvalidFormat, []byte(strconv.Itoa(i)))
+	}
+	we.Add("db", "", "ns", "", ReasonScanKey, []byte("bad"))
+
+	counts := we.Counts()
+	if counts["db"]["cpu"][ReasonInvalidFormat] != maxWriteErrorSamples+10 || counts["db"][""][ReasonScanKey] != 1 {
+		t.Errorf("counts: got %v", counts)
+	}
+	samples := we.Samples()
+	if len(samples) != maxWriteErrorSamples {
+		t.Fatalf("samples: got %d, want %d", len(samples), maxWriteErrorSamples)
+	}
+	if samples[0].Line != "bad" || samples[1].Line != strconv.Itoa(maxWriteErrorSamples+9) || samples[len(samples)-1].Line != "11" {
+		t.Errorf("samples order: got %v, %v, %v", samples[0].Line, samples[1].Line, samples[len(samples)-1].Line)
+	}
+
+	for i := 0; i < maxWriteErrorKeys; i++ {
+		we.Add("db"+strconv.Itoa(i), "", "ns", "cpu", ReasonInvalidFormat, []byte("bad"))
+	}
+	counts = we.Counts()
+	if len(counts) != maxWriteErrorKeys || counts[WriteErrorOther][WriteErrorOther][ReasonInvalidFormat] != 2 {
+		t.Errorf("max keys: got %d dbs, other %v", len(counts), counts[WriteErrorOther])
+	}
+	we.Add("db", "", "ns", "cpu", ReasonInvalidFormat, []byte("bad"))
+	if counts = we.Counts(); counts["db"]["cpu"][ReasonInvalidFormat] != maxWriteErrorSamples+11 {
+		t.Errorf("existing key: got %v", counts["db"])
+	}
+
+	we.Reset()
+	if len(we.Counts()) != 0 || len(we.Samples()) != 0 {
+		t.Errorf("reset: got %v, %v", we.Counts(), we.Samples())
+	}
+}
+
+func TestParseFieldTypeConflict(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want *FieldTypeConflictError
+	}{
+		{
+			name: "json",
+			body: `{"error":"partial write: field type conflict: input field \"value\" on measurement \"cpu\" is type integer, already exists as type float dropped=2"}`,
+			want: &FieldTypeConflictError{Measurement: "cpu", Field: "value", Type: "integer", Existing: "float", Dropped: 2},
+		},
+		{
+			name: "text",
+			body: `field type conflict: input field "up" on measurement "net io" is type string, already exists as type boolean`,
+			want: &FieldTypeConflictError{Measurement: "net io", Field: "up", Type: "string", Existing: "boolean"},
+		},
+		{
+			name: "other",
+			body: `{"error":"unable to parse 'cpu value=': missing field value"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseFieldTypeConflict([]byte(tt.body))
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("ParseFieldTypeConflict() = %v, want %v", got, tt.want)
+			}
+			if got != nil && !errors.Is(got, ErrBadRequest) {
+				t.Errorf("ParseFieldTypeConflict() = %v, not a bad request", got)
+			}
+		})
+	}
+}
+
+func TestWritePointsErrors(t *testing.T) {
+	transforms, err := NewTransforms(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, err := models.ParsePointsString("cpu,host=h1 value=1 100\nmem value=2 200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ProxyConfig{}
+	ip := &Proxy{WriteErrors: NewWriteErrors(), transforms: transforms, shardKeys: NewShardKeys(cfg), dbCircles: NewDBCircles(cfg)}
+	ip.WritePoints(points, "db", "")
+	if counts := ip.WriteErrors.Counts(); counts["db"]["cpu"][ReasonNoBackends] != 1 || counts["db"]["mem"][ReasonNoBackends] != 1 {
+		t.Errorf("no backends: got %v", counts)
+	}
+
+	// the backend closed fails to write to its buffer
+	be := &Backend{HttpBackend: &HttpBackend{Name: "influxdb-1", Url: "http://127.0.0.1:8086", Weight: 1}}
+	be.running.Store(false)
+	circle := &Circle{CircleId: 0, Name: "circle-1", Backends: []*Backend{be}, router: NewHashRing(HashConsistent, 256), mapToBackend: make(map[string]*Backend)}
+	circle.addRouter(be, 0, "idx")
+	ip.Circles = []*Circle{circle}
+	ip.WriteErrors.Reset()
+	if err = ip.WritePoints(points, "db", ""); err == nil {
+		t.Error("backend closed: got no error")
+	}
+	if counts := ip.WriteErrors.Counts(); counts["db"]["cpu"][ReasonBackendClosed] != 1 || counts["db"]["mem"][ReasonBackendClosed] != 1 {
+		t.Errorf("backend closed: got %v", counts)
+	}
+}
@@ -53,7 +53,8 @@ func main() {
 	cfg.PrintSummary()
 
 	mux := service.NewServeMux()
-	service.NewHttpService(cfg).Register(mux)
+	hs := service.NewHttpService(cfg)
+	hs.Register(mux)
 
 	server := &http.Server{
 		Addr:        cfg.ListenAddr,
@@ -61,8 +62,13 @@ func main() {
 		IdleTimeout: time.Duration(cfg.IdleTimeout) * time.Second,
 	}
 	if cfg.HTTPSEnabled {
-		log.Printf("https service start, listen on %s", server.Addr)
-		err = server.ListenAndServeTLS(cfg.HTTPSCert, cfg.HTTPSKey)
+		server.TLSConfig, err = hs.TLSConfig(cfg)
+		if err != nil {
+			log.Printf("https config error: %s", err)
+			return
+		}
+		log.Printf("https service start, listen on %s, client auth: %s", server.Addr, cfg.HTTPSClientAuth)
+		err = server.ListenAndServeTLS("", "")
 	} else {
 		log.Printf("http service start, listen on %s", server.Addr)
 		err = server.ListenAndServe()
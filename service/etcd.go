@@ -0,0 +1,77 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+// syncEtcd applies the state shared in etcd, the local one is put if absent, and then watches the changes
+func (hs *HttpService) syncEtcd(cfg *backend.ProxyConfig) {
+	etcd := hs.ip.Etcd
+	values, revision, err := etcd.GetAll()
+	if err != nil {
+		log.Printf("etcd get state error: %s", err)
+	}
+	if _, ok := values[backend.EtcdCircles]; !ok && err == nil {
+		b, err := backend.MarshalCircles(cfg.Circles)
+		if err == nil {
+			err = etcd.Put(backend.EtcdCircles, b)
+		}
+		if err != nil {
+			log.Printf("etcd put circles error: %s", err)
+		}
+	}
+	if _, ok := values[backend.EtcdDBList]; !ok && err == nil {
+		b, _ := json.Marshal(append([]string{}, cfg.DBList...))
+		if err := etcd.Put(backend.EtcdDBList, b); err != nil {
+			log.Printf("etcd put db list error: %s", err)
+		}
+	}
+	for name, value := range values {
+		hs.applyState(name, value)
+	}
+	go etcd.Watch(revision+1, hs.applyState)
+}
+
+func (hs *HttpService) applyState(name string, value []byte) {
+	switch {
+	case name == backend.EtcdCircles:
+		circfgs, err := backend.UnmarshalCircles(value)
+		if err != nil {
+			log.Printf("etcd circles error: %s", err)
+			return
+		}
+		updated, added := hs.ip.SyncCircles(circfgs)
+		for _, id := range updated {
+			hs.tx.SetCircle(id, hs.ip.AllCircles()[id])
+		}
+		for _, id := range added {
+			hs.tx.AddCircleState(circfgs[id], hs.ip.AllCircles()[id])
+		}
+	case name == backend.EtcdDBList:
+		var dbs []string
+		if err := json.Unmarshal(value, &dbs); err != nil {
+			log.Printf("etcd db list error: %s", err)
+			return
+		}
+		hs.ip.SetDBList(dbs)
+	case name == backend.EtcdResyncing:
+		hs.tx.Resyncing = string(value) == "true"
+	case strings.HasPrefix(name, backend.EtcdTransferPrefix):
+		circleId, err := strconv.Atoi(strings.TrimPrefix(name, backend.EtcdTransferPrefix)) // nolint:golint
+		if err != nil || circleId < 0 || circleId >= len(hs.tx.CircleStates) {
+			return
+		}
+		cs := hs.tx.CircleStates[circleId]
+		cs.Transferring = string(value) == "true"
+		cs.SetTransferIn(cs.Transferring)
+	}
+}
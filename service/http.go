@@ -7,17 +7,22 @@ package service
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chengshiwen/influx-proxy/backend"
 	"github.com/chengshiwen/influx-proxy/service/prometheus"
@@ -30,10 +35,18 @@ import (
 
 var (
 	ErrInvalidTick    = errors.New("invalid tick, require non-negative integer")
+	ErrInvalidRange   = errors.New("invalid start or end, require unix seconds or RFC3339 time, and start before end")
 	ErrInvalidWorker  = errors.New("invalid worker, require positive integer")
 	ErrInvalidBatch   = errors.New("invalid batch, require positive integer")
 	ErrInvalidLimit   = errors.New("invalid limit, require positive integer")
+	ErrInvalidVerify  = errors.New("invalid verify, require boolean")
+	ErrInvalidDryRun  = errors.New("invalid dry_run, require boolean")
+	ErrInvalidConfirm = errors.New("invalid confirm, require boolean")
+	ErrInvalidMeas    = errors.New("invalid measurements, require names or /regexp/, comma-separated")
+	ErrInvalidWorkers = errors.New("invalid read_worker, write_worker, backend_read_worker or backend_write_worker, require non-negative integer")
+	ErrInvalidRate    = errors.New("invalid point_rate, mb_rate or query_rate, require non-negative number")
 	ErrInvalidHaAddrs = errors.New("invalid ha_addrs, require at least two addresses as <host:port>, comma-separated")
+	ErrBodyTooLarge   = errors.New("request body too large")
 )
 
 type ServeMux struct {
@@ -51,80 +64,340 @@ func (mux *ServeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type HttpService struct { // nolint:golint
-	ip           *backend.Proxy
-	tx           *transfer.Transfer
-	username     string
-	password     string
-	authEncrypt  bool
-	writeTracing bool
-	queryTracing bool
-	pprofEnabled bool
+	ip             *backend.Proxy
+	tx             *transfer.Transfer
+	users          *backend.Users
+	tokens         *backend.Tokens
+	tenants        *backend.Tenants
+	masks          *backend.Masker
+	hmac           *backend.HmacVerifier
+	sharedSecret   string
+	oidc           *backend.Oidc
+	certUsers      map[string]string
+	certs          *backend.CertReloader
+	dataFilter     *backend.IPFilter
+	adminFilter    *backend.IPFilter
+	auditLog       *backend.AuditLog
+	passthrough    bool
+	writeTracing   bool
+	queryTracing   bool
+	pprofEnabled   bool
+	maxBodySize    int64
+	maxDecodedSize int64
+	driftWindow    int
 }
 
 func NewHttpService(cfg *backend.ProxyConfig) (hs *HttpService) { // nolint:golint
 	ip := backend.NewProxy(cfg)
 	hs = &HttpService{
-		ip:           ip,
-		tx:           transfer.NewTransfer(cfg, ip.Circles),
-		username:     cfg.Username,
-		password:     cfg.Password,
-		authEncrypt:  cfg.AuthEncrypt,
-		writeTracing: cfg.WriteTracing,
-		queryTracing: cfg.QueryTracing,
-		pprofEnabled: cfg.PprofEnabled,
+		ip:             ip,
+		tx:             transfer.NewTransfer(cfg, ip.AllCircles()),
+		users:          backend.NewUsers(cfg),
+		tokens:         backend.NewTokens(cfg),
+		tenants:        backend.NewTenants(cfg),
+		masks:          backend.NewMasker(cfg),
+		hmac:           backend.NewHmacVerifier(cfg),
+		sharedSecret:   cfg.SharedSecret,
+		oidc:           backend.NewOidc(cfg),
+		certUsers:      cfg.HTTPSClientUsers,
+		passthrough:    cfg.AuthPassthrough,
+		writeTracing:   cfg.WriteTracing,
+		queryTracing:   cfg.QueryTracing,
+		pprofEnabled:   cfg.PprofEnabled,
+		maxBodySize:    cfg.MaxBodySize,
+		maxDecodedSize: cfg.MaxDecodedSize,
+		driftWindow:    cfg.DriftCheckWindow,
+	}
+	// the lists are checked by config
+	hs.dataFilter, _ = backend.NewIPFilter(cfg.DataAllowList, cfg.DataDenyList)
+	hs.adminFilter, _ = backend.NewIPFilter(cfg.AdminAllowList, cfg.AdminDenyList)
+	var err error
+	if hs.auditLog, err = backend.NewAuditLog(cfg); err != nil {
+		log.Fatalf("open audit log error: %s", err)
+	}
+	if ip.Etcd != nil {
+		hs.tx.Etcd = ip.Etcd
+		hs.syncEtcd(cfg)
 	}
 	return
 }
 
+// TLSConfig returns the tls config of https, whose certificate is reloaded on change or by /admin/cert/reload
+func (hs *HttpService) TLSConfig(cfg *backend.ProxyConfig) (tlsConfig *tls.Config, err error) {
+	tlsConfig, hs.certs, err = backend.NewServerTLSConfig(cfg)
+	return
+}
+
 func (hs *HttpService) Register(mux *ServeMux) {
 	mux.HandleFunc("/ping", hs.HandlerPing)
-	mux.HandleFunc("/query", hs.HandlerQuery)
+	mux.HandleFunc("/query", hs.auditDDL(hs.HandlerQuery))
+	mux.HandleFunc("/query/kill", hs.audit(hs.HandlerQueryKill))
+	mux.HandleFunc("/query/template", hs.audit(hs.HandlerQueryTemplate))
+	mux.HandleFunc("/query/run", hs.HandlerQueryRun)
 	mux.HandleFunc("/write", hs.HandlerWrite)
 	mux.HandleFunc("/api/v2/query", hs.HandlerQueryV2)
 	mux.HandleFunc("/api/v2/write", hs.HandlerWriteV2)
 	mux.HandleFunc("/health", hs.HandlerHealth)
 	mux.HandleFunc("/replica", hs.HandlerReplica)
+	mux.HandleFunc("/ring", hs.HandlerRing)
 	mux.HandleFunc("/encrypt", hs.HandlerEncrypt)
 	mux.HandleFunc("/decrypt", hs.HandlerDecrypt)
-	mux.HandleFunc("/rebalance", hs.HandlerRebalance)
-	mux.HandleFunc("/recovery", hs.HandlerRecovery)
-	mux.HandleFunc("/resync", hs.HandlerResync)
-	mux.HandleFunc("/cleanup", hs.HandlerCleanup)
-	mux.HandleFunc("/transfer/state", hs.HandlerTransferState)
-	mux.HandleFunc("/transfer/stats", hs.HandlerTransferStats)
+	mux.HandleFunc("/circle", hs.audit(hs.HandlerCircle))
+	mux.HandleFunc("/circle/write", hs.audit(hs.HandlerCircleWrite))
+	mux.HandleFunc("/admin/backend", hs.audit(hs.HandlerAdminBackend))
+	mux.HandleFunc("/admin/backend/plan", hs.audit(hs.HandlerAdminBackendPlan))
+	mux.HandleFunc("/admin/user", hs.audit(hs.HandlerAdminUser))
+	mux.HandleFunc("/admin/user/grant", hs.audit(hs.HandlerAdminUserGrant))
+	mux.HandleFunc("/admin/cert/reload", hs.audit(hs.HandlerAdminCertReload))
+	mux.HandleFunc("/admin/cipher/reencrypt", hs.audit(hs.HandlerAdminCipherReencrypt))
+	mux.HandleFunc("/admin/token", hs.audit(hs.HandlerAdminToken))
+	mux.HandleFunc("/rebalance", hs.audit(hs.HandlerRebalance))
+	mux.HandleFunc("/recovery", hs.audit(hs.HandlerRecovery))
+	mux.HandleFunc("/resync", hs.audit(hs.HandlerResync))
+	mux.HandleFunc("/cleanup", hs.audit(hs.HandlerCleanup))
+	mux.HandleFunc("/transfer/state", hs.audit(hs.HandlerTransferState))
+	mux.HandleFunc("/transfer/stats", hs.audit(hs.HandlerTransferStats))
+	mux.HandleFunc("/transfer/pause", hs.audit(hs.HandlerTransferPause))
+	mux.HandleFunc("/transfer/resume", hs.audit(hs.HandlerTransferResume))
+	mux.HandleFunc("/transfer/cancel", hs.audit(hs.HandlerTransferCancel))
+	mux.HandleFunc("/transfer/lock", hs.audit(hs.HandlerTransferLock))
+	mux.HandleFunc("/transfer/consistency", hs.audit(hs.HandlerTransferConsistency))
 	mux.HandleFunc("/api/v1/prom/read", hs.HandlerPromRead)
 	mux.HandleFunc("/api/v1/prom/write", hs.HandlerPromWrite)
+	mux.HandleFunc("/debug/write-errors", hs.audit(hs.HandlerWriteErrors))
+	mux.HandleFunc("/metrics", hs.HandlerMetrics)
+	mux.HandleFunc("/quota", hs.HandlerQuota)
 	if hs.pprofEnabled {
 		mux.HandleFunc("/debug/pprof/", pprof.Index)
 		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	}
 }
 
+type auditKey struct{}
+
+// auditWriter keeps the status of response for the audit record
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (aw *auditWriter) WriteHeader(status int) {
+	if aw.status == 0 {
+		aw.status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *auditWriter) Flush() {
+	if flusher, ok := aw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// audit records every call of the handler to the audit log with the user, client, params and outcome
+func (hs *HttpService) audit(handler http.HandlerFunc) http.HandlerFunc {
+	return hs.auditIf(handler, nil)
+}
+
+// auditDDL records the calls of the handler whose queries have any statement of drop, delete or alter
+func (hs *HttpService) auditDDL(handler http.HandlerFunc) http.HandlerFunc {
+	return hs.auditIf(handler, func(req *http.Request) bool {
+		return backend.IsDDL(req.Form.Get("q"))
+	})
+}
+
+func (hs *HttpService) auditIf(handler http.HandlerFunc, match func(req *http.Request) bool) http.HandlerFunc {
+	if hs.auditLog == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		if match != nil {
+			// the form is parsed to be matched, and it's shared by the requests derived by the handler
+			req.ParseForm()
+			if !match(req) {
+				handler(w, req)
+				return
+			}
+		}
+		record := &backend.AuditRecord{
+			Time:   time.Now().Format(time.RFC3339Nano),
+			Client: req.RemoteAddr,
+			Method: req.Method,
+			Path:   req.URL.Path,
+		}
+		aw := &auditWriter{ResponseWriter: w}
+		req = req.WithContext(context.WithValue(req.Context(), auditKey{}, record))
+		handler(aw, req)
+		// the form is parsed by the handler if read, otherwise the body may be json
+		record.Params = req.Form
+		if record.Params == nil {
+			record.Params = req.URL.Query()
+		}
+		record.Status, record.Error = aw.status, w.Header().Get("X-Influxdb-Error")
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		if err := hs.auditLog.Write(record); err != nil {
+			log.Printf("write audit log error: %s", err)
+		}
+	}
+}
+
+// auditUser sets the user authenticated to the audit record of request if any
+func (hs *HttpService) auditUser(req *http.Request, user string) {
+	if record, ok := req.Context().Value(auditKey{}).(*backend.AuditRecord); ok {
+		record.User = user
+	}
+}
+
 func (hs *HttpService) HandlerPing(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (hs *HttpService) HandlerQuery(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "GET", "POST") {
+	req, ok := hs.checkMethodAndGrants(w, req, backend.RateLimitQuery, "GET", "POST")
+	if !ok {
 		return
 	}
 
+	// the databases of tenant are named without the prefix by its users
+	if tenant := backend.GetTenant(req); tenant != nil {
+		q, err := tenant.ScopeQuery(req.FormValue("q"))
+		if err != nil {
+			hs.WriteError(w, req, http.StatusForbidden, err.Error())
+			return
+		}
+		req.Form.Set("q", q)
+		req.Form.Set("db", tenant.DB(req.FormValue("db")))
+	}
 	db := req.FormValue("db")
 	q := req.FormValue("q")
-	body, err := hs.ip.Query(w, req)
+	masks := backend.GetMasks(req)
+	if err := masks.Check(q); err != nil {
+		hs.WriteError(w, req, http.StatusForbidden, err.Error())
+		return
+	}
+	backend.PrepareMasked(req)
+	release, err := hs.ip.Quota.Acquire(backend.GetUser(req), backend.TenantName(req), db, time.Now())
 	if err != nil {
 		log.Printf("influxql query error: %s, query: %s, db: %s, client: %s", err, q, db, req.RemoteAddr)
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		hs.WriteError(w, req, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	defer release()
+	var qt *backend.QueryTrace
+	if hs.queryTracing || req.FormValue("trace") == "true" {
+		req, qt = backend.WithQueryTrace(req)
+	}
+	sw := backend.NewStreamWriter(w)
+	var body []byte
+	if masks != nil {
+		// the masked response is buffered to be rewritten
+		body, err = hs.ip.Query(w, req)
+	} else {
+		body, err = hs.ip.Query(sw, req)
+	}
+	if qt != nil && !sw.Streamed {
+		w.Header().Set(backend.HeaderTrace, qt.String())
+	}
+	if err != nil {
+		log.Printf("influxql query error: %s, query: %s, db: %s, client: %s", err, q, db, req.RemoteAddr)
+		status := http.StatusBadRequest
+		switch err.(type) {
+		case *backend.QueryDeniedError, *backend.AuthorizationError, *backend.DestructiveError, *backend.TenantError:
+			status = http.StatusForbidden
+		}
+		hs.WriteError(w, req, status, err.Error())
 		return
 	}
-	hs.WriteBody(w, body)
+	if body, err = backend.MaskResponse(w, req, body); err != nil {
+		log.Printf("influxql query error: %s, query: %s, db: %s, client: %s", err, q, db, req.RemoteAddr)
+		hs.WriteError(w, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !sw.Streamed {
+		hs.WriteBody(w, body)
+	}
 	if hs.queryTracing {
-		log.Printf("influxql query: %s, db: %s, client: %s", q, db, req.RemoteAddr)
+		log.Printf("influxql query: %s, db: %s, client: %s, trace: %s", q, db, req.RemoteAddr, qt)
+	}
+}
+
+func (hs *HttpService) HandlerQueryKill(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAdmin(w, req, "POST") {
+		return
+	}
+
+	id, err := strconv.ParseInt(req.FormValue("id"), 10, 64)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, "invalid id")
+		return
+	}
+	err = hs.ip.Queries.Kill(id, "")
+	if err != nil {
+		hs.WriteError(w, req, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (hs *HttpService) HandlerQueryTemplate(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAdmin(w, req, "GET", "POST", "DELETE") {
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		hs.Write(w, req, http.StatusOK, hs.ip.Templates.List())
+	case "POST":
+		qt := &backend.QueryTemplate{}
+		decoder := json.NewDecoder(newLimitReader(req.Body, hs.maxBodySize))
+		if err := decoder.Decode(qt); err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, "invalid query template from body")
+			return
+		}
+		if hs.ip.IsForbiddenDB(qt.Db) {
+			hs.WriteError(w, req, http.StatusBadRequest, fmt.Sprintf("database forbidden: %s", qt.Db))
+			return
+		}
+		if err := hs.ip.Templates.Register(qt); err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		if err := hs.ip.Templates.Delete(req.FormValue("name")); err != nil {
+			hs.WriteError(w, req, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (hs *HttpService) HandlerQueryRun(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET", "POST") {
+		return
+	}
+
+	qt, err := hs.ip.Templates.Get(req.FormValue("name"))
+	if err != nil {
+		hs.WriteError(w, req, http.StatusNotFound, err.Error())
+		return
+	}
+	q, err := qt.Render(req.Form)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
 	}
+	// the rendered query is routed as a normal query on the database of template
+	req.Form.Set("q", q)
+	req.Form.Set("db", qt.Db)
+	hs.HandlerQuery(w, req)
 }
 
 func (hs *HttpService) HandlerQueryV2(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	req, ok := hs.checkMethodAndGrants(w, req, backend.RateLimitQuery, "POST")
+	if !ok {
 		return
 	}
 
@@ -163,12 +436,27 @@ func (hs *HttpService) HandlerQueryV2(w http.ResponseWriter, req *http.Request)
 		hs.WriteError(w, req, http.StatusBadRequest, fmt.Sprintf("unknown query type: %s", qr.Type))
 		return
 	}
+	// the flux responses aren't masked
+	if backend.GetMasks(req) != nil {
+		hs.WriteError(w, req, http.StatusForbidden, "flux query denied by mask rules")
+		return
+	}
+	if tenant := backend.GetTenant(req); tenant != nil {
+		if rbody, err = hs.scopeFlux(tenant, mt, rbody, qr); err != nil {
+			hs.WriteError(w, req, http.StatusForbidden, err.Error())
+			return
+		}
+	}
 
 	req.Body = ioutil.NopCloser(bytes.NewBuffer(rbody))
 	err = hs.ip.QueryFlux(w, req, qr)
 	if err != nil {
 		log.Printf("flux query error: %s, query: %s, spec: %s, client: %s", err, qr.Query, qr.Spec, req.RemoteAddr)
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		status := http.StatusBadRequest
+		if _, ok := err.(*backend.AuthorizationError); ok {
+			status = http.StatusForbidden
+		}
+		hs.WriteError(w, req, status, err.Error())
 		return
 	}
 	if hs.queryTracing {
@@ -177,7 +465,8 @@ func (hs *HttpService) HandlerQueryV2(w http.ResponseWriter, req *http.Request)
 }
 
 func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	req, ok := hs.checkMethodAndGrants(w, req, backend.RateLimitWrite, "POST")
+	if !ok {
 		return
 	}
 
@@ -193,18 +482,23 @@ func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	rp := req.URL.Query().Get("rp")
 	db, err := hs.queryDB(req, false)
 	if err != nil {
+		hs.dropForbidden(db, rp, precision)
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
-	rp := req.URL.Query().Get("rp")
+	if !hs.checkGrant(w, req, db, backend.PrivilegeWrite) {
+		return
+	}
 
 	hs.handlerWrite(db, rp, precision, w, req)
 }
 
 func (hs *HttpService) HandlerWriteV2(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	req, ok := hs.checkMethodAndGrants(w, req, backend.RateLimitWrite, "POST")
+	if !ok {
 		return
 	}
 
@@ -226,42 +520,86 @@ func (hs *HttpService) HandlerWriteV2(w http.ResponseWriter, req *http.Request)
 		hs.WriteError(w, req, http.StatusNotFound, err.Error())
 		return
 	}
+	db = backend.GetTenant(req).DB(db)
 	if hs.ip.IsForbiddenDB(db) {
+		hs.dropForbidden(db, rp, precision)
 		hs.WriteError(w, req, http.StatusBadRequest, fmt.Sprintf("database forbidden: %s", db))
 		return
 	}
+	if !hs.checkGrant(w, req, db, backend.PrivilegeWrite) {
+		return
+	}
 
 	hs.handlerWrite(db, rp, precision, w, req)
 }
 
 func (hs *HttpService) handlerWrite(db, rp, precision string, w http.ResponseWriter, req *http.Request) {
-	body := req.Body
+	var body io.Reader = newLimitReader(req.Body, hs.maxBodySize)
+	// the signature is verified over the body as sent, before decoding
+	if hs.hmac != nil {
+		raw, err := ioutil.ReadAll(body)
+		if err != nil {
+			if err == ErrBodyTooLarge {
+				hs.WriteError(w, req, http.StatusRequestEntityTooLarge, err.Error())
+				return
+			}
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err = hs.hmac.Verify(req, raw, time.Now()); err != nil {
+			hs.WriteError(w, req, http.StatusUnauthorized, err.Error())
+			return
+		}
+		body = bytes.NewReader(raw)
+	}
 	if req.Header.Get("Content-Encoding") == "gzip" {
 		b, err := gzip.NewReader(body)
 		if err != nil {
+			if err == ErrBodyTooLarge {
+				hs.WriteError(w, req, http.StatusRequestEntityTooLarge, err.Error())
+				return
+			}
 			hs.WriteError(w, req, http.StatusBadRequest, "unable to decode gzip body")
 			return
 		}
 		defer b.Close()
-		body = b
+		body = newLimitReader(b, hs.maxDecodedSize)
 	}
 	p, err := ioutil.ReadAll(body)
 	if err != nil {
+		if err == ErrBodyTooLarge {
+			hs.WriteError(w, req, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
+	if err = hs.ip.Quota.AllowWrite(backend.GetUser(req), backend.TenantName(req), db, backend.CountPoints(p), time.Now()); err != nil {
+		hs.WriteError(w, req, http.StatusTooManyRequests, err.Error())
+		return
+	}
 
-	err = hs.ip.Write(p, db, rp, precision)
-	if err == nil {
-		w.WriteHeader(http.StatusNoContent)
+	if req.URL.Query().Get("backfill") == "true" {
+		err = hs.ip.WriteBackfill(p, db, rp, precision)
+		if err == backend.ErrBackfillBusy {
+			hs.WriteError(w, req, http.StatusTooManyRequests, err.Error())
+			return
+		}
+	} else {
+		err = hs.ip.Write(p, db, rp, precision)
+	}
+	if err != nil {
+		hs.WriteError(w, req, http.StatusInternalServerError, err.Error())
+		return
 	}
+	w.WriteHeader(http.StatusNoContent)
 	if hs.writeTracing {
 		log.Printf("write line protocol, db: %s, rp: %s, precision: %s, data: %s, client: %s", db, rp, precision, p, req.RemoteAddr)
 	}
 }
 
 func (hs *HttpService) HandlerHealth(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "GET") {
+	if !hs.checkMethodAndAuthScope(w, req, backend.ScopeHealth, "GET") {
 		return
 	}
 	stats := req.URL.Query().Get("stats") == "true"
@@ -277,29 +615,75 @@ func (hs *HttpService) HandlerHealth(w http.ResponseWriter, req *http.Request) {
 }
 
 func (hs *HttpService) HandlerReplica(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "GET") {
+	db := req.URL.Query().Get("db")
+	meas := req.URL.Query().Get("meas")
+	// the bulk mode lists the databases and measurements across tenants, which requires admin
+	if meas == "" && !hs.checkMethodAndAdmin(w, req, "GET") {
 		return
 	}
+	if meas != "" {
+		// the single measurement mode is scoped by the tenant and grants as the query
+		var ok bool
+		if req, ok = hs.checkMethodAndGrants(w, req, backend.RateLimitQuery, "GET"); !ok {
+			return
+		}
+		var err error
+		if db, err = hs.queryDB(req, false); err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !hs.checkGrant(w, req, db, backend.PrivilegeRead) {
+			return
+		}
+	}
 
-	db := req.URL.Query().Get("db")
-	meas := req.URL.Query().Get("meas")
 	if db != "" && meas != "" {
-		key := backend.GetKey(db, meas)
-		backends := hs.ip.GetBackends(key)
-		data := make([]map[string]interface{}, len(backends))
-		for i, b := range backends {
-			c := hs.ip.Circles[i]
-			data[i] = map[string]interface{}{
-				"backend": map[string]string{"name": b.Name, "url": b.Url},
-				"circle":  map[string]interface{}{"id": c.CircleId, "name": c.Name},
+		// all the backends of circle are returned if the measurement is spread by tags
+		data := make([]map[string]interface{}, 0, len(hs.ip.AllCircles()))
+		for _, c := range hs.ip.GetCircles(db) {
+			for _, b := range c.GetReplicasByMeasurements(db, []string{meas}) {
+				data = append(data, map[string]interface{}{
+					"backend": map[string]string{"name": b.Name, "url": b.Url},
+					"circle":  map[string]interface{}{"id": c.CircleId, "name": c.Name},
+				})
 			}
 		}
 		hs.Write(w, req, http.StatusOK, data)
+	} else if meas == "" {
+		// the bulk mode walks the measurements of the database, or of all databases if db is empty
+		var dbs []string
+		if db != "" {
+			dbs = []string{db}
+		}
+		hs.Write(w, req, http.StatusOK, hs.ip.ReplicaMap(dbs))
 	} else {
 		hs.WriteError(w, req, http.StatusBadRequest, "invalid db or meas")
 	}
 }
 
+func (hs *HttpService) HandlerRing(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAdmin(w, req, "GET", "POST") {
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		hs.Write(w, req, http.StatusOK, hs.ip.ExportPlacement(hs.formValues(req, "dbs")))
+	case "POST":
+		placement := &backend.Placement{}
+		decoder := json.NewDecoder(newLimitReader(req.Body, hs.maxBodySize))
+		if err := decoder.Decode(placement); err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, "invalid placement from body")
+			return
+		}
+		diffs := hs.ip.VerifyPlacement(placement)
+		if diffs == nil {
+			diffs = []string{}
+		}
+		hs.Write(w, req, http.StatusOK, map[string]interface{}{"agreed": len(diffs) == 0, "diffs": diffs})
+	}
+}
+
 func (hs *HttpService) HandlerEncrypt(w http.ResponseWriter, req *http.Request) {
 	if !hs.checkMethod(w, req, "GET") {
 		return
@@ -323,8 +707,294 @@ func (hs *HttpService) HandlerDecrypt(w http.ResponseWriter, req *http.Request)
 	hs.WriteText(w, http.StatusOK, decrypt)
 }
 
+func (hs *HttpService) HandlerCircle(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndScope(w, req, backend.ScopeBackendWrite, "POST") {
+		return
+	}
+
+	circfg, err := backend.NewCircleConfig(newLimitReader(req.Body, hs.maxBodySize))
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, "invalid circle from body")
+		return
+	}
+
+	// the new circle is seeded by recovery from the circle of from_circle_id if specified
+	recovery := req.URL.Query().Get("from_circle_id") != ""
+	var fromCircleId int // nolint:golint
+	params := transfer.NewParams()
+	if recovery {
+		fromCircleId, err = hs.formCircleId(req, "from_circle_id")
+		if err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			return
+		}
+		if hs.tx.CircleStates[fromCircleId].Transferring {
+			hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d is transferring", fromCircleId))
+			return
+		}
+		if hs.tx.Resyncing {
+			hs.WriteText(w, http.StatusBadRequest, "proxy is resyncing")
+			return
+		}
+		err = hs.setParam(req, params)
+		if err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = hs.setHaAddrs(req)
+		if err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	circle, err := hs.ip.AddCircle(circfg)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	hs.tx.AddCircleState(circfg, circle)
+
+	if !recovery {
+		hs.Write(w, req, http.StatusCreated, circle.GetHealth(false))
+		return
+	}
+	dbs := hs.formValues(req, "dbs")
+	hs.startTransfer(w, req, "recovery", params, func() {
+		hs.tx.Recovery(fromCircleId, circle.CircleId, nil, dbs, transfer.TimeRange{})
+	})
+}
+
+func (hs *HttpService) HandlerCircleWrite(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAdmin(w, req, "POST") {
+		return
+	}
+
+	circleId, err := hs.formCircleId(req, "circle_id") // nolint:golint
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	enabled, err := hs.formBool(req, "enabled")
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, "invalid enabled")
+		return
+	}
+	circle := hs.ip.AllCircles()[circleId]
+	circle.SetWriteEnabled(enabled)
+	log.Printf("circle %d write enabled: %t", circleId, enabled)
+	hs.Write(w, req, http.StatusOK, circle.GetHealth(false))
+}
+
+func (hs *HttpService) HandlerAdminBackend(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndScope(w, req, backend.ScopeBackendWrite, "POST", "DELETE") {
+		return
+	}
+
+	var bkcfg *backend.BackendConfig
+	if req.Method == "POST" {
+		var err error
+		bkcfg, err = backend.NewBackendConfig(newLimitReader(req.Body, hs.maxBodySize))
+		if err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, "invalid backend from body")
+			return
+		}
+	}
+	circleId, err := hs.formCircleId(req, "circle_id") // nolint:golint
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	if hs.tx.CircleStates[circleId].Transferring {
+		hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d is transferring", circleId))
+		return
+	}
+
+	var circle *backend.Circle
+	switch req.Method {
+	case "POST":
+		circle, err = hs.ip.AddBackend(circleId, bkcfg)
+	case "DELETE":
+		circle, err = hs.ip.RemoveBackend(circleId, req.FormValue("name"))
+	}
+	if err == backend.ErrBackendNotFound {
+		hs.WriteError(w, req, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	hs.tx.SetCircle(circleId, circle)
+	hs.Write(w, req, http.StatusOK, circle.GetHealth(false))
+}
+
+func (hs *HttpService) HandlerAdminBackendPlan(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndScope(w, req, backend.ScopeBackendWrite, "POST") {
+		return
+	}
+
+	// the operation is read from url before the body is decoded
+	operation := req.URL.Query().Get("operation")
+	if operation != "add" && operation != "rm" {
+		hs.WriteError(w, req, http.StatusBadRequest, "invalid operation")
+		return
+	}
+	var bkcfg *backend.BackendConfig
+	if operation == "add" {
+		var err error
+		bkcfg, err = backend.NewBackendConfig(newLimitReader(req.Body, hs.maxBodySize))
+		if err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, "invalid backend from body")
+			return
+		}
+	}
+	circleId, err := hs.formCircleId(req, "circle_id") // nolint:golint
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var plan *backend.TopologyPlan
+	dbs := hs.formValues(req, "dbs")
+	switch operation {
+	case "add":
+		plan, err = hs.ip.PlanAddBackend(circleId, bkcfg, dbs)
+	case "rm":
+		plan, err = hs.ip.PlanRemoveBackend(circleId, req.FormValue("name"), dbs)
+	}
+	if err == backend.ErrBackendNotFound {
+		hs.WriteError(w, req, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	hs.Write(w, req, http.StatusOK, plan)
+}
+
+func (hs *HttpService) HandlerAdminUser(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAdmin(w, req, "GET", "POST", "DELETE") {
+		return
+	}
+
+	var err error
+	switch req.Method {
+	case "GET":
+		hs.Write(w, req, http.StatusOK, hs.users.List())
+		return
+	case "POST":
+		username := req.FormValue("username")
+		err = hs.users.Set(username, req.FormValue("password"))
+		if admin := req.FormValue("admin"); err == nil && admin != "" {
+			err = hs.users.SetAdmin(username, admin == "true")
+		}
+	case "DELETE":
+		err = hs.users.Delete(req.FormValue("username"))
+	}
+	if err == backend.ErrUserNotFound {
+		hs.WriteError(w, req, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	hs.WriteText(w, http.StatusOK, "ok")
+}
+
+func (hs *HttpService) HandlerAdminUserGrant(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAdmin(w, req, "POST", "DELETE") {
+		return
+	}
+
+	var err error
+	username, db := req.FormValue("username"), req.FormValue("db")
+	switch req.Method {
+	case "POST":
+		err = hs.users.Grant(username, db, req.FormValue("privilege"))
+	case "DELETE":
+		err = hs.users.Revoke(username, db)
+	}
+	if err == backend.ErrUserNotFound {
+		hs.WriteError(w, req, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	hs.WriteText(w, http.StatusOK, "ok")
+}
+
+func (hs *HttpService) HandlerAdminToken(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAdmin(w, req, "GET", "POST", "DELETE") {
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		hs.Write(w, req, http.StatusOK, hs.tokens.List())
+	case "POST":
+		info, token, err := hs.tokens.Create(req.FormValue("name"), hs.formValues(req, "scopes"), time.Now())
+		if err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			return
+		}
+		hs.Write(w, req, http.StatusOK, map[string]interface{}{"id": info.ID, "name": info.Name, "scopes": info.Scopes, "token": token})
+	case "DELETE":
+		err := hs.tokens.Delete(req.FormValue("id"))
+		if err == backend.ErrTokenNotFound {
+			hs.WriteError(w, req, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			hs.WriteError(w, req, http.StatusInternalServerError, err.Error())
+			return
+		}
+		hs.WriteText(w, http.StatusOK, "ok")
+	}
+}
+
+func (hs *HttpService) HandlerAdminCertReload(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndScope(w, req, backend.ScopeReload, "POST") {
+		return
+	}
+
+	if hs.certs != nil {
+		if err := hs.certs.Reload(); err != nil {
+			hs.WriteError(w, req, http.StatusInternalServerError, fmt.Sprintf("https: %s", err))
+			return
+		}
+	}
+	if err := hs.ip.ReloadCerts(); err != nil {
+		hs.WriteError(w, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+	hs.WriteText(w, http.StatusOK, "ok")
+}
+
+func (hs *HttpService) HandlerAdminCipherReencrypt(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAdmin(w, req, "POST") {
+		return
+	}
+
+	users, err := hs.users.Reencrypt()
+	if err != nil {
+		hs.WriteError(w, req, http.StatusInternalServerError, fmt.Sprintf("users: %s", err))
+		return
+	}
+	backends, err := hs.ip.ReencryptBackends()
+	if err != nil {
+		hs.WriteError(w, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+	hs.Write(w, req, http.StatusOK, map[string]int{"users": users, "backends": backends})
+}
+
 func (hs *HttpService) HandlerRebalance(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	if !hs.checkMethodAndScope(w, req, backend.ScopeTransferWrite, "POST") {
 		return
 	}
 
@@ -352,10 +1022,9 @@ func (hs *HttpService) HandlerRebalance(w http.ResponseWriter, req *http.Request
 		}
 		for _, bkcfg := range body.Backends {
 			backends = append(backends, backend.NewSimpleBackend(bkcfg))
-			hs.tx.CircleStates[circleId].Stats[bkcfg.Url] = &transfer.Stats{}
 		}
 	}
-	backends = append(backends, hs.ip.Circles[circleId].Backends...)
+	backends = append(backends, hs.ip.AllCircles()[circleId].Backends...)
 
 	if hs.tx.CircleStates[circleId].Transferring {
 		hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d is transferring", circleId))
@@ -366,19 +1035,26 @@ func (hs *HttpService) HandlerRebalance(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	err = hs.setParam(req)
+	params, err := hs.setTransferParams(req, true)
 	if err != nil {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	dbs := hs.formValues(req, "dbs")
-	go hs.tx.Rebalance(circleId, backends, dbs)
-	hs.WriteText(w, http.StatusAccepted, "accepted")
+	if params.DryRun {
+		dr := hs.tx.NewDryRun(params)
+		dr.Rebalance(circleId, backends, dbs)
+		hs.Write(w, req, http.StatusOK, dr.GetDryRunResult())
+		return
+	}
+	hs.startTransfer(w, req, "rebalance", params, func() {
+		hs.tx.Rebalance(circleId, backends, dbs)
+	})
 }
 
 func (hs *HttpService) HandlerRecovery(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	if !hs.checkMethodAndScope(w, req, backend.ScopeTransferWrite, "POST") {
 		return
 	}
 
@@ -396,6 +1072,11 @@ func (hs *HttpService) HandlerRecovery(w http.ResponseWriter, req *http.Request)
 		hs.WriteError(w, req, http.StatusBadRequest, "from_circle_id and to_circle_id cannot be same")
 		return
 	}
+	tr, err := hs.formTimeRange(req, 0)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	if hs.tx.CircleStates[fromCircleId].Transferring || hs.tx.CircleStates[toCircleId].Transferring {
 		hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d or %d is transferring", fromCircleId, toCircleId))
@@ -406,7 +1087,7 @@ func (hs *HttpService) HandlerRecovery(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	err = hs.setParam(req)
+	params, err := hs.setTransferParams(req, true)
 	if err != nil {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
@@ -414,75 +1095,186 @@ func (hs *HttpService) HandlerRecovery(w http.ResponseWriter, req *http.Request)
 
 	backendUrls := hs.formValues(req, "backend_urls")
 	dbs := hs.formValues(req, "dbs")
-	go hs.tx.Recovery(fromCircleId, toCircleId, backendUrls, dbs)
-	hs.WriteText(w, http.StatusAccepted, "accepted")
+	if params.DryRun {
+		dr := hs.tx.NewDryRun(params)
+		dr.Recovery(fromCircleId, toCircleId, backendUrls, dbs, tr)
+		hs.Write(w, req, http.StatusOK, dr.GetDryRunResult())
+		return
+	}
+	hs.startTransfer(w, req, "recovery", params, func() {
+		hs.tx.Recovery(fromCircleId, toCircleId, backendUrls, dbs, tr)
+	})
 }
 
 func (hs *HttpService) HandlerResync(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	if !hs.checkMethodAndScope(w, req, backend.ScopeTransferWrite, "POST") {
+		return
+	}
+
+	tick, err := hs.formTick(req)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	// tick is kept as the start for compatibility
+	tr, err := hs.formTimeRange(req, tick)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	for _, cs := range hs.tx.CircleStates {
+		if cs.Transferring {
+			hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d is transferring", cs.CircleId))
+			return
+		}
+	}
+	if hs.tx.Resyncing {
+		hs.WriteText(w, http.StatusBadRequest, "proxy is resyncing")
+		return
+	}
+
+	params, err := hs.setTransferParams(req, false)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dbs := hs.formValues(req, "dbs")
+	if params.DryRun {
+		dr := hs.tx.NewDryRun(params)
+		dr.Resync(dbs, tr)
+		hs.Write(w, req, http.StatusOK, dr.GetDryRunResult())
+		return
+	}
+	hs.startTransfer(w, req, "resync", params, func() {
+		hs.tx.Resync(dbs, tr)
+	})
+}
+
+func (hs *HttpService) HandlerCleanup(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndScope(w, req, backend.ScopeTransferWrite, "POST") {
+		return
+	}
+
+	circleId, err := hs.formCircleId(req, "circle_id") // nolint:golint
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if hs.tx.CircleStates[circleId].Transferring {
+		hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d is transferring", circleId))
+		return
+	}
+	if hs.tx.Resyncing {
+		hs.WriteText(w, http.StatusBadRequest, "proxy is resyncing")
 		return
 	}
 
-	tick, err := hs.formTick(req)
+	params := transfer.NewParams()
+	err = hs.setParam(req, params)
 	if err != nil {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	for _, cs := range hs.tx.CircleStates {
-		if cs.Transferring {
-			hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d is transferring", cs.CircleId))
-			return
-		}
-	}
-	if hs.tx.Resyncing {
-		hs.WriteText(w, http.StatusBadRequest, "proxy is resyncing")
+	err = hs.setConfirm(req, params)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	err = hs.setParam(req)
+	err = hs.setHaAddrs(req)
 	if err != nil {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	dbs := hs.formValues(req, "dbs")
-	go hs.tx.Resync(dbs, tick)
-	hs.WriteText(w, http.StatusAccepted, "accepted")
+	hs.startTransfer(w, req, "cleanup", params, func() {
+		hs.tx.Cleanup(circleId)
+	})
 }
 
-func (hs *HttpService) HandlerCleanup(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+// startTransfer runs the transfer of the params in background once the transfer lock is acquired, so that the
+// other proxies reject the duplicate submissions, and the params are set only for the transfer accepted
+func (hs *HttpService) startTransfer(w http.ResponseWriter, req *http.Request, operation string, params *transfer.Params, fn func()) {
+	release, err := hs.tx.Acquire(operation)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusConflict, err.Error())
 		return
 	}
+	go func() {
+		defer release()
+		hs.tx.SetParams(params)
+		fn()
+	}()
+	hs.WriteText(w, http.StatusAccepted, "accepted")
+}
 
-	circleId, err := hs.formCircleId(req, "circle_id") // nolint:golint
-	if err != nil {
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+func (hs *HttpService) HandlerTransferLock(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndScope(w, req, transferScope(req), "GET", "POST", "DELETE") {
 		return
 	}
 
-	if hs.tx.CircleStates[circleId].Transferring {
-		hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d is transferring", circleId))
+	if req.Method == "GET" {
+		hs.Write(w, req, http.StatusOK, map[string]interface{}{"holder": hs.tx.GetLockHolder()})
 		return
 	}
-	if hs.tx.Resyncing {
-		hs.WriteText(w, http.StatusBadRequest, "proxy is resyncing")
+	owner := req.FormValue("owner")
+	if owner == "" {
+		hs.WriteError(w, req, http.StatusBadRequest, "missing owner")
+		return
+	}
+	if req.Method == "DELETE" {
+		hs.tx.Unlock(owner)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	holder, ok := hs.tx.TryLock(owner, req.FormValue("operation"))
+	if !ok {
+		// the holder is returned to the proxy rejected
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(util.MarshalJSON(holder, false))
+		return
+	}
+	hs.Write(w, req, http.StatusOK, holder)
+}
+
+func (hs *HttpService) HandlerTransferConsistency(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndScope(w, req, transferScope(req), "GET", "POST") {
 		return
 	}
 
-	err = hs.setParam(req)
+	if req.Method == "GET" {
+		cr := hs.tx.GetConsistencyReport()
+		if cr == nil {
+			hs.WriteError(w, req, http.StatusNotFound, "no consistency check run")
+			return
+		}
+		hs.Write(w, req, http.StatusOK, cr)
+		return
+	}
+	tr, err := hs.formTimeRange(req, time.Now().Unix()-int64(hs.driftWindow))
 	if err != nil {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	go hs.tx.Cleanup(circleId)
+	mf, err := transfer.NewMeasurementFilter(hs.formValues(req, "measurements"))
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, ErrInvalidMeas.Error())
+		return
+	}
+	if !hs.tx.StartConsistencyCheck(hs.formValues(req, "dbs"), mf, tr) {
+		hs.WriteError(w, req, http.StatusConflict, "consistency check is running")
+		return
+	}
 	hs.WriteText(w, http.StatusAccepted, "accepted")
 }
 
 func (hs *HttpService) HandlerTransferState(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "GET", "POST") {
+	if !hs.checkMethodAndScope(w, req, transferScope(req), "GET", "POST") {
 		return
 	}
 
@@ -495,7 +1287,7 @@ func (hs *HttpService) HandlerTransferState(w http.ResponseWriter, req *http.Req
 				"transferring": cs.Transferring,
 			}
 		}
-		state := map[string]interface{}{"resyncing": hs.tx.Resyncing, "circles": data}
+		state := map[string]interface{}{"resyncing": hs.tx.Resyncing, "paused": hs.tx.IsPaused(), "lock": hs.tx.GetLockHolder(), "circles": data}
 		hs.Write(w, req, http.StatusOK, state)
 		return
 	} else if req.Method == "POST" {
@@ -538,8 +1330,41 @@ func (hs *HttpService) HandlerTransferState(w http.ResponseWriter, req *http.Req
 	}
 }
 
+func (hs *HttpService) HandlerTransferPause(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndScope(w, req, backend.ScopeTransferWrite, "POST") {
+		return
+	}
+
+	hs.tx.Pause()
+	log.Printf("transfer paused")
+	hs.Write(w, req, http.StatusOK, map[string]interface{}{"paused": true})
+}
+
+func (hs *HttpService) HandlerTransferResume(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndScope(w, req, backend.ScopeTransferWrite, "POST") {
+		return
+	}
+
+	hs.tx.Resume()
+	log.Printf("transfer resumed")
+	hs.Write(w, req, http.StatusOK, map[string]interface{}{"paused": false})
+}
+
+func (hs *HttpService) HandlerTransferCancel(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndScope(w, req, backend.ScopeTransferWrite, "POST") {
+		return
+	}
+
+	if !hs.tx.Cancel() {
+		hs.WriteError(w, req, http.StatusBadRequest, "no transfer running")
+		return
+	}
+	log.Printf("transfer cancelled")
+	hs.Write(w, req, http.StatusOK, map[string]interface{}{"cancelled": true})
+}
+
 func (hs *HttpService) HandlerTransferStats(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "GET") {
+	if !hs.checkMethodAndScope(w, req, backend.ScopeTransferRead, "GET") {
 		return
 	}
 
@@ -551,14 +1376,40 @@ func (hs *HttpService) HandlerTransferStats(w http.ResponseWriter, req *http.Req
 
 	statsType := req.FormValue("type")
 	if statsType == "rebalance" || statsType == "recovery" || statsType == "resync" || statsType == "cleanup" {
-		hs.Write(w, req, http.StatusOK, hs.tx.CircleStates[circleId].Stats)
+		cs := hs.tx.CircleStates[circleId]
+		if req.FormValue("summary") == "true" {
+			hs.Write(w, req, http.StatusOK, map[string]interface{}{"circle": cs.GetSummary(), "backends": cs.GetStats()})
+		} else {
+			hs.Write(w, req, http.StatusOK, cs.GetStats())
+		}
 	} else {
 		hs.WriteError(w, req, http.StatusBadRequest, "invalid stats type")
 	}
 }
 
+func (hs *HttpService) HandlerMetrics(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuthScope(w, req, backend.ScopeHealth, "GET") {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	hs.ip.WriteMetrics(w)
+	hs.tx.WriteMetrics(w)
+	hs.ip.RateLimiter.WriteMetrics(w)
+}
+
+func (hs *HttpService) HandlerQuota(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAdmin(w, req, "GET") {
+		return
+	}
+
+	hs.Write(w, req, http.StatusOK, hs.ip.Quota.Usages())
+}
+
 func (hs *HttpService) HandlerPromRead(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	req, ok := hs.checkMethodAndGrants(w, req, backend.RateLimitQuery, "POST")
+	if !ok {
 		return
 	}
 
@@ -567,6 +1418,14 @@ func (hs *HttpService) HandlerPromRead(w http.ResponseWriter, req *http.Request)
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
+	if !hs.checkGrant(w, req, db, backend.PrivilegeRead) {
+		return
+	}
+	// the prometheus responses aren't masked
+	if backend.GetMasks(req) != nil {
+		hs.WriteError(w, req, http.StatusForbidden, "prometheus read denied by mask rules")
+		return
+	}
 
 	compressed, err := ioutil.ReadAll(req.Body)
 	if err != nil {
@@ -617,18 +1476,27 @@ func (hs *HttpService) HandlerPromRead(w http.ResponseWriter, req *http.Request)
 }
 
 func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	req, ok := hs.checkMethodAndGrants(w, req, backend.RateLimitWrite, "POST")
+	if !ok {
 		return
 	}
 
+	rp := req.URL.Query().Get("rp")
 	db, err := hs.queryDB(req, false)
 	if err != nil {
+		hs.dropForbidden(db, rp, "ns")
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
-	rp := req.URL.Query().Get("rp")
+	if !hs.checkGrant(w, req, db, backend.PrivilegeWrite) {
+		return
+	}
 
-	body := req.Body
+	if hs.maxBodySize > 0 && req.ContentLength > hs.maxBodySize {
+		hs.WriteError(w, req, http.StatusRequestEntityTooLarge, ErrBodyTooLarge.Error())
+		return
+	}
+	body := newLimitReader(req.Body, hs.maxBodySize)
 	var bs []byte
 	if req.ContentLength > 0 {
 		// This will just be an initial hint for the reader, as the
@@ -642,10 +1510,19 @@ func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request
 		if hs.writeTracing {
 			log.Printf("prom write handler unable to read bytes from request body")
 		}
+		if err == ErrBodyTooLarge {
+			hs.WriteError(w, req, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	if n, err := snappy.DecodedLen(buf.Bytes()); err == nil && hs.maxDecodedSize > 0 && int64(n) > hs.maxDecodedSize {
+		hs.WriteError(w, req, http.StatusRequestEntityTooLarge, ErrBodyTooLarge.Error())
+		return
+	}
+
 	reqBuf, err := snappy.Decode(nil, buf.Bytes())
 	if err != nil {
 		if hs.writeTracing {
@@ -677,11 +1554,35 @@ func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request
 		}
 	}
 
+	if err = hs.ip.Quota.AllowWrite(backend.GetUser(req), backend.TenantName(req), db, len(points), time.Now()); err != nil {
+		hs.WriteError(w, req, http.StatusTooManyRequests, err.Error())
+		return
+	}
+
 	// Write points.
 	err = hs.ip.WritePoints(points, db, rp)
-	if err == nil {
+	if err != nil {
+		hs.WriteError(w, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (hs *HttpService) HandlerWriteErrors(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAdmin(w, req, "GET", "DELETE") {
+		return
+	}
+
+	if req.Method == "DELETE" {
+		hs.ip.WriteErrors.Reset()
 		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	resp := map[string]interface{}{
+		"counts":  hs.ip.WriteErrors.Counts(),
+		"samples": hs.ip.WriteErrors.Samples(),
 	}
+	hs.Write(w, req, http.StatusOK, resp)
 }
 
 func (hs *HttpService) Write(w http.ResponseWriter, req *http.Request, status int, data interface{}) {
@@ -718,6 +1619,65 @@ func (hs *HttpService) checkMethodAndAuth(w http.ResponseWriter, req *http.Reque
 	return hs.checkMethod(w, req, methods...) && hs.checkAuth(w, req)
 }
 
+// checkMethodAndAdmin checks the user is admin, which is required by the management endpoints
+func (hs *HttpService) checkMethodAndAdmin(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	return hs.checkMethod(w, req, methods...) && hs.checkAdmin(w, req)
+}
+
+// checkMethodAndGrants returns the request carrying the grants of the user authenticated, which are
+// checked by the handlers of queries and writes, the client is rate limited by kind of query or write
+func (hs *HttpService) checkMethodAndGrants(w http.ResponseWriter, req *http.Request, kind string, methods ...string) (*http.Request, bool) {
+	if !hs.checkMethod(w, req, methods...) {
+		return req, false
+	}
+	req, ok := hs.checkGrants(w, req, kind)
+	if ok && hs.passthrough {
+		req = backend.WithPassthrough(req)
+	}
+	return req, ok
+}
+
+// checkMethodAndScope checks the api token of request has the scope, or the user is admin without api token
+func (hs *HttpService) checkMethodAndScope(w http.ResponseWriter, req *http.Request, scope string, methods ...string) bool {
+	return hs.checkMethod(w, req, methods...) && hs.checkScope(w, req, scope, hs.checkAdmin)
+}
+
+// checkMethodAndAuthScope checks the api token of request has the scope, or the user is authenticated without api token
+func (hs *HttpService) checkMethodAndAuthScope(w http.ResponseWriter, req *http.Request, scope string, methods ...string) bool {
+	return hs.checkMethod(w, req, methods...) && hs.checkScope(w, req, scope, hs.checkAuth)
+}
+
+// checkScope checks the api token of bearer by the scope, the request without api token is checked by check instead.
+// The clients of api tokens are filtered as the admin endpoints, and audited as token:<id>
+func (hs *HttpService) checkScope(w http.ResponseWriter, req *http.Request, scope string, check func(http.ResponseWriter, *http.Request) bool) bool {
+	token, bearer := hs.parseBearer(req)
+	if !bearer || !backend.IsToken(token) {
+		return check(w, req)
+	}
+	if !hs.checkClient(w, req, hs.adminFilter) {
+		return false
+	}
+	info, err := hs.tokens.Verify(token, scope)
+	if err == backend.ErrInvalidAPIKey {
+		hs.WriteError(w, req, http.StatusUnauthorized, err.Error())
+		return false
+	}
+	hs.auditUser(req, "token:"+info.ID)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusForbidden, fmt.Sprintf("%s: %s", err, scope))
+		return false
+	}
+	return true
+}
+
+// transferScope returns the scope of transfer endpoints by method
+func transferScope(req *http.Request) string {
+	if req.Method == "GET" {
+		return backend.ScopeTransferRead
+	}
+	return backend.ScopeTransferWrite
+}
+
 func (hs *HttpService) checkMethod(w http.ResponseWriter, req *http.Request, methods ...string) bool {
 	for _, method := range methods {
 		if req.Method == method {
@@ -729,21 +1689,139 @@ func (hs *HttpService) checkMethod(w http.ResponseWriter, req *http.Request, met
 }
 
 func (hs *HttpService) checkAuth(w http.ResponseWriter, req *http.Request) bool {
-	if hs.username == "" && hs.password == "" {
-		return true
+	_, u, ok := hs.authenticate(w, req)
+	hs.auditUser(req, u)
+	return ok
+}
+
+// checkClient checks the client ip is allowed by the filter of endpoint group before authentication
+func (hs *HttpService) checkClient(w http.ResponseWriter, req *http.Request, filter *backend.IPFilter) bool {
+	if !filter.Allows(req.RemoteAddr) {
+		hs.WriteError(w, req, http.StatusForbidden, "client ip not allowed")
+		return false
+	}
+	return true
+}
+
+func (hs *HttpService) checkAdmin(w http.ResponseWriter, req *http.Request) bool {
+	if !hs.checkClient(w, req, hs.adminFilter) {
+		return false
+	}
+	user, u, ok := hs.authenticate(w, req)
+	hs.auditUser(req, u)
+	if ok && user != nil && !user.Admin {
+		hs.WriteError(w, req, http.StatusForbidden, "admin privilege required")
+		return false
+	}
+	return ok
+}
+
+// checkGrants returns the request carrying the grants of the user authenticated, the admin is granted all
+func (hs *HttpService) checkGrants(w http.ResponseWriter, req *http.Request, kind string) (*http.Request, bool) {
+	if !hs.checkClient(w, req, hs.dataFilter) {
+		return req, false
+	}
+	user, u, ok := hs.authenticate(w, req)
+	hs.auditUser(req, u)
+	if !ok || !hs.checkRateLimit(w, req, kind, u) {
+		return req, false
+	}
+	req = backend.WithTenant(backend.WithUser(req, u), hs.tenants.Lookup(u))
+	if user == nil || user.Admin {
+		return req, true
+	}
+	req = backend.WithMasks(req, hs.masks.Lookup(u))
+	return backend.WithGrants(req, u, user.Grants), true
+}
+
+// checkRateLimit checks the rate limit of the client, which is the user authenticated or the ip without auth
+func (hs *HttpService) checkRateLimit(w http.ResponseWriter, req *http.Request, kind, user string) bool {
+	client := user
+	if client == "" {
+		client = req.RemoteAddr
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			client = host
+		}
+	}
+	if !hs.ip.RateLimiter.Allow(kind, client, time.Now()) {
+		w.Header().Set("Retry-After", "1")
+		hs.WriteError(w, req, http.StatusTooManyRequests, fmt.Sprintf("%s rate limit exceeded", kind))
+		return false
+	}
+	return true
+}
+
+// authenticate returns the user authenticated and its username, the user is nil if there is no user nor oidc
+func (hs *HttpService) authenticate(w http.ResponseWriter, req *http.Request) (*backend.UserConfig, string, bool) {
+	if !hs.users.Enabled() && hs.oidc == nil {
+		return nil, "", true
+	}
+	// the identities of client certificate are mapped by https_client_users, or taken as the usernames
+	for _, id := range backend.CertIdentities(req.TLS) {
+		u := id
+		if mapped, ok := hs.certUsers[id]; ok {
+			u = mapped
+		}
+		if user, ok := hs.users.Lookup(u); ok {
+			return user, u, true
+		}
+	}
+	token, bearer := hs.parseBearer(req)
+	if bearer && hs.oidc != nil && (hs.sharedSecret == "" || !backend.IsHmacJWT(token)) {
+		user, err := hs.oidc.Authenticate(token, time.Now())
+		if err != nil {
+			hs.WriteError(w, req, http.StatusUnauthorized, err.Error())
+			return nil, "", false
+		}
+		return user, user.Username, true
+	}
+	if bearer && hs.sharedSecret != "" {
+		u, err := backend.ParseJWT(token, hs.sharedSecret, time.Now())
+		if err != nil {
+			hs.WriteError(w, req, http.StatusUnauthorized, err.Error())
+			return nil, "", false
+		}
+		if user, ok := hs.users.Lookup(u); ok {
+			return user, u, true
+		}
+		hs.WriteError(w, req, http.StatusUnauthorized, "user not found")
+		return nil, "", false
 	}
 	q := req.URL.Query()
-	if u, p := q.Get("u"), q.Get("p"); hs.compareAuth(u, p) {
-		return true
+	if u, p := q.Get("u"), q.Get("p"); u != "" || p != "" {
+		if user, ok := hs.users.Authenticate(u, p); ok {
+			return user, u, true
+		}
 	}
-	if u, p, ok := req.BasicAuth(); ok && hs.compareAuth(u, p) {
-		return true
+	if u, p, ok := req.BasicAuth(); ok {
+		if user, ok := hs.users.Authenticate(u, p); ok {
+			return user, u, true
+		}
 	}
-	if u, p, ok := hs.parseAuth(req); ok && hs.compareAuth(u, p) {
-		return true
+	if u, p, ok := hs.parseAuth(req); ok {
+		if user, ok := hs.users.Authenticate(u, p); ok {
+			return user, u, true
+		}
 	}
 	hs.WriteError(w, req, http.StatusUnauthorized, "authentication failed")
-	return false
+	return nil, "", false
+}
+
+// checkGrant checks the privilege on db is granted to the user of request
+func (hs *HttpService) checkGrant(w http.ResponseWriter, req *http.Request, db, privilege string) bool {
+	if err := backend.Authorize(req, db, privilege); err != nil {
+		hs.WriteError(w, req, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+// parseBearer returns the jwt token of the bearer authorization
+func (hs *HttpService) parseBearer(req *http.Request) (string, bool) {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):]), true
+	}
+	return "", false
 }
 
 func (hs *HttpService) parseAuth(req *http.Request) (string, string, bool) {
@@ -760,17 +1838,6 @@ func (hs *HttpService) parseAuth(req *http.Request) (string, string, bool) {
 	return "", "", false
 }
 
-func (hs *HttpService) compareAuth(u, p string) bool {
-	return hs.transAuth(u) == hs.username && hs.transAuth(p) == hs.password
-}
-
-func (hs *HttpService) transAuth(text string) string {
-	if hs.authEncrypt {
-		return util.AesEncrypt(text)
-	}
-	return text
-}
-
 func (hs *HttpService) bucket2dbrp(bucket string) (string, string, error) {
 	// test for a slash in our bucket name.
 	switch idx := strings.IndexByte(bucket, '/'); idx {
@@ -795,6 +1862,13 @@ func (hs *HttpService) bucket2dbrp(bucket string) (string, string, error) {
 	}
 }
 
+// dropForbidden counts the write rejected for the forbidden db in the write errors, once per request
+func (hs *HttpService) dropForbidden(db, rp, precision string) {
+	if db != "" && hs.ip.IsForbiddenDB(db) {
+		hs.ip.WriteErrors.Add(db, rp, precision, "", backend.ReasonForbiddenDB, nil)
+	}
+}
+
 func (hs *HttpService) queryDB(req *http.Request, form bool) (string, error) {
 	var db string
 	if form {
@@ -805,12 +1879,37 @@ func (hs *HttpService) queryDB(req *http.Request, form bool) (string, error) {
 	if db == "" {
 		return db, errors.New("database not found")
 	}
+	db = backend.GetTenant(req).DB(db)
+	if form {
+		req.Form.Set("db", db)
+	}
 	if hs.ip.IsForbiddenDB(db) {
 		return db, fmt.Errorf("database forbidden: %s", db)
 	}
 	return db, nil
 }
 
+// scopeFlux returns the body with the query scoped by the tenant, the spec is denied since it's not rewritten
+func (hs *HttpService) scopeFlux(tenant *backend.Tenant, mt string, rbody []byte, qr *backend.QueryRequest) ([]byte, error) {
+	if qr.Spec != nil {
+		return nil, &backend.TenantError{Tenant: tenant.Name, Statement: "spec"}
+	}
+	q, err := tenant.ScopeFlux(qr.Query)
+	if err != nil {
+		return nil, err
+	}
+	qr.Query = q
+	if mt == "application/vnd.flux" {
+		return []byte(q), nil
+	}
+	body := make(map[string]interface{})
+	if err = json.Unmarshal(rbody, &body); err != nil {
+		return nil, err
+	}
+	body["query"] = q
+	return json.Marshal(body)
+}
+
 func (hs *HttpService) formValues(req *http.Request, key string) []string {
 	var values []string
 	str := strings.Trim(req.FormValue(key), ", ")
@@ -836,77 +1935,219 @@ func (hs *HttpService) formTick(req *http.Request) (int64, error) {
 	return tick, nil
 }
 
+// formTimeRange returns the time range of start and end in unix seconds or RFC3339 time, start defaults to def
+func (hs *HttpService) formTimeRange(req *http.Request, def int64) (transfer.TimeRange, error) {
+	tr := transfer.TimeRange{Start: def}
+	for key, ts := range map[string]*int64{"start": &tr.Start, "end": &tr.End} {
+		str := strings.TrimSpace(req.FormValue(key))
+		if str == "" {
+			continue
+		}
+		if sec, err := strconv.ParseInt(str, 10, 64); err == nil && sec >= 0 {
+			*ts = sec
+		} else if t, err := time.Parse(time.RFC3339, str); err == nil && t.Unix() >= 0 {
+			*ts = t.Unix()
+		} else {
+			return tr, ErrInvalidRange
+		}
+	}
+	if tr.End > 0 && tr.Start >= tr.End {
+		return tr, ErrInvalidRange
+	}
+	return tr, nil
+}
+
 func (hs *HttpService) formCircleId(req *http.Request, key string) (int, error) { // nolint:golint
 	circleId, err := strconv.Atoi(req.FormValue(key)) // nolint:golint
-	if err != nil || circleId < 0 || circleId >= len(hs.ip.Circles) {
+	if err != nil || circleId < 0 || circleId >= len(hs.ip.AllCircles()) {
 		return circleId, fmt.Errorf("invalid %s", key)
 	}
 	return circleId, nil
 }
 
-func (hs *HttpService) setParam(req *http.Request) error {
+// setTransferParams returns the params of rebalance, recovery or resync parsed from the request, with verify if
+// verifiable, and sets the proxies of ha_addrs to acquire the transfer lock from
+func (hs *HttpService) setTransferParams(req *http.Request, verifiable bool) (*transfer.Params, error) {
+	params := transfer.NewParams()
+	err := hs.setParam(req, params)
+	if err != nil {
+		return nil, err
+	}
+	if verifiable {
+		err = hs.setVerify(req, params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = hs.setDryRun(req, params)
+	if err != nil {
+		return nil, err
+	}
+	err = hs.setMeasurements(req, params)
+	if err != nil {
+		return nil, err
+	}
+	err = hs.setHaAddrs(req)
+	if err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func (hs *HttpService) setParam(req *http.Request, p *transfer.Params) error {
 	var err error
-	err = hs.setWorker(req)
+	err = hs.setWorker(req, p)
 	if err != nil {
 		return err
 	}
-	err = hs.setBatch(req)
+	err = hs.setBatch(req, p)
 	if err != nil {
 		return err
 	}
-	err = hs.setLimit(req)
+	err = hs.setLimit(req, p)
 	if err != nil {
 		return err
 	}
-	err = hs.setHaAddrs(req)
+	err = hs.setConcurrency(req, p)
+	if err != nil {
+		return err
+	}
+	err = hs.setRates(req, p)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (hs *HttpService) setWorker(req *http.Request) error {
+func (hs *HttpService) setWorker(req *http.Request, p *transfer.Params) error {
 	str := strings.TrimSpace(req.FormValue("worker"))
 	if str != "" {
 		worker, err := strconv.Atoi(str)
 		if err != nil || worker <= 0 {
 			return ErrInvalidWorker
 		}
-		hs.tx.Worker = worker
+		p.Worker = worker
 	} else {
-		hs.tx.Worker = transfer.DefaultWorker
+		p.Worker = transfer.DefaultWorker
 	}
 	return nil
 }
 
-func (hs *HttpService) setBatch(req *http.Request) error {
+func (hs *HttpService) setBatch(req *http.Request, p *transfer.Params) error {
 	str := strings.TrimSpace(req.FormValue("batch"))
 	if str != "" {
 		batch, err := strconv.Atoi(str)
 		if err != nil || batch <= 0 {
 			return ErrInvalidBatch
 		}
-		hs.tx.Batch = batch
+		p.Batch = batch
 	} else {
-		hs.tx.Batch = transfer.DefaultBatch
+		p.Batch = transfer.DefaultBatch
 	}
 	return nil
 }
 
-func (hs *HttpService) setLimit(req *http.Request) error {
+func (hs *HttpService) setLimit(req *http.Request, p *transfer.Params) error {
 	str := strings.TrimSpace(req.FormValue("limit"))
 	if str != "" {
 		limit, err := strconv.Atoi(str)
 		if err != nil || limit <= 0 {
 			return ErrInvalidLimit
 		}
-		hs.tx.Limit = limit
+		p.Limit = limit
 	} else {
-		hs.tx.Limit = transfer.DefaultLimit
+		p.Limit = transfer.DefaultLimit
+	}
+	return nil
+}
+
+func (hs *HttpService) setVerify(req *http.Request, p *transfer.Params) error {
+	verify := false
+	if req.FormValue("verify") != "" {
+		var err error
+		if verify, err = hs.formBool(req, "verify"); err != nil {
+			return ErrInvalidVerify
+		}
+	}
+	p.Verify = verify
+	return nil
+}
+
+func (hs *HttpService) setDryRun(req *http.Request, p *transfer.Params) error {
+	dryRun := false
+	if req.FormValue("dry_run") != "" {
+		var err error
+		if dryRun, err = hs.formBool(req, "dry_run"); err != nil {
+			return ErrInvalidDryRun
+		}
+	}
+	p.DryRun = dryRun
+	return nil
+}
+
+func (hs *HttpService) setConfirm(req *http.Request, p *transfer.Params) error {
+	confirm := true
+	if req.FormValue("confirm") != "" {
+		var err error
+		if confirm, err = hs.formBool(req, "confirm"); err != nil {
+			return ErrInvalidConfirm
+		}
 	}
+	p.Confirm = confirm
 	return nil
 }
 
+func (hs *HttpService) setMeasurements(req *http.Request, p *transfer.Params) error {
+	mf, err := transfer.NewMeasurementFilter(hs.formValues(req, "measurements"))
+	if err != nil {
+		return ErrInvalidMeas
+	}
+	p.MeasFilter = mf
+	return nil
+}
+
+// setConcurrency sets the max concurrent queries against the source backends and writes to the destination
+// backends, in total and per backend, independently of worker, 0 means unlimited
+func (hs *HttpService) setConcurrency(req *http.Request, p *transfer.Params) error {
+	values := make([]int, 4)
+	for i, key := range []string{"read_worker", "write_worker", "backend_read_worker", "backend_write_worker"} {
+		if str := strings.TrimSpace(req.FormValue(key)); str != "" {
+			n, err := strconv.Atoi(str)
+			if err != nil || n < 0 {
+				return ErrInvalidWorkers
+			}
+			values[i] = n
+		}
+	}
+	p.ReadWorker, p.WriteWorker, p.ReadCap, p.WriteCap = values[0], values[1], values[2], values[3]
+	return nil
+}
+
+// setRates sets the speed limits of transfer, 0 means unlimited
+func (hs *HttpService) setRates(req *http.Request, p *transfer.Params) error {
+	var pointRate, queryRate int
+	var mbRate float64
+	var err error
+	if str := strings.TrimSpace(req.FormValue("point_rate")); str != "" {
+		if pointRate, err = strconv.Atoi(str); err != nil || pointRate < 0 {
+			return ErrInvalidRate
+		}
+	}
+	if str := strings.TrimSpace(req.FormValue("mb_rate")); str != "" {
+		if mbRate, err = strconv.ParseFloat(str, 64); err != nil || mbRate < 0 {
+			return ErrInvalidRate
+		}
+	}
+	if str := strings.TrimSpace(req.FormValue("query_rate")); str != "" {
+		if queryRate, err = strconv.Atoi(str); err != nil || queryRate < 0 {
+			return ErrInvalidRate
+		}
+	}
+	p.PointRate, p.MBRate, p.QueryRate = pointRate, mbRate, queryRate
+	return nil
+}
+
+// setHaAddrs sets the proxies to acquire the transfer lock from, which are kept for the later transfers
 func (hs *HttpService) setHaAddrs(req *http.Request) error {
 	haAddrs := hs.formValues(req, "ha_addrs")
 	if len(haAddrs) > 1 {
@@ -922,3 +2163,31 @@ func (hs *HttpService) setHaAddrs(req *http.Request) error {
 	}
 	return nil
 }
+
+// limitReader returns ErrBodyTooLarge once more than n bytes are read, n <= 0 means no limit
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func newLimitReader(r io.Reader, n int64) io.Reader {
+	if n <= 0 {
+		return r
+	}
+	return &limitReader{r: r, n: n}
+}
+
+func (lr *limitReader) Read(p []byte) (n int, err error) {
+	if lr.n < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	if int64(len(p)) > lr.n+1 {
+		p = p[:lr.n+1]
+	}
+	n, err = lr.r.Read(p)
+	lr.n -= int64(n)
+	if lr.n < 0 {
+		return n, ErrBodyTooLarge
+	}
+	return
+}
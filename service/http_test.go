@@ -0,0 +1,215 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+)
+
+const testConfig = `{
+    "circles": [{"name": "circle-1", "backends": [{"name": "influxdb-1", "url": "%s"}]}],
+    "data_dir": "%s",
+    "tlog_dir": "%s",
+    "audit_log": "%s",
+    "users": [
+        {"username": "admin", "password": "admin", "admin": true},
+        {"username": "alice", "password": "alice", "grants": {"db1": "read"}},
+        {"username": "bob", "password": "bob"},
+        {"username": "tom", "password": "tom", "grants": {"t1_db1": "all"}}
+    ],
+    "tenants": [{"name": "t1", "prefix": "t1_", "users": ["tom"]}],
+    "mask_rules": [{"name": "pii", "users": ["alice"], "db": "db1", "measurement": "cpu", "columns": ["host"], "action": "redact"}],
+    "quotas": [{"user": "admin", "db": "prom", "write_rate": 1, "write_burst": 1}]
+}`
+
+// newTestService returns the service of the users, tenant and mask rule of testConfig with one backend
+// answering every query by an empty result
+func newTestService(t *testing.T) (*HttpService, http.Handler, string) {
+	influxdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/query" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog := filepath.Join(dir, "audit.log")
+	cfgfile := filepath.Join(dir, "proxy.json")
+	cfg := fmt.Sprintf(testConfig, influxdb.URL, filepath.Join(dir, "data"), filepath.Join(dir, "log"), auditLog)
+	if err = ioutil.WriteFile(cfgfile, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := backend.NewFileConfig(cfgfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := NewHttpService(config)
+	mux := NewServeMux()
+	hs.Register(mux)
+	t.Cleanup(func() {
+		hs.ip.Close()
+		influxdb.Close()
+		os.RemoveAll(dir)
+	})
+	return hs, mux, auditLog
+}
+
+func TestHttpServiceGates(t *testing.T) {
+	hs, mux, _ := newTestService(t)
+	_, readToken, err := hs.tokens.Create("ci", []string{backend.ScopeTransferRead}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		user   string
+		token  string
+		want   int
+		err    string
+	}{
+		{name: "admin: admin user", method: "GET", path: "/admin/user", user: "admin", want: http.StatusOK},
+		{name: "admin: non-admin user", method: "GET", path: "/admin/user", user: "alice", want: http.StatusForbidden, err: "admin privilege required"},
+		{name: "admin: unauthenticated", method: "GET", path: "/admin/user", want: http.StatusUnauthorized, err: "authentication failed"},
+		{name: "scope: token granted", method: "GET", path: "/transfer/state", token: readToken, want: http.StatusOK},
+		{name: "scope: token not granted", method: "POST", path: "/transfer/pause", token: readToken, want: http.StatusForbidden, err: "api token scope not granted: transfer:write"},
+		{name: "scope: invalid token", method: "GET", path: "/transfer/state", token: backend.TokenPrefix + "invalid", want: http.StatusUnauthorized, err: "invalid api token"},
+		{name: "scope: non-admin user without token", method: "GET", path: "/transfer/state", user: "alice", want: http.StatusForbidden, err: "admin privilege required"},
+		{name: "grant: granted db", method: "GET", path: "/query?db=db1&q=select+value+from+mem", user: "alice", want: http.StatusOK},
+		{name: "grant: db not granted", method: "GET", path: "/query?db=db2&q=select+value+from+mem", user: "alice", want: http.StatusForbidden, err: "requires read privilege on database db2"},
+		{name: "grant: privilege not granted", method: "POST", path: "/write?db=db1", user: "alice", want: http.StatusForbidden, err: "requires write privilege on database db1"},
+		{name: "grant: no grants", method: "GET", path: "/query?db=db1&q=select+value+from+mem", user: "bob", want: http.StatusForbidden, err: "requires read privilege on database db1"},
+		{name: "tenant: db of tenant", method: "GET", path: "/query?db=db1&q=select+value+from+mem", user: "tom", want: http.StatusOK},
+		{name: "tenant: show queries across tenants", method: "GET", path: "/query?db=db1&q=show+queries", user: "tom", want: http.StatusForbidden, err: "statement show queries not allowed for tenant t1"},
+		{name: "tenant: fully qualified db scoped to tenant", method: "GET", path: "/query?db=db1&q=select+value+from+%22db2%22..%22mem%22", user: "tom", want: http.StatusForbidden, err: "requires read privilege on database t1_db2"},
+		{name: "mask: masked column selected", method: "GET", path: "/query?db=db1&q=select+host,value+from+cpu", user: "alice", want: http.StatusOK},
+		{name: "mask: where on masked column", method: "GET", path: "/query?db=db1&q=select+value+from+cpu+where+host=%27h1%27", user: "alice", want: http.StatusForbidden, err: "column host is not allowed in where"},
+		{name: "replica: granted db", method: "GET", path: "/replica?db=db1&meas=cpu", user: "alice", want: http.StatusOK},
+		{name: "replica: db not granted", method: "GET", path: "/replica?db=db2&meas=cpu", user: "alice", want: http.StatusForbidden, err: "requires read privilege on database db2"},
+		{name: "replica: db of tenant", method: "GET", path: "/replica?db=db1&meas=cpu", user: "tom", want: http.StatusOK},
+		{name: "replica: db of other tenant", method: "GET", path: "/replica?db=db2&meas=cpu", user: "tom", want: http.StatusForbidden, err: "requires read privilege on database t1_db2"},
+		{name: "mask: into from masked measurement", method: "GET", path: "/query?db=db1&q=select+host+into+leak+from+cpu", user: "alice", want: http.StatusForbidden, err: "into is not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("cpu value=1"))
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.user)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if err := w.Header().Get("X-Influxdb-Error"); w.Code != tt.want || !strings.Contains(err, tt.err) {
+				t.Errorf("got status %d error %q, want %d %q", w.Code, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestHttpServiceAudit(t *testing.T) {
+	hs, mux, auditLog := newTestService(t)
+	info, token, err := hs.tokens.Create("ci", []string{backend.ScopeTransferRead}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		user   string
+		token  string
+		status int
+		audit  string
+	}{
+		{name: "authenticated user instead of u", method: "GET", path: "/admin/user?u=admin&p=wrong", user: "alice", status: http.StatusForbidden, audit: "alice"},
+		{name: "u without password", method: "GET", path: "/admin/user?u=admin", status: http.StatusUnauthorized, audit: ""},
+		{name: "admin user", method: "GET", path: "/admin/user", user: "admin", status: http.StatusOK, audit: "admin"},
+		{name: "api token", method: "GET", path: "/transfer/state", token: token, status: http.StatusOK, audit: "token:" + info.ID},
+		{name: "ddl query", method: "POST", path: "/query?db=db1&q=drop+measurement+mem", user: "alice", status: http.StatusForbidden, audit: "alice"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.user)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d, error: %s", w.Code, tt.status, w.Header().Get("X-Influxdb-Error"))
+			}
+			data, err := ioutil.ReadFile(auditLog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			if len(lines) != i+1 {
+				t.Fatalf("got %d audit records, want %d", len(lines), i+1)
+			}
+			var record backend.AuditRecord
+			if err = json.Unmarshal([]byte(lines[i]), &record); err != nil {
+				t.Fatal(err)
+			}
+			if record.User != tt.audit {
+				t.Errorf("got audit user %q, want %q", record.User, tt.audit)
+			}
+			if record.Path != req.URL.Path || record.Status != tt.status {
+				t.Errorf("got audit path %s status %d, want %s %d", record.Path, record.Status, req.URL.Path, tt.status)
+			}
+		})
+	}
+}
+
+func TestHttpServicePromWriteQuota(t *testing.T) {
+	_, mux, _ := newTestService(t)
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	wr := &remote.WriteRequest{Timeseries: []*remote.TimeSeries{{
+		Labels:  []*remote.LabelPair{{Name: "__name__", Value: "up"}, {Name: "job", Value: "proxy"}},
+		Samples: []*remote.Sample{{Value: 1, TimestampMs: ms - 1000}, {Value: 1, TimestampMs: ms}},
+	}}}
+	data, err := proto.Marshal(wr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := snappy.Encode(nil, data)
+
+	// the batch larger than the burst is allowed once the bucket is full, and the next one exceeds the rate
+	for i, want := range []int{http.StatusNoContent, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("POST", "/api/v1/prom/write?db=prom", bytes.NewReader(body))
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("write %d: got status %d, want %d, error: %s", i, w.Code, want, w.Header().Get("X-Influxdb-Error"))
+		}
+	}
+}
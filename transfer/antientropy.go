@@ -0,0 +1,125 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+// runAntiEntropy checks the window of seconds before now every interval seconds and repairs the divergences,
+// it's skipped while a transfer or consistency check is running
+func (tx *Transfer) runAntiEntropy(interval, window int, maxPoints int64) {
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadInt32(&tx.running) > 0 || tx.Resyncing {
+			continue
+		}
+		tx.antiEntropy(window, maxPoints)
+	}
+}
+
+// antiEntropy copies the points of each divergent time bucket from every circle to the others with different
+// counts, as read repair does, the writes of the same points are idempotent. The buckets whose counts differ by
+// more than maxPoints are only reported, which require resync or recovery
+func (tx *Transfer) antiEntropy(window int, maxPoints int64) {
+	release, err := tx.Acquire("anti-entropy")
+	if err != nil {
+		tlog.Printf("anti-entropy skipped: %s", err)
+		return
+	}
+	defer release()
+	cr, tr, ok := tx.newConsistencyCheck(TimeRange{Start: time.Now().Unix() - int64(window)})
+	if !ok {
+		return
+	}
+	tx.runCheck(cr, nil, nil, tr)
+	if len(cr.Divergences) == 0 {
+		return
+	}
+
+	tx.begin()
+	defer tx.end()
+	tx.operation.Store("anti-entropy")
+	// the bucket of counts is grouped by VerifyBucket
+	bucket := int64(backend.GetGroupInterval("group by time("+VerifyBucket+")") / time.Second)
+	stats := &Stats{}
+	for _, d := range cr.Divergences {
+		if tx.isCancelled() {
+			break
+		}
+		var lo, hi int64 = -1, 0
+		for _, n := range d.Counts {
+			if lo < 0 || n < lo {
+				lo = n
+			}
+			if n > hi {
+				hi = n
+			}
+		}
+		if hi-lo > maxPoints {
+			atomic.AddInt32(&cr.RepairSkipped, 1)
+			tlog.Printf("anti-entropy skipped, too many points differ: %d, db:%s rp:%s meas:%s time:%d", hi-lo, d.Db, d.Rp, d.Meas, d.Time)
+			continue
+		}
+		str := TimeRange{Start: d.Time / int64(time.Second), End: d.Time/int64(time.Second) + bucket}
+		if str.Start < tr.Start {
+			str.Start = tr.Start
+		}
+		if str.End > tr.End {
+			str.End = tr.End
+		}
+		if tx.repairBucket(d, str, stats) {
+			atomic.AddInt32(&cr.RepairedBuckets, 1)
+		} else {
+			atomic.AddInt32(&cr.RepairFailed, 1)
+		}
+	}
+	tlog.Printf("anti-entropy done: repaired buckets: %d, failed: %d, skipped: %d, points: %d",
+		cr.RepairedBuckets, cr.RepairFailed, cr.RepairSkipped, stats.PointCount)
+}
+
+// repairBucket copies the points of the time range from an active replica of each circle having points
+// to the active replicas of the circles whose counts differ
+func (tx *Transfer) repairBucket(d *Divergence, tr TimeRange, stats *Stats) bool {
+	replicas := make(map[int][]*backend.Backend, len(d.Counts))
+	for circleId := range d.Counts { // nolint:golint
+		for _, be := range tx.CircleStates[circleId].GetReplicasByMeasurement(d.Db, d.Meas) {
+			if be.IsActive() {
+				replicas[circleId] = append(replicas[circleId], be)
+			}
+		}
+		if len(replicas[circleId]) == 0 {
+			return false
+		}
+	}
+	repaired := true
+	for circleId, n := range d.Counts { // nolint:golint
+		if n == 0 {
+			continue
+		}
+		dsts := make([]*backend.Backend, 0)
+		for otherId, m := range d.Counts { // nolint:golint
+			if otherId != circleId && m != n {
+				dsts = append(dsts, replicas[otherId]...)
+			}
+		}
+		if len(dsts) == 0 {
+			continue
+		}
+		src := replicas[circleId][0]
+		err := tx.transfer(src, dsts, d.Db, d.Rp, d.Meas, tr, stats)
+		if err != nil {
+			tlog.Printf("anti-entropy error: %s, src:%s dst:%v db:%s rp:%s meas:%s range:%s", err, src.Url, getBackendUrls(dsts), d.Db, d.Rp, d.Meas, tr)
+			repaired = false
+			continue
+		}
+		tlog.Printf("anti-entropy repaired, src:%s dst:%v db:%s rp:%s meas:%s range:%s", src.Url, getBackendUrls(dsts), d.Db, d.Rp, d.Meas, tr)
+	}
+	return repaired
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// AuditRecord is a chunk of points written from the source to a destination, start and end are the times of
+// the first and last points in nanoseconds, and the duration is in milliseconds including the retries
+type AuditRecord struct {
+	Time      string `json:"time"`
+	Operation string `json:"operation"`
+	Src       string `json:"src"`
+	Dst       string `json:"dst"`
+	Db        string `json:"db"`
+	Rp        string `json:"rp"`
+	Meas      string `json:"meas"`
+	Start     int64  `json:"start"`
+	End       int64  `json:"end"`
+	Points    int64  `json:"points"`
+	Bytes     int64  `json:"bytes"`
+	Duration  int64  `json:"duration"`
+	Attempts  int    `json:"attempts"`
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+}
+
+// auditLog writes the audit records as json lines to transfer_audit.log under tlog dir, the rotated files are kept
+type auditLog struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+// the file is created by lumberjack on the first write
+func newAuditLog(dir string) *auditLog {
+	return &auditLog{w: &lumberjack.Logger{Filename: filepath.Join(dir, "transfer_audit.log"), MaxSize: 100}}
+}
+
+func (al *auditLog) write(r *AuditRecord) {
+	r.Time = time.Now().Format(time.RFC3339Nano)
+	b, err := json.Marshal(r)
+	if err != nil {
+		tlog.Printf("marshal audit record error: %s", err)
+		return
+	}
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if _, err = al.w.Write(append(b, '\n')); err != nil {
+		tlog.Printf("write audit record error: %s", err)
+	}
+}
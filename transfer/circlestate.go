@@ -6,17 +6,133 @@ package transfer
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/chengshiwen/influx-proxy/backend"
 )
 
+// Stats is the progress of the measurements of a source backend, the measurements checked are counted as
+// transfer_count or inplace_count, and the ones required to transfer are then done, failed or running,
+// the failed time ranges are retried before counted as failed, and reported in failures
 type Stats struct {
-	DatabaseTotal    int32 `json:"database_total"`
-	DatabaseDone     int32 `json:"database_done"`
-	MeasurementTotal int32 `json:"measurement_total"`
-	MeasurementDone  int32 `json:"measurement_done"`
-	TransferCount    int32 `json:"transfer_count"`
-	InPlaceCount     int32 `json:"inplace_count"`
+	DatabaseTotal    int32       `json:"database_total"`
+	DatabaseDone     int32       `json:"database_done"`
+	MeasurementTotal int32       `json:"measurement_total"`
+	MeasurementDone  int32       `json:"measurement_done"`
+	TransferCount    int32       `json:"transfer_count"`
+	InPlaceCount     int32       `json:"inplace_count"`
+	TransferDone     int32       `json:"transfer_done"`
+	TransferFailed   int32       `json:"transfer_failed"`
+	TransferRunning  int32       `json:"transfer_running"`
+	TransferRetrying int32       `json:"transfer_retrying"`
+	TransferRetried  int32       `json:"transfer_retried"`
+	PointCount       int64       `json:"point_count"`
+	ByteCount        int64       `json:"byte_count"`
+	Rate             float64     `json:"rate"`
+	ETA              int64       `json:"eta"`
+	VerifyDone       int32       `json:"verify_done"`
+	Mismatches       []*Mismatch `json:"mismatches,omitempty"`
+	Failures         []*Failure  `json:"failures,omitempty"`
+	Conflicts        []*Conflict `json:"conflicts,omitempty"`
+	startTime        int64
+	lock             sync.Mutex
+}
+
+// Failure is a time range of measurement failed to transfer after the attempts, which can be transferred again
+// by the parameters measurements, start and end
+type Failure struct {
+	Db       string `json:"db"`
+	Rp       string `json:"rp"`
+	Meas     string `json:"meas"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+func (s *Stats) addFailure(f *Failure) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.Failures) < MaxFailures {
+		s.Failures = append(s.Failures, f)
+	}
+}
+
+func (s *Stats) start() {
+	atomic.StoreInt64(&s.startTime, time.Now().UnixNano())
+}
+
+// snapshot returns the copy of stats with the rate in points per second, and the eta in seconds estimated by
+// the measurements completed so far, the eta is -1 if nothing is completed yet
+func (s *Stats) snapshot(now time.Time) *Stats {
+	ss := &Stats{
+		DatabaseTotal:    atomic.LoadInt32(&s.DatabaseTotal),
+		DatabaseDone:     atomic.LoadInt32(&s.DatabaseDone),
+		MeasurementTotal: atomic.LoadInt32(&s.MeasurementTotal),
+		MeasurementDone:  atomic.LoadInt32(&s.MeasurementDone),
+		TransferCount:    atomic.LoadInt32(&s.TransferCount),
+		InPlaceCount:     atomic.LoadInt32(&s.InPlaceCount),
+		TransferDone:     atomic.LoadInt32(&s.TransferDone),
+		TransferFailed:   atomic.LoadInt32(&s.TransferFailed),
+		TransferRetrying: atomic.LoadInt32(&s.TransferRetrying),
+		TransferRetried:  atomic.LoadInt32(&s.TransferRetried),
+		PointCount:       atomic.LoadInt64(&s.PointCount),
+		ByteCount:        atomic.LoadInt64(&s.ByteCount),
+		VerifyDone:       atomic.LoadInt32(&s.VerifyDone),
+		startTime:        atomic.LoadInt64(&s.startTime),
+	}
+	s.lock.Lock()
+	ss.Mismatches = append(ss.Mismatches, s.Mismatches...)
+	ss.Failures = append(ss.Failures, s.Failures...)
+	ss.Conflicts = append(ss.Conflicts, s.Conflicts...)
+	s.lock.Unlock()
+	// the transfer may be completed before it's counted
+	if running := ss.TransferCount - ss.TransferDone - ss.TransferFailed; running > 0 {
+		ss.TransferRunning = running
+	}
+	ss.estimate(now)
+	return ss
+}
+
+func (s *Stats) add(o *Stats) {
+	s.DatabaseTotal += o.DatabaseTotal
+	s.DatabaseDone += o.DatabaseDone
+	s.MeasurementTotal += o.MeasurementTotal
+	s.MeasurementDone += o.MeasurementDone
+	s.TransferCount += o.TransferCount
+	s.InPlaceCount += o.InPlaceCount
+	s.TransferDone += o.TransferDone
+	s.TransferFailed += o.TransferFailed
+	s.TransferRunning += o.TransferRunning
+	s.TransferRetrying += o.TransferRetrying
+	s.TransferRetried += o.TransferRetried
+	s.PointCount += o.PointCount
+	s.ByteCount += o.ByteCount
+	s.VerifyDone += o.VerifyDone
+	s.Mismatches = append(s.Mismatches, o.Mismatches...)
+	s.Failures = append(s.Failures, o.Failures...)
+	s.Conflicts = append(s.Conflicts, o.Conflicts...)
+	if o.startTime > 0 && (s.startTime == 0 || o.startTime < s.startTime) {
+		s.startTime = o.startTime
+	}
+}
+
+func (s *Stats) estimate(now time.Time) {
+	s.ETA = -1
+	if s.startTime == 0 {
+		return
+	}
+	elapsed := now.Sub(time.Unix(0, s.startTime)).Seconds()
+	if elapsed > 0 {
+		s.Rate = float64(s.PointCount) / elapsed
+	}
+	completed := s.InPlaceCount + s.TransferDone + s.TransferFailed
+	if completed >= s.MeasurementTotal {
+		s.ETA = 0
+	} else if completed > 0 {
+		s.ETA = int64(elapsed * float64(s.MeasurementTotal-completed) / float64(completed))
+	}
 }
 
 type CircleState struct {
@@ -46,5 +162,39 @@ func (cs *CircleState) ResetStates() {
 		s.MeasurementDone = 0
 		s.TransferCount = 0
 		s.InPlaceCount = 0
+		s.TransferDone = 0
+		s.TransferFailed = 0
+		s.TransferRetrying = 0
+		s.TransferRetried = 0
+		s.PointCount = 0
+		s.ByteCount = 0
+		s.VerifyDone = 0
+		s.startTime = 0
+		s.lock.Lock()
+		s.Mismatches = nil
+		s.Failures = nil
+		s.Conflicts = nil
+		s.lock.Unlock()
+	}
+}
+
+// GetStats returns the snapshots of stats of the backends by url
+func (cs *CircleState) GetStats() map[string]*Stats {
+	now := time.Now()
+	stats := make(map[string]*Stats, len(cs.Stats))
+	for url, s := range cs.Stats {
+		stats[url] = s.snapshot(now)
+	}
+	return stats
+}
+
+// GetSummary returns the stats of the circle summed from the backends
+func (cs *CircleState) GetSummary() *Stats {
+	now := time.Now()
+	summary := &Stats{}
+	for _, s := range cs.Stats {
+		summary.add(s.snapshot(now))
 	}
+	summary.estimate(now)
+	return summary
 }
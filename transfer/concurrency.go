@@ -0,0 +1,97 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"sync"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+// semaphore limits the concurrency, a nil semaphore is unlimited
+type semaphore chan struct{}
+
+// newSemaphore returns nil if n is not positive
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+func (s semaphore) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// concurrency limits the queries against the source backends and the writes to the destination backends,
+// in total and per backend, independently of the workers of measurements
+type concurrency struct {
+	reads         semaphore
+	writes        semaphore
+	backendReads  int
+	backendWrites int
+	readsByUrl    map[string]semaphore // nolint:golint
+	writesByUrl   map[string]semaphore // nolint:golint
+	lock          sync.Mutex
+}
+
+func newConcurrency(reads, writes, backendReads, backendWrites int) *concurrency {
+	return &concurrency{
+		reads:         newSemaphore(reads),
+		writes:        newSemaphore(writes),
+		backendReads:  backendReads,
+		backendWrites: backendWrites,
+		readsByUrl:    make(map[string]semaphore),
+		writesByUrl:   make(map[string]semaphore),
+	}
+}
+
+func (c *concurrency) backend(sems map[string]semaphore, url string, n int) semaphore {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s, ok := sems[url]
+	if !ok {
+		s = newSemaphore(n)
+		sems[url] = s
+	}
+	return s
+}
+
+// read blocks until a query against be is allowed, the returned function releases it
+func (c *concurrency) read(be *backend.Backend) func() {
+	s := c.backend(c.readsByUrl, be.Url, c.backendReads)
+	c.reads.acquire()
+	s.acquire()
+	return func() {
+		s.release()
+		c.reads.release()
+	}
+}
+
+// write blocks until a write to be is allowed, the returned function releases it
+func (c *concurrency) write(be *backend.Backend) func() {
+	s := c.backend(c.writesByUrl, be.Url, c.backendWrites)
+	c.writes.acquire()
+	s.acquire()
+	return func() {
+		s.release()
+		c.writes.release()
+	}
+}
+
+// writeTo writes the lines to dst within the limits of concurrency
+func (tx *Transfer) writeTo(dst *backend.Backend, db, rp string, p []byte) error {
+	release := tx.concurrency.write(dst)
+	defer release()
+	return dst.Write(db, rp, p)
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+// MaxConflicts is the max number of field type conflicts kept in the stats of a backend
+var MaxConflicts = 100
+
+// Conflict is a field of measurement whose type differs from the existing one on the destination, the points
+// conflicted are dropped by the destination, or written again with the values cast to the existing type
+type Conflict struct {
+	Db       string `json:"db"`
+	Rp       string `json:"rp"`
+	Meas     string `json:"meas"`
+	Dst      string `json:"dst"`
+	Field    string `json:"field"`
+	Type     string `json:"type"`
+	Existing string `json:"existing"`
+	Dropped  int    `json:"dropped"`
+	Cast     bool   `json:"cast"`
+}
+
+func (s *Stats) addConflict(c *Conflict) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.Conflicts) < MaxConflicts {
+		s.Conflicts = append(s.Conflicts, c)
+	}
+}
+
+// fieldCasts are the types of fields cast by destination, learned from the conflicts of a measurement,
+// so that the later batches are cast before written
+type fieldCasts struct {
+	types map[string]map[string]string
+	lock  sync.Mutex
+}
+
+func newFieldCasts() *fieldCasts {
+	return &fieldCasts{types: make(map[string]map[string]string)}
+}
+
+// fieldMap returns the types of fields written to the destination, or fieldMap itself and false if nothing is cast
+func (fc *fieldCasts) fieldMap(dst string, fieldMap map[string]string) (map[string]string, bool) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	casts := fc.types[dst]
+	if len(casts) == 0 {
+		return fieldMap, false
+	}
+	fm := make(map[string]string, len(fieldMap))
+	for field, vtype := range fieldMap {
+		fm[field] = vtype
+	}
+	for field, vtype := range casts {
+		fm[field] = vtype
+	}
+	return fm, true
+}
+
+// add returns false if the field is already cast to the type
+func (fc *fieldCasts) add(dst, field, vtype string) bool {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if fc.types[dst] == nil {
+		fc.types[dst] = make(map[string]string)
+	}
+	if fc.types[dst][field] == vtype {
+		return false
+	}
+	fc.types[dst][field] = vtype
+	return true
+}
+
+// writeConflicted records the conflict of the write to dst, and if the policy is cast, writes the points again
+// with the values of the fields conflicted cast to the existing types, until no new conflict is reported
+func (tx *Transfer) writeConflicted(dst *backend.Backend, db, rp, meas string, columns []string, values [][]interface{}, tagMap util.Set, fieldMap map[string]string, casts *fieldCasts, conflict *backend.FieldTypeConflictError, stats *Stats) error {
+	for {
+		c := &Conflict{Db: db, Rp: rp, Meas: meas, Dst: dst.Url, Field: conflict.Field, Type: conflict.Type, Existing: conflict.Existing, Dropped: conflict.Dropped}
+		if tx.conflict != backend.ConflictCast || !casts.add(dst.Url, conflict.Field, conflict.Existing) {
+			tlog.Printf("transfer field type conflict: %s, dst:%s db:%s rp:%s meas:%s", conflict, dst.Url, db, rp, meas)
+			stats.addConflict(c)
+			return conflict
+		}
+		c.Cast = true
+		stats.addConflict(c)
+		tlog.Printf("transfer field type conflict cast: %s, dst:%s db:%s rp:%s meas:%s", conflict, dst.Url, db, rp, meas)
+		fm, _ := casts.fieldMap(dst.Url, fieldMap)
+		p := formatLines(meas, columns, values, tagMap, fm)
+		err := tx.writeTo(dst, db, rp, p)
+		var ok bool
+		if conflict, ok = err.(*backend.FieldTypeConflictError); !ok {
+			return err
+		}
+	}
+}
+
+// formatField returns the field value of line protocol cast to vtype, or false if the value can't be cast
+func formatField(v interface{}, vtype string) (string, bool) {
+	switch tv := v.(type) {
+	case bool:
+		switch vtype {
+		case "float":
+			if tv {
+				return "1", true
+			}
+			return "0", true
+		case "integer":
+			if tv {
+				return "1i", true
+			}
+			return "0i", true
+		case "string":
+			return fmt.Sprintf("\"%t\"", tv), true
+		case "boolean":
+			return strconv.FormatBool(tv), true
+		}
+	case string:
+		switch vtype {
+		case "float":
+			if f, err := strconv.ParseFloat(tv, 64); err == nil {
+				return strconv.FormatFloat(f, 'g', -1, 64), true
+			}
+		case "integer":
+			if n, err := strconv.ParseInt(tv, 10, 64); err == nil {
+				return strconv.FormatInt(n, 10) + "i", true
+			}
+			if f, err := strconv.ParseFloat(tv, 64); err == nil {
+				return strconv.FormatInt(int64(f), 10) + "i", true
+			}
+		case "string":
+			return fmt.Sprintf("\"%s\"", models.EscapeStringField(tv)), true
+		case "boolean":
+			if b, err := strconv.ParseBool(tv); err == nil {
+				return strconv.FormatBool(b), true
+			}
+		}
+	default:
+		// the numbers are decoded as json.Number
+		s := util.CastString(v)
+		switch vtype {
+		case "float":
+			return s, true
+		case "integer":
+			if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return s + "i", true
+			}
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return strconv.FormatInt(int64(f), 10) + "i", true
+			}
+		case "string":
+			return fmt.Sprintf("\"%s\"", models.EscapeStringField(s)), true
+		case "boolean":
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return strconv.FormatBool(f != 0), true
+			}
+		}
+	}
+	return "", false
+}
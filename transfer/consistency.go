@@ -0,0 +1,305 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+var (
+	// ConsistencyWorker is the number of measurements checked concurrently
+	ConsistencyWorker = 2
+	// ConsistencyDelay is the seconds before now excluded from the check, so that the points being written
+	// to the circles are not compared
+	ConsistencyDelay = 60
+	// MaxDivergences is the max number of divergences and errors kept in the report
+	MaxDivergences = 1000
+)
+
+// Divergence is a time bucket of a measurement whose point counts differ between circles, the counts
+// are by circle id and the time is the start of the bucket in nanoseconds
+type Divergence struct {
+	Db     string        `json:"db"`
+	Rp     string        `json:"rp"`
+	Meas   string        `json:"meas"`
+	Time   int64         `json:"time"`
+	Counts map[int]int64 `json:"counts"`
+}
+
+// ConsistencyReport is the divergences found by the last consistency check between circles
+type ConsistencyReport struct {
+	Running          bool          `json:"running"`
+	Start            int64         `json:"start"`
+	End              int64         `json:"end"`
+	From             int64         `json:"from"`
+	To               int64         `json:"to"`
+	Duration         float64       `json:"duration"`
+	MeasurementTotal int32         `json:"measurement_total"`
+	MeasurementDone  int32         `json:"measurement_done"`
+	DivergentMeas    int32         `json:"divergent_measurements"`
+	DivergentBuckets int32         `json:"divergent_buckets"`
+	RepairedBuckets  int32         `json:"repaired_buckets"`
+	RepairFailed     int32         `json:"repair_failed_buckets"`
+	RepairSkipped    int32         `json:"repair_skipped_buckets"`
+	Divergences      []*Divergence `json:"divergences"`
+	Errors           []string      `json:"errors"`
+	lock             sync.Mutex
+}
+
+func (cr *ConsistencyReport) addDivergence(d *Divergence) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.DivergentBuckets++
+	if len(cr.Divergences) < MaxDivergences {
+		cr.Divergences = append(cr.Divergences, d)
+	}
+}
+
+func (cr *ConsistencyReport) addError(err string) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if len(cr.Errors) < MaxDivergences {
+		cr.Errors = append(cr.Errors, err)
+	}
+}
+
+// consistency keeps the report of the running or last consistency check
+type consistency struct {
+	running int32
+	report  *ConsistencyReport
+	lock    sync.Mutex
+}
+
+// GetConsistencyReport returns a copy of the report of the running or last consistency check, or nil if never run
+func (tx *Transfer) GetConsistencyReport() *ConsistencyReport {
+	tx.consistency.lock.Lock()
+	cr := tx.consistency.report
+	tx.consistency.lock.Unlock()
+	if cr == nil {
+		return nil
+	}
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	return &ConsistencyReport{
+		Running:          cr.Running,
+		Start:            cr.Start,
+		End:              cr.End,
+		From:             cr.From,
+		To:               cr.To,
+		Duration:         cr.Duration,
+		MeasurementTotal: atomic.LoadInt32(&cr.MeasurementTotal),
+		MeasurementDone:  atomic.LoadInt32(&cr.MeasurementDone),
+		DivergentMeas:    atomic.LoadInt32(&cr.DivergentMeas),
+		DivergentBuckets: cr.DivergentBuckets,
+		RepairedBuckets:  atomic.LoadInt32(&cr.RepairedBuckets),
+		RepairFailed:     atomic.LoadInt32(&cr.RepairFailed),
+		RepairSkipped:    atomic.LoadInt32(&cr.RepairSkipped),
+		Divergences:      append([]*Divergence{}, cr.Divergences...),
+		Errors:           append([]string{}, cr.Errors...),
+	}
+}
+
+// StartConsistencyCheck compares the point counts per time bucket of the measurements between the circles in
+// background, the end 0 means ConsistencyDelay seconds before now. It returns false if a check is running
+func (tx *Transfer) StartConsistencyCheck(dbs []string, mf *MeasurementFilter, tr TimeRange) bool {
+	cr, tr, ok := tx.newConsistencyCheck(tr)
+	if !ok {
+		return false
+	}
+	go tx.runCheck(cr, dbs, mf, tr)
+	return true
+}
+
+// newConsistencyCheck returns the report of a new check and its time range, or false if a check is running
+func (tx *Transfer) newConsistencyCheck(tr TimeRange) (*ConsistencyReport, TimeRange, bool) {
+	if !atomic.CompareAndSwapInt32(&tx.consistency.running, 0, 1) {
+		return nil, tr, false
+	}
+	now := time.Now().Unix()
+	if tr.End <= 0 {
+		tr.End = now - int64(ConsistencyDelay)
+	}
+	cr := &ConsistencyReport{Running: true, Start: now, From: tr.Start, To: tr.End}
+	tx.consistency.lock.Lock()
+	tx.consistency.report = cr
+	tx.consistency.lock.Unlock()
+	return cr, tr, true
+}
+
+// runCheck runs the check of the report and completes it, the divergences are sorted
+func (tx *Transfer) runCheck(cr *ConsistencyReport, dbs []string, mf *MeasurementFilter, tr TimeRange) {
+	defer atomic.StoreInt32(&tx.consistency.running, 0)
+	tx.checkConsistency(cr, dbs, mf, tr)
+	end := time.Now()
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	sort.Slice(cr.Divergences, func(i, j int) bool {
+		di, dj := cr.Divergences[i], cr.Divergences[j]
+		if di.Db != dj.Db {
+			return di.Db < dj.Db
+		}
+		if di.Meas != dj.Meas {
+			return di.Meas < dj.Meas
+		}
+		if di.Rp != dj.Rp {
+			return di.Rp < dj.Rp
+		}
+		return di.Time < dj.Time
+	})
+	cr.Running = false
+	cr.End = end.Unix()
+	cr.Duration = end.Sub(time.Unix(cr.Start, 0)).Seconds()
+	tlog.Printf("consistency check done: measurements: %d, divergent measurements: %d, divergent buckets: %d",
+		cr.MeasurementTotal, cr.DivergentMeas, cr.DivergentBuckets)
+}
+
+// runConsistencyCheck checks the window of seconds before now every interval seconds, the check is skipped
+// while a transfer is running since the circles diverge until it's done
+func (tx *Transfer) runConsistencyCheck(interval, window int) {
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadInt32(&tx.running) > 0 || tx.Resyncing {
+			continue
+		}
+		tx.StartConsistencyCheck(nil, nil, TimeRange{Start: time.Now().Unix() - int64(window)})
+	}
+}
+
+func (tx *Transfer) checkConsistency(cr *ConsistencyReport, dbs []string, mf *MeasurementFilter, tr TimeRange) {
+	if len(dbs) == 0 {
+		dbs = tx.getDatabases()
+	}
+	type task struct {
+		db   string
+		meas string
+	}
+	var tasks []task
+	for _, db := range dbs {
+		measures := util.NewSet()
+		for _, cs := range tx.CircleStates {
+			for _, be := range cs.Backends {
+				if be.IsActive() {
+					for _, meas := range mf.filter(be.GetMeasurements(db)) {
+						measures.Add(meas)
+					}
+				}
+			}
+		}
+		names := make([]string, 0, len(measures))
+		for meas := range measures {
+			names = append(names, meas)
+		}
+		sort.Strings(names)
+		for _, meas := range names {
+			tasks = append(tasks, task{db, meas})
+		}
+	}
+	atomic.StoreInt32(&cr.MeasurementTotal, int32(len(tasks)))
+	tlog.Printf("consistency check start: measurements: %d, time range: %s", len(tasks), tr)
+
+	ch := make(chan task)
+	var wg sync.WaitGroup
+	for i := 0; i < ConsistencyWorker; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range ch {
+				tx.checkMeasurement(cr, t.db, t.meas, tr)
+				atomic.AddInt32(&cr.MeasurementDone, 1)
+			}
+		}()
+	}
+	for _, t := range tasks {
+		ch <- t
+	}
+	close(ch)
+	wg.Wait()
+}
+
+// checkMeasurement compares the point counts of the measurement on an active replica of each circle owning db,
+// the measurements spread by tags are skipped
+func (tx *Transfer) checkMeasurement(cr *ConsistencyReport, db, meas string, tr TimeRange) {
+	owners := make(map[int]*backend.Backend)
+	rps := util.NewSet()
+	for _, cs := range tx.CircleStates {
+		if !tx.dbCircles.Contains(db, cs.CircleId) {
+			continue
+		}
+		replicas := cs.GetReplicasByMeasurement(db, meas)
+		if replicas == nil {
+			return
+		}
+		for _, be := range replicas {
+			if be.IsActive() {
+				owners[cs.CircleId] = be
+				for _, rp := range be.GetRetentionPolicies(db) {
+					rps.Add(rp)
+				}
+				break
+			}
+		}
+		if owners[cs.CircleId] == nil {
+			cr.addError(fmt.Sprintf("circle %d: no active replica of db:%s meas:%s", cs.CircleId, db, meas))
+		}
+	}
+	if len(owners) < 2 {
+		return
+	}
+	divergent := false
+	for rp := range rps {
+		if tx.compareCircles(cr, owners, db, rp, meas, tr) {
+			divergent = true
+		}
+	}
+	if divergent {
+		atomic.AddInt32(&cr.DivergentMeas, 1)
+		tlog.Printf("consistency divergent: db:%s meas:%s", db, meas)
+	}
+}
+
+// compareCircles adds the time buckets whose point counts differ between the owners of circles to the report,
+// and returns whether any bucket differs
+func (tx *Transfer) compareCircles(cr *ConsistencyReport, owners map[int]*backend.Backend, db, rp, meas string, tr TimeRange) bool {
+	counts := make(map[int]map[int64]int64, len(owners))
+	buckets := make(map[int64]bool)
+	for circleId, be := range owners { // nolint:golint
+		c, err := countPoints(be, db, rp, meas, tr, nil)
+		if err != nil {
+			tlog.Printf("consistency count error: %s, backend:%s db:%s rp:%s meas:%s", err, be.Url, db, rp, meas)
+			cr.addError(fmt.Sprintf("backend:%s db:%s rp:%s meas:%s: %s", be.Url, db, rp, meas, err))
+			return false
+		}
+		counts[circleId] = c
+		for bucket := range c {
+			buckets[bucket] = true
+		}
+	}
+	divergent := false
+	for bucket := range buckets {
+		d := &Divergence{Db: db, Rp: rp, Meas: meas, Time: bucket, Counts: make(map[int]int64, len(counts))}
+		equal := true
+		for circleId, c := range counts { // nolint:golint
+			d.Counts[circleId] = c[bucket]
+			for _, o := range counts {
+				if o[bucket] != c[bucket] {
+					equal = false
+				}
+			}
+		}
+		if !equal {
+			divergent = true
+			cr.addDivergence(d)
+		}
+	}
+	return divergent
+}
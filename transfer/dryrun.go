@@ -0,0 +1,81 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+// PlannedTransfer is a measurement which would be transferred from the source to the destinations
+type PlannedTransfer struct {
+	Db     string   `json:"db"`
+	Meas   string   `json:"meas"`
+	Rps    []string `json:"rps"`
+	Src    string   `json:"src"`
+	Dsts   []string `json:"dsts"`
+	Series int64    `json:"series"`
+	Bytes  int64    `json:"bytes"`
+}
+
+// DryRunResult is the transfers enumerated by dry run, the series and bytes are estimated on the sources
+type DryRunResult struct {
+	Transfers []*PlannedTransfer `json:"transfers"`
+	Series    int64              `json:"series"`
+	Bytes     int64              `json:"bytes"`
+	stats     *backend.PlanStats
+	lock      sync.Mutex
+}
+
+// NewDryRun returns a private transfer to run the dry run of the params, which shares only the circles and
+// settings with tx, so that the dry run leaves the stats, params and pool of the running transfer untouched
+func (tx *Transfer) NewDryRun(p *Params) *Transfer {
+	dr := &Transfer{
+		Params:       *p,
+		tlogDir:      tx.tlogDir,
+		CircleStates: make([]*CircleState, len(tx.CircleStates)),
+		dbCircles:    tx.dbCircles,
+		pauseCond:    sync.NewCond(&sync.Mutex{}),
+		conflict:     tx.conflict,
+	}
+	dr.DryRun = true
+	for idx, cs := range tx.CircleStates {
+		dr.CircleStates[idx] = &CircleState{Circle: cs.Circle, Stats: make(map[string]*Stats)}
+		for _, be := range cs.Backends {
+			dr.CircleStates[idx].Stats[be.Url] = &Stats{}
+		}
+	}
+	return dr
+}
+
+func newDryRunResult() *DryRunResult {
+	return &DryRunResult{Transfers: make([]*PlannedTransfer, 0), stats: backend.NewPlanStats()}
+}
+
+func (dr *DryRunResult) add(src *backend.Backend, dsts []*backend.Backend, db, meas string, rps []string) {
+	pt := &PlannedTransfer{Db: db, Meas: meas, Rps: rps, Src: src.Url, Dsts: getBackendUrls(dsts)}
+	pt.Series, pt.Bytes = dr.stats.Estimate(src, db, meas)
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+	dr.Transfers = append(dr.Transfers, pt)
+	dr.Series += pt.Series
+	dr.Bytes += pt.Bytes
+}
+
+// sort orders the transfers by database, measurement and source once the dry run is done
+func (dr *DryRunResult) sort() {
+	sort.Slice(dr.Transfers, func(i, j int) bool {
+		a, b := dr.Transfers[i], dr.Transfers[j]
+		if a.Db != b.Db {
+			return a.Db < b.Db
+		}
+		if a.Meas != b.Meas {
+			return a.Meas < b.Meas
+		}
+		return a.Src < b.Src
+	})
+}
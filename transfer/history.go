@@ -0,0 +1,167 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HistorySaveInterval is the interval in seconds of saving the stats while the transfer is running
+var HistorySaveInterval = 10
+
+// Totals accumulates the runs of an operation
+type Totals struct {
+	Runs         int64   `json:"runs"`
+	Cancelled    int64   `json:"cancelled"`
+	Done         int64   `json:"transfer_done"`
+	Failed       int64   `json:"transfer_failed"`
+	PointCount   int64   `json:"point_count"`
+	ByteCount    int64   `json:"byte_count"`
+	Duration     float64 `json:"duration"`
+	LastDuration float64 `json:"last_duration"`
+	LastEnd      int64   `json:"last_end"`
+}
+
+// history saves the stats of circles and the totals of operations to file under data dir,
+// so that they survive the restarts of proxy
+type history struct {
+	path   string
+	Stats  map[int]map[string]*Stats `json:"stats"`
+	Totals map[string]*Totals        `json:"totals"`
+	lock   sync.Mutex
+}
+
+func loadHistory(path string) *history {
+	h := &history{path: path, Stats: make(map[int]map[string]*Stats), Totals: make(map[string]*Totals)}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			tlog.Printf("read transfer history error: %s", err)
+		}
+		return h
+	}
+	if err = json.Unmarshal(b, h); err != nil {
+		tlog.Printf("load transfer history error: %s", err)
+	}
+	if h.Stats == nil {
+		h.Stats = make(map[int]map[string]*Stats)
+	}
+	if h.Totals == nil {
+		h.Totals = make(map[string]*Totals)
+	}
+	return h
+}
+
+// restore sets the stats of circles saved before restart
+func (h *history) restore(css []*CircleState) {
+	for _, cs := range css {
+		for url, saved := range h.Stats[cs.CircleId] {
+			if s, ok := cs.Stats[url]; ok {
+				s.add(saved)
+				// nothing is retried after restart
+				s.TransferRetrying = 0
+			}
+		}
+	}
+}
+
+func (h *history) save(css []*CircleState) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, cs := range css {
+		h.Stats[cs.CircleId] = cs.GetStats()
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		tlog.Printf("marshal transfer history error: %s", err)
+		return
+	}
+	if err = ioutil.WriteFile(h.path, b, 0644); err != nil {
+		tlog.Printf("write transfer history error: %s", err)
+	}
+}
+
+// GetTotals returns the copies of totals by operation
+func (h *history) GetTotals() map[string]*Totals {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	totals := make(map[string]*Totals, len(h.Totals))
+	for op, t := range h.Totals {
+		tt := *t
+		totals[op] = &tt
+	}
+	return totals
+}
+
+// track saves the stats of circles periodically while the operation is running, the returned function
+// adds the run to the totals, saves them and notifies the webhook once the operation is done
+func (tx *Transfer) track(operation string, css ...*CircleState) func() {
+	if tx.DryRun {
+		return func() {}
+	}
+	tx.operation.Store(operation)
+	begin := time.Now()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(HistorySaveInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				tx.history.save(tx.CircleStates)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		end := time.Now()
+		cancelled := tx.isCancelled()
+		tx.history.lock.Lock()
+		t, ok := tx.history.Totals[operation]
+		if !ok {
+			t = &Totals{}
+			tx.history.Totals[operation] = t
+		}
+		t.Runs++
+		if cancelled {
+			t.Cancelled++
+		}
+		for _, cs := range css {
+			s := cs.GetSummary()
+			t.Done += int64(s.TransferDone)
+			t.Failed += int64(s.TransferFailed)
+			t.PointCount += s.PointCount
+			t.ByteCount += s.ByteCount
+		}
+		t.LastDuration = end.Sub(begin).Seconds()
+		t.Duration += t.LastDuration
+		t.LastEnd = end.Unix()
+		tx.history.lock.Unlock()
+		tx.history.save(tx.CircleStates)
+		tx.notify(newNotification(operation, begin, end, cancelled, css))
+	}
+}
+
+// getOperation returns the operation running lastly
+func (tx *Transfer) getOperation() string {
+	operation, _ := tx.operation.Load().(string)
+	return operation
+}
+
+func sortedOperations(totals map[string]*Totals) []string {
+	ops := make([]string, 0, len(totals))
+	for op := range totals {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	return ops
+}
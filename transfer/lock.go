@@ -0,0 +1,213 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+// LockTTL is the seconds the transfer lock is held by a proxy which stops refreshing it, e.g. crashed
+var LockTTL = 60
+
+// LockHolder is the proxy running a transfer operation
+type LockHolder struct {
+	Owner     string `json:"owner"`
+	Operation string `json:"operation"`
+	Since     int64  `json:"since"`
+	expire    time.Time
+}
+
+// LockedError is returned if the transfer lock is held by another proxy
+type LockedError struct {
+	Holder *LockHolder
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder == nil {
+		return "transfer is running on another proxy"
+	}
+	return fmt.Sprintf("transfer %s is running on %s since %d", e.Holder.Operation, e.Holder.Owner, e.Holder.Since)
+}
+
+// transferLock is the local state of the transfer lock granted to the owner
+type transferLock struct {
+	holder *LockHolder
+	lock   sync.Mutex
+}
+
+// TryLock grants the lock to the owner, or refreshes it if already granted,
+// it fails with the holder if the lock is held by another owner and not expired
+func (tx *Transfer) TryLock(owner, operation string) (*LockHolder, bool) {
+	tl := &tx.transferLock
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	now := time.Now()
+	if tl.holder != nil && tl.holder.Owner != owner && now.Before(tl.holder.expire) {
+		h := *tl.holder
+		return &h, false
+	}
+	if tl.holder == nil || tl.holder.Owner != owner {
+		tl.holder = &LockHolder{Owner: owner, Operation: operation, Since: now.Unix()}
+	}
+	tl.holder.expire = now.Add(time.Duration(LockTTL) * time.Second)
+	h := *tl.holder
+	return &h, true
+}
+
+// Unlock releases the lock if it's granted to the owner
+func (tx *Transfer) Unlock(owner string) {
+	tl := &tx.transferLock
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	if tl.holder != nil && tl.holder.Owner == owner {
+		tl.holder = nil
+	}
+}
+
+// GetLockHolder returns the holder of the lock, or nil if not held
+func (tx *Transfer) GetLockHolder() *LockHolder {
+	tl := &tx.transferLock
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	if tl.holder == nil || time.Now().After(tl.holder.expire) {
+		return nil
+	}
+	h := *tl.holder
+	return &h
+}
+
+// Acquire acquires the transfer lock shared by the proxies for the operation, by etcd if configured, otherwise from
+// all the proxies of ha_addrs, so that only one proxy runs the transfer at a time. The lock is refreshed in
+// background until the returned release is called. The proxies of ha_addrs unreachable are skipped, and no lock
+// is required without etcd and ha_addrs
+func (tx *Transfer) Acquire(operation string) (release func(), err error) {
+	if tx.Etcd == nil && len(tx.HaAddrs) == 0 {
+		return func() {}, nil
+	}
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano())
+	var refresh, unlock func()
+	if tx.Etcd != nil {
+		refresh, unlock, err = tx.acquireEtcd(owner, operation)
+	} else {
+		refresh, unlock, err = tx.acquirePeers(owner, operation)
+	}
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(LockTTL) * time.Second / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				refresh()
+			}
+		}
+	}()
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			close(done)
+			unlock()
+		})
+	}
+	return release, nil
+}
+
+func (tx *Transfer) acquireEtcd(owner, operation string) (refresh, unlock func(), err error) {
+	value, _ := json.Marshal(&LockHolder{Owner: owner, Operation: operation, Since: time.Now().Unix()})
+	lease, held, err := tx.Etcd.Lock(backend.EtcdTransferLock, value, LockTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if lease == "" {
+		var holder *LockHolder
+		if len(held) > 0 {
+			holder = &LockHolder{}
+			json.Unmarshal(held, holder)
+		}
+		return nil, nil, &LockedError{Holder: holder}
+	}
+	refresh = func() {
+		if err := tx.Etcd.KeepAlive(lease); err != nil {
+			tlog.Printf("keep alive transfer lock error: %s", err)
+		}
+	}
+	unlock = func() {
+		if err := tx.Etcd.Unlock(lease); err != nil {
+			tlog.Printf("unlock transfer lock error: %s", err)
+		}
+	}
+	return
+}
+
+func (tx *Transfer) acquirePeers(owner, operation string) (refresh, unlock func(), err error) {
+	if holder, ok := tx.TryLock(owner, operation); !ok {
+		return nil, nil, &LockedError{Holder: holder}
+	}
+	addrs := append([]string{}, tx.HaAddrs...)
+	client := backend.NewClient(tx.httpsEnabled, 10)
+	query := "owner=" + url.QueryEscape(owner) + "&operation=" + url.QueryEscape(operation)
+	unlock = func() {
+		tx.Unlock(owner)
+		for _, addr := range addrs {
+			if rsp, err := tx.requestPeer(client, "DELETE", addr, query); err == nil {
+				rsp.Body.Close()
+			}
+		}
+	}
+	refresh = func() {
+		tx.TryLock(owner, operation)
+		for _, addr := range addrs {
+			if rsp, err := tx.requestPeer(client, "POST", addr, query); err == nil {
+				rsp.Body.Close()
+			}
+		}
+	}
+	for _, addr := range addrs {
+		rsp, err := tx.requestPeer(client, "POST", addr, query)
+		if err != nil {
+			tlog.Printf("lock transfer on %s error: %s", addr, err)
+			continue
+		}
+		if rsp.StatusCode == http.StatusConflict {
+			holder := &LockHolder{}
+			json.NewDecoder(rsp.Body).Decode(holder)
+			rsp.Body.Close()
+			unlock()
+			return nil, nil, &LockedError{Holder: holder}
+		}
+		rsp.Body.Close()
+	}
+	return
+}
+
+func (tx *Transfer) requestPeer(client *http.Client, method, addr, query string) (*http.Response, error) {
+	u := fmt.Sprintf("http://%s/transfer/lock?%s", addr, query)
+	if tx.httpsEnabled {
+		u = strings.Replace(u, "http", "https", 1)
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if tx.username != "" || tx.password != "" {
+		backend.SetBasicAuth(req, tx.username, tx.password, tx.authEncrypt)
+	}
+	return client.Do(req)
+}
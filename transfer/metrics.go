@@ -0,0 +1,82 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+// WriteMetrics writes the totals of operations and the stats of backends in the prometheus text format
+func (tx *Transfer) WriteMetrics(w io.Writer) {
+	mw := &util.MetricWriter{W: w}
+	totals := tx.history.GetTotals()
+	ops := sortedOperations(totals)
+	counters := []struct {
+		name  string
+		help  string
+		value func(t *Totals) float64
+	}{
+		{"influx_proxy_transfer_runs_total", "Number of transfer operations run.", func(t *Totals) float64 { return float64(t.Runs) }},
+		{"influx_proxy_transfer_cancelled_total", "Number of transfer operations cancelled.", func(t *Totals) float64 { return float64(t.Cancelled) }},
+		{"influx_proxy_transfer_done_total", "Number of measurements transferred.", func(t *Totals) float64 { return float64(t.Done) }},
+		{"influx_proxy_transfer_failed_total", "Number of measurements failed to transfer.", func(t *Totals) float64 { return float64(t.Failed) }},
+		{"influx_proxy_transfer_points_total", "Number of points transferred.", func(t *Totals) float64 { return float64(t.PointCount) }},
+		{"influx_proxy_transfer_bytes_total", "Number of bytes of lines transferred.", func(t *Totals) float64 { return float64(t.ByteCount) }},
+		{"influx_proxy_transfer_duration_seconds_total", "Duration of transfer operations in seconds.", func(t *Totals) float64 { return t.Duration }},
+	}
+	for _, c := range counters {
+		mw.Header(c.name, "counter", c.help)
+		for _, op := range ops {
+			mw.Sample(c.name, c.value(totals[op]), "operation", op)
+		}
+	}
+	mw.Header("influx_proxy_transfer_last_duration_seconds", "gauge", "Duration of the last transfer operation in seconds.")
+	for _, op := range ops {
+		mw.Sample("influx_proxy_transfer_last_duration_seconds", totals[op].LastDuration, "operation", op)
+	}
+	mw.Header("influx_proxy_transfer_last_end_timestamp_seconds", "gauge", "Unix time of the end of the last transfer operation.")
+	for _, op := range ops {
+		mw.Sample("influx_proxy_transfer_last_end_timestamp_seconds", float64(totals[op].LastEnd), "operation", op)
+	}
+
+	type backendStats struct {
+		circleId string
+		url      string
+		stats    *Stats
+	}
+	var bss []backendStats
+	for _, cs := range tx.CircleStates {
+		for url, s := range cs.GetStats() {
+			bss = append(bss, backendStats{strconv.Itoa(cs.CircleId), url, s})
+		}
+	}
+	sort.Slice(bss, func(i, j int) bool {
+		if bss[i].circleId != bss[j].circleId {
+			return bss[i].circleId < bss[j].circleId
+		}
+		return bss[i].url < bss[j].url
+	})
+	name := "influx_proxy_transfer_backend_measurements"
+	mw.Header(name, "gauge", "Number of measurements of the last transfer operation by source backend and status.")
+	for _, bs := range bss {
+		mw.Sample(name, float64(bs.stats.TransferDone), "circle_id", bs.circleId, "backend", bs.url, "status", "done")
+		mw.Sample(name, float64(bs.stats.TransferFailed), "circle_id", bs.circleId, "backend", bs.url, "status", "failed")
+		mw.Sample(name, float64(bs.stats.TransferRunning), "circle_id", bs.circleId, "backend", bs.url, "status", "running")
+	}
+	name = "influx_proxy_transfer_backend_retries"
+	mw.Header(name, "gauge", "Number of retries of failed time ranges of the last transfer operation by source backend.")
+	for _, bs := range bss {
+		mw.Sample(name, float64(bs.stats.TransferRetried), "circle_id", bs.circleId, "backend", bs.url)
+	}
+	name = "influx_proxy_transfer_backend_points"
+	mw.Header(name, "gauge", "Number of points transferred by the last transfer operation by source backend.")
+	for _, bs := range bss {
+		mw.Sample(name, float64(bs.stats.PointCount), "circle_id", bs.circleId, "backend", bs.url)
+	}
+}
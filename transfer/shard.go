@@ -0,0 +1,97 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+// shardRanges caches the time ranges of shards per backend, database and retention policy queried by show shards
+type shardRanges struct {
+	ranges map[*backend.Backend]map[string]map[string][]TimeRange
+	lock   sync.Mutex
+}
+
+func newShardRanges() *shardRanges {
+	return &shardRanges{ranges: make(map[*backend.Backend]map[string]map[string][]TimeRange)}
+}
+
+// split returns the time ranges of shards of the source intersected with tr, so that each shard is transferred
+// by its own task, or tr itself if the shards are unknown
+func (sr *shardRanges) split(src *backend.Backend, db, rp string, tr TimeRange) []TimeRange {
+	sr.lock.Lock()
+	if sr.ranges[src] == nil {
+		sr.ranges[src] = getShardRanges(src)
+	}
+	shards := sr.ranges[src][db][rp]
+	sr.lock.Unlock()
+	if len(shards) == 0 {
+		return []TimeRange{tr}
+	}
+	trs := make([]TimeRange, 0, len(shards))
+	for _, shard := range shards {
+		// the time range of 0 is unbounded, the shards before 1970 are scanned at once
+		if shard.End <= 0 {
+			return []TimeRange{tr}
+		}
+		if tr.Start > shard.Start {
+			shard.Start = tr.Start
+		}
+		if tr.End > 0 && tr.End < shard.End {
+			shard.End = tr.End
+		}
+		if shard.Start < shard.End {
+			trs = append(trs, shard)
+		}
+	}
+	return trs
+}
+
+// getShardRanges returns the time ranges of shards by database and retention policy
+func getShardRanges(be *backend.Backend) map[string]map[string][]TimeRange {
+	ranges := make(map[string]map[string][]TimeRange)
+	body, err := be.QueryIQL("GET", "", "show shards", "")
+	if err != nil {
+		tlog.Printf("show shards error: %s, backend:%s", err, be.Url)
+		return ranges
+	}
+	series, _ := backend.SeriesFromResponseBytes(body)
+	for _, s := range series {
+		index := make(map[string]int)
+		for i, column := range s.Columns {
+			index[column] = i
+		}
+		idb, irp, istart, iend := index["database"], index["retention_policy"], index["start_time"], index["end_time"]
+		for _, value := range s.Values {
+			if len(value) != len(s.Columns) {
+				continue
+			}
+			db, _ := value[idb].(string)
+			rp, _ := value[irp].(string)
+			start, err1 := parseShardTime(value[istart])
+			end, err2 := parseShardTime(value[iend])
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			if ranges[db] == nil {
+				ranges[db] = make(map[string][]TimeRange)
+			}
+			ranges[db][rp] = append(ranges[db][rp], TimeRange{Start: start, End: end})
+		}
+	}
+	return ranges
+}
+
+func parseShardTime(v interface{}) (int64, error) {
+	s, _ := v.(string)
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
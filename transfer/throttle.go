@@ -0,0 +1,41 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttle spaces the amounts taken by the workers evenly to the rate per second, a nil throttle is unlimited
+type Throttle struct {
+	rate float64
+	next time.Time
+	lock sync.Mutex
+}
+
+// NewThrottle returns nil if rate is not positive
+func NewThrottle(rate float64) *Throttle {
+	if rate <= 0 {
+		return nil
+	}
+	return &Throttle{rate: rate}
+}
+
+// Wait blocks until the amount n is allowed, the amount larger than the rate is allowed at once and delays the next
+func (t *Throttle) Wait(n int64) {
+	if t == nil || n <= 0 {
+		return
+	}
+	t.lock.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(float64(n) / t.rate * float64(time.Second)))
+	t.lock.Unlock()
+	time.Sleep(wait)
+}
@@ -6,11 +6,14 @@ package transfer
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -27,60 +30,317 @@ var (
 	FieldTypes    = []string{"float", "integer", "string", "boolean"}
 	RetryCount    = 10
 	RetryInterval = 15
+	TaskAttempts  = 3
+	MaxFailures   = 100
 	DefaultWorker = 1
 	DefaultBatch  = 25000
 	DefaultLimit  = 1000000
 	tlog          = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
 )
 
+var ErrTransferCancelled = errors.New("transfer cancelled")
+
+// TimeRange is the time window of points transferred in unix seconds, start is inclusive and end is exclusive,
+// 0 means unbounded
+type TimeRange struct {
+	Start int64
+	End   int64
+}
+
+func (tr TimeRange) String() string {
+	return fmt.Sprintf("%d-%d", tr.Start, tr.End)
+}
+
+// where returns the where clause of the time window, or empty if unbounded
+func (tr TimeRange) where() string {
+	var conds []string
+	if tr.Start > 0 {
+		conds = append(conds, fmt.Sprintf("time >= %ds", tr.Start))
+	}
+	if tr.End > 0 {
+		conds = append(conds, fmt.Sprintf("time < %ds", tr.End))
+	}
+	if len(conds) == 0 {
+		return ""
+	}
+	return "where " + strings.Join(conds, " and ")
+}
+
+// MeasurementFilter matches the measurements by exact names or /regexp/, the nil filter matches any measurement
+type MeasurementFilter struct {
+	names util.Set
+	res   []*regexp.Regexp
+}
+
+// NewMeasurementFilter returns nil if patterns is empty
+func NewMeasurementFilter(patterns []string) (*MeasurementFilter, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	mf := &MeasurementFilter{names: util.NewSet()}
+	for _, pattern := range patterns {
+		if backend.IsRegexMeasurement(pattern) {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, err
+			}
+			mf.res = append(mf.res, re)
+		} else {
+			mf.names.Add(pattern)
+		}
+	}
+	return mf, nil
+}
+
+func (mf *MeasurementFilter) Match(meas string) bool {
+	if mf == nil || mf.names[meas] {
+		return true
+	}
+	for _, re := range mf.res {
+		if re.MatchString(meas) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the measurements matched
+func (mf *MeasurementFilter) filter(measures []string) []string {
+	if mf == nil {
+		return measures
+	}
+	matched := make([]string, 0)
+	for _, meas := range measures {
+		if mf.Match(meas) {
+			matched = append(matched, meas)
+		}
+	}
+	return matched
+}
+
 type QueryResult struct {
 	Series models.Rows
 	Err    error
 }
 
+// Params are the parameters of a transfer job, which are parsed from the request before the job is started
+type Params struct {
+	Worker      int
+	ReadWorker  int
+	WriteWorker int
+	ReadCap     int
+	WriteCap    int
+	Batch       int
+	Limit       int
+	PointRate   int
+	MBRate      float64
+	QueryRate   int
+	Verify      bool
+	DryRun      bool
+	Confirm     bool
+	MeasFilter  *MeasurementFilter
+}
+
+// NewParams returns the default params
+func NewParams() *Params {
+	return &Params{
+		Worker:  DefaultWorker,
+		Batch:   DefaultBatch,
+		Limit:   DefaultLimit,
+		Confirm: true,
+	}
+}
+
 type Transfer struct {
 	username     string
 	password     string
 	authEncrypt  bool
 	httpsEnabled bool
 
+	Params
 	pool         *ants.Pool
 	tlogDir      string
 	CircleStates []*CircleState
-	Worker       int
-	Batch        int
-	Limit        int
 	Resyncing    bool
 	HaAddrs      []string
+	Etcd         *backend.Etcd
+	dbCircles    backend.DBCircles
+	paused       bool
+	pauseCond    *sync.Cond
+	running      int32
+	cancelled    int32
+	throttles    *throttles
+	concurrency  *concurrency
+	dryRunResult *DryRunResult
+	shardRanges  *shardRanges
+	history      *history
+	webhook      string
+	conflict     string
+	transferLock transferLock
+	audit        *auditLog
+	consistency  consistency
+	operation    atomic.Value
+}
+
+// throttles limit the points and bytes written and the queries against the source backends
+type throttles struct {
+	points  *Throttle
+	bytes   *Throttle
+	queries *Throttle
 }
 
 func NewTransfer(cfg *backend.ProxyConfig, circles []*backend.Circle) (tx *Transfer) {
 	tx = &Transfer{
 		tlogDir:      cfg.TLogDir,
+		Params:       *NewParams(),
 		CircleStates: make([]*CircleState, len(cfg.Circles)),
-		Worker:       DefaultWorker,
-		Batch:        DefaultBatch,
-		Limit:        DefaultLimit,
+		dbCircles:    backend.NewDBCircles(cfg),
+		pauseCond:    sync.NewCond(&sync.Mutex{}),
+		history:      loadHistory(filepath.Join(cfg.DataDir, "transfer.json")),
+		webhook:      cfg.TransferWebhook,
+		conflict:     cfg.ConflictPolicy,
+		audit:        newAuditLog(cfg.TLogDir),
 	}
 	for idx, circfg := range cfg.Circles {
 		tx.CircleStates[idx] = NewCircleState(circfg, circles[idx])
 	}
+	tx.history.restore(tx.CircleStates)
+	if cfg.DriftCheckInterval > 0 {
+		go tx.runConsistencyCheck(cfg.DriftCheckInterval, cfg.DriftCheckWindow)
+	}
+	if cfg.AntiEntropyTime > 0 {
+		go tx.runAntiEntropy(cfg.AntiEntropyTime, cfg.AntiEntropyWindow, cfg.AntiEntropyPoints)
+	}
 	return
 }
 
+// AddCircleState adds the state of the circle added to proxy at runtime
+func (tx *Transfer) AddCircleState(cfg *backend.CircleConfig, circle *backend.Circle) {
+	css := make([]*CircleState, 0, len(tx.CircleStates)+1)
+	css = append(css, tx.CircleStates...)
+	tx.CircleStates = append(css, NewCircleState(cfg, circle))
+}
+
+// SetCircle sets the circle whose backends are changed at runtime, and registers the stats of the backends added
+func (tx *Transfer) SetCircle(circleId int, circle *backend.Circle) { // nolint:golint
+	cs := tx.CircleStates[circleId]
+	cs.Circle = circle
+	for _, be := range circle.Backends {
+		if _, ok := cs.Stats[be.Url]; !ok {
+			cs.Stats[be.Url] = &Stats{}
+		}
+	}
+}
+
+// Pause suspends the transfer workers at the next chunk or measurement, the chunks in flight are finished
+func (tx *Transfer) Pause() {
+	tx.pauseCond.L.Lock()
+	defer tx.pauseCond.L.Unlock()
+	tx.paused = true
+}
+
+func (tx *Transfer) Resume() {
+	tx.pauseCond.L.Lock()
+	defer tx.pauseCond.L.Unlock()
+	tx.paused = false
+	tx.pauseCond.Broadcast()
+}
+
+func (tx *Transfer) IsPaused() bool {
+	tx.pauseCond.L.Lock()
+	defer tx.pauseCond.L.Unlock()
+	return tx.paused
+}
+
+// Cancel aborts the running transfers, the workers stop at the next chunk or measurement, and the measurements
+// left are not transferred, it returns false if no transfer is running
+func (tx *Transfer) Cancel() bool {
+	if atomic.LoadInt32(&tx.running) == 0 {
+		return false
+	}
+	atomic.StoreInt32(&tx.cancelled, 1)
+	// the paused workers are resumed to stop
+	tx.Resume()
+	return true
+}
+
+func (tx *Transfer) isCancelled() bool {
+	return atomic.LoadInt32(&tx.cancelled) == 1
+}
+
+// begin marks a transfer running, the cancellation is cleared if no other transfer is running
+func (tx *Transfer) begin() {
+	if atomic.AddInt32(&tx.running, 1) == 1 {
+		atomic.StoreInt32(&tx.cancelled, 0)
+	}
+	tx.throttles = &throttles{
+		points:  NewThrottle(float64(tx.PointRate)),
+		bytes:   NewThrottle(tx.MBRate * 1024 * 1024),
+		queries: NewThrottle(float64(tx.QueryRate)),
+	}
+	tx.concurrency = newConcurrency(tx.ReadWorker, tx.WriteWorker, tx.ReadCap, tx.WriteCap)
+	tx.shardRanges = newShardRanges()
+	if tx.DryRun {
+		tx.dryRunResult = newDryRunResult()
+	}
+}
+
+// GetDryRunResult returns the transfers enumerated by the last dry run
+func (tx *Transfer) GetDryRunResult() *DryRunResult {
+	dr := tx.dryRunResult
+	if dr == nil {
+		return newDryRunResult()
+	}
+	dr.sort()
+	return dr
+}
+
+func (tx *Transfer) end() {
+	atomic.AddInt32(&tx.running, -1)
+}
+
+// logCancelled logs how far the operation got if it's cancelled, and returns whether it's cancelled
+func (tx *Transfer) logCancelled(operation string, css ...*CircleState) bool {
+	if !tx.isCancelled() {
+		return false
+	}
+	for _, cs := range css {
+		s := cs.GetSummary()
+		tlog.Printf("%s cancelled: circle %d, measurement done: %d/%d, transfer done: %d, failed: %d, points: %d, bytes: %d",
+			operation, cs.CircleId, s.MeasurementDone, s.MeasurementTotal, s.TransferDone, s.TransferFailed, s.PointCount, s.ByteCount)
+	}
+	return true
+}
+
+// waitResumed blocks while the transfer is paused
+func (tx *Transfer) waitResumed() {
+	tx.pauseCond.L.Lock()
+	defer tx.pauseCond.L.Unlock()
+	for tx.paused {
+		tx.pauseCond.Wait()
+	}
+}
+
 func (tx *Transfer) resetCircleStates() {
 	for _, cs := range tx.CircleStates {
 		cs.ResetStates()
 	}
 }
 
+// SetParams sets the params of the job once it is accepted, so that the requests rejected leave the running job untouched
+func (tx *Transfer) SetParams(p *Params) {
+	tx.Params = *p
+}
+
 func (tx *Transfer) resetBasicParam() {
-	tx.Worker = DefaultWorker
-	tx.Batch = DefaultBatch
-	tx.Limit = DefaultLimit
+	tx.Params = *NewParams()
 }
 
 func (tx *Transfer) setLogOutput(name string) {
+	// the dry run keeps the log output of the running transfer
+	if tx.DryRun {
+		return
+	}
 	logPath := filepath.Join(tx.tlogDir, name)
 	if logPath == "" {
 		tlog.SetOutput(os.Stdout)
@@ -95,16 +355,21 @@ func (tx *Transfer) setLogOutput(name string) {
 	}
 }
 
-func (tx *Transfer) getRetentionPolicies(db string) []string {
-	rps := make([]string, 0)
+// getRetentionPolicyInfos returns the retention policies of db from the active backends, the first one seen of
+// each name wins, and only the first default one is kept default
+func (tx *Transfer) getRetentionPolicyInfos(db string) []*backend.RetentionPolicy {
+	rps := make([]*backend.RetentionPolicy, 0)
 	rpm := make(map[string]bool)
+	hasDefault := false
 	for _, cs := range tx.CircleStates {
 		for _, be := range cs.Backends {
 			if be.IsActive() {
-				for _, rp := range be.GetRetentionPolicies(db) {
-					if _, ok := rpm[rp]; !ok {
+				for _, rp := range be.GetRetentionPolicyInfos(db) {
+					if _, ok := rpm[rp.Name]; !ok {
+						rp.Default = rp.Default && !hasDefault
+						hasDefault = hasDefault || rp.Default
 						rps = append(rps, rp)
-						rpm[rp] = true
+						rpm[rp.Name] = true
 					}
 				}
 			}
@@ -113,6 +378,90 @@ func (tx *Transfer) getRetentionPolicies(db string) []string {
 	return rps
 }
 
+// createRetentionPolicies creates the retention policies of db with their durations on the backends lacking them,
+// or alters the ones of other durations, so that the points don't land in a wrong retention
+func (tx *Transfer) createRetentionPolicies(backends []*backend.Backend, db string) {
+	rps := tx.getRetentionPolicyInfos(db)
+	tlog.Printf("create retention policy, db: %s, rps: %d", db, len(rps))
+	for _, be := range backends {
+		if !be.IsActive() {
+			continue
+		}
+		existing := make(map[string]*backend.RetentionPolicy)
+		for _, rp := range be.GetRetentionPolicyInfos(db) {
+			existing[rp.Name] = rp
+		}
+		for _, rp := range rps {
+			var q string
+			if erp, ok := existing[rp.Name]; !ok {
+				q = fmt.Sprintf("create retention policy \"%s\" on \"%s\" duration %s replication 1", util.EscapeIdentifier(rp.Name), util.EscapeIdentifier(db), rp.Duration)
+			} else if erp.Duration != rp.Duration || erp.ShardGroupDuration != rp.ShardGroupDuration || (rp.Default && !erp.Default) {
+				q = fmt.Sprintf("alter retention policy \"%s\" on \"%s\" duration %s", util.EscapeIdentifier(rp.Name), util.EscapeIdentifier(db), rp.Duration)
+			} else {
+				continue
+			}
+			if rp.ShardGroupDuration != "" {
+				q += " shard duration " + rp.ShardGroupDuration
+			}
+			if rp.Default {
+				q += " default"
+			}
+			if err := execStatement(be, db, q); err != nil {
+				tlog.Printf("create retention policy error: %s, backend: %s, db: %s, rp: %s", err, be.Url, db, rp.Name)
+			}
+		}
+	}
+}
+
+// createContinuousQueries creates the continuous queries of db found on the active backends on the backends lacking them
+func (tx *Transfer) createContinuousQueries(backends []*backend.Backend, db string) {
+	existing := make(map[*backend.Backend]map[string]string)
+	cqs := make(map[string]string)
+	for _, be := range backends {
+		if be.IsActive() {
+			existing[be] = be.GetContinuousQueries(db)
+			for name, query := range existing[be] {
+				if _, ok := cqs[name]; !ok {
+					cqs[name] = query
+				}
+			}
+		}
+	}
+	for name, query := range cqs {
+		for be, bcqs := range existing {
+			if _, ok := bcqs[name]; ok {
+				continue
+			}
+			if err := execStatement(be, db, query); err != nil {
+				tlog.Printf("create continuous query error: %s, backend: %s, db: %s, cq: %s", err, be.Url, db, name)
+			} else {
+				tlog.Printf("create continuous query, backend: %s, db: %s, cq: %s", be.Url, db, name)
+			}
+		}
+	}
+}
+
+// execStatement executes the statement on the backend, the error of statement in the response is returned as well
+func execStatement(be *backend.Backend, db, q string) error {
+	qr := be.Query(backend.NewQueryRequest("POST", db, q, ""), nil, true)
+	if qr.Err != nil {
+		return qr.Err
+	}
+	rsp, err := backend.ResponseFromResponseBytes(qr.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.Err != "" {
+		return errors.New(rsp.Err)
+	}
+	for _, r := range rsp.Results {
+		if r.Err != "" {
+			return errors.New(r.Err)
+		}
+	}
+	return nil
+}
+
 func (tx *Transfer) getDatabases() []string {
 	dbs := make([]string, 0)
 	dbm := make(map[string]bool)
@@ -135,6 +484,9 @@ func (tx *Transfer) createDatabases(dbs []string) ([]string, error) {
 	if len(dbs) == 0 {
 		dbs = tx.getDatabases()
 	}
+	if tx.DryRun {
+		return dbs, nil
+	}
 	if len(dbs) > 0 {
 		backends := make([]*backend.Backend, 0)
 		for _, cs := range tx.CircleStates {
@@ -149,17 +501,8 @@ func (tx *Transfer) createDatabases(dbs []string) ([]string, error) {
 				tlog.Printf("create databases error: %s, db: %s, dbs: %v", err, db, dbs)
 				return dbs, err
 			}
-			// create retention policy
-			rps := tx.getRetentionPolicies(db)
-			tlog.Printf("create retention policy, db: %s, rps: %v", db, rps)
-			for _, rp := range rps {
-				q = fmt.Sprintf("create retention policy \"%s\" on \"%s\" duration 0s replication 1", util.EscapeIdentifier(rp), util.EscapeIdentifier(db))
-				req = backend.NewQueryRequest("POST", "", q, "")
-				_, _, err = backend.QueryInParallel(backends, req, nil, false)
-				if err != nil {
-					tlog.Printf("create retention policy error: %s, db: %s, rp: %s", err, db, rp)
-				}
-			}
+			tx.createRetentionPolicies(backends, db)
+			tx.createContinuousQueries(backends, db)
 		}
 	} else {
 		tlog.Printf("databases are empty in all backends")
@@ -199,94 +542,141 @@ func reformFieldKeys(fieldKeys map[string][]string) map[string]string {
 	return fieldMap
 }
 
-func (tx *Transfer) write(ch chan *QueryResult, dsts []*backend.Backend, db, rp, meas string, tagMap util.Set, fieldMap map[string]string) error {
+// formatLines returns the lines of points, the fields are formatted by their types in fieldMap, and the points
+// without any field are skipped
+func formatLines(meas string, columns []string, values [][]interface{}, tagMap util.Set, fieldMap map[string]string) []byte {
 	var buf bytes.Buffer
+	for _, value := range values {
+		mtagSet := []string{util.EscapeMeasurement(meas)}
+		fieldSet := make([]string, 0)
+		for i := 1; i < len(value); i++ {
+			k := columns[i]
+			v := value[i]
+			if v == nil {
+				continue
+			}
+			if tagMap[k] {
+				mtagSet = append(mtagSet, fmt.Sprintf("%s=%s", util.EscapeTag(k), util.EscapeTag(util.CastString(v))))
+			} else if vtype, ok := fieldMap[k]; ok {
+				if fv, ok := formatField(v, vtype); ok {
+					fieldSet = append(fieldSet, fmt.Sprintf("%s=%s", util.EscapeTag(k), fv))
+				}
+			}
+		}
+		if len(fieldSet) == 0 {
+			continue
+		}
+		mtagStr := strings.Join(mtagSet, ",")
+		fieldStr := strings.Join(fieldSet, ",")
+		buf.WriteString(fmt.Sprintf("%s %s %v\n", mtagStr, fieldStr, value[0]))
+	}
+	return buf.Bytes()
+}
+
+func (tx *Transfer) write(ch chan *QueryResult, src *backend.Backend, dsts []*backend.Backend, db, rp, meas string, tagMap util.Set, fieldMap map[string]string, stats *Stats) error {
 	var wg sync.WaitGroup
 	pool, err := ants.NewPool(len(dsts) * 20)
 	if err != nil {
 		return err
 	}
 	defer pool.Release()
+	casts := newFieldCasts()
+	// the destinations failed after the retries fail the time range, which is retried and reported by the task
+	var failed int
+	var firstErr error
+	var failedLock sync.Mutex
 	for qr := range ch {
 		if qr.Err != nil {
 			return qr.Err
 		}
 		serie := qr.Series[0]
 		columns := serie.Columns
-		valen := len(serie.Values)
-		for idx, value := range serie.Values {
-			mtagSet := []string{util.EscapeMeasurement(meas)}
-			fieldSet := make([]string, 0)
-			for i := 1; i < len(value); i++ {
-				k := columns[i]
-				v := value[i]
-				if tagMap[k] {
-					if v != nil {
-						mtagSet = append(mtagSet, fmt.Sprintf("%s=%s", util.EscapeTag(k), util.EscapeTag(util.CastString(v))))
+		for from := 0; from < len(serie.Values); from += tx.Batch {
+			to := from + tx.Batch
+			if to > len(serie.Values) {
+				to = len(serie.Values)
+			}
+			values := serie.Values[from:to]
+			p := formatLines(meas, columns, values, tagMap, fieldMap)
+			n := int64(len(values))
+			// the points are ordered by time desc
+			first, _ := strconv.ParseInt(fmt.Sprint(values[0][0]), 10, 64)
+			last, _ := strconv.ParseInt(fmt.Sprint(values[n-1][0]), 10, 64)
+			record := AuditRecord{Operation: tx.getOperation(), Src: src.Url, Db: db, Rp: rp, Meas: meas, Start: last, End: first, Points: n, Bytes: int64(len(p))}
+			tx.throttles.points.Wait(n)
+			tx.throttles.bytes.Wait(int64(len(p)))
+			atomic.AddInt64(&stats.PointCount, n)
+			atomic.AddInt64(&stats.ByteCount, int64(len(p)))
+			for _, dst := range dsts {
+				dst := dst
+				wg.Add(1)
+				pool.Submit(func() {
+					defer wg.Done()
+					var err error
+					begin := time.Now()
+					record := record
+					// the fields conflicted before are cast for the destination
+					dp := p
+					if fm, ok := casts.fieldMap(dst.Url, fieldMap); ok {
+						dp = formatLines(meas, columns, values, tagMap, fm)
 					}
-				} else if vtype, ok := fieldMap[k]; ok {
-					if v != nil {
-						if vtype == "float" || vtype == "boolean" {
-							fieldSet = append(fieldSet, fmt.Sprintf("%s=%v", util.EscapeTag(k), v))
-						} else if vtype == "integer" {
-							fieldSet = append(fieldSet, fmt.Sprintf("%s=%vi", util.EscapeTag(k), v))
-						} else if vtype == "string" {
-							fieldSet = append(fieldSet, fmt.Sprintf("%s=\"%s\"", util.EscapeTag(k), models.EscapeStringField(util.CastString(v))))
+					for i := 0; i <= RetryCount; i++ {
+						if i > 0 {
+							time.Sleep(time.Duration(RetryInterval) * time.Second)
+							tlog.Printf("transfer write retry: %d, err:%s dst:%s db:%s rp:%s meas:%s", i, err, dst.Url, db, rp, meas)
 						}
-					}
-				}
-			}
-			mtagStr := strings.Join(mtagSet, ",")
-			fieldStr := strings.Join(fieldSet, ",")
-			line := fmt.Sprintf("%s %s %v\n", mtagStr, fieldStr, value[0])
-			buf.WriteString(line)
-			if (idx+1)%tx.Batch == 0 || idx+1 == valen {
-				p := buf.Bytes()
-				for _, dst := range dsts {
-					dst := dst
-					wg.Add(1)
-					pool.Submit(func() {
-						defer wg.Done()
-						var err error
-						for i := 0; i <= RetryCount; i++ {
-							if i > 0 {
-								time.Sleep(time.Duration(RetryInterval) * time.Second)
-								tlog.Printf("transfer write retry: %d, err:%s dst:%s db:%s rp:%s meas:%s", i, err, dst.Url, db, rp, meas)
-							}
-							err = dst.Write(db, rp, p)
-							if err == nil {
-								break
-							}
+						record.Attempts++
+						err = tx.writeTo(dst, db, rp, dp)
+						// the bad request fails again
+						if err == nil || errors.Is(err, backend.ErrBadRequest) {
+							break
 						}
-						if err != nil {
-							tlog.Printf("transfer write error: %s, dst:%s db:%s rp:%s meas:%s", err, dst.Url, db, rp, meas)
+					}
+					if conflict, ok := err.(*backend.FieldTypeConflictError); ok {
+						err = tx.writeConflicted(dst, db, rp, meas, columns, values, tagMap, fieldMap, casts, conflict, stats)
+					}
+					record.Dst, record.Duration, record.Result = dst.Url, time.Since(begin).Milliseconds(), "ok"
+					if err != nil {
+						tlog.Printf("transfer write error: %s, dst:%s db:%s rp:%s meas:%s", err, dst.Url, db, rp, meas)
+						record.Result, record.Error = "error", err.Error()
+						failedLock.Lock()
+						if failed++; firstErr == nil {
+							firstErr = fmt.Errorf("%w, dst:%s", err, dst.Url)
 						}
-					})
-				}
-				buf = bytes.Buffer{}
+						failedLock.Unlock()
+					}
+					tx.audit.write(&record)
+				})
 			}
 		}
 	}
 	wg.Wait()
+	if failed > 0 {
+		return fmt.Errorf("write failed of %d batches: %w", failed, firstErr)
+	}
 	return nil
 }
 
-func (tx *Transfer) query(ch chan *QueryResult, src *backend.Backend, db, rp, meas string, tick int64) {
+func (tx *Transfer) query(ch chan *QueryResult, src *backend.Backend, db, rp, meas string, tr TimeRange) {
 	defer close(ch)
 	for offset := 0; ; offset += tx.Limit {
-		whereClause := ""
-		if tick > 0 {
-			whereClause = fmt.Sprintf("where time >= %ds", tick)
+		tx.waitResumed()
+		if tx.isCancelled() {
+			ch <- &QueryResult{Err: ErrTransferCancelled}
+			return
 		}
-		q := fmt.Sprintf("select * from \"%s\".\"%s\" %s order by time desc limit %d offset %d", util.EscapeIdentifier(rp), util.EscapeIdentifier(meas), whereClause, tx.Limit, offset)
+		q := fmt.Sprintf("select * from \"%s\".\"%s\" %s order by time desc limit %d offset %d", util.EscapeIdentifier(rp), util.EscapeIdentifier(meas), tr.where(), tx.Limit, offset)
 		var rsp []byte
 		var err error
 		for i := 0; i <= RetryCount; i++ {
 			if i > 0 {
 				time.Sleep(time.Duration(RetryInterval) * time.Second)
-				tlog.Printf("transfer query retry: %d, err:%s src:%s db:%s rp:%s meas:%s tick:%d limit:%d offset:%d", i, err, src.Url, db, rp, meas, tick, tx.Limit, offset)
+				tlog.Printf("transfer query retry: %d, err:%s src:%s db:%s rp:%s meas:%s range:%s limit:%d offset:%d", i, err, src.Url, db, rp, meas, tr, tx.Limit, offset)
 			}
+			tx.throttles.queries.Wait(1)
+			release := tx.concurrency.read(src)
 			rsp, err = src.QueryIQL("GET", db, q, "ns")
+			release()
 			if err == nil {
 				break
 			}
@@ -307,9 +697,9 @@ func (tx *Transfer) query(ch chan *QueryResult, src *backend.Backend, db, rp, me
 	}
 }
 
-func (tx *Transfer) transfer(src *backend.Backend, dsts []*backend.Backend, db, rp, meas string, tick int64) error {
+func (tx *Transfer) transfer(src *backend.Backend, dsts []*backend.Backend, db, rp, meas string, tr TimeRange, stats *Stats) error {
 	ch := make(chan *QueryResult, 4)
-	go tx.query(ch, src, db, rp, meas, tick)
+	go tx.query(ch, src, db, rp, meas, tr)
 
 	var tagMap util.Set
 	var fieldMap map[string]string
@@ -327,34 +717,105 @@ func (tx *Transfer) transfer(src *backend.Backend, dsts []*backend.Backend, db,
 		fieldMap = reformFieldKeys(fieldKeys)
 	}()
 	wg.Wait()
-	return tx.write(ch, dsts, db, rp, meas, tagMap, fieldMap)
+	return tx.write(ch, src, dsts, db, rp, meas, tagMap, fieldMap, stats)
 }
 
-func (tx *Transfer) submitTransfer(cs *CircleState, src *backend.Backend, dsts []*backend.Backend, db, meas string, tick int64) {
+func (tx *Transfer) submitTransfer(cs *CircleState, src *backend.Backend, dsts []*backend.Backend, db, meas string, tr TimeRange) {
+	stats := cs.Stats[src.Url]
 	rps := src.GetRetentionPolicies(db)
+	if tx.DryRun {
+		tx.dryRunResult.add(src, dsts, db, meas, rps)
+		atomic.AddInt32(&stats.TransferDone, 1)
+		return
+	}
+	// each shard of the retention policies is transferred by its own task in parallel
+	type task struct {
+		rp string
+		tr TimeRange
+	}
+	tasks := make([]task, 0, len(rps))
 	for _, rp := range rps {
-		rp := rp
-		cs.wg.Add(1)
-		tx.pool.Submit(func() {
-			defer cs.wg.Done()
-			err := tx.transfer(src, dsts, db, rp, meas, tick)
-			if err == nil {
-				tlog.Printf("transfer done, src:%s dst:%v db:%s rp:%s meas:%s tick:%d", src.Url, getBackendUrls(dsts), db, rp, meas, tick)
-			} else {
-				tlog.Printf("transfer error: %s, src:%s dst:%v db:%s rp:%s meas:%s tick:%d", err, src.Url, getBackendUrls(dsts), db, rp, meas, tick)
+		for _, str := range tx.shardRanges.split(src, db, rp, tr) {
+			tasks = append(tasks, task{rp: rp, tr: str})
+		}
+	}
+	if len(tasks) == 0 {
+		atomic.AddInt32(&stats.TransferDone, 1)
+		return
+	}
+	// the measurement is done once all the tasks are done, or failed if any fails after the retries
+	pending, failed := int32(len(tasks)), int32(0)
+	for _, t := range tasks {
+		tx.submitTask(cs, src, dsts, db, t.rp, meas, t.tr, 1, func(err error) {
+			if err != nil {
+				atomic.StoreInt32(&failed, 1)
+			}
+			if atomic.AddInt32(&pending, -1) == 0 {
+				if atomic.LoadInt32(&failed) == 1 {
+					atomic.AddInt32(&stats.TransferFailed, 1)
+				} else {
+					atomic.AddInt32(&stats.TransferDone, 1)
+				}
 			}
 		})
 	}
 }
 
-func (tx *Transfer) submitCleanup(cs *CircleState, be *backend.Backend, db, meas string) {
+// submitTask submits the transfer of the time range to the pool, the failed one is queued to retry after
+// RetryInterval multiplied by the attempt, until TaskAttempts is reached and it's reported in the failures
+func (tx *Transfer) submitTask(cs *CircleState, src *backend.Backend, dsts []*backend.Backend, db, rp, meas string, tr TimeRange, attempt int, done func(error)) {
+	stats := cs.Stats[src.Url]
 	cs.wg.Add(1)
 	tx.pool.Submit(func() {
 		defer cs.wg.Done()
+		err := tx.transfer(src, dsts, db, rp, meas, tr, stats)
+		if err == nil {
+			tlog.Printf("transfer done, src:%s dst:%v db:%s rp:%s meas:%s range:%s", src.Url, getBackendUrls(dsts), db, rp, meas, tr)
+			if tx.Verify {
+				tx.verify(src, dsts, db, rp, meas, tr, stats)
+			}
+			done(nil)
+			return
+		}
+		tlog.Printf("transfer error: %s, src:%s dst:%v db:%s rp:%s meas:%s range:%s attempt:%d", err, src.Url, getBackendUrls(dsts), db, rp, meas, tr, attempt)
+		if attempt < TaskAttempts && !tx.isCancelled() {
+			atomic.AddInt32(&stats.TransferRetrying, 1)
+			cs.wg.Add(1)
+			time.AfterFunc(time.Duration(RetryInterval*attempt)*time.Second, func() {
+				defer cs.wg.Done()
+				atomic.AddInt32(&stats.TransferRetrying, -1)
+				atomic.AddInt32(&stats.TransferRetried, 1)
+				tx.submitTask(cs, src, dsts, db, rp, meas, tr, attempt+1, done)
+			})
+			return
+		}
+		stats.addFailure(&Failure{Db: db, Rp: rp, Meas: meas, Start: tr.Start, End: tr.End, Attempts: attempt, Error: err.Error()})
+		done(err)
+	})
+}
+
+// submitCleanup drops the measurement once its points are verified on the owners, or only reports it if not confirmed
+func (tx *Transfer) submitCleanup(cs *CircleState, be *backend.Backend, owners []*backend.Backend, db, meas string) {
+	cs.wg.Add(1)
+	tx.pool.Submit(func() {
+		defer cs.wg.Done()
+		stats := cs.Stats[be.Url]
+		if !tx.verifyCleanup(be, owners, db, meas, stats) {
+			atomic.AddInt32(&stats.TransferFailed, 1)
+			tlog.Printf("cleanup skipped, unverified on owners, backend:%s owners:%v db:%s meas:%s", be.Url, getBackendUrls(owners), db, meas)
+			return
+		}
+		if !tx.Confirm {
+			atomic.AddInt32(&stats.TransferDone, 1)
+			tlog.Printf("cleanup verified, not confirmed, backend:%s db:%s meas:%s", be.Url, db, meas)
+			return
+		}
 		_, err := be.DropMeasurement(db, meas)
 		if err == nil {
+			atomic.AddInt32(&stats.TransferDone, 1)
 			tlog.Printf("cleanup done, backend:%s db:%s meas:%s", be.Url, db, meas)
 		} else {
+			atomic.AddInt32(&stats.TransferFailed, 1)
 			tlog.Printf("cleanup error: %s, backend:%s db:%s meas:%s", err, be.Url, db, meas)
 		}
 	})
@@ -368,6 +829,7 @@ func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []stri
 	}
 
 	stats := cs.Stats[be.Url]
+	stats.start()
 	stats.DatabaseTotal = int32(len(dbs))
 	measures := make([][]string, len(dbs))
 	var wg sync.WaitGroup
@@ -375,7 +837,7 @@ func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []stri
 		wg.Add(1)
 		go func(i int, db string) {
 			defer wg.Done()
-			measures[i] = be.GetMeasurements(db)
+			measures[i] = tx.MeasFilter.filter(be.GetMeasurements(db))
 		}(i, db)
 	}
 	wg.Wait()
@@ -385,6 +847,10 @@ func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []stri
 
 	for i, db := range dbs {
 		for _, meas := range measures[i] {
+			tx.waitResumed()
+			if tx.isCancelled() {
+				return
+			}
 			require := fn(cs, be, db, meas, args)
 			if require {
 				atomic.AddInt32(&stats.TransferCount, 1)
@@ -398,22 +864,38 @@ func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []stri
 }
 
 func (tx *Transfer) Rebalance(circleId int, backends []*backend.Backend, dbs []string) { // nolint:golint
+	tx.begin()
+	defer tx.end()
 	tx.setLogOutput("rebalance.log")
 	dbs, err := tx.createDatabases(dbs)
 	if err != nil || len(dbs) == 0 {
+		if err != nil {
+			tx.notifyError("rebalance", err)
+		}
 		return
 	}
 	tx.pool, err = ants.NewPool(tx.Worker)
 	if err != nil {
 		tlog.Printf("new pool error: %s", err)
+		tx.notifyError("rebalance", err)
 		return
 	}
 	defer tx.pool.Release()
 	tlog.Printf("rebalance start: circle %d", circleId)
 	cs := tx.CircleStates[circleId]
+	// the backends removed from the circle have the stats as well
+	for _, be := range backends {
+		if _, ok := cs.Stats[be.Url]; !ok {
+			cs.Stats[be.Url] = &Stats{}
+		}
+	}
 	tx.resetCircleStates()
-	tx.broadcastTransferring(cs, true)
-	defer tx.broadcastTransferring(cs, false)
+	defer tx.track("rebalance", cs)()
+	// the dry run changes no state
+	if !tx.DryRun {
+		tx.broadcastTransferring(cs, true)
+		defer tx.broadcastTransferring(cs, false)
+	}
 
 	for _, be := range backends {
 		cs.wg.Add(1)
@@ -421,28 +903,39 @@ func (tx *Transfer) Rebalance(circleId int, backends []*backend.Backend, dbs []s
 	}
 	cs.wg.Wait()
 	tx.resetBasicParam()
-	tlog.Printf("rebalance done: circle %d", circleId)
+	if !tx.logCancelled("rebalance", cs) {
+		tlog.Printf("rebalance done: circle %d", circleId)
+	}
 }
 
 func (tx *Transfer) runRebalance(cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
-	key := backend.GetKey(db, meas)
-	dst := cs.GetBackend(key)
-	require = dst.Url != be.Url
+	dsts := cs.GetReplicasByMeasurement(db, meas)
+	if dsts == nil {
+		tlog.Printf("backend:%s db:%s meas:%s skipped, sharded by tags", be.Url, db, meas)
+		return false
+	}
+	require = !cs.IsReplica(be.Url, db, meas)
 	if require {
-		tx.submitTransfer(cs, be, []*backend.Backend{dst}, db, meas, 0)
+		tx.submitTransfer(cs, be, dsts, db, meas, TimeRange{})
 	}
 	return
 }
 
-func (tx *Transfer) Recovery(fromCircleId, toCircleId int, backendUrls []string, dbs []string) { // nolint:golint
+func (tx *Transfer) Recovery(fromCircleId, toCircleId int, backendUrls []string, dbs []string, tr TimeRange) { // nolint:golint
+	tx.begin()
+	defer tx.end()
 	tx.setLogOutput("recovery.log")
 	dbs, err := tx.createDatabases(dbs)
 	if err != nil || len(dbs) == 0 {
+		if err != nil {
+			tx.notifyError("recovery", err)
+		}
 		return
 	}
 	tx.pool, err = ants.NewPool(tx.Worker)
 	if err != nil {
 		tlog.Printf("new pool error: %s", err)
+		tx.notifyError("recovery", err)
 		return
 	}
 	defer tx.pool.Release()
@@ -450,8 +943,12 @@ func (tx *Transfer) Recovery(fromCircleId, toCircleId int, backendUrls []string,
 	fcs := tx.CircleStates[fromCircleId]
 	tcs := tx.CircleStates[toCircleId]
 	tx.resetCircleStates()
-	tx.broadcastTransferring(tcs, true)
-	defer tx.broadcastTransferring(tcs, false)
+	defer tx.track("recovery", fcs)()
+	// the dry run changes no state
+	if !tx.DryRun {
+		tx.broadcastTransferring(tcs, true)
+		defer tx.broadcastTransferring(tcs, false)
+	}
 
 	backendUrlSet := util.NewSet() // nolint:golint
 	if len(backendUrls) != 0 {
@@ -465,86 +962,126 @@ func (tx *Transfer) Recovery(fromCircleId, toCircleId int, backendUrls []string,
 	}
 	for _, be := range fcs.Backends {
 		fcs.wg.Add(1)
-		go tx.runTransfer(fcs, be, dbs, tx.runRecovery, tcs, backendUrlSet)
+		go tx.runTransfer(fcs, be, dbs, tx.runRecovery, tcs, backendUrlSet, tr)
 	}
 	fcs.wg.Wait()
 	tx.resetBasicParam()
-	tlog.Printf("recovery done: circle from %d to %d", fromCircleId, toCircleId)
+	if !tx.logCancelled("recovery", fcs) {
+		tlog.Printf("recovery done: circle from %d to %d", fromCircleId, toCircleId)
+	}
 }
 
 func (tx *Transfer) runRecovery(fcs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
 	tcs := args[0].(*CircleState)
 	backendUrlSet := args[1].(util.Set) // nolint:golint
-	key := backend.GetKey(db, meas)
-	dst := tcs.GetBackend(key)
-	require = backendUrlSet[dst.Url]
+	tr := args[2].(TimeRange)
+	if !tx.dbCircles.Contains(db, tcs.CircleId) {
+		return false
+	}
+	replicas := tcs.GetReplicasByMeasurement(db, meas)
+	if replicas == nil {
+		tlog.Printf("backend:%s db:%s meas:%s skipped, sharded by tags", be.Url, db, meas)
+		return false
+	}
+	dsts := make([]*backend.Backend, 0)
+	for _, dst := range replicas {
+		if backendUrlSet[dst.Url] {
+			dsts = append(dsts, dst)
+		}
+	}
+	require = len(dsts) > 0
 	if require {
-		tx.submitTransfer(fcs, be, []*backend.Backend{dst}, db, meas, 0)
+		tx.submitTransfer(fcs, be, dsts, db, meas, tr)
 	}
 	return
 }
 
-func (tx *Transfer) Resync(dbs []string, tick int64) {
+func (tx *Transfer) Resync(dbs []string, tr TimeRange) {
+	tx.begin()
+	defer tx.end()
 	tx.setLogOutput("resync.log")
 	dbs, err := tx.createDatabases(dbs)
 	if err != nil || len(dbs) == 0 {
+		if err != nil {
+			tx.notifyError("resync", err)
+		}
 		return
 	}
 	tx.pool, err = ants.NewPool(tx.Worker)
 	if err != nil {
 		tlog.Printf("new pool error: %s", err)
+		tx.notifyError("resync", err)
 		return
 	}
 	defer tx.pool.Release()
 	tlog.Printf("resync start")
 	tx.resetCircleStates()
-	tx.broadcastResyncing(true)
-	defer tx.broadcastResyncing(false)
+	defer tx.track("resync", tx.CircleStates...)()
+	// the dry run changes no state
+	if !tx.DryRun {
+		tx.broadcastResyncing(true)
+		defer tx.broadcastResyncing(false)
+	}
 
 	for _, cs := range tx.CircleStates {
 		tlog.Printf("resync start: circle %d", cs.CircleId)
 		for _, be := range cs.Backends {
 			cs.wg.Add(1)
-			go tx.runTransfer(cs, be, dbs, tx.runResync, tick)
+			go tx.runTransfer(cs, be, dbs, tx.runResync, tr)
 		}
 		cs.wg.Wait()
+		if tx.isCancelled() {
+			break
+		}
 		tlog.Printf("resync done: circle %d", cs.CircleId)
 	}
 	tx.resetBasicParam()
-	tlog.Printf("resync done")
+	if !tx.logCancelled("resync", tx.CircleStates...) {
+		tlog.Printf("resync done")
+	}
 }
 
 func (tx *Transfer) runResync(cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
-	tick := args[0].(int64)
-	key := backend.GetKey(db, meas)
+	tr := args[0].(TimeRange)
 	dsts := make([]*backend.Backend, 0)
 	for _, tcs := range tx.CircleStates {
-		if tcs.CircleId != cs.CircleId {
-			dst := tcs.GetBackend(key)
-			dsts = append(dsts, dst)
+		if tcs.CircleId != cs.CircleId && tx.dbCircles.Contains(db, tcs.CircleId) {
+			replicas := tcs.GetReplicasByMeasurement(db, meas)
+			if replicas == nil {
+				tlog.Printf("backend:%s db:%s meas:%s skipped, sharded by tags", be.Url, db, meas)
+				return false
+			}
+			dsts = append(dsts, replicas...)
 		}
 	}
 	require = len(dsts) > 0
 	if require {
-		tx.submitTransfer(cs, be, dsts, db, meas, tick)
+		tx.submitTransfer(cs, be, dsts, db, meas, tr)
 	}
 	return
 }
 
 func (tx *Transfer) Cleanup(circleId int) { // nolint:golint
+	tx.begin()
+	defer tx.end()
 	tx.setLogOutput("cleanup.log")
 	var err error
 	tx.pool, err = ants.NewPool(tx.Worker)
 	if err != nil {
 		tlog.Printf("new pool error: %s", err)
+		tx.notifyError("cleanup", err)
 		return
 	}
 	defer tx.pool.Release()
 	tlog.Printf("cleanup start: circle %d", circleId)
 	cs := tx.CircleStates[circleId]
 	tx.resetCircleStates()
-	tx.broadcastTransferring(cs, true)
-	defer tx.broadcastTransferring(cs, false)
+	defer tx.track("cleanup", cs)()
+	// the cleanup not confirmed changes no state
+	if tx.Confirm {
+		tx.broadcastTransferring(cs, true)
+		defer tx.broadcastTransferring(cs, false)
+	}
 
 	for _, be := range cs.Backends {
 		dbs := be.GetDatabases()
@@ -555,16 +1092,22 @@ func (tx *Transfer) Cleanup(circleId int) { // nolint:golint
 	}
 	cs.wg.Wait()
 	tx.resetBasicParam()
-	tlog.Printf("cleanup done: circle %d", circleId)
+	if !tx.logCancelled("cleanup", cs) {
+		tlog.Printf("cleanup done: circle %d", circleId)
+	}
 }
 
 func (tx *Transfer) runCleanup(cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
-	key := backend.GetKey(db, meas)
-	dst := cs.GetBackend(key)
-	require = dst.Url != be.Url
+	owners := cs.GetReplicasByMeasurement(db, meas)
+	if owners == nil {
+		// the measurements spread by tags are never cleaned up
+		tlog.Printf("backend:%s db:%s meas:%s skipped, sharded by tags", be.Url, db, meas)
+		return false
+	}
+	require = !cs.IsReplica(be.Url, db, meas)
 	if require {
 		tlog.Printf("backend:%s db:%s meas:%s require to cleanup", be.Url, db, meas)
-		tx.submitCleanup(cs, be, db, meas)
+		tx.submitCleanup(cs, be, owners, db, meas)
 	} else {
 		tlog.Printf("backend:%s db:%s meas:%s checked", be.Url, db, meas)
 	}
@@ -573,6 +1116,7 @@ func (tx *Transfer) runCleanup(cs *CircleState, be *backend.Backend, db string,
 
 func (tx *Transfer) broadcastResyncing(resyncing bool) {
 	tx.Resyncing = resyncing
+	tx.putState(backend.EtcdResyncing, resyncing)
 	client := backend.NewClient(tx.httpsEnabled, 10)
 	for _, addr := range tx.HaAddrs {
 		url := fmt.Sprintf("http://%s/transfer/state?resyncing=%t", addr, resyncing)
@@ -583,6 +1127,7 @@ func (tx *Transfer) broadcastResyncing(resyncing bool) {
 func (tx *Transfer) broadcastTransferring(cs *CircleState, transferring bool) {
 	cs.Transferring = transferring
 	cs.SetTransferIn(transferring)
+	tx.putState(backend.EtcdTransferPrefix+strconv.Itoa(cs.CircleId), transferring)
 	client := backend.NewClient(tx.httpsEnabled, 10)
 	for _, addr := range tx.HaAddrs {
 		url := fmt.Sprintf("http://%s/transfer/state?circle_id=%d&transferring=%t", addr, cs.CircleId, transferring)
@@ -590,6 +1135,16 @@ func (tx *Transfer) broadcastTransferring(cs *CircleState, transferring bool) {
 	}
 }
 
+// putState puts the transfer state to etcd so that the other proxies watch it
+func (tx *Transfer) putState(name string, state bool) {
+	if tx.Etcd == nil {
+		return
+	}
+	if err := tx.Etcd.Put(name, []byte(strconv.FormatBool(state))); err != nil {
+		tlog.Printf("put state error: %s, name: %s", err, name)
+	}
+}
+
 func (tx *Transfer) postBroadcast(client *http.Client, url string) {
 	if tx.httpsEnabled {
 		url = strings.Replace(url, "http", "https", 1)
@@ -0,0 +1,155 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+var (
+	// VerifyBucket is the time bucket of point counts compared by verification
+	VerifyBucket = "1d"
+	// MaxMismatches is the max number of mismatches kept in the stats of a backend
+	MaxMismatches = 100
+)
+
+// Mismatch is a measurement whose destination has fewer points than the source in some time buckets
+type Mismatch struct {
+	Db      string `json:"db"`
+	Rp      string `json:"rp"`
+	Meas    string `json:"meas"`
+	Dst     string `json:"dst"`
+	Buckets int    `json:"buckets"`
+	Src     int64  `json:"src_points"`
+	Dest    int64  `json:"dst_points"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (s *Stats) addMismatch(m *Mismatch) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.Mismatches) < MaxMismatches {
+		s.Mismatches = append(s.Mismatches, m)
+	}
+}
+
+// verify compares the point counts per time bucket of the measurement transferred from src to each dst
+func (tx *Transfer) verify(src *backend.Backend, dsts []*backend.Backend, db, rp, meas string, tr TimeRange, stats *Stats) {
+	defer atomic.AddInt32(&stats.VerifyDone, 1)
+	srcCounts, err := countPoints(src, db, rp, meas, tr, tx.throttles.queries)
+	if err != nil {
+		tlog.Printf("verify count error: %s, src:%s db:%s rp:%s meas:%s", err, src.Url, db, rp, meas)
+		stats.addMismatch(&Mismatch{Db: db, Rp: rp, Meas: meas, Error: err.Error()})
+		return
+	}
+	for _, dst := range dsts {
+		dstCounts, err := countPoints(dst, db, rp, meas, tr, tx.throttles.queries)
+		if err != nil {
+			tlog.Printf("verify count error: %s, dst:%s db:%s rp:%s meas:%s", err, dst.Url, db, rp, meas)
+			stats.addMismatch(&Mismatch{Db: db, Rp: rp, Meas: meas, Dst: dst.Url, Error: err.Error()})
+			continue
+		}
+		m := compareCounts(srcCounts, dstCounts)
+		m.Db, m.Rp, m.Meas, m.Dst = db, rp, meas, dst.Url
+		if m.Buckets > 0 {
+			tlog.Printf("verify mismatch, src:%s dst:%s db:%s rp:%s meas:%s buckets:%d src_points:%d dst_points:%d", src.Url, dst.Url, db, rp, meas, m.Buckets, m.Src, m.Dest)
+			stats.addMismatch(m)
+		}
+	}
+}
+
+// compareCounts returns the mismatch of the point counts, the destination may have more points written since,
+// but never fewer in any bucket
+func compareCounts(srcCounts, dstCounts map[int64]int64) *Mismatch {
+	m := &Mismatch{}
+	for bucket, n := range srcCounts {
+		m.Src += n
+		m.Dest += dstCounts[bucket]
+		if dstCounts[bucket] < n {
+			m.Buckets++
+		}
+	}
+	return m
+}
+
+// verifyCleanup returns whether all the points of the measurement on the backend exist on each owner of it,
+// so that the local copy is safe to drop, the mismatches are added to the stats
+func (tx *Transfer) verifyCleanup(be *backend.Backend, owners []*backend.Backend, db, meas string, stats *Stats) bool {
+	safe := true
+	for _, rp := range be.GetRetentionPolicies(db) {
+		counts, err := countPoints(be, db, rp, meas, TimeRange{}, tx.throttles.queries)
+		if err != nil {
+			stats.addMismatch(&Mismatch{Db: db, Rp: rp, Meas: meas, Error: err.Error()})
+			return false
+		}
+		if len(counts) == 0 {
+			continue
+		}
+		for _, owner := range owners {
+			if !owner.IsActive() {
+				stats.addMismatch(&Mismatch{Db: db, Rp: rp, Meas: meas, Dst: owner.Url, Error: "owner unavailable"})
+				safe = false
+				continue
+			}
+			ownerCounts, err := countPoints(owner, db, rp, meas, TimeRange{}, tx.throttles.queries)
+			if err != nil {
+				stats.addMismatch(&Mismatch{Db: db, Rp: rp, Meas: meas, Dst: owner.Url, Error: err.Error()})
+				safe = false
+				continue
+			}
+			m := compareCounts(counts, ownerCounts)
+			if m.Buckets > 0 {
+				m.Db, m.Rp, m.Meas, m.Dst = db, rp, meas, owner.Url
+				tlog.Printf("cleanup mismatch, backend:%s owner:%s db:%s rp:%s meas:%s buckets:%d points:%d owner_points:%d", be.Url, owner.Url, db, rp, meas, m.Buckets, m.Src, m.Dest)
+				stats.addMismatch(m)
+				safe = false
+			}
+		}
+	}
+	return safe
+}
+
+// countPoints returns the point counts by time bucket, the count of a bucket is the max count of the fields,
+// the query waits for the throttle
+func countPoints(be *backend.Backend, db, rp, meas string, tr TimeRange, throttle *Throttle) (map[int64]int64, error) {
+	// group by time requires a lower bound of time
+	where := fmt.Sprintf("where time >= %ds", tr.Start)
+	if tr.End > 0 {
+		where += fmt.Sprintf(" and time < %ds", tr.End)
+	}
+	q := fmt.Sprintf("select count(*) from \"%s\".\"%s\" %s group by time(%s) fill(none)", util.EscapeIdentifier(rp), util.EscapeIdentifier(meas), where, VerifyBucket)
+	throttle.Wait(1)
+	rsp, err := be.QueryIQL("GET", db, q, "ns")
+	if err != nil {
+		return nil, err
+	}
+	series, err := backend.SeriesFromResponseBytes(rsp)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[int64]int64)
+	for _, serie := range series {
+		for _, value := range serie.Values {
+			t, ok := value[0].(json.Number)
+			if !ok {
+				continue
+			}
+			bucket, _ := t.Int64()
+			for _, v := range value[1:] {
+				if n, ok := v.(json.Number); ok {
+					if c, _ := n.Int64(); c > counts[bucket] {
+						counts[bucket] = c
+					}
+				}
+			}
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+const (
+	StatusDone      = "done"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// Notification is posted to the transfer webhook once an operation finishes, or fails to start
+type Notification struct {
+	Operation string  `json:"operation"`
+	Status    string  `json:"status"`
+	CircleIds []int   `json:"circle_ids"` // nolint:golint
+	Start     int64   `json:"start"`
+	End       int64   `json:"end"`
+	Duration  float64 `json:"duration"`
+	Error     string  `json:"error,omitempty"`
+	Summary   *Stats  `json:"summary,omitempty"`
+}
+
+// newNotification returns the notification of the operation done, failed if any measurement failed
+func newNotification(operation string, begin, end time.Time, cancelled bool, css []*CircleState) *Notification {
+	n := &Notification{
+		Operation: operation,
+		Status:    StatusDone,
+		CircleIds: make([]int, 0, len(css)),
+		Start:     begin.Unix(),
+		End:       end.Unix(),
+		Duration:  end.Sub(begin).Seconds(),
+		Summary:   &Stats{},
+	}
+	for _, cs := range css {
+		n.CircleIds = append(n.CircleIds, cs.CircleId)
+		n.Summary.add(cs.GetSummary())
+	}
+	n.Summary.estimate(end)
+	if cancelled {
+		n.Status = StatusCancelled
+	} else if n.Summary.TransferFailed > 0 {
+		n.Status = StatusFailed
+	}
+	return n
+}
+
+// notifyError notifies that the operation fails to start
+func (tx *Transfer) notifyError(operation string, err error) {
+	now := time.Now().Unix()
+	tx.notify(&Notification{Operation: operation, Status: StatusFailed, CircleIds: []int{}, Start: now, End: now, Error: err.Error()})
+}
+
+// notify posts the notification to the transfer webhook in background, the failure is only logged
+func (tx *Transfer) notify(n *Notification) {
+	if tx.webhook == "" || tx.DryRun {
+		return
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		tlog.Printf("marshal notification error: %s", err)
+		return
+	}
+	go func() {
+		client := backend.NewClient(false, 10)
+		rsp, err := client.Post(tx.webhook, "application/json", bytes.NewReader(body))
+		if err == nil {
+			rsp.Body.Close()
+			if rsp.StatusCode/100 != 2 {
+				err = fmt.Errorf("status code %d", rsp.StatusCode)
+			}
+		}
+		if err != nil {
+			tlog.Printf("notify webhook error: %s, operation: %s, status: %s", err, n.Operation, n.Status)
+		}
+	}()
+}
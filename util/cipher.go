@@ -8,47 +8,181 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
 )
 
-var cipherKey = []byte("consistentcipher")
-var aesCipher, _ = aes.NewCipher(cipherKey)
-var blockSize = aesCipher.BlockSize()
-var iv = cipherKey[:blockSize]
+var (
+	ErrInvalidCipherKey = errors.New("invalid cipher key, require 16, 24 or 32 bytes")
+	ErrUnknownCipherKey = errors.New("crypto/cipher: unknown key")
+)
+
+// builtinCipherKey is the default key, the texts encrypted by it have no key id
+var builtinCipherKey = "consistentcipher"
 
 var encodeURL = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_!"
 var base64RawURLEncoding = base64.NewEncoding(encodeURL).WithPadding(base64.NoPadding)
 
+// keyIdSep separates the key id and the encrypted text, which is not in the encoding
+const keyIdSep = "." // nolint:golint
+
+// cipherVersion prefixes the texts encrypted by a random iv prepended to the encrypted bytes, which is not
+// in the encoding. The texts without it are encrypted by the iv of key as before, and still decrypted
+const cipherVersion = "v2-"
+
+type aesKey struct {
+	id    string
+	key   string
+	block cipher.Block
+	iv    []byte // iv of the texts without version
+}
+
+var (
+	// cipherKey encrypts and decrypts, and cipherKeys decrypt by key id
+	cipherKey  *aesKey
+	cipherKeys map[string]*aesKey
+)
+
+func init() {
+	if err := SetCipherKeys("", nil); err != nil {
+		panic(err)
+	}
+}
+
+func newAesKey(key string) (*aesKey, error) {
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return nil, ErrInvalidCipherKey
+	}
+	ak := &aesKey{key: key, block: block, iv: []byte(key)[:block.BlockSize()]}
+	if key != builtinCipherKey {
+		sum := sha256.Sum256([]byte(key))
+		ak.id = hex.EncodeToString(sum[:4])
+	}
+	return ak, nil
+}
+
+// SetCipherKeys sets the key to encrypt and decrypt, and the old keys only to decrypt the texts encrypted before
+// rotation. The built-in key is used if key is empty, and it always decrypts the texts without key id
+func SetCipherKeys(key string, oldKeys []string) error {
+	if key == "" {
+		key = builtinCipherKey
+	}
+	current, err := newAesKey(key)
+	if err != nil {
+		return err
+	}
+	keys := map[string]*aesKey{current.id: current}
+	for _, k := range append([]string{builtinCipherKey}, oldKeys...) {
+		ak, err := newAesKey(k)
+		if err != nil {
+			return err
+		}
+		if _, ok := keys[ak.id]; !ok {
+			keys[ak.id] = ak
+		}
+	}
+	cipherKey, cipherKeys = current, keys
+	return nil
+}
+
+// CheckCipherKey returns whether the key is the current one, compared in constant time
 func CheckCipherKey(key string) bool {
-	return key == string(cipherKey)
+	return subtle.ConstantTimeCompare([]byte(key), []byte(cipherKey.key)) == 1
+}
+
+// IsCurrentCipher returns whether the text is encrypted by the current key with a random iv
+func IsCurrentCipher(encrypt string) bool {
+	id := ""
+	if i := strings.Index(encrypt, keyIdSep); i >= 0 {
+		id, encrypt = encrypt[:i], encrypt[i+1:]
+	}
+	return id == cipherKey.id && strings.HasPrefix(encrypt, cipherVersion)
 }
 
+// AesEncrypt encrypts by the current key and a random iv, so that the same texts are encrypted differently.
+// The text is prefixed by the version, and by the key id unless it's the built-in key
 func AesEncrypt(origin string) string {
 	if len(origin) == 0 {
 		return ""
 	}
+	blockSize := cipherKey.block.BlockSize()
 	originBytes := padding([]byte(origin), blockSize)
-	blockMode := cipher.NewCBCEncrypter(aesCipher, iv)
-	encryptBytes := make([]byte, len(originBytes))
-	blockMode.CryptBlocks(encryptBytes, originBytes)
-	return base64RawURLEncoding.EncodeToString(encryptBytes)
+	encryptBytes := make([]byte, blockSize+len(originBytes))
+	iv := encryptBytes[:blockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		panic(err)
+	}
+	blockMode := cipher.NewCBCEncrypter(cipherKey.block, iv)
+	blockMode.CryptBlocks(encryptBytes[blockSize:], originBytes)
+	encrypt := cipherVersion + base64RawURLEncoding.EncodeToString(encryptBytes)
+	if cipherKey.id != "" {
+		encrypt = cipherKey.id + keyIdSep + encrypt
+	}
+	return encrypt
 }
 
+// AesDecrypt returns the message of error instead if failed
 func AesDecrypt(encrypt string) string {
+	origin, err := AesDecryptChecked(encrypt)
+	if err != nil {
+		return err.Error()
+	}
+	return origin
+}
+
+// AesDecryptChecked decrypts by the key of key id, the current one or an old one, and by the iv prepended
+// if versioned, otherwise by the iv of key
+func AesDecryptChecked(encrypt string) (string, error) {
 	if len(encrypt) == 0 {
-		return ""
+		return "", nil
+	}
+	id := ""
+	if i := strings.Index(encrypt, keyIdSep); i >= 0 {
+		id, encrypt = encrypt[:i], encrypt[i+1:]
+	}
+	ak, ok := cipherKeys[id]
+	if !ok {
+		return "", ErrUnknownCipherKey
 	}
-	encryptBytes, err := base64RawURLEncoding.DecodeString(encrypt)
+	versioned := strings.HasPrefix(encrypt, cipherVersion)
+	encryptBytes, err := base64RawURLEncoding.DecodeString(strings.TrimPrefix(encrypt, cipherVersion))
 	if err != nil {
-		return err.Error()
+		return "", err
+	}
+	blockSize := ak.block.BlockSize()
+	iv := ak.iv
+	if versioned {
+		if len(encryptBytes) < blockSize {
+			return "", errors.New("crypto/cipher: input shorter than iv")
+		}
+		iv, encryptBytes = encryptBytes[:blockSize], encryptBytes[blockSize:]
 	}
 	if len(encryptBytes)%blockSize != 0 {
-		return "crypto/cipher: input not full blocks"
+		return "", errors.New("crypto/cipher: input not full blocks")
 	}
-	blockMode := cipher.NewCBCDecrypter(aesCipher, iv)
+	blockMode := cipher.NewCBCDecrypter(ak.block, iv)
 	originBytes := make([]byte, len(encryptBytes))
 	blockMode.CryptBlocks(originBytes, encryptBytes)
-	return string(unpadding(originBytes))
+	return string(unpadding(originBytes)), nil
+}
+
+// AesReencrypt encrypts the text by the current key again, it's unchanged if already
+func AesReencrypt(encrypt string) (string, error) {
+	if IsCurrentCipher(encrypt) {
+		return encrypt, nil
+	}
+	origin, err := AesDecryptChecked(encrypt)
+	if err != nil {
+		return "", err
+	}
+	return AesEncrypt(origin), nil
 }
 
 func padding(data []byte, blockSize int) []byte {
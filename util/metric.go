@@ -0,0 +1,86 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// LatencyBuckets are the upper bounds of histogram buckets of latencies in seconds
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MetricWriter writes the metrics in the prometheus text format
+type MetricWriter struct {
+	W io.Writer
+}
+
+func (mw *MetricWriter) Header(name, typ, help string) {
+	fmt.Fprintf(mw.W, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (mw *MetricWriter) Sample(name string, value float64, labels ...string) {
+	fmt.Fprint(mw.W, name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		sep := ","
+		if i == 0 {
+			sep = "{"
+		}
+		fmt.Fprintf(mw.W, "%s%s=%s", sep, labels[i], strconv.Quote(labels[i+1]))
+	}
+	if len(labels) > 0 {
+		fmt.Fprint(mw.W, "}")
+	}
+	fmt.Fprintf(mw.W, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// Histogram writes the cumulative buckets, the sum and the count of the histogram
+func (mw *MetricWriter) Histogram(name string, h *Histogram, labels ...string) {
+	buckets, counts, sum, count := h.snapshot()
+	labels = labels[:len(labels):len(labels)]
+	var cumulative uint64
+	for i, bound := range buckets {
+		cumulative += counts[i]
+		mw.Sample(name+"_bucket", float64(cumulative), append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+	}
+	mw.Sample(name+"_bucket", float64(count), append(labels, "le", "+Inf")...)
+	mw.Sample(name+"_sum", sum, labels...)
+	mw.Sample(name+"_count", float64(count), labels...)
+}
+
+// Histogram counts the observations by the upper bounds of buckets, it's safe for concurrent use
+type Histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram returns the histogram of the upper bounds sorted
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) snapshot() (buckets []float64, counts []uint64, sum float64, count uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.buckets, append([]uint64(nil), h.counts...), h.sum, h.count
+}